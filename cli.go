@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func runCommand(args []string) int {
+	// Entry point for the command line, returns the exit code.
+	switch args[0] {
+	case "serve":
+		serve()
+		return 0
+	case "import":
+		return importCommand(args[1:])
+	case "purge":
+		return purgeCommand(args[1:])
+	case "apikey":
+		return apiKeyCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q, available commands are: serve, import, purge, apikey\n", args[0])
+	return 2
+}
+
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "format of the input, csv or ndjson (default: from the file extension)")
+	batch := flags.Int("batch", defaultImportBatch, "number of contracts to insert at once")
+	tenant := flags.String("tenant", DefaultTenant, "tenant the contracts belong to")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: charlie import [-format csv|ndjson] [-batch n] [-tenant ID] FILE")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	if !validTenant(*tenant) {
+		fmt.Fprintf(os.Stderr, "invalid tenant %q\n", *tenant)
+		return 2
+	}
+
+	name := flags.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(name), ".")
+	}
+
+	var input io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+		input = file
+	}
+
+	store, err := OpenStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close(context.TODO())
+
+	scoped, err := store.ForTenant(*tenant)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report, err := importContracts(context.TODO(), scoped, input, *format, *batch, os.Getenv("USER"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(report)
+
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func purgeCommand(args []string) int {
+	flags := flag.NewFlagSet("purge", flag.ContinueOnError)
+	retention := flags.String("retention", PurgeRetention, "ISO 8601 duration to keep deleted contracts for")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: charlie purge [-retention P30D]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	before, err := purgeBefore(*retention, time.Now().UTC())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	store, err := OpenStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close(context.TODO())
+
+	purged, err := store.Purge(context.TODO(), before)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("purged %d contracts deleted before %s\n", purged, before.Format(time.RFC3339))
+	return 0
+}
+
+func apiKeyCommand(args []string) int {
+	// Manages API keys, e.g. to create the first admin key.
+	flags := flag.NewFlagSet("apikey", flag.ContinueOnError)
+	role := flags.String("role", RoleViewer, "role of the created key: viewer, editor, approver or admin")
+	admin := flags.Bool("admin", false, "same as -role admin")
+	tenant := flags.String("tenant", DefaultTenant, "tenant the created key belongs to")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: charlie apikey create [-role ROLE | -admin] [-tenant ID] NAME | list | delete ID")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return 2
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if !validTenant(*tenant) {
+		fmt.Fprintf(os.Stderr, "invalid tenant %q\n", *tenant)
+		return 2
+	}
+	if *admin {
+		*role = RoleAdmin
+	}
+	if roleRanks[*role] == 0 {
+		fmt.Fprintf(os.Stderr, "unknown role %q\n", *role)
+		return 2
+	}
+
+	store, err := OpenStore()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close(context.TODO())
+	keys := store.APIKeys()
+
+	switch {
+	case args[0] == "create" && flags.NArg() == 1:
+		key, secret, err := NewAPIKey(flags.Arg(0), *role)
+		if err == nil {
+			key.Tenant = *tenant
+			err = keys.Create(context.TODO(), key)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("created key %s, which won't be shown again:\n%s\n", key.ID.Hex(), secret)
+	case args[0] == "list" && flags.NArg() == 0:
+		list, err := keys.List(context.TODO())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, key := range list {
+			fmt.Printf("%s  %s...  role=%s  tenant=%s  %s\n", key.ID.Hex(), key.Prefix, key.role(), key.Tenant, key.Name)
+		}
+	case args[0] == "delete" && flags.NArg() == 1:
+		id, err := primitive.ObjectIDFromHex(flags.Arg(0))
+		if err == nil {
+			err = keys.Delete(context.TODO(), id)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+	return 0
+}
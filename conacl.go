@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+var ErrGrantNotFound = errors.New("grant not found")
+
+// Roles of principals, each allowed to do whatever the ones before it
+// are: viewers read, editors change contracts, approvers also approve
+// the changes of others and admins manage everything.
+const (
+	RoleViewer   = "viewer"
+	RoleEditor   = "editor"
+	RoleApprover = "approver"
+	RoleAdmin    = "admin"
+	// Only granted on contracts, to deny any access to them.
+	RoleNone = "none"
+)
+
+var roleRanks = map[string]int{RoleViewer: 1, RoleEditor: 2, RoleApprover: 3, RoleAdmin: 4}
+
+// Permissions checked before handling requests.
+const (
+	PermRead    = "read"
+	PermWrite   = "write"
+	PermApprove = "approve"
+	PermManage  = "manage"
+)
+
+// The least role having each permission.
+var permissionRoles = map[string]string{
+	PermRead:    RoleViewer,
+	PermWrite:   RoleEditor,
+	PermApprove: RoleApprover,
+	PermManage:  RoleAdmin,
+}
+
+func roleAllows(role, permission string) bool {
+	return roleRanks[role] >= roleRanks[permissionRoles[permission]]
+}
+
+func higherRole(a, b string) string {
+	if roleRanks[b] > roleRanks[a] {
+		return b
+	}
+	return a
+}
+
+// PermissionError tells which permission a principal is missing, and
+// the role it would take to have it.
+type PermissionError struct {
+	Permission string
+	Role       string
+	Required   string
+}
+
+func (e *PermissionError) Error() string {
+	role := "no role"
+	if e.Role != "" && e.Role != RoleNone {
+		role = "the " + e.Role + " role"
+	}
+	return fmt.Sprintf("the %s permission requires the %s role or higher, but the principal has %s",
+		e.Permission, e.Required, role)
+}
+
+func (e *PermissionError) Unwrap() error {
+	return ErrForbidden
+}
+
+func authorize(role, permission string) error {
+	if roleAllows(role, permission) {
+		return nil
+	}
+	return &PermissionError{Permission: permission, Role: role, Required: permissionRoles[permission]}
+}
+
+// Grant gives a subject a role on a single contract in place of the role
+// it has on every contract of its tenant, which may be more or less than
+// that role. Admins of the tenant keep their role so that no contract can
+// be locked out.
+type Grant struct {
+	ContractID primitive.ObjectID `bson:"contract_id" json:"contract_id"`
+	Subject    string             `bson:"subject" json:"subject"`
+	Role       string             `bson:"role" json:"role"`
+	GrantedBy  string             `bson:"granted_by,omitempty" json:"granted_by,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
+
+type GrantStore interface {
+	// Put stores a grant, replacing the one the subject had on the
+	// contract if any.
+	Put(ctx context.Context, grant *Grant) error
+	// Get returns the grant of a subject on a contract, or ErrGrantNotFound.
+	Get(ctx context.Context, contractID primitive.ObjectID, subject string) (*Grant, error)
+	// List returns the grants on a contract, ordered by subject.
+	List(ctx context.Context, contractID primitive.ObjectID) ([]*Grant, error)
+	// Denied returns the IDs of the contracts the subject was
+	// granted the none role on.
+	Denied(ctx context.Context, subject string) ([]primitive.ObjectID, error)
+	// Delete revokes a grant, or returns ErrGrantNotFound.
+	Delete(ctx context.Context, contractID primitive.ObjectID, subject string) error
+}
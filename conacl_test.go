@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRoles(t *testing.T) {
+	require.True(t, roleAllows(RoleViewer, PermRead))
+	require.False(t, roleAllows(RoleViewer, PermWrite))
+	require.True(t, roleAllows(RoleApprover, PermWrite))
+	require.False(t, roleAllows(RoleApprover, PermManage))
+	require.False(t, roleAllows("", PermRead))
+	require.False(t, roleAllows("owner", PermRead))
+
+	require.Equal(t, RoleEditor, higherRole(RoleViewer, RoleEditor))
+	require.Equal(t, RoleAdmin, higherRole(RoleAdmin, RoleApprover))
+	require.Equal(t, RoleViewer, higherRole(RoleViewer, "owner"))
+
+	require.NoError(t, authorize(RoleEditor, PermWrite))
+	err := authorize(RoleViewer, PermWrite)
+	require.ErrorIs(t, err, ErrForbidden)
+	require.Equal(t, "the write permission requires the editor role or higher, but the principal has the viewer role",
+		err.Error())
+	require.Contains(t, authorize("", PermRead).Error(), "has no role")
+}
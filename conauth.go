@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"hash"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnauthenticated = errors.New("authentication is required")
+	ErrForbidden       = errors.New("not allowed to do this")
+	ErrAPIKeyNotFound  = errors.New("api key not found")
+)
+
+// Ways principals authenticate.
+const (
+	AuthAPIKey = "api_key"
+	AuthJWT    = "jwt"
+)
+
+// Principal is whoever made a request, as told by its credentials.
+type Principal struct {
+	Subject string `json:"subject"`
+	Name    string `json:"name,omitempty"`
+	Method  string `json:"method"`
+	// Role is what the principal may do with any contract of its
+	// tenant, grants may allow it more on single contracts.
+	Role string `json:"role"`
+	// Tenant is whose contracts the principal works with.
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Authenticator tells who made a request given the token it came with.
+// Tokens that are not of its kind get neither a principal nor an error,
+// so that authenticators can be chained.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*Principal, error)
+}
+
+func unauthenticated(reason string) error {
+	return fmt.Errorf("%w: %s", ErrUnauthenticated, reason)
+}
+
+const apiKeyPrefix = "ck_"
+
+// APIKey is a key to the API, of which only the hash is kept. Prefix
+// is the start of the key, so that people can tell their keys apart.
+// Keys belong to a tenant, and so do the principals they authenticate.
+type APIKey struct {
+	ID     primitive.ObjectID `bson:"_id" json:"_id"`
+	Tenant string             `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	Name   string             `bson:"name" json:"name"`
+	Prefix string             `bson:"prefix" json:"prefix"`
+	Hash   string             `bson:"hash" json:"-"`
+	Role   string             `bson:"role,omitempty" json:"role"`
+	// Admin is set on the admin keys created before roles.
+	Admin     bool      `bson:"admin,omitempty" json:"-"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+}
+
+func (k *APIKey) role() string {
+	// Keys created before roles could do anything but manage
+	// keys, unless they were admin keys.
+	switch {
+	case k.Role != "":
+		return k.Role
+	case k.Admin:
+		return RoleAdmin
+	}
+	return RoleEditor
+}
+
+func hashAPIKey(key string) string {
+	// Keys are random enough for a plain hash to do.
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func NewAPIKey(name, role string) (*APIKey, string, error) {
+	// Returns the key along with its secret, which is not kept.
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	return &APIKey{
+		ID:        primitive.NewObjectID(),
+		Name:      name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		Hash:      hashAPIKey(key),
+		Role:      role,
+		CreatedAt: time.Now().UTC(),
+	}, key, nil
+}
+
+type APIKeyStore interface {
+	// Create stores a new key.
+	Create(ctx context.Context, key *APIKey) error
+	// Lookup returns the key with the given hash, or ErrAPIKeyNotFound.
+	Lookup(ctx context.Context, hash string) (*APIKey, error)
+	// List returns every key, the oldest first.
+	List(ctx context.Context) ([]*APIKey, error)
+	// Delete removes a key, or returns ErrAPIKeyNotFound.
+	Delete(ctx context.Context, id primitive.ObjectID) error
+}
+
+// tenantAPIKeys are the API keys of a tenant, so that its admins only
+// manage those.
+type tenantAPIKeys struct {
+	APIKeyStore
+	tenant string
+}
+
+func (s tenantAPIKeys) Create(ctx context.Context, key *APIKey) error {
+	key.Tenant = s.tenant
+	return s.APIKeyStore.Create(ctx, key)
+}
+
+func (s tenantAPIKeys) Lookup(ctx context.Context, hash string) (*APIKey, error) {
+	key, err := s.APIKeyStore.Lookup(ctx, hash)
+	if err == nil && key.Tenant != s.tenant {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s tenantAPIKeys) List(ctx context.Context) ([]*APIKey, error) {
+	keys, err := s.APIKeyStore.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	owned := make([]*APIKey, 0, len(keys))
+	for _, key := range keys {
+		if key.Tenant == s.tenant {
+			owned = append(owned, key)
+		}
+	}
+	return owned, nil
+}
+
+func (s tenantAPIKeys) Delete(ctx context.Context, id primitive.ObjectID) error {
+	keys, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.ID == id {
+			return s.APIKeyStore.Delete(ctx, id)
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+// APIKeyAuthenticator authenticates the keys in a store.
+type APIKeyAuthenticator struct {
+	Store APIKeyStore
+}
+
+func (a APIKeyAuthenticator) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil, nil
+	}
+	key, err := a.Store.Lookup(ctx, hashAPIKey(token))
+	if err == ErrAPIKeyNotFound {
+		return nil, unauthenticated("invalid api key")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Principal{
+		Subject: "api_key:" + key.ID.Hex(), Name: key.Name, Method: AuthAPIKey, Role: key.role(), Tenant: key.Tenant,
+	}, nil
+}
+
+// JWTAuthenticator verifies JSON Web Tokens against the given keys:
+// []byte secrets for HS256, HS384 and HS512, RSA public keys for RS256,
+// RS384 and RS512, ECDSA ones for ES256, ES384 and ES512 and Ed25519
+// ones for EdDSA. Keys are picked by the "kid" header of tokens, tokens
+// with no "kid" are tried against all of them. Issuer and Audience are
+// checked if they are set.
+type JWTAuthenticator struct {
+	Keys     map[string]interface{}
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+	now      func() time.Time
+}
+
+// JWTClaims are the claims of a token that matter here. The principal
+// has the highest of its roles (viewer if it has none of them), and
+// belongs to the tenant of the "tenant" claim.
+type JWTClaims struct {
+	Subject   string          `json:"sub"`
+	Name      string          `json:"name"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+	Roles     []string        `json:"roles"`
+	Tenant    string          `json:"tenant"`
+}
+
+func (c *JWTClaims) audiences() []string {
+	// The audience is either a single one or a list of them.
+	var audiences []string
+	if err := json.Unmarshal(c.Audience, &audiences); err == nil {
+		return audiences
+	}
+	var audience string
+	if err := json.Unmarshal(c.Audience, &audience); err == nil && audience != "" {
+		return []string{audience}
+	}
+	return nil
+}
+
+var jwtHashes = map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+
+func verifyJWS(alg string, key interface{}, signed, signature []byte) bool {
+	/*
+		Tells if the signature of a token is made by the key with the
+		algorithm. The algorithm must suit the key, so that tokens can't
+		make a public key be used as an HMAC secret.
+	*/
+	if alg == "EdDSA" {
+		public, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(public, signed, signature)
+	}
+	if len(alg) != 5 {
+		return false
+	}
+	kind, size := alg[:2], jwtHashes[alg[2:]]
+	if size == 0 {
+		return false
+	}
+	newHash := map[crypto.Hash]func() hash.Hash{
+		crypto.SHA256: sha256.New, crypto.SHA384: sha512.New384, crypto.SHA512: sha512.New,
+	}[size]
+	digest := newHash()
+	digest.Write(signed)
+	sum := digest.Sum(nil)
+
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(newHash, key)
+		mac.Write(signed)
+		return kind == "HS" && hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return kind == "RS" && rsa.VerifyPKCS1v15(key, size, sum, signature) == nil
+	case *ecdsa.PublicKey:
+		// Signatures are r and s, each as long as the curve needs.
+		length := (key.Curve.Params().BitSize + 7) / 8
+		if kind != "ES" || len(signature) != 2*length {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:length])
+		s := new(big.Int).SetBytes(signature[length:])
+		return ecdsa.Verify(key, sum, r, s)
+	}
+	return false
+}
+
+func (a *JWTAuthenticator) Authenticate(_ context.Context, token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, unauthenticated("malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, unauthenticated("malformed token")
+	}
+
+	signed, verified := []byte(parts[0]+"."+parts[1]), false
+	for id, key := range a.Keys {
+		if header.KeyID != "" && id != header.KeyID {
+			continue
+		}
+		if verified = verifyJWS(header.Algorithm, key, signed, signature); verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, unauthenticated("invalid token signature")
+	}
+
+	var claims JWTClaims
+	if raw, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(raw, &claims) != nil {
+		return nil, unauthenticated("malformed token")
+	}
+	if err = a.check(&claims); err != nil {
+		return nil, err
+	}
+
+	principal := &Principal{Subject: claims.Subject, Name: claims.Name, Method: AuthJWT, Tenant: claims.Tenant}
+	for _, role := range claims.Roles {
+		principal.Role = higherRole(principal.Role, role)
+	}
+	if principal.Role == "" {
+		principal.Role = RoleViewer
+	}
+	return principal, nil
+}
+
+func (a *JWTAuthenticator) check(claims *JWTClaims) error {
+	now := time.Now()
+	if a.now != nil {
+		now = a.now()
+	}
+	switch {
+	case claims.Subject == "":
+		return unauthenticated("token has no subject")
+	case claims.ExpiresAt == nil:
+		return unauthenticated("token has no expiration time")
+	case !now.Before(time.Unix(*claims.ExpiresAt, 0).Add(a.Leeway)):
+		return unauthenticated("token has expired")
+	case claims.NotBefore != nil && now.Add(a.Leeway).Before(time.Unix(*claims.NotBefore, 0)):
+		return unauthenticated("token is not valid yet")
+	case a.Issuer != "" && claims.Issuer != a.Issuer:
+		return unauthenticated("token is not issued by the expected issuer")
+	case !validTenant(claims.Tenant):
+		return unauthenticated("token has an invalid tenant")
+	}
+	if a.Audience != "" {
+		for _, audience := range claims.audiences() {
+			if audience == a.Audience {
+				return nil
+			}
+		}
+		return unauthenticated("token is not meant for this audience")
+	}
+	return nil
+}
+
+func LoadJWTKeys(paths []string) (map[string]interface{}, error) {
+	/*
+		Reads the PEM encoded public keys (or certificates) of the
+		given files, which are identified by their names without the
+		extension, e.g. the ID of "keys/2023-01.pem" is "2023-01".
+	*/
+	keys := make(map[string]interface{})
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data found", path)
+		}
+
+		var key interface{}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			err = fmt.Errorf("unsupported PEM block %q", block.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		name := filepath.Base(path)
+		keys[strings.TrimSuffix(name, filepath.Ext(name))] = key
+	}
+	return keys, nil
+}
+
+func NewAuthenticators(store ContractStore) ([]Authenticator, error) {
+	// The authenticators enabled by AUTH_METHODS, none if it is empty.
+	var authenticators []Authenticator
+	for _, method := range strings.Split(AuthMethods, ",") {
+		switch strings.TrimSpace(method) {
+		case "":
+		case AuthAPIKey:
+			authenticators = append(authenticators, APIKeyAuthenticator{Store: store.APIKeys()})
+		case AuthJWT:
+			var paths []string
+			for _, path := range strings.Split(JWTKeyFiles, ",") {
+				if path = strings.TrimSpace(path); path != "" {
+					paths = append(paths, path)
+				}
+			}
+			keys, err := LoadJWTKeys(paths)
+			if err != nil {
+				return nil, err
+			}
+			if JWTSecret != "" {
+				keys[""] = []byte(JWTSecret)
+			}
+			if len(keys) == 0 {
+				return nil, fmt.Errorf("jwt authentication needs JWT_KEYS or JWT_SECRET")
+			}
+			authenticators = append(authenticators, &JWTAuthenticator{
+				Keys: keys, Issuer: JWTIssuer, Audience: JWTAudience, Leeway: time.Minute,
+			})
+		default:
+			return nil, fmt.Errorf("unknown authentication method %q", method)
+		}
+	}
+	return authenticators, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	var parts []string
+	for _, part := range []interface{}{header, claims} {
+		raw, err := json.Marshal(part)
+		require.NoError(t, err)
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(raw))
+	}
+	signed := []byte(strings.Join(parts, "."))
+	sum := sha256.Sum256(signed)
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+		require.NoError(t, err)
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return string(signed) + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	secret := []byte("a shared secret")
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	auth := &JWTAuthenticator{
+		Keys:     map[string]interface{}{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey, "": secret},
+		Issuer:   "https://issuer.example",
+		Audience: "charlie",
+		now:      func() time.Time { return now },
+	}
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub": "alice", "name": "Alice", "iss": "https://issuer.example", "aud": []string{"charlie"},
+			"exp": now.Add(time.Hour).Unix(), "roles": []string{"admin"},
+		}
+		for key, value := range changes {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	for _, token := range []string{
+		signJWT(t, "RS256", "rsa", rsaKey, claims(nil)),
+		signJWT(t, "ES256", "ec", ecKey, claims(nil)),
+		signJWT(t, "HS256", "", secret, claims(nil)),
+		signJWT(t, "ES256", "", ecKey, claims(nil)),
+	} {
+		principal, err := auth.Authenticate(ctx, token)
+		require.NoError(t, err)
+		require.Equal(t, &Principal{Subject: "alice", Name: "Alice", Method: AuthJWT, Role: RoleAdmin}, principal)
+	}
+
+	principal, err := auth.Authenticate(ctx, signJWT(t, "HS256", "", secret, claims(map[string]interface{}{
+		"aud": "charlie", "roles": nil, "tenant": "acme",
+	})))
+	require.NoError(t, err)
+	require.Equal(t, RoleViewer, principal.Role)
+	require.Equal(t, "acme", principal.Tenant)
+
+	for _, token := range []string{
+		signJWT(t, "RS256", "ec", rsaKey, claims(nil)),
+		signJWT(t, "HS256", "", []byte("another secret"), claims(nil)),
+		signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+		signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"exp": nil})),
+		signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+		signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"aud": "someone else"})),
+		signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"iss": "elsewhere"})),
+		signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"sub": ""})),
+		signJWT(t, "HS256", "", secret, claims(map[string]interface{}{"tenant": "../admin"})),
+		signJWT(t, "none", "", nil, claims(nil)),
+		"not.a.token",
+	} {
+		_, err = auth.Authenticate(ctx, token)
+		require.ErrorIs(t, err, ErrUnauthenticated, token)
+	}
+
+	// The public key must not pass for an HMAC secret.
+	public, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	_, err = auth.Authenticate(ctx, signJWT(t, "HS256", "rsa", public, claims(nil)))
+	require.ErrorIs(t, err, ErrUnauthenticated)
+
+	principal, err = auth.Authenticate(ctx, "ck_not_a_jwt")
+	require.NoError(t, err)
+	require.Nil(t, principal)
+}
+
+func TestLoadJWTKeys(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "2023-01.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0600))
+	keys, err := LoadJWTKeys([]string{path})
+	require.NoError(t, err)
+	require.True(t, key.PublicKey.Equal(keys["2023-01"]))
+
+	require.NoError(t, os.WriteFile(path, []byte("nothing"), 0600))
+	_, err = LoadJWTKeys([]string{path})
+	require.Error(t, err)
+}
+
+func TestAPIKeyAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	key, secret, err := NewAPIKey("deploy", RoleEditor)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(secret, key.Prefix))
+	require.NoError(t, store.APIKeys().Create(ctx, key))
+
+	auth := APIKeyAuthenticator{Store: store.APIKeys()}
+	principal, err := auth.Authenticate(ctx, secret)
+	require.NoError(t, err)
+	require.Equal(t, &Principal{
+		Subject: "api_key:" + key.ID.Hex(), Name: "deploy", Method: AuthAPIKey, Role: RoleEditor,
+	}, principal)
+
+	// Admin keys created before roles are still admin keys.
+	legacy, legacySecret, err := NewAPIKey("legacy", "")
+	require.NoError(t, err)
+	legacy.Admin = true
+	require.NoError(t, store.APIKeys().Create(ctx, legacy))
+	principal, err = auth.Authenticate(ctx, legacySecret)
+	require.NoError(t, err)
+	require.Equal(t, RoleAdmin, principal.Role)
+
+	_, err = auth.Authenticate(ctx, secret+"x")
+	require.ErrorIs(t, err, ErrUnauthenticated)
+	principal, err = auth.Authenticate(ctx, "a.b.c")
+	require.NoError(t, err)
+	require.Nil(t, principal)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"time"
+)
+
+// Types of the boundaries of active branches.
+const (
+	ChangeStart  = "start"  // The contract comes into effect.
+	ChangeUpdate = "change" // One branch follows another.
+	ChangeEnd    = "end"    // The contract ends.
+)
+
+// Change is a point in time where the data in effect for a contract
+// changes, i.e. where an active branch starts or ends. OldData is nil
+// where the contract starts and NewData is nil where it ends.
+type Change struct {
+	ContractID primitive.ObjectID  `json:"contract_id"`
+	Meta       ArbitraryData       `json:"meta"`
+	At         time.Time           `json:"at"`
+	Type       string              `json:"type"`
+	Ending     *primitive.ObjectID `json:"ending,omitempty"`   // The branch that ends.
+	Starting   *primitive.ObjectID `json:"starting,omitempty"` // The branch that starts.
+	OldData    ArbitraryData       `json:"old_data"`
+	NewData    ArbitraryData       `json:"new_data"`
+}
+
+func within(w Window, t time.Time) bool {
+	// Unlike Contains, tells if a point in time is in [From, To).
+	return (w.From.IsZero() || !t.Before(w.From)) && (w.To.IsZero() || t.Before(w.To))
+}
+
+func changing(contract *Contract, window Window) bool {
+	for _, item := range contract.Active() {
+		if within(window, item.StartAt) || within(window, item.EndAt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Contract) Changes(window Window) []*Change {
+	/*
+		Returns the boundaries of the active branches within the window,
+		in chronological order. A branch ending where the next one starts
+		makes a single change, the one ending where nothing follows marks
+		the end of the contract (or of its current terms if there is a
+		gap before the next branch).
+	*/
+	var changes []*Change
+	add := func(at time.Time, kind string, ending, starting *Branch) {
+		if !within(window, at) {
+			return
+		}
+		change := &Change{ContractID: c.ID, Meta: c.Meta, At: at, Type: kind}
+		if ending != nil {
+			change.Ending = &ending.ID
+			change.OldData = c.ResolveData(ending)
+		}
+		if starting != nil {
+			change.Starting = &starting.ID
+			change.NewData = c.ResolveData(starting)
+		}
+		changes = append(changes, change)
+	}
+
+	var previous *Branch
+	for _, item := range c.Active() {
+		switch {
+		case previous == nil:
+			add(item.StartAt, ChangeStart, nil, item)
+		case previous.EndAt.Equal(item.StartAt):
+			add(item.StartAt, ChangeUpdate, previous, item)
+		default:
+			add(previous.EndAt, ChangeEnd, previous, nil)
+			add(item.StartAt, ChangeStart, nil, item)
+		}
+		previous = item
+	}
+	if previous != nil {
+		add(previous.EndAt, ChangeEnd, previous, nil)
+	}
+	return changes
+}
+
+// Boundary is a time at which an active branch of a contract starts or
+// ends. A contract has at most one boundary at a time, which makes both
+// enough to tell where a page of changes ends.
+type Boundary struct {
+	At         time.Time          `bson:"at"`
+	ContractID primitive.ObjectID `bson:"contract_id"`
+}
+
+func (b Boundary) after(other Boundary) bool {
+	if cmp := compareDate(b.At, other.At); cmp != 0 {
+		return cmp > 0
+	}
+	return bytes.Compare(b.ContractID[:], other.ContractID[:]) > 0
+}
+
+// BoundaryQuery selects the boundaries within a window, only those
+// after the given one if any, at most Limit of them unless it is zero.
+type BoundaryQuery struct {
+	Window Window
+	After  *Boundary
+	Limit  int64
+}
+
+func (c *Contract) boundaries(query BoundaryQuery) []Boundary {
+	var boundaries []Boundary
+	for _, change := range c.Changes(query.Window) {
+		boundary := Boundary{At: change.At, ContractID: c.ID}
+		if query.After == nil || boundary.after(*query.After) {
+			boundaries = append(boundaries, boundary)
+		}
+	}
+	return boundaries
+}
+
+func orderBoundaries(boundaries []Boundary, limit int64) []Boundary {
+	// Sorts the boundaries, drops those given more than once (as a
+	// branch ending where another one starts) and applies the limit.
+	sort.Slice(boundaries, func(i, j int) bool {
+		return boundaries[j].after(boundaries[i])
+	})
+	ordered := make([]Boundary, 0, len(boundaries))
+	for _, boundary := range boundaries {
+		if len(ordered) == 0 || boundary.after(ordered[len(ordered)-1]) {
+			ordered = append(ordered, boundary)
+		}
+	}
+	if limit > 0 && int64(len(ordered)) > limit {
+		ordered = ordered[:limit]
+	}
+	return ordered
+}
+
+// ChangeQuery selects the changes within a window of the contracts
+// selected by Contracts. Changes are ordered by their time and then by
+// contract ID; only the ones that come after the cursor are selected.
+type ChangeQuery struct {
+	Window    Window
+	Contracts ContractQuery
+	CursorAt  time.Time
+	Cursor    primitive.ObjectID
+	Limit     int // Maximum number of changes, zero for no limit.
+}
+
+// How many boundaries are read at once when changes are not limited.
+const changeBatch = 500
+
+func contractChanges(ctx context.Context, store ContractStore, query ChangeQuery, id primitive.ObjectID) ([]*Change, error) {
+	// The changes of a contract within the window, none if the
+	// contract is not selected by the query.
+	contract, err := store.Get(ctx, id)
+	if contract, err = visible(contract, err, query.Contracts.IncludeDeleted); err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !query.Contracts.Filter.Match(contract) {
+		return nil, nil
+	}
+	return contract.Changes(query.Window), nil
+}
+
+func FindChanges(ctx context.Context, store ContractStore, query ChangeQuery) ([]*Change, bool, error) {
+	/*
+		Reads the boundaries of active branches in the order of the
+		changes, a page at a time, and makes changes of those that belong
+		to contracts selected by the query until one more than the limit
+		is found. That one only tells that there are more changes.
+	*/
+	boundaries := BoundaryQuery{Window: query.Window, Limit: changeBatch}
+	if query.Limit > 0 {
+		boundaries.Limit = int64(query.Limit) + 1
+	}
+	if !query.Cursor.IsZero() {
+		boundaries.After = &Boundary{At: query.CursorAt, ContractID: query.Cursor}
+	}
+
+	// The changes of the contracts read so far, by their ID.
+	loaded := make(map[primitive.ObjectID][]*Change)
+	changes := make([]*Change, 0)
+	for {
+		page, err := store.Boundaries(ctx, boundaries)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, boundary := range page {
+			found, ok := loaded[boundary.ContractID]
+			if !ok {
+				if found, err = contractChanges(ctx, store, query, boundary.ContractID); err != nil {
+					return nil, false, err
+				}
+				loaded[boundary.ContractID] = found
+			}
+			for _, change := range found {
+				if change.At.Equal(boundary.At) {
+					changes = append(changes, change)
+				}
+			}
+			if query.Limit > 0 && len(changes) > query.Limit {
+				return changes[:query.Limit], true, nil
+			}
+		}
+		if int64(len(page)) < boundaries.Limit {
+			return changes, false, nil
+		}
+		boundaries.After = &page[len(page)-1]
+	}
+}
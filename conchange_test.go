@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestContractChanges(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 1, 1), newDate(2023, 1, 1), ArbitraryData{"price": 10}, ArbitraryData{"plan": "gold"})
+	branch, _ := contract.Branch(newDate(2022, 3, 1), newDate(2022, 6, 1), ArbitraryData{"price": 12})
+
+	changes := contract.Changes(Window{})
+	require.Len(t, changes, 4)
+
+	start, raise, fall, end := changes[0], changes[1], changes[2], changes[3]
+	require.Equal(t, ChangeStart, start.Type)
+	require.Equal(t, newDate(2022, 1, 1), start.At)
+	require.Nil(t, start.OldData)
+	require.Equal(t, ArbitraryData{"price": 10}, start.NewData)
+
+	require.Equal(t, ChangeUpdate, raise.Type)
+	require.Equal(t, newDate(2022, 3, 1), raise.At)
+	require.Equal(t, ArbitraryData{"price": 10}, raise.OldData)
+	require.Equal(t, ArbitraryData{"price": 12}, raise.NewData)
+	require.Equal(t, branch.ID, *raise.Starting)
+
+	require.Equal(t, ChangeUpdate, fall.Type)
+	require.Equal(t, branch.ID, *fall.Ending)
+	require.Equal(t, ArbitraryData{"price": 10}, fall.NewData)
+
+	require.Equal(t, ChangeEnd, end.Type)
+	require.Equal(t, newDate(2023, 1, 1), end.At)
+	require.Nil(t, end.NewData)
+	require.Nil(t, end.Starting)
+
+	changes = contract.Changes(Window{From: newDate(2022, 3, 1), To: newDate(2022, 6, 1)})
+	require.Len(t, changes, 1)
+	require.Equal(t, raise.At, changes[0].At)
+
+	require.True(t, changing(contract, Window{From: newDate(2022, 12, 1), To: newDate(2023, 2, 1)}))
+	require.False(t, changing(contract, Window{From: newDate(2022, 7, 1), To: newDate(2022, 12, 1)}))
+}
+
+// countingStore counts the contracts loaded through it.
+type countingStore struct {
+	ContractStore
+	loaded int
+}
+
+func (s *countingStore) Get(ctx context.Context, id primitive.ObjectID) (*Contract, error) {
+	s.loaded++
+	return s.ContractStore.Get(ctx, id)
+}
+
+func TestFindChanges(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{ContractStore: NewMemoryStore()}
+
+	var contracts []*Contract
+	for month := time.January; month <= time.October; month++ {
+		meta := ArbitraryData{"plan": "gold"}
+		if month%2 == 0 {
+			meta["plan"] = "silver"
+		}
+		contract, _ := NewContract(newDate(2022, month, 1), newDate(2023, month, 1), ArbitraryData{}, meta)
+		contracts = append(contracts, contract)
+	}
+	require.NoError(t, store.Insert(ctx, contracts))
+
+	query := ChangeQuery{Window: Window{From: newDate(2022, 1, 1), To: newDate(2022, 12, 1)}, Limit: 2}
+	changes, more, err := FindChanges(ctx, store, query)
+	require.NoError(t, err)
+	require.True(t, more)
+	require.Len(t, changes, 2)
+	require.Equal(t, contracts[1].ID, changes[1].ContractID)
+	// Only the contracts of the page (and the one telling there are
+	// more changes) are loaded.
+	require.Equal(t, 3, store.loaded)
+
+	query.Cursor, query.CursorAt = changes[1].ContractID, changes[1].At
+	query.Contracts.Filter.Conditions = []Condition{{Field: "meta.plan", Op: "eq", Values: []string{"gold"}}}
+	query.Limit = 10
+	changes, more, err = FindChanges(ctx, store, query)
+	require.NoError(t, err)
+	require.False(t, more)
+	require.Len(t, changes, 4)
+	for i, change := range changes {
+		require.Equal(t, contracts[2*i+2].ID, change.ContractID)
+		require.Equal(t, ChangeStart, change.Type)
+	}
+}
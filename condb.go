@@ -6,11 +6,30 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
 	"os"
+	"strconv"
 	"time"
 )
 
 var DBName = os.Getenv("DATABASE_NAME")
 var MongoURI = os.Getenv("MONGO_URI")
+var StorageBackend = os.Getenv("STORAGE_BACKEND")
+var StoragePath = getenv("STORAGE_PATH", "charlie.db")
+var MergeRetries, _ = strconv.Atoi(os.Getenv("MERGE_RETRIES"))
+var PurgeRetention = getenv("PURGE_RETENTION", "P30D")
+var AuthMethods = os.Getenv("AUTH_METHODS")
+var JWTKeyFiles = os.Getenv("JWT_KEYS")
+var JWTSecret = os.Getenv("JWT_SECRET")
+var JWTIssuer = os.Getenv("JWT_ISSUER")
+var JWTAudience = os.Getenv("JWT_AUDIENCE")
+var TenantDatabases = os.Getenv("TENANT_DATABASES") == "true"
+var BranchApproval = os.Getenv("BRANCH_APPROVAL") == "true"
+
+func getenv(key, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
 
 type MongoInstance struct {
 	Client   *mongo.Client
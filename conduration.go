@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is an ISO 8601 duration such as "P1Y2M" or "P3DT12H". Years,
+// months, weeks and days are calendar aware, so they are kept apart from
+// the clock part instead of being converted to a time.Duration.
+type Duration struct {
+	Negative bool
+	Years    int
+	Months   int
+	Weeks    int
+	Days     int
+	Clock    time.Duration
+}
+
+var durationPattern = regexp.MustCompile(
+	`^([+-])?P(?:(\d+)Y)?(?:(\d+)M)?(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:[.,]\d+)?)S)?)?$`)
+
+func ParseDuration(value string) (Duration, error) {
+	var d Duration
+
+	match := durationPattern.FindStringSubmatch(value)
+	if match == nil || strings.HasSuffix(value, "P") || strings.HasSuffix(value, "T") {
+		return d, fmt.Errorf("%q is not a valid ISO 8601 duration", value)
+	}
+
+	d.Negative = match[1] == "-"
+	for i, target := range []*int{&d.Years, &d.Months, &d.Weeks, &d.Days} {
+		if match[i+2] != "" {
+			n, err := strconv.Atoi(match[i+2])
+			if err != nil {
+				return d, fmt.Errorf("%q is not a valid ISO 8601 duration", value)
+			}
+			*target = n
+		}
+	}
+
+	for i, unit := range []time.Duration{time.Hour, time.Minute} {
+		if match[i+6] != "" {
+			n, err := strconv.ParseInt(match[i+6], 10, 64)
+			if err != nil {
+				return d, fmt.Errorf("%q is not a valid ISO 8601 duration", value)
+			}
+			d.Clock += time.Duration(n) * unit
+		}
+	}
+	if seconds := match[8]; seconds != "" {
+		n, err := strconv.ParseFloat(strings.Replace(seconds, ",", ".", 1), 64)
+		if err != nil {
+			return d, fmt.Errorf("%q is not a valid ISO 8601 duration", value)
+		}
+		d.Clock += time.Duration(n * float64(time.Second))
+	}
+	return d, nil
+}
+
+func (d Duration) AddTo(t time.Time) time.Time {
+	sign := 1
+	if d.Negative {
+		sign = -1
+	}
+	return t.AddDate(sign*d.Years, sign*d.Months, sign*(d.Weeks*7+d.Days)).
+		Add(time.Duration(sign) * d.Clock)
+}
+
+func formatClock(b *strings.Builder, clock time.Duration) {
+	hours := clock / time.Hour
+	clock -= hours * time.Hour
+	minutes := clock / time.Minute
+	clock -= minutes * time.Minute
+
+	if hours != 0 {
+		_, _ = fmt.Fprintf(b, "%dH", hours)
+	}
+	if minutes != 0 {
+		_, _ = fmt.Fprintf(b, "%dM", minutes)
+	}
+	if clock != 0 {
+		b.WriteString(strconv.FormatFloat(clock.Seconds(), 'f', -1, 64) + "S")
+	}
+}
+
+func (d Duration) String() string {
+	if d == (Duration{}) || d == (Duration{Negative: true}) {
+		return "PT0S"
+	}
+
+	var b strings.Builder
+	if d.Negative {
+		b.WriteByte('-')
+	}
+	b.WriteByte('P')
+	for _, part := range []struct {
+		n    int
+		unit string
+	}{{d.Years, "Y"}, {d.Months, "M"}, {d.Weeks, "W"}, {d.Days, "D"}} {
+		if part.n != 0 {
+			_, _ = fmt.Fprintf(&b, "%d%s", part.n, part.unit)
+		}
+	}
+	if d.Clock != 0 {
+		b.WriteByte('T')
+		formatClock(&b, d.Clock)
+	}
+	return b.String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value string
+	if err := json.Unmarshal(b, &value); err != nil {
+		return fmt.Errorf("duration must be an ISO 8601 duration string")
+	}
+	parsed, err := ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+func isoDuration(d time.Duration) string {
+	// Format duration as ISO 8601, days being the largest unit
+	// since a time.Duration carries no calendar information.
+	if d == 0 {
+		return "PT0S"
+	}
+
+	var b strings.Builder
+	if d < 0 {
+		b.WriteByte('-')
+		d = -d
+	}
+	b.WriteByte('P')
+	if days := d / day; days > 0 {
+		_, _ = fmt.Fprintf(&b, "%dD", days)
+		d -= days * day
+	}
+	if d > 0 {
+		b.WriteByte('T')
+		formatClock(&b, d)
+	}
+	return b.String()
+}
+
+// RelativeTime is either an absolute point in time, or an ISO 8601
+// duration prefixed with a sign (e.g. "+P45D") that is relative to
+// some other point in time.
+type RelativeTime struct {
+	Time   time.Time
+	Offset *Duration
+}
+
+func ParseRelativeTime(value string) (RelativeTime, error) {
+	if strings.HasPrefix(value, "+P") || strings.HasPrefix(value, "-P") {
+		offset, err := ParseDuration(value)
+		if err != nil {
+			return RelativeTime{}, err
+		}
+		return RelativeTime{Offset: &offset}, nil
+	}
+
+	t, err := parseTime(value)
+	if err != nil {
+		return RelativeTime{}, fmt.Errorf(
+			"%q is neither a date, an RFC 3339 timestamp nor a relative ISO 8601 duration", value)
+	}
+	return RelativeTime{Time: t}, nil
+}
+
+func (r RelativeTime) Resolve(base time.Time) time.Time {
+	if r.Offset != nil {
+		return r.Offset.AddTo(base)
+	}
+	return r.Time
+}
+
+func (r RelativeTime) MarshalJSON() ([]byte, error) {
+	if r.Offset != nil {
+		value := r.Offset.String()
+		if !r.Offset.Negative {
+			value = "+" + value
+		}
+		return json.Marshal(value)
+	}
+	return json.Marshal(r.Time)
+}
+
+func (r *RelativeTime) UnmarshalJSON(b []byte) error {
+	var value string
+	if err := json.Unmarshal(b, &value); err != nil {
+		return fmt.Errorf("time must be a string")
+	}
+	parsed, err := ParseRelativeTime(value)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func resolveEnd(startAt time.Time, endAt *RelativeTime, term *Duration) time.Time {
+	// Resolves the end date given either as an absolute or relative
+	// date, or as a term; a zero time is returned for neither.
+	switch {
+	case endAt != nil:
+		return endAt.Resolve(startAt)
+	case term != nil:
+		return term.AddTo(startAt)
+	}
+	return time.Time{}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	cases := map[string]Duration{
+		"P1Y":              {Years: 1},
+		"P1Y2M10D":         {Years: 1, Months: 2, Days: 10},
+		"P2W":              {Weeks: 2},
+		"PT36H":            {Clock: time.Hour * 36},
+		"P3DT4H5M6.5S":     {Days: 3, Clock: time.Hour*4 + time.Minute*5 + time.Millisecond*6500},
+		"PT0,5S":           {Clock: time.Millisecond * 500},
+		"+P45D":            {Days: 45},
+		"-P1M":             {Negative: true, Months: 1},
+		"P0D":              {},
+		"P1Y1M1W1DT1H1M1S": {Years: 1, Months: 1, Weeks: 1, Days: 1, Clock: time.Hour + time.Minute + time.Second},
+	}
+	for value, expected := range cases {
+		d, err := ParseDuration(value)
+		require.NoError(t, err, value)
+		require.Equal(t, expected, d, value)
+	}
+
+	for _, value := range []string{"", "P", "PT", "P1DT", "1Y", "P1.5Y", "PT1S1M", "P1H", "P-1D"} {
+		_, err := ParseDuration(value)
+		require.Error(t, err, value)
+	}
+}
+
+func TestDuration_String(t *testing.T) {
+	for _, value := range []string{"P1Y", "P1Y2M10D", "P2W", "PT36H", "P3DT4H5M6.5S", "-P1M", "PT1M"} {
+		d, err := ParseDuration(value)
+		require.NoError(t, err)
+		require.Equal(t, value, d.String())
+	}
+	require.Equal(t, "PT0S", Duration{}.String())
+}
+
+func TestDuration_AddTo(t *testing.T) {
+	d, _ := ParseDuration("P1M")
+	require.Equal(t, newDate(2023, 3, 3), d.AddTo(newDate(2023, 1, 31)))
+
+	d, _ = ParseDuration("P1Y")
+	require.Equal(t, newDate(2025, 2, 28), d.AddTo(newDate(2024, 2, 28)))
+
+	d, _ = ParseDuration("-P1W")
+	require.Equal(t, newDate(2022, 10, 3), d.AddTo(newDate(2022, 10, 10)))
+
+	d, _ = ParseDuration("P1DT12H")
+	require.Equal(t, newDate(2022, 10, 11).Add(time.Hour*12), d.AddTo(newDate(2022, 10, 10)))
+}
+
+func TestIsoDuration(t *testing.T) {
+	require.Equal(t, "PT0S", isoDuration(0))
+	require.Equal(t, "P365D", isoDuration(time.Hour*24*365))
+	require.Equal(t, "PT12H30M", isoDuration(time.Hour*12+time.Minute*30))
+	require.Equal(t, "P1DT1.5S", isoDuration(day+time.Millisecond*1500))
+	require.Equal(t, "-P2D", isoDuration(-2*day))
+}
+
+func TestRelativeTime(t *testing.T) {
+	var r RelativeTime
+	require.NoError(t, json.Unmarshal([]byte(`"+P45D"`), &r))
+	require.Equal(t, newDate(2022, 11, 24), r.Resolve(newDate(2022, 10, 10)))
+
+	encoded, _ := json.Marshal(r)
+	require.Equal(t, `"+P45D"`, string(encoded))
+
+	require.NoError(t, json.Unmarshal([]byte(`"2023-10-10T00:00:00Z"`), &r))
+	require.Equal(t, newDate(2023, 10, 10), r.Resolve(newDate(2022, 10, 10)))
+
+	require.Error(t, json.Unmarshal([]byte(`"P45D"`), &r))
+	require.Error(t, json.Unmarshal([]byte(`10`), &r))
+
+	term := &Duration{Years: 1}
+	require.Equal(t, newDate(2023, 10, 10), resolveEnd(newDate(2022, 10, 10), nil, term))
+	require.True(t, resolveEnd(newDate(2022, 10, 10), nil, nil).IsZero())
+}
+
+func TestBranchJSONSpan(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{"key": "world"}, nil)
+
+	encoded, err := json.Marshal(contract)
+	require.NoError(t, err)
+
+	var decoded struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	require.Equal(t, "365days", decoded.Items[0]["span"])
+	require.Equal(t, "P365D", decoded.Items[0]["span_iso"])
+	require.Equal(t, "2022-10-10T00:00:00Z", decoded.Items[0]["start_at"])
+	require.Equal(t, contract.Items[0].ID.Hex(), decoded.Items[0]["_id"])
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"reflect"
+	"time"
+)
+
+// Types of the operations recorded in the event log.
+const (
+	EventCreate  = "create"
+	EventBranch  = "branch"
+	EventMeta    = "meta"
+	EventRevert  = "revert"
+	EventDelete  = "delete"
+	EventRestore = "restore"
+)
+
+// Event is an operation applied to a contract. Events are never
+// changed once recorded, so that replaying them in order rebuilds
+// the contract as it was after any of them.
+type Event struct {
+	ID         primitive.ObjectID `bson:"_id" json:"_id"`
+	ContractID primitive.ObjectID `bson:"contract_id" json:"contract_id"`
+	Sequence   int64              `bson:"sequence" json:"sequence"` // The version of the contract after the event.
+	Type       string             `bson:"type" json:"type"`
+	Actor      string             `bson:"actor" json:"actor"`
+	Payload    EventPayload       `bson:"payload" json:"payload"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
+
+type EventPayload struct {
+	StartAt *time.Time    `bson:"start_at,omitempty" json:"start_at,omitempty"`
+	EndAt   *time.Time    `bson:"end_at,omitempty" json:"end_at,omitempty"`
+	Data    ArbitraryData `bson:"data" json:"data,omitempty"`
+	// The meta of the contract after the event, nil if unchanged.
+	Meta ArbitraryData `bson:"meta" json:"meta"`
+	// The version a revert went back to.
+	Version *int64 `bson:"version,omitempty" json:"version,omitempty"`
+	// The branches created by the operation, in the order they were
+	// created. Replays use these to restore their IDs.
+	Branches []RecordedBranch `bson:"branches,omitempty" json:"branches,omitempty"`
+	// The proposal a branch was made for, if any.
+	Proposal *primitive.ObjectID `bson:"proposal,omitempty" json:"proposal,omitempty"`
+}
+
+type RecordedBranch struct {
+	ID        primitive.ObjectID `bson:"_id" json:"_id"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func NewEvent(contract *Contract, kind, actor string, payload EventPayload, created []*Branch) *Event {
+	for _, branch := range created {
+		payload.Branches = append(payload.Branches, RecordedBranch{ID: branch.ID, CreatedAt: branch.CreatedAt})
+	}
+	return &Event{
+		ID:         primitive.NewObjectID(),
+		ContractID: contract.ID,
+		Sequence:   contract.Version,
+		Type:       kind,
+		Actor:      actor,
+		Payload:    payload,
+		CreatedAt:  time.Now().UTC(),
+	}
+}
+
+func insertedEvents(inserted map[primitive.ObjectID]bool, events []*Event) []*Event {
+	/*
+		The events of the inserted contracts, each version once: of the
+		contracts given with the same ID only the first one is inserted,
+		so only the first of their events is kept.
+	*/
+	type version struct {
+		contract primitive.ObjectID
+		sequence int64
+	}
+	seen := make(map[version]bool)
+	var kept []*Event
+	for _, event := range events {
+		key := version{event.ContractID, event.Sequence}
+		if inserted[event.ContractID] && !seen[key] {
+			seen[key] = true
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
+
+func (e *Event) restore(contract *Contract, before int) error {
+	/*
+		Operations create branches with new IDs, so the ones created by
+		replaying an event are given the IDs they were originally given,
+		both in the branches themselves and in the replacement lists.
+	*/
+	created := contract.Items[before:]
+	if len(created) != len(e.Payload.Branches) {
+		return fmt.Errorf(
+			"event %d created %d branches, but %d were recorded",
+			e.Sequence, len(created), len(e.Payload.Branches))
+	}
+
+	ids := make(map[primitive.ObjectID]primitive.ObjectID)
+	for i, item := range created {
+		ids[item.ID] = e.Payload.Branches[i].ID
+		item.ID = e.Payload.Branches[i].ID
+		item.CreatedAt = e.Payload.Branches[i].CreatedAt
+		item.CreatedBy = e.Actor
+	}
+	for _, item := range contract.Items {
+		for i, id := range item.ReplacedBy {
+			if recorded, exists := ids[id]; exists {
+				item.ReplacedBy[i] = recorded
+			}
+		}
+	}
+	return nil
+}
+
+func Replay(events []*Event) (*Contract, error) {
+	return replay(events, nil)
+}
+
+func replay(events []*Event, visit func(*Event, *Contract)) (*Contract, error) {
+	/*
+		Rebuilds a contract by applying its events in order, the
+		first one being the creation of the contract. Visit, if
+		given, is called with the contract after each event.
+	*/
+	var contract *Contract
+	for i, event := range events {
+		if event.Sequence != int64(i) {
+			return nil, fmt.Errorf("expected event %d, got event %d", i, event.Sequence)
+		}
+		if (i == 0) != (event.Type == EventCreate) {
+			return nil, fmt.Errorf("event %d: only the first event can create the contract", i)
+		}
+
+		payload := event.Payload
+		switch event.Type {
+		case EventCreate:
+			if payload.StartAt == nil || payload.EndAt == nil {
+				return nil, fmt.Errorf("event %d: start and end dates are required", i)
+			}
+			created, err := NewContract(*payload.StartAt, *payload.EndAt, payload.Data, payload.Meta)
+			if err != nil {
+				return nil, fmt.Errorf("event %d: %s", i, err)
+			}
+			created.ID = event.ContractID
+			created.CreatedAt = event.CreatedAt
+			if err = event.restore(created, 0); err != nil {
+				return nil, err
+			}
+			contract = created
+		case EventBranch:
+			if payload.StartAt == nil {
+				return nil, fmt.Errorf("event %d: start date is required", i)
+			}
+			var endAt time.Time
+			if payload.EndAt != nil {
+				endAt = *payload.EndAt
+			}
+			before := len(contract.Items)
+			if _, err := contract.Branch(*payload.StartAt, endAt, payload.Data); err != nil {
+				return nil, fmt.Errorf("event %d: %s", i, err)
+			}
+			if err := event.restore(contract, before); err != nil {
+				return nil, err
+			}
+		case EventMeta:
+		case EventDelete:
+			deletedAt := event.CreatedAt
+			contract.DeletedAt = &deletedAt
+		case EventRestore:
+			contract.DeletedAt = nil
+		case EventRevert:
+			if payload.Version == nil || *payload.Version < 0 || *payload.Version >= int64(i) {
+				return nil, fmt.Errorf("event %d: can only revert to a former version", i)
+			}
+			target, err := Replay(events[:*payload.Version+1])
+			if err != nil {
+				return nil, err
+			}
+			contract.Items = target.Items
+			contract.Meta = target.Meta
+		default:
+			return nil, fmt.Errorf("event %d: unknown type %q", i, event.Type)
+		}
+
+		if payload.Meta != nil && event.Type != EventCreate {
+			contract.Meta = payload.Meta
+		}
+		contract.Version = event.Sequence
+		contract.UpdatedAt = event.CreatedAt
+		if visit != nil {
+			visit(event, contract)
+		}
+	}
+
+	if contract == nil {
+		return nil, fmt.Errorf("there are no events to replay")
+	}
+	return contract, nil
+}
+
+// MetaRevision is the meta of a contract as set by an event.
+type MetaRevision struct {
+	Version   int64         `json:"version"`
+	Meta      ArbitraryData `json:"meta"`
+	Actor     string        `json:"actor"`
+	Event     string        `json:"event"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+func MetaHistory(events []*Event) ([]*MetaRevision, error) {
+	/*
+		Replays the events to tell the revisions of the meta, oldest
+		first. Reverts set the meta without recording it, and any
+		event might set the meta to what it was, so revisions are told
+		by comparing the meta after each event.
+	*/
+	revisions := make([]*MetaRevision, 0)
+	_, err := replay(events, func(event *Event, contract *Contract) {
+		if n := len(revisions); n > 0 && jsonEqual(revisions[n-1].Meta, contract.Meta) {
+			return
+		}
+		revisions = append(revisions, &MetaRevision{
+			Version:   event.Sequence,
+			Meta:      contract.Meta,
+			Actor:     event.Actor,
+			Event:     event.Type,
+			CreatedAt: event.CreatedAt,
+		})
+	})
+	return revisions, err
+}
+
+// MetaAt returns the revision in effect at the given time, or nil if
+// the contract did not exist yet.
+func MetaAt(revisions []*MetaRevision, at time.Time) *MetaRevision {
+	var current *MetaRevision
+	for _, revision := range revisions {
+		if revision.CreatedAt.After(at) {
+			break
+		}
+		current = revision
+	}
+	return current
+}
+
+func contractState(contract *Contract) (interface{}, error) {
+	// The state of a contract, comparable regardless of the order
+	// of map keys and the precision of times. Authors of branches are
+	// left out, branches created before they were kept have none.
+	raw, err := bson.Marshal(bson.M{"items": contract.Items, "meta": contract.Meta})
+	if err != nil {
+		return nil, err
+	}
+	var state bson.M
+	if err = bson.Unmarshal(raw, &state); err != nil {
+		return nil, err
+	}
+	if items, ok := state["items"].(bson.A); ok {
+		for _, item := range items {
+			if item, ok := item.(bson.M); ok {
+				delete(item, "created_by")
+			}
+		}
+	}
+	return state, nil
+}
+
+// Consistent tells if replaying gives the same items and meta as the
+// stored contract.
+func Consistent(stored, replayed *Contract) (bool, error) {
+	a, err := contractState(stored)
+	if err != nil {
+		return false, err
+	}
+	b, err := contractState(replayed)
+	if err != nil {
+		return false, err
+	}
+	return stored.Version == replayed.Version && reflect.DeepEqual(a, b), nil
+}
+
+type EventStore interface {
+	// Append records new events, failing if an event with the same
+	// sequence was already recorded for the contract.
+	Append(ctx context.Context, events ...*Event) error
+	// List returns the events of a contract up to (and including) the
+	// given sequence, or all of them if it is negative.
+	List(ctx context.Context, contractID primitive.ObjectID, until int64) ([]*Event, error)
+}
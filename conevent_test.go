@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	startAt, endAt := newDate(2022, 10, 10), newDate(2023, 10, 10)
+	contract, _ := NewContract(startAt, endAt, ArbitraryData{"key": "world"}, ArbitraryData{"name": "Lease"})
+	events := []*Event{NewEvent(contract, EventCreate, "alice", EventPayload{
+		StartAt: &startAt, EndAt: &endAt, Data: ArbitraryData{"key": "world"}, Meta: ArbitraryData{"name": "Lease"},
+	}, contract.Items)}
+
+	branch := func(startAt time.Time, data ArbitraryData) {
+		before := len(contract.Items)
+		created, err := contract.Branch(startAt, time.Time{}, data)
+		require.NoError(t, err)
+		contract.Version++
+		events = append(events, NewEvent(contract, EventBranch, "bob", EventPayload{
+			StartAt: &created.StartAt, EndAt: &created.EndAt, Data: data,
+		}, contract.Items[before:]))
+	}
+
+	branch(newDate(2022, 11, 10), ArbitraryData{"key": "venus"})
+	snapshot, _ := cloneContract(contract)
+	branch(newDate(2023, 2, 10), ArbitraryData{"key": "mars"})
+
+	contract.Meta = ArbitraryData{"name": "Rent"}
+	contract.Version++
+	events = append(events, NewEvent(contract, EventMeta, "", EventPayload{Meta: contract.Meta}, nil))
+
+	replayed, err := Replay(events)
+	require.NoError(t, err)
+	consistent, err := Consistent(contract, replayed)
+	require.NoError(t, err)
+	require.True(t, consistent)
+	require.Equal(t, contract.Items[4].ID, replayed.Items[4].ID)
+	require.Equal(t, contract.Items[1].ReplacedBy, replayed.Items[1].ReplacedBy)
+
+	// Replaying a prefix gives the contract as it was.
+	replayed, err = Replay(events[:2])
+	require.NoError(t, err)
+	consistent, _ = Consistent(snapshot, replayed)
+	require.True(t, consistent)
+
+	version := int64(1)
+	contract.Items, contract.Meta = snapshot.Items, snapshot.Meta
+	contract.Version++
+	events = append(events, NewEvent(contract, EventRevert, "", EventPayload{Version: &version}, nil))
+
+	replayed, err = Replay(events)
+	require.NoError(t, err)
+	consistent, _ = Consistent(contract, replayed)
+	require.True(t, consistent)
+	require.EqualValues(t, 4, replayed.Version)
+
+	// Tampered branches don't match the replay.
+	contract.Items[0].Data = ArbitraryData{"key": "pluto"}
+	consistent, _ = Consistent(contract, replayed)
+	require.False(t, consistent)
+
+	_, err = Replay(events[1:])
+	require.Error(t, err)
+	_, err = Replay(nil)
+	require.Error(t, err)
+}
+
+func TestMetaHistory(t *testing.T) {
+	startAt, endAt := newDate(2022, 10, 10), newDate(2023, 10, 10)
+	contract, _ := NewContract(startAt, endAt, ArbitraryData{"key": "world"}, ArbitraryData{"name": "Lease"})
+	events := []*Event{NewEvent(contract, EventCreate, "alice", EventPayload{
+		StartAt: &startAt, EndAt: &endAt, Data: ArbitraryData{"key": "world"}, Meta: ArbitraryData{"name": "Lease"},
+	}, contract.Items)}
+	events[0].CreatedAt = newDate(2022, 1, 1)
+
+	record := func(kind string, at time.Time, payload EventPayload) {
+		contract.Version++
+		event := NewEvent(contract, kind, "bob", payload, nil)
+		event.CreatedAt = at
+		events = append(events, event)
+	}
+	record(EventMeta, newDate(2022, 2, 1), EventPayload{Meta: ArbitraryData{"name": "Rent"}})
+	// Setting the same meta is no revision.
+	record(EventMeta, newDate(2022, 3, 1), EventPayload{Meta: ArbitraryData{"name": "Rent"}})
+	version := int64(0)
+	record(EventRevert, newDate(2022, 4, 1), EventPayload{Version: &version})
+
+	revisions, err := MetaHistory(events)
+	require.NoError(t, err)
+	require.Len(t, revisions, 3)
+	require.Equal(t, []int64{0, 1, 3}, []int64{revisions[0].Version, revisions[1].Version, revisions[2].Version})
+	require.Equal(t, ArbitraryData{"name": "Rent"}, revisions[1].Meta)
+	require.Equal(t, "bob", revisions[1].Actor)
+	require.Equal(t, ArbitraryData{"name": "Lease"}, revisions[2].Meta)
+	require.Equal(t, EventRevert, revisions[2].Event)
+
+	require.Nil(t, MetaAt(revisions, newDate(2021, 1, 1)))
+	require.Equal(t, revisions[0], MetaAt(revisions, newDate(2022, 1, 15)))
+	require.Equal(t, revisions[1], MetaAt(revisions, newDate(2022, 3, 15)))
+	require.Equal(t, revisions[2], MetaAt(revisions, newDate(2022, 4, 1)))
+}
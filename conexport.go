@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"time"
+)
+
+type timelineCSV struct {
+	w        *csv.Writer
+	dataKeys []string
+	metaKeys []string
+}
+
+func newTimelineCSV(w io.Writer, dataKeys, metaKeys []string) (*timelineCSV, error) {
+	/*
+		Flattens contract timelines into CSV rows, one row per active
+		segment. Selected keys of the (resolved) data and the meta are
+		written as columns of their own; if no data keys are selected, the
+		whole data is written as JSON in a single column.
+	*/
+	t := &timelineCSV{w: csv.NewWriter(w), dataKeys: dataKeys, metaKeys: metaKeys}
+
+	header := []string{"contract_id", "branch_id", "start_at", "end_at", "span"}
+	for _, key := range metaKeys {
+		header = append(header, "meta."+key)
+	}
+	if len(dataKeys) == 0 {
+		header = append(header, "data")
+	}
+	for _, key := range dataKeys {
+		header = append(header, "data."+key)
+	}
+	if err := t.w.Write(header); err != nil {
+		return nil, err
+	}
+	t.w.Flush()
+	return t, t.w.Error()
+}
+
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case primitive.ObjectID:
+		return v.Hex()
+	case time.Time:
+		return v.UTC().Format(time.RFC3339)
+	case bool, int, int32, int64, float64:
+		return fmt.Sprint(v)
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(encoded)
+}
+
+func (t *timelineCSV) Write(c *Contract) error {
+	for _, item := range c.Active() {
+		data := c.ResolveData(item)
+		row := []string{
+			c.ID.Hex(),
+			item.ID.Hex(),
+			item.StartAt.UTC().Format(time.RFC3339),
+			item.EndAt.UTC().Format(time.RFC3339),
+			duration(item.Span()),
+		}
+		for _, key := range t.metaKeys {
+			row = append(row, csvValue(c.Meta[key]))
+		}
+		if len(t.dataKeys) == 0 {
+			encoded, err := json.Marshal(data)
+			if err != nil {
+				return err
+			}
+			row = append(row, string(encoded))
+		}
+		for _, key := range t.dataKeys {
+			row = append(row, csvValue(data[key]))
+		}
+		if err := t.w.Write(row); err != nil {
+			return err
+		}
+	}
+	t.w.Flush()
+	return t.w.Error()
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/csv"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimelineCSV(t *testing.T) {
+	startAt, endAt := newDate(2022, 10, 10), newDate(2023, 10, 10)
+
+	contract, _ := NewContract(startAt, endAt, ArbitraryData{"key": "world", "price": 10}, ArbitraryData{"name": "Lease"})
+	_, _ = contract.Branch(startAt.Add(time.Hour*24*30), time.Time{}, ArbitraryData{"key": "venus"})
+
+	var b strings.Builder
+	w, err := newTimelineCSV(&b, []string{"key", "price"}, []string{"name"})
+	require.NoError(t, err)
+	require.NoError(t, w.Write(contract))
+
+	rows, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	require.NoError(t, err)
+
+	left, head := contract.Items[1], contract.Items[2]
+	require.Equal(t, [][]string{
+		{"contract_id", "branch_id", "start_at", "end_at", "span", "meta.name", "data.key", "data.price"},
+		{contract.ID.Hex(), left.ID.Hex(), "2022-10-10T00:00:00Z", "2022-11-09T00:00:00Z", "30days", "Lease", "world", "10"},
+		{contract.ID.Hex(), head.ID.Hex(), "2022-11-09T00:00:00Z", "2023-10-10T00:00:00Z", "335days", "Lease", "venus", ""},
+	}, rows)
+}
+
+func TestTimelineCSVWholeData(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{"key": "world"}, nil)
+
+	var b strings.Builder
+	w, err := newTimelineCSV(&b, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(contract))
+
+	rows, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	require.NoError(t, err)
+	require.Equal(t, "data", rows[0][5])
+	require.Equal(t, `{"key":"world"}`, rows[1][5])
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operators of filter conditions.
+var conditionOperators = map[string]bool{
+	"eq": true, "ne": true, "in": true, "gt": true, "gte": true, "lt": true, "lte": true,
+}
+
+// Condition compares a field of contracts with the given values. Fields
+// are either "meta.<path>", "data.<key>" or one of "created_at",
+// "updated_at", "start_at" and "end_at" (the bounds of the contract).
+// Meta paths reach into nested objects, but not into arrays: an array
+// matches no value. Values are kept as given and converted to the type
+// of the value they are compared with, so "10" matches both the number
+// 10 and the string.
+type Condition struct {
+	Field  string
+	Op     string
+	Values []string // Only the "in" operator takes more than one.
+}
+
+func NewCondition(field, op string, values ...string) (Condition, error) {
+	condition := Condition{Field: field, Op: op, Values: values}
+	switch {
+	case !conditionOperators[op]:
+		return condition, fmt.Errorf("unknown operator %q", op)
+	case len(values) == 0 || (op != "in" && len(values) > 1):
+		return condition, fmt.Errorf("%s takes a single value", op)
+	case strings.HasPrefix(field, "meta.") || strings.HasPrefix(field, "data."):
+		return condition, nil
+	}
+
+	switch field {
+	case "created_at", "updated_at", "start_at", "end_at":
+		for _, value := range values {
+			if _, err := parseTime(value); err != nil {
+				return condition, fmt.Errorf("%s must be a date or an RFC 3339 timestamp", field)
+			}
+		}
+		return condition, nil
+	}
+	return condition, fmt.Errorf("cannot filter by %q", field)
+}
+
+func (c Condition) usesItems() bool {
+	return strings.HasPrefix(c.Field, "data.") || c.Field == "start_at" || c.Field == "end_at"
+}
+
+func compareValue(stored interface{}, value string) (int, bool) {
+	// Compares a stored value with a filter value converted to its
+	// type, tells false if they are not comparable.
+	var number float64
+	switch stored := stored.(type) {
+	case string:
+		return strings.Compare(stored, value), true
+	case bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil || parsed != stored {
+			return 1, err == nil
+		}
+		return 0, true
+	case time.Time:
+		parsed, err := parseTime(value)
+		if err != nil {
+			return 0, false
+		}
+		return compareDate(stored, parsed), true
+	case primitive.DateTime:
+		return compareValue(stored.Time().UTC(), value)
+	case int:
+		number = float64(stored)
+	case int32:
+		number = float64(stored)
+	case int64:
+		number = float64(stored)
+	case float64:
+		number = stored
+	default:
+		return 0, false
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	switch {
+	case err != nil:
+		return 0, false
+	case number < parsed:
+		return -1, true
+	case number > parsed:
+		return 1, true
+	}
+	return 0, true
+}
+
+func (c Condition) Match(stored interface{}, exists bool) bool {
+	if c.Op == "ne" {
+		cmp, ok := compareValue(stored, c.Values[0])
+		return !exists || !ok || cmp != 0
+	}
+	if !exists {
+		return false
+	}
+	for _, value := range c.Values {
+		cmp, ok := compareValue(stored, value)
+		if !ok {
+			continue
+		}
+		switch c.Op {
+		case "eq", "in":
+			if cmp == 0 {
+				return true
+			}
+		case "gt":
+			return cmp > 0
+		case "gte":
+			return cmp >= 0
+		case "lt":
+			return cmp < 0
+		case "lte":
+			return cmp <= 0
+		}
+	}
+	return false
+}
+
+// ContractFilter selects the contracts that satisfy every condition.
+// ActiveAt selects contracts that have a branch in effect at that time,
+// data conditions are checked against the data in effect at DataAt
+// (the current time if zero). Changing selects contracts that have an
+// active branch starting or ending within the window. Excluded contracts
+// are never selected, such as those a principal was denied.
+type ContractFilter struct {
+	Conditions []Condition
+	ActiveAt   time.Time
+	DataAt     time.Time
+	Changing   Window
+	Exclude    []primitive.ObjectID
+}
+
+func (f ContractFilter) Empty() bool {
+	return len(f.Conditions) == 0 && f.ActiveAt.IsZero() && f.Changing == (Window{}) && len(f.Exclude) == 0
+}
+
+// usesItems tells if the items of contracts are needed to filter them.
+func (f ContractFilter) usesItems() bool {
+	for _, condition := range f.Conditions {
+		if condition.usesItems() {
+			return true
+		}
+	}
+	return !f.ActiveAt.IsZero() || f.Changing != (Window{})
+}
+
+func lookupPath(meta ArbitraryData, path string) (interface{}, bool) {
+	var value interface{} = meta
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func effectiveAt(contract *Contract, at time.Time) *Branch {
+	for _, item := range contract.Active() {
+		if !item.StartAt.After(at) && item.EndAt.After(at) {
+			return item
+		}
+	}
+	return nil
+}
+
+func (f ContractFilter) Match(contract *Contract) bool {
+	for _, id := range f.Exclude {
+		if id == contract.ID {
+			return false
+		}
+	}
+	if !f.ActiveAt.IsZero() && effectiveAt(contract, f.ActiveAt) == nil {
+		return false
+	}
+	if f.Changing != (Window{}) && !changing(contract, f.Changing) {
+		return false
+	}
+
+	var data ArbitraryData
+	for _, condition := range f.Conditions {
+		var stored interface{}
+		var exists bool
+
+		switch field := condition.Field; {
+		case strings.HasPrefix(field, "meta."):
+			stored, exists = lookupPath(contract.Meta, strings.TrimPrefix(field, "meta."))
+		case strings.HasPrefix(field, "data."):
+			if data == nil {
+				at := f.DataAt
+				if at.IsZero() {
+					at = time.Now().UTC()
+				}
+				if branch := effectiveAt(contract, at); branch != nil {
+					data = contract.ResolveData(branch)
+				}
+			}
+			stored, exists = data[strings.TrimPrefix(field, "data.")]
+		case field == "created_at":
+			stored, exists = contract.CreatedAt, true
+		case field == "updated_at":
+			stored, exists = contract.UpdatedAt, true
+		case field == "start_at", field == "end_at":
+			startAt, endAt := contract.Bounds()
+			stored, exists = startAt, len(contract.Items) > 0
+			if field == "end_at" {
+				stored = endAt
+			}
+		}
+
+		if !condition.Match(stored, exists) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortValue is the value of the field a contract is sorted by.
+func sortValue(contract *Contract, field string) time.Time {
+	switch field {
+	case "created_at":
+		return contract.CreatedAt
+	case "updated_at":
+		return contract.UpdatedAt
+	}
+	return contract.ID.Timestamp()
+}
+
+// after tells if a contract comes after the cursor of the query.
+func (q ContractQuery) after(contract *Contract) bool {
+	if q.Cursor.IsZero() {
+		return true
+	}
+	cmp := 0
+	if !q.byID() {
+		cmp = compareDate(sortValue(contract, q.Sort), q.CursorValue)
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(contract.ID.Hex(), q.Cursor.Hex())
+	}
+	if q.Ascending {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// filteredCursor applies the filter and the limit of a query to
+// contracts read from a cursor over a broader selection.
+type filteredCursor struct {
+	ContractCursor
+	query   ContractQuery
+	current *Contract
+	count   int64
+	err     error
+}
+
+func filterCursor(cur ContractCursor, query ContractQuery) ContractCursor {
+	return &filteredCursor{ContractCursor: cur, query: query}
+}
+
+func (c *filteredCursor) Next(ctx context.Context) bool {
+	for c.err == nil && (c.query.Limit <= 0 || c.count < c.query.Limit) && c.ContractCursor.Next(ctx) {
+		contract, err := c.ContractCursor.Contract()
+		if err != nil {
+			c.err = err
+			return false
+		}
+		if !c.query.Filter.Match(contract) {
+			continue
+		}
+		if c.query.OmitItems {
+			contract.Items = nil
+		}
+		c.current = contract
+		c.count++
+		return true
+	}
+	return false
+}
+
+func (c *filteredCursor) Contract() (*Contract, error) {
+	return c.current, nil
+}
+
+func (c *filteredCursor) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.ContractCursor.Err()
+}
+
+// sliceCursor is a cursor over contracts that are already loaded.
+type sliceCursor struct {
+	contracts []*Contract
+	current   *Contract
+}
+
+func (c *sliceCursor) Next(context.Context) bool {
+	if len(c.contracts) == 0 {
+		return false
+	}
+	c.current, c.contracts = c.contracts[0], c.contracts[1:]
+	return true
+}
+
+func (c *sliceCursor) Contract() (*Contract, error) {
+	return c.current, nil
+}
+
+func (c *sliceCursor) Err() error {
+	return nil
+}
+
+func (c *sliceCursor) Close(context.Context) error {
+	c.contracts = nil
+	return nil
+}
+
+func sortContracts(contracts []*Contract, query ContractQuery) {
+	sort.SliceStable(contracts, func(i, j int) bool {
+		a, b := contracts[i], contracts[j]
+		cmp := compareDate(sortValue(a, query.Sort), sortValue(b, query.Sort))
+		if cmp == 0 {
+			cmp = strings.Compare(a.ID.Hex(), b.ID.Hex())
+		}
+		if query.Ascending {
+			return cmp < 0
+		}
+		return cmp > 0
+	})
+}
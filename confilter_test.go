@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCondition(t *testing.T) {
+	condition := func(field, op string, values ...string) Condition {
+		c, err := NewCondition(field, op, values...)
+		require.NoError(t, err)
+		return c
+	}
+
+	require.True(t, condition("meta.seats", "eq", "10").Match(float64(10), true))
+	require.True(t, condition("meta.seats", "eq", "10").Match(int32(10), true))
+	require.True(t, condition("meta.seats", "eq", "10").Match("10", true))
+	require.False(t, condition("meta.seats", "eq", "10").Match(float64(10), false))
+	require.True(t, condition("meta.seats", "gte", "10").Match(float64(12), true))
+	require.False(t, condition("meta.seats", "lt", "10").Match(float64(12), true))
+	require.False(t, condition("meta.seats", "lt", "ten").Match(float64(5), true))
+	require.True(t, condition("meta.plan", "in", "gold", "silver").Match("silver", true))
+	require.False(t, condition("meta.plan", "in", "gold", "silver").Match("bronze", true))
+	require.True(t, condition("meta.plan", "ne", "gold").Match("silver", true))
+	require.True(t, condition("meta.plan", "ne", "gold").Match(nil, false))
+	require.True(t, condition("meta.trial", "eq", "true").Match(true, true))
+	require.True(t, condition("created_at", "lt", "2023-01-01").Match(newDate(2022, 12, 31), true))
+
+	for _, args := range [][]string{
+		{"meta.plan", "like", "gold"},
+		{"meta.plan", "eq", "gold", "silver"},
+		{"created_at", "gt", "yesterday"},
+		{"version", "gt", "1"},
+	} {
+		_, err := NewCondition(args[0], args[1], args[2:]...)
+		require.Error(t, err, args)
+	}
+}
+
+func TestContractFilter(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{"price": 10}, ArbitraryData{"plan": "gold"})
+	_, _ = contract.Branch(newDate(2023, 1, 1), time.Time{}, ArbitraryData{"price": 12})
+
+	match := func(filter ContractFilter) bool {
+		return filter.Match(contract)
+	}
+	conditions := func(args ...string) []Condition {
+		c, err := NewCondition(args[0], args[1], args[2:]...)
+		require.NoError(t, err)
+		return []Condition{c}
+	}
+
+	require.True(t, match(ContractFilter{}))
+	require.True(t, match(ContractFilter{ActiveAt: newDate(2023, 5, 1)}))
+	require.False(t, match(ContractFilter{ActiveAt: newDate(2023, 10, 10)}))
+
+	require.True(t, match(ContractFilter{Conditions: conditions("data.price", "eq", "10"), DataAt: newDate(2022, 12, 1)}))
+	require.True(t, match(ContractFilter{Conditions: conditions("data.price", "gt", "10"), DataAt: newDate(2023, 2, 1)}))
+	require.False(t, match(ContractFilter{Conditions: conditions("data.price", "gt", "0"), DataAt: newDate(2024, 1, 1)}))
+
+	require.True(t, match(ContractFilter{Conditions: conditions("start_at", "eq", "2022-10-10")}))
+	require.True(t, match(ContractFilter{Conditions: conditions("end_at", "lte", "2023-12-31")}))
+	require.False(t, match(ContractFilter{Conditions: conditions("meta.plan", "eq", "silver")}))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"strings"
+	"time"
+)
+
+// GanttOptions controls the output of Contract.Gantt.
+type GanttOptions struct {
+	Width int  // Width of the timeline in characters.
+	ASCII bool // Only use ASCII characters when drawing.
+}
+
+type ganttGlyphs struct {
+	active, replaced, blank, edge string
+	replacedBy, ref               string
+}
+
+var unicodeGlyphs = ganttGlyphs{
+	active: "█", replaced: "░", blank: " ", edge: "│",
+	replacedBy: "→", ref: "↰",
+}
+
+var asciiGlyphs = ganttGlyphs{
+	active: "#", replaced: ".", blank: " ", edge: "|",
+	replacedBy: "->", ref: "<-",
+}
+
+const defaultGanttWidth = 60
+
+// shortID returns the trailing (counter) part of an ObjectID, which
+// is enough to tell apart the branches of a single contract.
+func shortID(id primitive.ObjectID) string {
+	return id.Hex()[18:]
+}
+
+func (c *Contract) Gantt(w io.Writer, opts GanttOptions) error {
+	/*
+		Draws the contract as a timeline, one row per branch, with the
+		bars scaled proportionally between the earliest start and the
+		latest end. Replaced branches are dimmed and prefixed with '*'
+		(as in Explain), followed by the rows that replaced them. Branches
+		that carry a data reference point back to the row they refer to.
+	*/
+	width := opts.Width
+	if width <= 0 {
+		width = defaultGanttWidth
+	}
+	glyphs := unicodeGlyphs
+	if opts.ASCII {
+		glyphs = asciiGlyphs
+	}
+
+	if len(c.Items) == 0 {
+		_, err := fmt.Fprintln(w, "span=0s,count=0")
+		return err
+	}
+
+	rows := make(map[primitive.ObjectID]int, len(c.Items))
+	start, end := c.Items[0].StartAt, c.Items[0].EndAt
+	for i, item := range c.Items {
+		rows[item.ID] = i
+		start = minDate(start, item.StartAt)
+		end = maxDate(end, item.EndAt)
+	}
+	total := end.Sub(start)
+
+	column := func(t time.Time) int {
+		return int(float64(t.Sub(start)) / float64(total) * float64(width))
+	}
+
+	labelWidth := len(fmt.Sprint(len(c.Items)-1)) + 1 + len(shortID(c.Items[0].ID))
+	first, last := start.Format("2006-01-02"), end.Format("2006-01-02")
+	padding := maxInt(1, width-len(first)-len(last))
+
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, "%*s   %s%s%s\n", labelWidth, "", first, strings.Repeat(" ", padding), last)
+
+	var span time.Duration
+	for i, item := range c.Items {
+		bar, prefix := glyphs.active, ";"
+		if len(item.ReplacedBy) == 0 {
+			span += item.Span()
+		} else {
+			bar, prefix = glyphs.replaced, "*"
+		}
+
+		from, to := column(item.StartAt), column(item.EndAt)
+		if to <= from {
+			to = from + 1
+		}
+		if to > width {
+			from, to = width-1, width
+		}
+
+		label := fmt.Sprintf("%d %s", i, shortID(item.ID))
+		_, _ = fmt.Fprintf(&b, "%-*s %s%s%s%s%s%s %s",
+			labelWidth, label, prefix, glyphs.edge,
+			strings.Repeat(glyphs.blank, from),
+			strings.Repeat(bar, to-from),
+			strings.Repeat(glyphs.blank, width-to),
+			glyphs.edge, duration(item.Span()))
+
+		if len(item.ReplacedBy) > 0 {
+			var targets []string
+			for _, id := range item.ReplacedBy {
+				if row, ok := rows[id]; ok {
+					targets = append(targets, fmt.Sprint(row))
+				}
+			}
+			_, _ = fmt.Fprintf(&b, " %s %s", glyphs.replacedBy, strings.Join(targets, ","))
+		}
+
+		if ref, ok := item.Data["_ref"].(primitive.ObjectID); ok {
+			if row, ok := rows[ref]; ok {
+				_, _ = fmt.Fprintf(&b, " %s %d", glyphs.ref, row)
+			}
+		}
+		b.WriteByte('\n')
+	}
+	_, _ = fmt.Fprintf(&b, "span=%s,count=%d\n", duration(span), len(c.Items))
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContract_Gantt(t *testing.T) {
+	startAt, endAt := newDate(2022, 10, 10), newDate(2023, 10, 10)
+
+	contract, _ := NewContract(startAt, endAt, ArbitraryData{"key": "world"}, nil)
+	_, _ = contract.Branch(startAt.Add(time.Hour*24*73), startAt.Add(time.Hour*24*146), ArbitraryData{"key": "venus"})
+
+	var b strings.Builder
+	require.NoError(t, contract.Gantt(&b, GanttOptions{Width: 20, ASCII: true}))
+
+	items := contract.Items
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	require.Equal(t, []string{
+		"           2022-10-10 2023-10-10",
+		fmt.Sprintf("0 %s *|....................| 365days -> 1,2,3", shortID(items[0].ID)),
+		fmt.Sprintf("1 %s ;|####                | 73days <- 0", shortID(items[1].ID)),
+		fmt.Sprintf("2 %s ;|    ####            | 73days", shortID(items[2].ID)),
+		fmt.Sprintf("3 %s ;|        ############| 219days <- 0", shortID(items[3].ID)),
+		"span=365days,count=4",
+	}, lines)
+}
+
+func TestContract_GanttUnicode(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{"key": "world"}, nil)
+	_, _ = contract.Branch(newDate(2023, 10, 10), newDate(2023, 12, 1), ArbitraryData{"key": "venus"})
+
+	var b strings.Builder
+	require.NoError(t, contract.Gantt(&b, GanttOptions{}))
+
+	lines := strings.Split(b.String(), "\n")
+	require.Contains(t, lines[0], "2022-10-10")
+	require.Contains(t, lines[0], "2023-12-01")
+	require.Contains(t, lines[1], "│"+strings.Repeat("█", 52))
+	require.Contains(t, lines[2], strings.Repeat("█", 7)+"│")
+	require.NotContains(t, b.String(), "░")
+	require.Contains(t, b.String(), "span=417days,count=2")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CalendarOptions controls the output of WriteCalendar.
+type CalendarOptions struct {
+	Notice []time.Duration // Notice periods to mark before each contract end.
+	Stamp  time.Time       // Creation time of the calendar, defaults to now.
+}
+
+const (
+	icalDateTime  = "20060102T150405Z"
+	icalDate      = "20060102"
+	icalLineLimit = 75
+)
+
+type icalWriter struct {
+	b strings.Builder
+}
+
+func (w *icalWriter) line(name, value string) {
+	// Writes a content line, folding it so that no line
+	// exceeds 75 octets as required by RFC 5545.
+	line, limit := name+":"+value, icalLineLimit
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		w.b.WriteString(line[:cut] + "\r\n ")
+		// Continuation lines start with a space.
+		line, limit = line[cut:], icalLineLimit-1
+	}
+	w.b.WriteString(line + "\r\n")
+}
+
+func (w *icalWriter) text(name, value string) {
+	w.line(name, icalEscape(value))
+}
+
+func icalEscape(s string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(s)
+}
+
+func contractTitle(c *Contract) string {
+	if name, ok := c.Meta["name"].(string); ok && name != "" {
+		return name
+	}
+	return "Contract " + c.ID.Hex()
+}
+
+func summarizeData(data ArbitraryData) string {
+	// Formats data as sorted "key: value" lines.
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, len(keys))
+	for i, key := range keys {
+		lines[i] = fmt.Sprintf("%s: %v", key, data[key])
+	}
+	return strings.Join(lines, "\n")
+}
+
+func noticeDays(d time.Duration) string {
+	if days := d / day; days*day == d {
+		return fmt.Sprintf("%d days", days)
+	}
+	return duration(d)
+}
+
+func metaNotice(c *Contract) []time.Duration {
+	// Contracts may specify their notice period in
+	// days with the "notice_days" meta key.
+	var days float64
+	switch v := c.Meta["notice_days"].(type) {
+	case int:
+		days = float64(v)
+	case int32:
+		days = float64(v)
+	case int64:
+		days = float64(v)
+	case float64:
+		days = v
+	default:
+		return nil
+	}
+	if days <= 0 {
+		return nil
+	}
+	return []time.Duration{time.Duration(days * float64(day))}
+}
+
+func (w *icalWriter) event(uid string, stamp time.Time, fn func()) {
+	w.line("BEGIN", "VEVENT")
+	w.line("UID", uid)
+	w.line("DTSTAMP", stamp.Format(icalDateTime))
+	fn()
+	w.line("END", "VEVENT")
+}
+
+func (w *icalWriter) contract(c *Contract, opts CalendarOptions) {
+	title := contractTitle(c)
+
+	for _, item := range c.Active() {
+		w.event(item.ID.Hex()+"@charlie", opts.Stamp, func() {
+			w.line("DTSTART", item.StartAt.UTC().Format(icalDateTime))
+			w.line("DTEND", item.EndAt.UTC().Format(icalDateTime))
+			w.text("SUMMARY", title)
+			w.text("DESCRIPTION", summarizeData(c.ResolveData(item)))
+		})
+	}
+
+	_, endAt := c.Bounds()
+	if endAt.IsZero() {
+		return
+	}
+
+	w.event(c.ID.Hex()+"-end@charlie", opts.Stamp, func() {
+		w.line("DTSTART;VALUE=DATE", endAt.UTC().Format(icalDate))
+		w.text("SUMMARY", title+" ends")
+	})
+
+	notices := opts.Notice
+	if len(notices) == 0 {
+		notices = metaNotice(c)
+	}
+
+	for _, notice := range notices {
+		deadline := endAt.Add(-notice)
+		uid := fmt.Sprintf("%s-notice-%d@charlie", c.ID.Hex(), int64(notice.Seconds()))
+		w.event(uid, opts.Stamp, func() {
+			w.line("DTSTART;VALUE=DATE", deadline.UTC().Format(icalDate))
+			w.text("SUMMARY", fmt.Sprintf("%s notice deadline (%s)", title, noticeDays(notice)))
+			w.text("DESCRIPTION", fmt.Sprintf("Contract ends at %s.", endAt.UTC().Format(time.RFC3339)))
+		})
+	}
+}
+
+func WriteCalendar(w io.Writer, contracts []*Contract, opts CalendarOptions) error {
+	/*
+		Writes the given contracts as an RFC 5545 calendar. Each active
+		segment of a contract timeline becomes an event carrying its
+		resolved data in the description, along with all-day events for
+		the end of the contract and any of the given notice deadlines.
+	*/
+	cal, err := newCalendarStream(w, opts)
+	if err != nil {
+		return err
+	}
+	for _, contract := range contracts {
+		if err = cal.Write(contract); err != nil {
+			return err
+		}
+	}
+	return cal.Close()
+}
+
+// calendarStream writes a calendar as WriteCalendar does, one contract
+// at a time so that calendars of many contracts are not kept in memory.
+type calendarStream struct {
+	w    io.Writer
+	opts CalendarOptions
+	cal  icalWriter
+}
+
+func newCalendarStream(w io.Writer, opts CalendarOptions) (*calendarStream, error) {
+	if opts.Stamp.IsZero() {
+		opts.Stamp = time.Now()
+	}
+	opts.Stamp = opts.Stamp.UTC()
+
+	s := &calendarStream{w: w, opts: opts}
+	s.cal.line("BEGIN", "VCALENDAR")
+	s.cal.line("VERSION", "2.0")
+	s.cal.line("PRODID", "-//realsuayip//charlie//EN")
+	s.cal.line("CALSCALE", "GREGORIAN")
+	return s, s.flush()
+}
+
+func (s *calendarStream) flush() error {
+	_, err := io.WriteString(s.w, s.cal.b.String())
+	s.cal.b.Reset()
+	return err
+}
+
+func (s *calendarStream) Write(contract *Contract) error {
+	s.cal.contract(contract, s.opts)
+	return s.flush()
+}
+
+func (s *calendarStream) Close() error {
+	s.cal.line("END", "VCALENDAR")
+	return s.flush()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteCalendar(t *testing.T) {
+	startAt, endAt := newDate(2022, 10, 10), newDate(2023, 10, 10)
+
+	contract, _ := NewContract(startAt, endAt, ArbitraryData{"key": "world"}, ArbitraryData{"name": "Lease"})
+	_, _ = contract.Branch(startAt.Add(time.Hour*24*30), startAt.Add(time.Hour*24*60), ArbitraryData{"key": "venus"})
+
+	var b strings.Builder
+	err := WriteCalendar(&b, []*Contract{contract}, CalendarOptions{
+		Notice: []time.Duration{day * 30},
+		Stamp:  newDate(2022, 1, 1),
+	})
+	require.NoError(t, err)
+
+	out := b.String()
+	require.True(t, strings.HasPrefix(out, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n"))
+	require.True(t, strings.HasSuffix(out, "END:VCALENDAR\r\n"))
+
+	// Three active segments, contract end and a notice deadline.
+	require.Equal(t, 5, strings.Count(out, "BEGIN:VEVENT\r\n"))
+	require.Contains(t, out, "DTSTAMP:20220101T000000Z\r\n")
+
+	left, head, right := contract.Items[1], contract.Items[2], contract.Items[3]
+	require.Contains(t, out, "UID:"+left.ID.Hex()+"@charlie\r\nDTSTAMP:20220101T000000Z\r\n"+
+		"DTSTART:20221010T000000Z\r\nDTEND:20221109T000000Z\r\nSUMMARY:Lease\r\nDESCRIPTION:key: world\r\n")
+	require.Contains(t, out, "UID:"+head.ID.Hex()+"@charlie\r\nDTSTAMP:20220101T000000Z\r\n"+
+		"DTSTART:20221109T000000Z\r\nDTEND:20221209T000000Z\r\nSUMMARY:Lease\r\nDESCRIPTION:key: venus\r\n")
+	require.Contains(t, out, "UID:"+right.ID.Hex()+"@charlie\r\n")
+
+	require.Contains(t, out, "DTSTART;VALUE=DATE:20231010\r\nSUMMARY:Lease ends\r\n")
+	require.Contains(t, out, "DTSTART;VALUE=DATE:20230910\r\nSUMMARY:Lease notice deadline (30 days)\r\n")
+}
+
+func TestWriteCalendarMetaNotice(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), nil, ArbitraryData{"notice_days": 10})
+
+	var b strings.Builder
+	require.NoError(t, WriteCalendar(&b, []*Contract{contract}, CalendarOptions{}))
+	require.Contains(t, b.String(), "DTSTART;VALUE=DATE:20230930\r\n")
+}
+
+func TestICalFolding(t *testing.T) {
+	w := new(icalWriter)
+	w.text("DESCRIPTION", strings.Repeat("é", 120)+"; a, b\nc")
+
+	out := w.b.String()
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+		require.LessOrEqual(t, len(line), icalLineLimit)
+	}
+	unfolded := strings.ReplaceAll(out, "\r\n ", "")
+	require.Equal(t, "DESCRIPTION:"+strings.Repeat("é", 120)+`\; a\, b\nc`+"\r\n", unfolded)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// How long the responses of requests with idempotency keys are kept.
+const idempotencyTTL = 24 * time.Hour
+
+var errIdempotencyInProgress = errors.New("a request with this idempotency key is still in progress")
+
+// IdempotencyRecord is a request made with an idempotency key, along
+// with its response once it is complete.
+type IdempotencyRecord struct {
+	Key         string            `bson:"_id"`
+	RequestHash string            `bson:"request_hash"`
+	Completed   bool              `bson:"completed"`
+	Status      int               `bson:"status,omitempty"`
+	Headers     map[string]string `bson:"headers,omitempty"`
+	Body        []byte            `bson:"body,omitempty"`
+	CreatedAt   time.Time         `bson:"created_at"`
+}
+
+func (r *IdempotencyRecord) expired(now time.Time) bool {
+	return !r.CreatedAt.After(now.Add(-idempotencyTTL))
+}
+
+type IdempotencyStore interface {
+	// Reserve stores the record unless there is one with the same
+	// key that has not expired by the time it was created, in which
+	// case that one is returned instead.
+	Reserve(ctx context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error)
+	// Complete stores the response of the request of a record.
+	Complete(ctx context.Context, record *IdempotencyRecord) error
+	// Release forgets a record, so that its key can be used again.
+	Release(ctx context.Context, key string) error
+	// Expire forgets the records created before the given time.
+	Expire(ctx context.Context, before time.Time) error
+}
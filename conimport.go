@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ImportError describes why a row of an import could not be used.
+type ImportError struct {
+	Row    int    `json:"row"`
+	Ref    string `json:"ref,omitempty"`
+	Detail string `json:"detail"`
+}
+
+type importRow struct {
+	Ref     string        `json:"ref"`
+	StartAt string        `json:"start_at"`
+	EndAt   string        `json:"end_at"`
+	Data    ArbitraryData `json:"data"`
+	Meta    ArbitraryData `json:"meta"`
+	line    int
+}
+
+func readImportNDJSON(r io.Reader) ([]importRow, []ImportError) {
+	// Reads one row per line, blank lines are skipped. Rows with values
+	// of the wrong type still tell their ref, which is kept in the error.
+	var rows []importRow
+	var errors []ImportError
+
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		raw, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(raw)) > 0 {
+			row := importRow{line: line}
+			if err := json.Unmarshal(raw, &row); err != nil {
+				errors = append(errors, ImportError{Row: line, Ref: row.Ref, Detail: err.Error()})
+			} else {
+				rows = append(rows, row)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errors = append(errors, ImportError{Row: line, Detail: err.Error()})
+			break
+		}
+	}
+	return rows, errors
+}
+
+func csvCell(value string) interface{} {
+	// Cells holding valid JSON (numbers, booleans, objects...)
+	// are decoded, anything else is taken as a string.
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(value), &decoded); err == nil {
+		return decoded
+	}
+	return value
+}
+
+func readImportCSV(r io.Reader) ([]importRow, []ImportError) {
+	/*
+		Reads rows from CSV with a header line. The "ref", "start_at" and
+		"end_at" columns are taken as is. Data and meta are either given
+		as JSON objects in "data" and "meta" columns, or key by key in
+		columns such as "data.price" and "meta.name". Empty cells are
+		omitted. The ref is read first, so that rows with invalid cells
+		still tell it.
+	*/
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, []ImportError{{Row: 1, Detail: fmt.Sprintf("could not read the header: %s", err)}}
+	}
+	refColumn := -1
+	for i, column := range header {
+		if column == "ref" {
+			refColumn = i
+			break
+		}
+	}
+
+	var rows []importRow
+	var errors []ImportError
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if err != nil {
+			errors = append(errors, ImportError{Row: line, Detail: err.Error()})
+			continue
+		}
+
+		row := importRow{line: line, Data: ArbitraryData{}, Meta: ArbitraryData{}}
+		if refColumn >= 0 && refColumn < len(record) {
+			row.Ref = record[refColumn]
+		}
+		for i, value := range record {
+			if i >= len(header) || value == "" {
+				continue
+			}
+			switch column := header[i]; {
+			case column == "start_at":
+				row.StartAt = value
+			case column == "end_at":
+				row.EndAt = value
+			case column == "data":
+				err = json.Unmarshal([]byte(value), &row.Data)
+			case column == "meta":
+				err = json.Unmarshal([]byte(value), &row.Meta)
+			case strings.HasPrefix(column, "data."):
+				row.Data[strings.TrimPrefix(column, "data.")] = csvCell(value)
+			case strings.HasPrefix(column, "meta."):
+				row.Meta[strings.TrimPrefix(column, "meta.")] = csvCell(value)
+			}
+			if err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			errors = append(errors, ImportError{Row: line, Ref: row.Ref, Detail: err.Error()})
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows, errors
+}
+
+func readImport(r io.Reader, format string) ([]importRow, []ImportError, error) {
+	switch format {
+	case "csv":
+		rows, errors := readImportCSV(r)
+		return rows, errors, nil
+	case "ndjson":
+		rows, errors := readImportNDJSON(r)
+		return rows, errors, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported import format %q, expected csv or ndjson", format)
+}
+
+type importedContract struct {
+	ref      string
+	row      int
+	contract *Contract
+	events   []*Event
+}
+
+func buildImport(rows []importRow, unread []ImportError, actor string) ([]*importedContract, []ImportError) {
+	/*
+		Builds contracts from rows sharing the same ref. The first row of
+		a ref creates the contract, following rows are applied as
+		branches in the given order (their meta, if any, is merged into
+		the contract meta). A contract with any invalid row is dropped
+		as a whole, so that no partial history gets imported; that
+		includes the rows that could not be read at all.
+
+		Each row is an operation of its own in the event log, so
+		the version of a contract is the number of its branch rows.
+	*/
+	var imported []*importedContract
+	var errors []ImportError
+
+	byRef := make(map[string]*importedContract)
+	failed := make(map[string]bool)
+	for _, err := range unread {
+		if err.Ref != "" {
+			failed[err.Ref] = true
+		}
+	}
+
+	for _, row := range rows {
+		if row.Ref == "" {
+			errors = append(errors, ImportError{Row: row.line, Detail: "ref is required"})
+			continue
+		}
+		if failed[row.Ref] {
+			continue
+		}
+
+		fail := func(err error) {
+			errors = append(errors, ImportError{Row: row.line, Ref: row.Ref, Detail: err.Error()})
+			failed[row.Ref] = true
+			delete(byRef, row.Ref)
+		}
+
+		startAt, err := parseTime(row.StartAt)
+		if err != nil {
+			fail(fmt.Errorf("start_at must be a date or an RFC 3339 timestamp"))
+			continue
+		}
+		var endAt time.Time
+		if row.EndAt != "" {
+			relative, err := ParseRelativeTime(row.EndAt)
+			if err != nil {
+				fail(fmt.Errorf("end_at: %s", err))
+				continue
+			}
+			endAt = relative.Resolve(startAt)
+		}
+		if row.Data == nil {
+			fail(fmt.Errorf("data is required"))
+			continue
+		}
+
+		entry, exists := byRef[row.Ref]
+		if !exists {
+			if endAt.IsZero() {
+				fail(fmt.Errorf("end_at is required for the first row of a contract"))
+				continue
+			}
+			meta := row.Meta
+			if meta == nil {
+				meta = ArbitraryData{}
+			}
+			contract, err := NewContract(startAt, endAt, row.Data, meta)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			contract.UpdatedAt = contract.CreatedAt
+			attribute(contract.Items, actor)
+
+			event := NewEvent(contract, EventCreate, actor, EventPayload{
+				StartAt: &startAt, EndAt: &endAt, Data: row.Data, Meta: meta,
+			}, contract.Items)
+			entry = &importedContract{ref: row.Ref, row: row.line, contract: contract, events: []*Event{event}}
+			byRef[row.Ref] = entry
+			imported = append(imported, entry)
+			continue
+		}
+
+		before := len(entry.contract.Items)
+		branch, err := entry.contract.Branch(startAt, endAt, row.Data)
+		if err != nil {
+			fail(err)
+			continue
+		}
+		attribute(entry.contract.Items[before:], actor)
+		payload := EventPayload{StartAt: &branch.StartAt, EndAt: &branch.EndAt, Data: row.Data}
+		if len(row.Meta) > 0 {
+			meta := make(ArbitraryData, len(entry.contract.Meta))
+			for key, value := range entry.contract.Meta {
+				meta[key] = value
+			}
+			for key, value := range row.Meta {
+				meta[key] = value
+			}
+			entry.contract.Meta = meta
+			payload.Meta = meta
+		}
+		entry.contract.Version++
+		entry.events = append(entry.events,
+			NewEvent(entry.contract, EventBranch, actor, payload, entry.contract.Items[before:]))
+	}
+
+	// Drop contracts that failed after they were created.
+	var valid []*importedContract
+	for _, entry := range imported {
+		if !failed[entry.ref] {
+			valid = append(valid, entry)
+		}
+	}
+	return valid, errors
+}
+
+// ImportReport summarizes the outcome of an import.
+type ImportReport struct {
+	Imported  int                           `json:"imported"`
+	Contracts map[string]primitive.ObjectID `json:"contracts"`
+	Errors    []ImportError                 `json:"errors"`
+}
+
+const defaultImportBatch = 500
+
+func importContracts(
+	ctx context.Context, store ContractStore, r io.Reader, format string, batch int, actor string,
+) (*ImportReport, error) {
+	/*
+		Reads, builds and inserts contracts in batches. Rows that can't be
+		used are reported along with the reason; so are contracts that
+		could not be inserted, under their first row. When a batch fails
+		as a whole, each of its contracts is reported, so that the report
+		still tells which ones were imported.
+	*/
+	rows, errors, err := readImport(r, format)
+	if err != nil {
+		return nil, err
+	}
+	entries, buildErrors := buildImport(rows, errors, actor)
+	errors = append(errors, buildErrors...)
+
+	if batch <= 0 {
+		batch = defaultImportBatch
+	}
+
+	report := &ImportReport{Contracts: make(map[string]primitive.ObjectID)}
+	for start := 0; start < len(entries); start += batch {
+		chunk := entries[start:minInt(start+batch, len(entries))]
+
+		contracts := make([]*Contract, len(chunk))
+		var events []*Event
+		for i, entry := range chunk {
+			contracts[i] = entry.contract
+			events = append(events, entry.events...)
+		}
+
+		// The events are recorded along with the contracts.
+		err := store.Insert(ctx, contracts, events...)
+		failed, partial := err.(InsertErrors)
+		if err != nil && !partial {
+			failed = make(InsertErrors)
+			for i := range chunk {
+				failed[i] = err
+			}
+		}
+
+		for i, entry := range chunk {
+			if err, ok := failed[i]; ok {
+				errors = append(errors, ImportError{Row: entry.row, Ref: entry.ref, Detail: err.Error()})
+				continue
+			}
+			report.Contracts[entry.ref] = entry.contract.ID
+			report.Imported++
+		}
+	}
+
+	sort.SliceStable(errors, func(i, j int) bool {
+		return errors[i].Row < errors[j].Row
+	})
+	report.Errors = errors
+	if report.Errors == nil {
+		report.Errors = make([]ImportError, 0)
+	}
+	return report, nil
+}
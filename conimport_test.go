@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadImportCSV(t *testing.T) {
+	input := "ref,start_at,end_at,data.price,data.plan,meta.name,data\n" +
+		"a,2022-10-10,2023-10-10,10,basic,Lease,\n" +
+		"a,2022-11-10,,12,,,\n" +
+		`b,2022-10-10T00:00:00Z,2023-10-10T00:00:00Z,,,,"{""x"": true}"` + "\n" +
+		`c,2022-10-10,2023-10-10,,,,{broken` + "\n"
+
+	rows, errors := readImportCSV(strings.NewReader(input))
+	require.Len(t, rows, 3)
+	require.Equal(t, []ImportError{{Row: 5, Ref: "c", Detail: "invalid character 'b' looking for beginning of object key string"}}, errors)
+
+	require.Equal(t, importRow{
+		Ref: "a", StartAt: "2022-10-10", EndAt: "2023-10-10", line: 2,
+		Data: ArbitraryData{"price": float64(10), "plan": "basic"},
+		Meta: ArbitraryData{"name": "Lease"},
+	}, rows[0])
+	require.Equal(t, ArbitraryData{"price": float64(12)}, rows[1].Data)
+	require.Equal(t, ArbitraryData{"x": true}, rows[2].Data)
+
+	// The ref is told even if it comes after the invalid cell.
+	_, errors = readImportCSV(strings.NewReader("data,ref\n{broken,d\n"))
+	require.Len(t, errors, 1)
+	require.Equal(t, "d", errors[0].Ref)
+}
+
+func TestReadImportNDJSON(t *testing.T) {
+	input := `{"ref": "a", "start_at": "2022-10-10", "end_at": "2023-10-10", "data": {"price": 10}}` + "\n\n" +
+		`{"ref": "a", "start_at": "2022-11-10", "data": {"price": 12}}` + "\n" +
+		`not json` + "\n" +
+		`{"ref": "b", "start_at": "2022-11-10", "data": {}}` + "\n" +
+		`{"ref": "c", "start_at": "2022-11-10", "data": "none"}`
+
+	rows, errors := readImportNDJSON(strings.NewReader(input))
+	require.Len(t, rows, 3)
+	require.Len(t, errors, 2)
+	require.Equal(t, 4, errors[0].Row)
+	require.Equal(t, ImportError{Row: 6, Ref: "c", Detail: errors[1].Detail}, errors[1])
+	require.Equal(t, []int{1, 3, 5}, []int{rows[0].line, rows[1].line, rows[2].line})
+}
+
+func TestBuildImport(t *testing.T) {
+	rows := []importRow{
+		{line: 1, Ref: "a", StartAt: "2022-10-10", EndAt: "2023-10-10", Data: ArbitraryData{"price": 10}, Meta: ArbitraryData{"name": "Lease"}},
+		{line: 2, Ref: "b", StartAt: "2022-10-10", Data: ArbitraryData{}},
+		{line: 3, Ref: "a", StartAt: "2022-11-10", Data: ArbitraryData{"price": 12}, Meta: ArbitraryData{"tier": 2}},
+		{line: 4, Ref: "c", StartAt: "2022-10-10", EndAt: "2023-10-10", Data: ArbitraryData{}},
+		{line: 5, Ref: "c", StartAt: "2025-10-10", Data: ArbitraryData{}},
+		{line: 6, Ref: "c", StartAt: "2022-11-10", Data: ArbitraryData{}},
+		{line: 7, StartAt: "2022-11-10", Data: ArbitraryData{}},
+		{line: 8, Ref: "d", StartAt: "yesterday", Data: ArbitraryData{}},
+	}
+
+	entries, errors := buildImport(rows, nil, "")
+	require.Len(t, entries, 1)
+
+	entry := entries[0]
+	require.Equal(t, "a", entry.ref)
+	require.Equal(t, 1, entry.row)
+	require.Equal(t, ArbitraryData{"name": "Lease", "tier": 2}, entry.contract.Meta)
+
+	active := entry.contract.Active()
+	require.Len(t, active, 2)
+	require.Equal(t, newDate(2022, 11, 10), active[1].StartAt)
+	require.Equal(t, newDate(2023, 10, 10), active[1].EndAt)
+	require.Equal(t, time.Hour*24*31, active[0].Span())
+
+	require.Equal(t, []int{2, 5, 7, 8}, []int{errors[0].Row, errors[1].Row, errors[2].Row, errors[3].Row})
+	require.Contains(t, errors[0].Detail, "end_at is required")
+	require.Contains(t, errors[1].Detail, "out of the boundary")
+	require.Equal(t, "ref is required", errors[2].Detail)
+	require.Contains(t, errors[3].Detail, "start_at must be")
+}
+
+func TestBuildImportUnreadRows(t *testing.T) {
+	// A ref with a row that could not be read is not imported at all.
+	rows := []importRow{
+		{line: 1, Ref: "a", StartAt: "2022-10-10", EndAt: "2023-10-10", Data: ArbitraryData{}},
+		{line: 3, Ref: "b", StartAt: "2022-10-10", EndAt: "2023-10-10", Data: ArbitraryData{}},
+	}
+	entries, errors := buildImport(rows, []ImportError{{Row: 2, Ref: "a", Detail: "unreadable"}}, "")
+	require.Empty(t, errors)
+	require.Len(t, entries, 1)
+	require.Equal(t, "b", entries[0].ref)
+}
+
+// downStore fails to insert anything.
+type downStore struct {
+	ContractStore
+}
+
+func (s downStore) Insert(context.Context, []*Contract, ...*Event) error {
+	return errors.New("store is down")
+}
+
+func TestImportFailedBatch(t *testing.T) {
+	input := `{"ref": "a", "start_at": "2022-10-10", "end_at": "2023-10-10", "data": {}}` + "\n" +
+		`{"ref": "b", "start_at": "2022-10-10", "end_at": "2023-10-10", "data": {}}` + "\n"
+
+	report, err := importContracts(context.Background(), downStore{NewMemoryStore()}, strings.NewReader(input), "ndjson", 1, "")
+	require.NoError(t, err)
+	require.Zero(t, report.Imported)
+	require.Equal(t, []ImportError{
+		{Row: 1, Ref: "a", Detail: "store is down"},
+		{Row: 2, Ref: "b", Detail: "store is down"},
+	}, report.Errors)
+}
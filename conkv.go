@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// kvEngine is an ordered key/value storage organized in buckets, on top
+// of which the embedded backends (in memory and file) are implemented.
+type kvEngine interface {
+	View(fn func(tx kvTx) error) error
+	// Update runs fn in a read-write transaction, which is rolled
+	// back if fn returns an error.
+	Update(fn func(tx kvTx) error) error
+	Close() error
+}
+
+type kvTx interface {
+	// Get returns a copy of the value of given key, or nil.
+	Get(bucket string, key []byte) []byte
+	Put(bucket string, key, value []byte) error
+	Delete(bucket string, key []byte) error
+	// Scan visits the keys of a bucket in ascending (or descending) order,
+	// starting right after the given key (or from the first one if nil)
+	// until fn returns false. Values are only valid during the call.
+	Scan(bucket string, after []byte, descending bool, fn func(key, value []byte) (bool, error)) error
+}
+
+type memoryEngine struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemoryEngine() kvEngine {
+	return &memoryEngine{buckets: make(map[string]map[string][]byte)}
+}
+
+type memoryUndo struct {
+	bucket string
+	key    string
+	value  []byte
+	exists bool
+}
+
+type memoryTx struct {
+	engine   *memoryEngine
+	writable bool
+	undo     []memoryUndo
+}
+
+func (e *memoryEngine) View(fn func(tx kvTx) error) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return fn(&memoryTx{engine: e})
+}
+
+func (e *memoryEngine) Update(fn func(tx kvTx) error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tx := &memoryTx{engine: e, writable: true}
+	if err := fn(tx); err != nil {
+		// Restore the previous values in reverse order.
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			undo := tx.undo[i]
+			if undo.exists {
+				e.buckets[undo.bucket][undo.key] = undo.value
+			} else {
+				delete(e.buckets[undo.bucket], undo.key)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func (e *memoryEngine) Close() error {
+	return nil
+}
+
+func (tx *memoryTx) Get(bucket string, key []byte) []byte {
+	value, exists := tx.engine.buckets[bucket][string(key)]
+	if !exists {
+		return nil
+	}
+	return append([]byte{}, value...)
+}
+
+func (tx *memoryTx) remember(bucket string, key []byte) map[string][]byte {
+	if !tx.writable {
+		panic("kv: write in a read-only transaction")
+	}
+	items, exists := tx.engine.buckets[bucket]
+	if !exists {
+		items = make(map[string][]byte)
+		tx.engine.buckets[bucket] = items
+	}
+	value, exists := items[string(key)]
+	tx.undo = append(tx.undo, memoryUndo{bucket: bucket, key: string(key), value: value, exists: exists})
+	return items
+}
+
+func (tx *memoryTx) Put(bucket string, key, value []byte) error {
+	tx.remember(bucket, key)[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (tx *memoryTx) Delete(bucket string, key []byte) error {
+	delete(tx.remember(bucket, key), string(key))
+	return nil
+}
+
+func (tx *memoryTx) Scan(bucket string, after []byte, descending bool, fn func(key, value []byte) (bool, error)) error {
+	items := tx.engine.buckets[bucket]
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if descending {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+
+	for _, key := range keys {
+		if after != nil {
+			cmp := bytes.Compare([]byte(key), after)
+			if (!descending && cmp <= 0) || (descending && cmp >= 0) {
+				continue
+			}
+		}
+		// Keys might get deleted by fn while scanning.
+		value, exists := items[key]
+		if !exists {
+			continue
+		}
+		next, err := fn([]byte(key), value)
+		if err != nil || !next {
+			return err
+		}
+	}
+	return nil
+}
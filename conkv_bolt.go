@@ -0,0 +1,106 @@
+package main
+
+import (
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+type boltEngine struct {
+	db *bbolt.DB
+}
+
+func newBoltEngine(path string) (kvEngine, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltEngine{db: db}, nil
+}
+
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+func (e *boltEngine) View(fn func(tx kvTx) error) error {
+	return e.db.View(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (e *boltEngine) Update(fn func(tx kvTx) error) error {
+	return e.db.Update(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (e *boltEngine) Close() error {
+	return e.db.Close()
+}
+
+func (tx boltTx) Get(bucket string, key []byte) []byte {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	value := b.Get(key)
+	if value == nil {
+		return nil
+	}
+	// Values returned by bolt are only valid during the transaction.
+	return append([]byte{}, value...)
+}
+
+func (tx boltTx) Put(bucket string, key, value []byte) error {
+	b, err := tx.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put(key, value)
+}
+
+func (tx boltTx) Delete(bucket string, key []byte) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete(key)
+}
+
+func (tx boltTx) Scan(bucket string, after []byte, descending bool, fn func(key, value []byte) (bool, error)) error {
+	b := tx.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	// Deleting keys while iterating confuses bolt cursors, so they are
+	// visited by seeking right after the previous key on each step.
+	c := b.Cursor()
+	next := func(after []byte) ([]byte, []byte) {
+		if after == nil {
+			if descending {
+				return c.Last()
+			}
+			return c.First()
+		}
+		// Seek lands on the first key that is not less than the given one.
+		key, value := c.Seek(after)
+		if descending {
+			if key == nil {
+				return c.Last()
+			}
+			return c.Prev()
+		}
+		if key != nil && string(key) == string(after) {
+			return c.Next()
+		}
+		return key, value
+	}
+
+	for key, value := next(after); key != nil; key, value = next(after) {
+		proceed, err := fn(key, value)
+		if err != nil || !proceed {
+			return err
+		}
+		after = append([]byte{}, key...)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+)
+
+func kvEngines(t *testing.T) map[string]kvEngine {
+	bolt, err := newBoltEngine(filepath.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = bolt.Close() })
+
+	return map[string]kvEngine{"memory": newMemoryEngine(), "bolt": bolt}
+}
+
+func scanKeys(t *testing.T, engine kvEngine, after []byte, descending bool) string {
+	var keys string
+	err := engine.View(func(tx kvTx) error {
+		return tx.Scan("bucket", after, descending, func(key, _ []byte) (bool, error) {
+			keys += string(key)
+			return true, nil
+		})
+	})
+	require.NoError(t, err)
+	return keys
+}
+
+func TestKVScan(t *testing.T) {
+	for name, engine := range kvEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, "", scanKeys(t, engine, nil, false))
+
+			err := engine.Update(func(tx kvTx) error {
+				for _, key := range []string{"d", "b", "a", "e", "c"} {
+					if err := tx.Put("bucket", []byte(key), []byte("value-"+key)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			require.NoError(t, err)
+
+			require.Equal(t, "abcde", scanKeys(t, engine, nil, false))
+			require.Equal(t, "edcba", scanKeys(t, engine, nil, true))
+			require.Equal(t, "cde", scanKeys(t, engine, []byte("b"), false))
+			require.Equal(t, "ba", scanKeys(t, engine, []byte("c"), true))
+			require.Equal(t, "cde", scanKeys(t, engine, []byte("bb"), false))
+			require.Equal(t, "ba", scanKeys(t, engine, []byte("bb"), true))
+			require.Equal(t, "edcba", scanKeys(t, engine, []byte("z"), true))
+			require.Equal(t, "", scanKeys(t, engine, []byte("a"), true))
+
+			var seen []string
+			_ = engine.View(func(tx kvTx) error {
+				return tx.Scan("bucket", nil, false, func(key, value []byte) (bool, error) {
+					seen = append(seen, string(value))
+					return len(seen) < 2, nil
+				})
+			})
+			require.Equal(t, []string{"value-a", "value-b"}, seen)
+		})
+	}
+}
+
+func TestKVUpdate(t *testing.T) {
+	for name, engine := range kvEngines(t) {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, engine.Update(func(tx kvTx) error {
+				_ = tx.Put("bucket", []byte("a"), []byte("1"))
+				return tx.Put("bucket", []byte("b"), []byte("2"))
+			}))
+
+			// Failed transactions leave no trace.
+			failure := errors.New("failure")
+			err := engine.Update(func(tx kvTx) error {
+				_ = tx.Put("bucket", []byte("a"), []byte("changed"))
+				_ = tx.Put("bucket", []byte("c"), []byte("3"))
+				_ = tx.Delete("bucket", []byte("b"))
+				return failure
+			})
+			require.Equal(t, failure, err)
+
+			_ = engine.View(func(tx kvTx) error {
+				require.Equal(t, []byte("1"), tx.Get("bucket", []byte("a")))
+				require.Equal(t, []byte("2"), tx.Get("bucket", []byte("b")))
+				require.Nil(t, tx.Get("bucket", []byte("c")))
+				require.Nil(t, tx.Get("missing", []byte("a")))
+				return nil
+			})
+
+			// Deleting while scanning visits every key once.
+			var deleted string
+			require.NoError(t, engine.Update(func(tx kvTx) error {
+				return tx.Scan("bucket", nil, false, func(key, _ []byte) (bool, error) {
+					deleted += string(key)
+					return true, tx.Delete("bucket", key)
+				})
+			}))
+			require.Equal(t, "ab", deleted)
+			require.Equal(t, "", scanKeys(t, engine, nil, false))
+		})
+	}
+}
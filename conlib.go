@@ -1,11 +1,21 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
 	"time"
 )
 
+var (
+	ErrOutOfBounds   = errors.New("start date is out of bounds")
+	ErrEmptySpan     = errors.New("this branch would span nothing")
+	ErrUnknownBranch = errors.New("branch not found")
+	ErrDanglingRef   = errors.New("data refers to a branch that does not exist")
+)
+
 type Branch struct {
 	ID         primitive.ObjectID   `bson:"_id" json:"_id"`
 	Data       ArbitraryData        `bson:"data" json:"data"`
@@ -13,6 +23,7 @@ type Branch struct {
 	StartAt    time.Time            `bson:"start_at" json:"start_at"`
 	EndAt      time.Time            `bson:"end_at" json:"end_at"`
 	CreatedAt  time.Time            `bson:"created_at" json:"created_at"`
+	CreatedBy  string               `bson:"created_by,omitempty" json:"created_by,omitempty"`
 }
 
 func NewBranch(StartAt, EndAt time.Time, Data ArbitraryData) (*Branch, error) {
@@ -24,15 +35,32 @@ func NewBranch(StartAt, EndAt time.Time, Data ArbitraryData) (*Branch, error) {
 		CreatedAt: time.Now().UTC(),
 	}
 	if branch.Span() <= 0 {
-		return branch, fmt.Errorf("this branch would span nothing (%s)", branch)
+		return branch, fmt.Errorf("%w (%s)", ErrEmptySpan, branch)
 	}
 	return branch, nil
 }
 
+func attribute(branches []*Branch, author string) {
+	// Records who created the branches.
+	for _, branch := range branches {
+		branch.CreatedBy = author
+	}
+}
+
 func (b *Branch) Span() time.Duration {
 	return b.EndAt.Sub(b.StartAt)
 }
 
+func (b *Branch) MarshalJSON() ([]byte, error) {
+	// Include the span both in human-readable and ISO 8601 format.
+	type branch Branch
+	return json.Marshal(struct {
+		*branch
+		Span    string `json:"span"`
+		SpanISO string `json:"span_iso"`
+	}{(*branch)(b), duration(b.Span()), isoDuration(b.Span())})
+}
+
 func (b *Branch) String() string {
 	var replacedBy []primitive.ObjectID
 	for _, item := range b.ReplacedBy {
@@ -50,10 +78,13 @@ func (b *Branch) String() string {
 
 type Contract struct {
 	ID        primitive.ObjectID `bson:"_id" json:"_id"`
+	Tenant    string             `bson:"tenant,omitempty" json:"tenant,omitempty"`
 	Meta      ArbitraryData      `bson:"meta" json:"meta"`
-	Items     []*Branch          `bson:"items" json:"items"`
+	Items     []*Branch          `bson:"items" json:"items,omitempty"`
+	Version   int64              `bson:"version" json:"version"`
 	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
 	UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+	DeletedAt *time.Time         `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
 }
 
 func NewContract(StartAt, EndAt time.Time, Data ArbitraryData, Meta ArbitraryData) (*Contract, error) {
@@ -78,6 +109,40 @@ func (c *Contract) Contains(branch *Branch) bool {
 	return false
 }
 
+func (c *Contract) FindBranch(id primitive.ObjectID) (*Branch, error) {
+	for _, item := range c.Items {
+		if item.ID == id {
+			return item, nil
+		}
+	}
+	return nil, ErrUnknownBranch
+}
+
+func (c *Contract) checkRef(data ArbitraryData) error {
+	/*
+		Data may only refer to the data of another branch of the
+		contract. References given as hex strings, as they are in
+		JSON, are turned into IDs.
+	*/
+	ref, exists := data["_ref"]
+	if !exists {
+		return nil
+	}
+	id, ok := ref.(primitive.ObjectID)
+	if hex, isString := ref.(string); isString {
+		var err error
+		id, err = primitive.ObjectIDFromHex(hex)
+		ok = err == nil
+	}
+	if ok {
+		if _, err := c.FindBranch(id); err == nil {
+			data["_ref"] = id
+			return nil
+		}
+	}
+	return fmt.Errorf("%w (%v)", ErrDanglingRef, ref)
+}
+
 func (c *Contract) Shift(old, new *Branch, replace bool) {
 	if !c.Contains(new) {
 		c.Items = append(c.Items, new)
@@ -101,6 +166,44 @@ func (c *Contract) ResolveDataref(b *Branch) ArbitraryData {
 	}
 }
 
+func (c *Contract) ResolveData(b *Branch) ArbitraryData {
+	// Returns the data a branch effectively holds, following
+	// its data reference if there is one.
+	ref := c.ResolveDataref(b)["_ref"]
+	for _, branch := range c.Items {
+		if ref == branch.ID {
+			return branch.Data
+		}
+	}
+	return b.Data
+}
+
+func (c *Contract) Active() []*Branch {
+	// Returns the branches that are not replaced, ordered by their start date.
+	var items []*Branch
+	for _, item := range c.Items {
+		if len(item.ReplacedBy) == 0 {
+			items = append(items, item)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].StartAt.Before(items[j].StartAt)
+	})
+	return items
+}
+
+func (c *Contract) Bounds() (startAt, endAt time.Time) {
+	for i, item := range c.Active() {
+		if i == 0 || item.StartAt.Before(startAt) {
+			startAt = item.StartAt
+		}
+		if item.EndAt.After(endAt) {
+			endAt = item.EndAt
+		}
+	}
+	return startAt, endAt
+}
+
 func (c *Contract) Branch(StartAt, EndAt time.Time, Data ArbitraryData) (*Branch, error) {
 	var minStart, maxEnd time.Time
 	var items []*Branch
@@ -117,8 +220,12 @@ func (c *Contract) Branch(StartAt, EndAt time.Time, Data ArbitraryData) (*Branch
 
 	if StartAt.After(maxEnd) || StartAt.Before(minStart) {
 		return nil, fmt.Errorf(
-			"given start date (%s) is out of the boundary, the valid boundary is between %s and %s (inclusively)",
-			StartAt, minStart, maxEnd)
+			"%w: given start date (%s) is out of the boundary, the valid boundary is between %s and %s (inclusively)",
+			ErrOutOfBounds, StartAt, minStart, maxEnd)
+	}
+
+	if err := c.checkRef(Data); err != nil {
+		return nil, err
 	}
 
 	if time.Time.IsZero(EndAt) {
@@ -132,7 +132,7 @@ func TestContractBranchSpansNothing(t *testing.T) {
 	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{"key": "world"}, nil)
 
 	_, err := contract.Branch(newDate(2022, 10, 10), newDate(2022, 10, 10), nil)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrEmptySpan)
 	require.Contains(t, err.Error(), "this branch would span nothing")
 
 	_, err2 := contract.Branch(newDate(2022, 10, 10), newDate(2022, 10, 9), nil)
@@ -144,7 +144,7 @@ func TestContractBranchSpanDateOutOfBoundary(t *testing.T) {
 	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{"key": "world"}, nil)
 
 	_, err := contract.Branch(newDate(2023, 10, 10).Add(time.Hour*24*52), time.Time{}, nil)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrOutOfBounds)
 	require.Contains(t, err.Error(), "out of the boundary")
 
 	_, err2 := contract.Branch(newDate(2022, 10, 10).Truncate(time.Hour*24*52), time.Time{}, nil)
@@ -156,6 +156,24 @@ func TestContractBranchSpanDateOutOfBoundary(t *testing.T) {
 	require.True(t, head1.StartAt.Before(head.StartAt))
 }
 
+func TestContractBranchDanglingRef(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{"key": "world"}, nil)
+	initial := contract.Items[0]
+
+	_, err := contract.Branch(newDate(2023, 1, 1), time.Time{}, ArbitraryData{"_ref": "elsewhere"})
+	require.ErrorIs(t, err, ErrDanglingRef)
+	require.Len(t, contract.Items, 1)
+
+	_, err = contract.Branch(newDate(2023, 1, 1), time.Time{}, ArbitraryData{"_ref": initial.ID})
+	require.NoError(t, err)
+
+	found, err := contract.FindBranch(initial.ID)
+	require.NoError(t, err)
+	require.Same(t, initial, found)
+	_, err = contract.FindBranch(contract.ID)
+	require.ErrorIs(t, err, ErrUnknownBranch)
+}
+
 func TestContractSpanDateOutOfBoundary(t *testing.T) {
 	_, err := NewContract(newDate(2023, 10, 10), newDate(2015, 10, 10), nil, nil)
 	require.Error(t, err)
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+)
+
+// BranchInfo is a branch along with what it takes its contract to
+// make sense of it: the data it effectively holds, the branches that
+// replaced it and the ones it replaced. Branches that are split from
+// another one (the parts of it left outside a new branch) tell which.
+type BranchInfo struct {
+	Branch     *Branch              `json:"branch"`
+	Active     bool                 `json:"active"`
+	Data       ArbitraryData        `json:"data"`
+	ReplacedBy []primitive.ObjectID `json:"replaced_by"`
+	Replaces   []primitive.ObjectID `json:"replaces"`
+	SplitFrom  *primitive.ObjectID  `json:"split_from"`
+}
+
+// LineageEdge tells that a branch was replaced by another one.
+type LineageEdge struct {
+	From primitive.ObjectID `json:"from"`
+	To   primitive.ObjectID `json:"to"`
+}
+
+// Lineage is the graph of the branches a branch descends from and
+// the ones descending from it, in the order they were created.
+type Lineage struct {
+	Ancestors   []primitive.ObjectID `json:"ancestors"`
+	Descendants []primitive.ObjectID `json:"descendants"`
+	Branches    []*Branch            `json:"branches"`
+	Edges       []LineageEdge        `json:"edges"`
+}
+
+// replacements maps branches to the ones they replaced.
+func (c *Contract) replacements() map[primitive.ObjectID][]primitive.ObjectID {
+	replaces := make(map[primitive.ObjectID][]primitive.ObjectID)
+	for _, item := range c.Items {
+		for _, id := range item.ReplacedBy {
+			replaces[id] = append(replaces[id], item.ID)
+		}
+	}
+	return replaces
+}
+
+func (c *Contract) describe(branch *Branch, replaces map[primitive.ObjectID][]primitive.ObjectID) *BranchInfo {
+	info := &BranchInfo{
+		Branch:     branch,
+		Active:     len(branch.ReplacedBy) == 0,
+		Data:       c.ResolveData(branch),
+		ReplacedBy: branch.ReplacedBy,
+		Replaces:   replaces[branch.ID],
+	}
+	if info.ReplacedBy == nil {
+		info.ReplacedBy = make([]primitive.ObjectID, 0)
+	}
+	if info.Replaces == nil {
+		info.Replaces = make([]primitive.ObjectID, 0)
+	}
+	// Splits refer to the data of the branch they are split from
+	// and replace nothing but that branch.
+	if _, split := branch.Data["_ref"]; split && len(info.Replaces) == 1 {
+		info.SplitFrom = &info.Replaces[0]
+	}
+	return info
+}
+
+func (c *Contract) DescribeBranch(branch *Branch) *BranchInfo {
+	return c.describe(branch, c.replacements())
+}
+
+func (c *Contract) DescribeBranches(branches []*Branch) []*BranchInfo {
+	replaces := c.replacements()
+	infos := make([]*BranchInfo, len(branches))
+	for i, branch := range branches {
+		infos[i] = c.describe(branch, replaces)
+	}
+	return infos
+}
+
+func (c *Contract) Lineage(branch *Branch) *Lineage {
+	/*
+		Walks the replacements both ways: the ancestors of a branch are
+		the ones it replaced and so on, its descendants are the ones that
+		replaced it and so on. The edges are every replacement among
+		these branches.
+	*/
+	replaces := c.replacements()
+	walk := func(next func(primitive.ObjectID) []primitive.ObjectID) map[primitive.ObjectID]bool {
+		seen := make(map[primitive.ObjectID]bool)
+		queue := next(branch.ID)
+		for len(queue) > 0 {
+			id := queue[0]
+			queue = queue[1:]
+			if !seen[id] {
+				seen[id] = true
+				queue = append(queue, next(id)...)
+			}
+		}
+		return seen
+	}
+	ancestors := walk(func(id primitive.ObjectID) []primitive.ObjectID {
+		return replaces[id]
+	})
+	descendants := walk(func(id primitive.ObjectID) []primitive.ObjectID {
+		if item, err := c.FindBranch(id); err == nil {
+			return item.ReplacedBy
+		}
+		return nil
+	})
+
+	lineage := &Lineage{
+		Ancestors:   make([]primitive.ObjectID, 0),
+		Descendants: make([]primitive.ObjectID, 0),
+		Branches:    make([]*Branch, 0),
+		Edges:       make([]LineageEdge, 0),
+	}
+	nodes := make(map[primitive.ObjectID]bool)
+	for _, item := range c.Items {
+		switch {
+		case ancestors[item.ID]:
+			lineage.Ancestors = append(lineage.Ancestors, item.ID)
+		case descendants[item.ID]:
+			lineage.Descendants = append(lineage.Descendants, item.ID)
+		case item.ID != branch.ID:
+			continue
+		}
+		nodes[item.ID] = true
+		lineage.Branches = append(lineage.Branches, item)
+	}
+	for _, item := range lineage.Branches {
+		for _, id := range item.ReplacedBy {
+			if nodes[id] {
+				lineage.Edges = append(lineage.Edges, LineageEdge{From: item.ID, To: id})
+			}
+		}
+	}
+	return lineage
+}
+
+// BranchFilter selects branches of a contract within the window;
+// Replaced selects only the replaced ones.
+type BranchFilter struct {
+	Window   Window
+	Replaced bool
+}
+
+func (c *Contract) SelectBranches(filter BranchFilter) []*Branch {
+	// Returns the selected branches ordered by their start date,
+	// the ones created first coming first.
+	branches := make([]*Branch, 0)
+	for _, item := range c.Items {
+		if filter.Window.Contains(item) && (!filter.Replaced || len(item.ReplacedBy) > 0) {
+			branches = append(branches, item)
+		}
+	}
+	sort.SliceStable(branches, func(i, j int) bool {
+		return branches[i].StartAt.Before(branches[j].StartAt)
+	})
+	return branches
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestBranchLineage(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 1, 1), newDate(2023, 1, 1), ArbitraryData{"price": 10}, ArbitraryData{})
+	initial := contract.Items[0]
+	middle, _ := contract.Branch(newDate(2022, 3, 1), newDate(2022, 6, 1), ArbitraryData{"price": 12})
+	inner, _ := contract.Branch(newDate(2022, 4, 1), newDate(2022, 5, 1), ArbitraryData{"price": 14})
+
+	info := contract.DescribeBranch(initial)
+	require.False(t, info.Active)
+	require.Len(t, info.ReplacedBy, 3)
+	require.Empty(t, info.Replaces)
+	require.Nil(t, info.SplitFrom)
+
+	var splits []*BranchInfo
+	for _, item := range contract.DescribeBranches(contract.Items) {
+		if item.SplitFrom != nil && *item.SplitFrom == middle.ID {
+			splits = append(splits, item)
+		}
+	}
+	require.Len(t, splits, 2)
+	require.Equal(t, ArbitraryData{"price": 12}, splits[0].Data)
+	require.True(t, splits[0].Active)
+
+	lineage := contract.Lineage(inner)
+	require.Equal(t, []primitive.ObjectID{initial.ID, middle.ID}, lineage.Ancestors)
+	require.Empty(t, lineage.Descendants)
+	require.Equal(t, []LineageEdge{{initial.ID, middle.ID}, {middle.ID, inner.ID}}, lineage.Edges)
+
+	lineage = contract.Lineage(initial)
+	require.Empty(t, lineage.Ancestors)
+	require.Len(t, lineage.Descendants, 6)
+	require.Len(t, lineage.Edges, 6)
+
+	active := contract.SelectBranches(BranchFilter{Window: Window{Active: true}})
+	require.Len(t, active, 5)
+	require.Equal(t, newDate(2022, 1, 1), active[0].StartAt)
+	require.Len(t, contract.SelectBranches(BranchFilter{Replaced: true}), 2)
+	require.Len(t, contract.SelectBranches(BranchFilter{Window: Window{From: newDate(2022, 4, 15), To: newDate(2022, 4, 20)}}), 3)
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrPatchNotApplied tells that a contract did not satisfy the
+	// conditions of a patch, or that it is missing or deleted.
+	ErrPatchNotApplied = errors.New("the patch does not apply to the stored contract")
+	errPatchTestFailed = errors.New("a test operation of the patch failed")
+)
+
+// PatchOperation is an operation of a JSON Patch (RFC 6902).
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func parsePointer(pointer string) ([]string, error) {
+	// Splits a JSON Pointer (RFC 6901) into its reference tokens.
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%q is not a JSON pointer", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func metaPointer(pointer string) ([]string, error) {
+	tokens, err := parsePointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 || tokens[0] != "meta" {
+		return nil, fmt.Errorf("%q is not within /meta, only meta can be patched", pointer)
+	}
+	return tokens, nil
+}
+
+func ParseJSONPatch(body []byte) ([]PatchOperation, error) {
+	var ops []PatchOperation
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return nil, fmt.Errorf("a JSON Patch must be an array of operations: %s", err)
+	}
+	for i, op := range ops {
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, fmt.Errorf("operation %d: %s requires a value", i, op.Op)
+			}
+		case "move", "copy":
+			if _, err := metaPointer(op.From); err != nil {
+				return nil, fmt.Errorf("operation %d: %s", i, err)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d: unknown operation %q", i, op.Op)
+		}
+		if _, err := metaPointer(op.Path); err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+	}
+	return ops, nil
+}
+
+func plainJSON(value interface{}) (interface{}, error) {
+	// Turns a value into what decoding its JSON gives, so that values
+	// read from the store compare equal to the ones in patches.
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var plain interface{}
+	err = json.Unmarshal(raw, &plain)
+	return plain, err
+}
+
+func jsonEqual(a, b interface{}) bool {
+	a, errA := plainJSON(a)
+	b, errB := plainJSON(b)
+	return errA == nil && errB == nil && reflect.DeepEqual(a, b)
+}
+
+func arrayIndex(array []interface{}, token string, insert bool) (int, error) {
+	limit := len(array)
+	if insert {
+		if token == "-" {
+			return limit, nil
+		}
+		limit++
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index >= limit || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	return index, nil
+}
+
+func pointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			value, exists := container[token]
+			if !exists {
+				return nil, fmt.Errorf("%q does not exist", token)
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(container, token, false)
+			if err != nil {
+				return nil, err
+			}
+			doc = container[index]
+		default:
+			return nil, fmt.Errorf("%q does not exist", token)
+		}
+	}
+	return doc, nil
+}
+
+func pointerEdit(
+	doc interface{}, tokens []string, edit func(container interface{}, token string) (interface{}, error),
+) (interface{}, error) {
+	// Edits the container the pointer refers into and returns the
+	// document, with the containers on the way updated since editing
+	// arrays makes new ones.
+	if len(tokens) == 1 {
+		return edit(doc, tokens[0])
+	}
+	child, err := pointerGet(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = pointerEdit(child, tokens[1:], edit); err != nil {
+		return nil, err
+	}
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		container[tokens[0]] = child
+	case []interface{}:
+		index, _ := arrayIndex(container, tokens[0], false)
+		container[index] = child
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	return pointerEdit(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(container, token, true)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+		return nil, fmt.Errorf("cannot add %q to a value that is neither an object nor an array", token)
+	})
+}
+
+func pointerRemove(doc interface{}, tokens []string) (interface{}, error) {
+	return pointerEdit(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			if _, exists := container[token]; !exists {
+				return nil, fmt.Errorf("%q does not exist", token)
+			}
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(container, token, false)
+			if err != nil {
+				return nil, err
+			}
+			return append(container[:index], container[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("%q does not exist", token)
+	})
+}
+
+func applyJSONPatch(doc interface{}, ops []PatchOperation) (interface{}, error) {
+	/*
+		Applies the operations in order, failing as a whole if any of
+		them fails. The document is changed in place, so it is expected
+		to be a copy (see plainJSON).
+	*/
+	for i, op := range ops {
+		path, _ := parsePointer(op.Path)
+		from, _ := parsePointer(op.From)
+
+		var value interface{}
+		var err error
+		switch op.Op {
+		case "add", "replace", "test":
+			err = json.Unmarshal(op.Value, &value)
+		case "move", "copy":
+			if op.Op == "move" && strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, fmt.Errorf("operation %d: cannot move a value into itself", i)
+			}
+			if value, err = pointerGet(doc, from); err == nil {
+				value, err = plainJSON(value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+
+		switch op.Op {
+		case "add", "copy":
+			doc, err = pointerAdd(doc, path, value)
+		case "remove":
+			doc, err = pointerRemove(doc, path)
+		case "replace":
+			if doc, err = pointerRemove(doc, path); err == nil {
+				doc, err = pointerAdd(doc, path, value)
+			}
+		case "move":
+			if doc, err = pointerRemove(doc, from); err == nil {
+				doc, err = pointerAdd(doc, path, value)
+			}
+		case "test":
+			var current interface{}
+			if current, err = pointerGet(doc, path); err == nil && !jsonEqual(current, value) {
+				err = errPatchTestFailed
+			}
+		}
+		if err == errPatchTestFailed {
+			return nil, err
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %s", i, err)
+		}
+	}
+	return doc, nil
+}
+
+func applyMergePatch(target, patch interface{}) interface{} {
+	// Applies a JSON Merge Patch (RFC 7386).
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		object = make(map[string]interface{})
+	}
+	for key, value := range members {
+		if value == nil {
+			delete(object, key)
+		} else {
+			object[key] = applyMergePatch(object[key], value)
+		}
+	}
+	return object
+}
+
+func patchMeta(meta ArbitraryData, apply func(doc interface{}) (interface{}, error)) (ArbitraryData, error) {
+	// Patches a copy of the meta as in {"meta": {...}}, so that
+	// pointers and merge patches are relative to the contract.
+	doc, err := plainJSON(map[string]interface{}{"meta": meta})
+	if err != nil {
+		return nil, err
+	}
+	if doc, err = apply(doc); err != nil {
+		return nil, err
+	}
+	patched, ok := doc.(map[string]interface{})["meta"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("meta must remain an object")
+	}
+	return patched, nil
+}
+
+// MetaPatch is a change to the meta of a contract that stores make
+// in place, without replacing the rest of the meta. Paths are keys of
+// the meta, or dotted paths to keys of objects within it. The patch
+// only applies to contracts that are not deleted and satisfy all of
+// the conditions; Version is the expected version, unless negative.
+type MetaPatch struct {
+	Version int64
+	Set     map[string]interface{}
+	Unset   []string
+	Exists  []string               // Paths that must exist.
+	Objects []string               // Paths that must hold objects.
+	Merge   []string               // Paths that must hold objects, if anything.
+	Equal   map[string]interface{} // Paths that must hold these values.
+}
+
+func newMetaPatch() MetaPatch {
+	return MetaPatch{Version: -1, Set: make(map[string]interface{}), Equal: make(map[string]interface{})}
+}
+
+func metaKey(key string) bool {
+	// Keys that can be a part of dotted paths without ambiguity,
+	// numbers could as well be indices of arrays.
+	if key == "" || key == "-" || strings.ContainsAny(key, ".$") {
+		return false
+	}
+	_, err := strconv.Atoi(key)
+	return err != nil
+}
+
+func relatedPaths(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+func TranslateJSONPatch(ops []PatchOperation) (MetaPatch, bool) {
+	/*
+		Tells the in-place change equivalent to the operations, if there
+		is one. Each changed path must be distinct from the others, as
+		must be tested paths from the ones changed before them, so that
+		the order of the operations does not matter. Tests compare with
+		the stored values, which is only exact for scalars.
+	*/
+	patch := newMetaPatch()
+	var changed []string
+	for _, op := range ops {
+		tokens, _ := parsePointer(op.Path)
+		if len(tokens) < 2 {
+			return patch, false
+		}
+		for _, token := range tokens[1:] {
+			if !metaKey(token) {
+				return patch, false
+			}
+		}
+		path := strings.Join(tokens[1:], ".")
+		for _, other := range changed {
+			if relatedPaths(path, other) {
+				return patch, false
+			}
+		}
+		for i := 2; i < len(tokens); i++ {
+			patch.Objects = append(patch.Objects, strings.Join(tokens[1:i], "."))
+		}
+
+		var value interface{}
+		if len(op.Value) > 0 {
+			_ = json.Unmarshal(op.Value, &value)
+		}
+		switch op.Op {
+		case "test":
+			switch value.(type) {
+			case string, float64, bool:
+			default:
+				return patch, false
+			}
+			if current, exists := patch.Equal[path]; exists && current != value {
+				return patch, false
+			}
+			patch.Equal[path] = value
+			continue
+		case "add":
+			patch.Set[path] = value
+		case "replace":
+			patch.Set[path] = value
+			patch.Exists = append(patch.Exists, path)
+		case "remove":
+			patch.Unset = append(patch.Unset, path)
+			patch.Exists = append(patch.Exists, path)
+		default:
+			return patch, false
+		}
+		changed = append(changed, path)
+	}
+	return patch, true
+}
+
+func (p *MetaPatch) merge(prefix string, members map[string]interface{}) bool {
+	for key, value := range members {
+		if !metaKey(key) {
+			return false
+		}
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		switch value := value.(type) {
+		case nil:
+			p.Unset = append(p.Unset, path)
+		case map[string]interface{}:
+			/*
+				Merging into a missing value makes an object even if
+				nothing is set in it, which setting paths within it
+				doesn't, so at least one member has to be set.
+			*/
+			set := false
+			for _, member := range value {
+				set = set || member != nil
+			}
+			if !set || !p.merge(path, value) {
+				return false
+			}
+			p.Merge = append(p.Merge, path)
+		default:
+			p.Set[path] = value
+		}
+	}
+	return true
+}
+
+func TranslateMergePatch(meta map[string]interface{}) (MetaPatch, bool) {
+	// Tells the in-place change equivalent to merging into the meta.
+	patch := newMetaPatch()
+	return patch, patch.merge("", meta)
+}
+
+// Applies tells if the patch applies to a contract.
+func (p MetaPatch) Applies(contract *Contract) bool {
+	if contract.DeletedAt != nil || (p.Version >= 0 && p.Version != contract.Version) {
+		return false
+	}
+	for _, path := range p.Exists {
+		if _, exists := lookupPath(contract.Meta, path); !exists {
+			return false
+		}
+	}
+	for _, path := range p.Objects {
+		value, _ := lookupPath(contract.Meta, path)
+		if _, ok := value.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	for _, path := range p.Merge {
+		value, exists := lookupPath(contract.Meta, path)
+		if _, ok := value.(map[string]interface{}); exists && !ok {
+			return false
+		}
+	}
+	for path, expected := range p.Equal {
+		if value, exists := lookupPath(contract.Meta, path); !exists || !jsonEqual(value, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply changes the meta in place, creating the objects on the way to
+// the paths that are set.
+func (p MetaPatch) Apply(meta ArbitraryData) {
+	for path, value := range p.Set {
+		keys := strings.Split(path, ".")
+		object := meta
+		for _, key := range keys[:len(keys)-1] {
+			child, ok := object[key].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				object[key] = child
+			}
+			object = child
+		}
+		object[keys[len(keys)-1]] = value
+	}
+	for _, path := range p.Unset {
+		keys := strings.Split(path, ".")
+		object := meta
+		if len(keys) > 1 {
+			parent, _ := lookupPath(meta, strings.Join(keys[:len(keys)-1], "."))
+			if object, _ = parent.(map[string]interface{}); object == nil {
+				continue
+			}
+		}
+		delete(object, keys[len(keys)-1])
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func jsonPatch(t *testing.T, body string) []PatchOperation {
+	ops, err := ParseJSONPatch([]byte(body))
+	require.NoError(t, err)
+	return ops
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	meta := ArbitraryData{"plan": "gold", "seats": 10, "tags": []interface{}{"a", "b"}, "address": ArbitraryData{"city": "Izmir"}}
+
+	patched, err := patchMeta(meta, func(doc interface{}) (interface{}, error) {
+		return applyJSONPatch(doc, jsonPatch(t, `[
+			{"op": "test", "path": "/meta/plan", "value": "gold"},
+			{"op": "replace", "path": "/meta/plan", "value": "silver"},
+			{"op": "add", "path": "/meta/tags/1", "value": "c"},
+			{"op": "add", "path": "/meta/tags/-", "value": "d"},
+			{"op": "remove", "path": "/meta/seats"},
+			{"op": "copy", "from": "/meta/address/city", "path": "/meta/city"},
+			{"op": "move", "from": "/meta/address", "path": "/meta/location"},
+			{"op": "add", "path": "/meta/a~1b", "value": null}
+		]`))
+	})
+	require.NoError(t, err)
+	require.Equal(t, ArbitraryData{
+		"plan":     "silver",
+		"tags":     []interface{}{"a", "c", "b", "d"},
+		"city":     "Izmir",
+		"location": map[string]interface{}{"city": "Izmir"},
+		"a/b":      nil,
+	}, patched)
+	// The meta itself is left as is.
+	require.Equal(t, "gold", meta["plan"])
+
+	for body, expected := range map[string]string{
+		`[{"op": "test", "path": "/meta/plan", "value": "silver"}]`:            errPatchTestFailed.Error(),
+		`[{"op": "remove", "path": "/meta/missing"}]`:                          `operation 0: "missing" does not exist`,
+		`[{"op": "replace", "path": "/meta/tags/5", "value": 1}]`:              `operation 0: invalid array index "5"`,
+		`[{"op": "add", "path": "/meta/plan/x", "value": 1}]`:                  "operation 0: cannot add \"x\" to a value that is neither an object nor an array",
+		`[{"op": "move", "from": "/meta/address", "path": "/meta/address/x"}]`: "operation 0: cannot move a value into itself",
+		`[{"op": "replace", "path": "/meta", "value": []}]`:                    "meta must remain an object",
+	} {
+		_, err := patchMeta(meta, func(doc interface{}) (interface{}, error) {
+			return applyJSONPatch(doc, jsonPatch(t, body))
+		})
+		require.EqualError(t, err, expected, body)
+	}
+
+	for _, body := range []string{
+		`{"op": "add"}`,
+		`[{"op": "add", "path": "/meta/x"}]`,
+		`[{"op": "frobnicate", "path": "/meta/x"}]`,
+		`[{"op": "remove", "path": "/items/0"}]`,
+		`[{"op": "copy", "from": "/version", "path": "/meta/version"}]`,
+	} {
+		_, err := ParseJSONPatch([]byte(body))
+		require.Error(t, err, body)
+	}
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	var patch interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{"meta": {"plan": null, "address": {"zip": "35000"}, "seats": {"max": 5}}}`), &patch))
+
+	patched, err := patchMeta(ArbitraryData{"plan": "gold", "address": ArbitraryData{"city": "Izmir"}, "seats": 10},
+		func(doc interface{}) (interface{}, error) {
+			return applyMergePatch(doc, patch), nil
+		})
+	require.NoError(t, err)
+	require.Equal(t, ArbitraryData{
+		"address": map[string]interface{}{"city": "Izmir", "zip": "35000"},
+		"seats":   map[string]interface{}{"max": float64(5)},
+	}, patched)
+}
+
+func TestTranslatePatch(t *testing.T) {
+	patch, ok := TranslateJSONPatch(jsonPatch(t, `[
+		{"op": "test", "path": "/meta/plan", "value": "gold"},
+		{"op": "replace", "path": "/meta/plan", "value": "silver"},
+		{"op": "add", "path": "/meta/address/zip", "value": "35000"},
+		{"op": "remove", "path": "/meta/seats"}
+	]`))
+	require.True(t, ok)
+	require.Equal(t, map[string]interface{}{"plan": "silver", "address.zip": "35000"}, patch.Set)
+	require.Equal(t, []string{"seats"}, patch.Unset)
+	require.Equal(t, []string{"plan", "seats"}, patch.Exists)
+	require.Equal(t, []string{"address"}, patch.Objects)
+	require.Equal(t, map[string]interface{}{"plan": "gold"}, patch.Equal)
+
+	for _, body := range []string{
+		`[{"op": "move", "from": "/meta/a", "path": "/meta/b"}]`,
+		`[{"op": "add", "path": "/meta/tags/0", "value": 1}]`,
+		`[{"op": "add", "path": "/meta/a.b", "value": 1}]`,
+		`[{"op": "add", "path": "/meta/a", "value": {}}, {"op": "add", "path": "/meta/a/b", "value": 1}]`,
+		`[{"op": "remove", "path": "/meta/a"}, {"op": "test", "path": "/meta/a", "value": 1}]`,
+		`[{"op": "test", "path": "/meta/a", "value": {"b": 1}}]`,
+		`[{"op": "replace", "path": "/meta", "value": {}}]`,
+	} {
+		_, ok := TranslateJSONPatch(jsonPatch(t, body))
+		require.False(t, ok, body)
+	}
+
+	patch, ok = TranslateMergePatch(map[string]interface{}{"plan": nil, "address": map[string]interface{}{"zip": "35000"}})
+	require.True(t, ok)
+	require.Equal(t, map[string]interface{}{"address.zip": "35000"}, patch.Set)
+	require.Equal(t, []string{"plan"}, patch.Unset)
+	require.Equal(t, []string{"address"}, patch.Merge)
+
+	_, ok = TranslateMergePatch(map[string]interface{}{"address": map[string]interface{}{"zip": nil}})
+	require.False(t, ok)
+}
+
+func TestMetaPatch(t *testing.T) {
+	contract := &Contract{Version: 3, Meta: ArbitraryData{"plan": "gold", "seats": int32(10), "address": ArbitraryData{"city": "Izmir"}}}
+
+	patch, _ := TranslateJSONPatch(jsonPatch(t, `[
+		{"op": "test", "path": "/meta/seats", "value": 10},
+		{"op": "remove", "path": "/meta/plan"},
+		{"op": "add", "path": "/meta/address/zip", "value": "35000"},
+		{"op": "add", "path": "/meta/trial", "value": true}
+	]`))
+	require.True(t, patch.Applies(contract))
+	patch.Apply(contract.Meta)
+	require.Equal(t, ArbitraryData{
+		"seats":   int32(10),
+		"trial":   true,
+		"address": ArbitraryData{"city": "Izmir", "zip": "35000"},
+	}, contract.Meta)
+
+	// The plan is gone now.
+	require.False(t, patch.Applies(contract))
+
+	patch, _ = TranslateMergePatch(map[string]interface{}{"owner": map[string]interface{}{"name": "Ada"}})
+	require.True(t, patch.Applies(contract))
+	patch.Apply(contract.Meta)
+	require.Equal(t, map[string]interface{}{"name": "Ada"}, contract.Meta["owner"])
+
+	patch, _ = TranslateMergePatch(map[string]interface{}{"trial": map[string]interface{}{"days": 30}})
+	require.False(t, patch.Applies(contract))
+
+	patch = newMetaPatch()
+	patch.Version = 2
+	require.False(t, patch.Applies(contract))
+}
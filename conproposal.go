@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"time"
+)
+
+var (
+	ErrProposalNotFound = errors.New("proposal not found")
+	ErrProposalDecided  = errors.New("proposal was already decided")
+	ErrProposalStale    = errors.New("the branches of the contract changed after the proposal was made")
+)
+
+// States of proposals. Pending proposals are either accepted (and their
+// branch applied), rejected, or found stale when accepted since the
+// branches of the contract changed in the meantime.
+const (
+	ProposalPending  = "pending"
+	ProposalAccepted = "accepted"
+	ProposalRejected = "rejected"
+	ProposalStale    = "stale"
+)
+
+// Proposal is a branch waiting to be approved. It is made against a
+// version of the contract, and can only be applied to the branches of
+// that version, whatever else changed since.
+type Proposal struct {
+	ID          primitive.ObjectID `bson:"_id" json:"_id"`
+	ContractID  primitive.ObjectID `bson:"contract_id" json:"contract_id"`
+	BaseVersion int64              `bson:"base_version" json:"base_version"`
+	StartAt     time.Time          `bson:"start_at" json:"start_at"`
+	EndAt       time.Time          `bson:"end_at" json:"end_at"`
+	Data        ArbitraryData      `bson:"data" json:"data"`
+	Status      string             `bson:"status" json:"status"`
+	ProposedBy  string             `bson:"proposed_by,omitempty" json:"proposed_by,omitempty"`
+	CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+	DecidedBy   string             `bson:"decided_by,omitempty" json:"decided_by,omitempty"`
+	DecidedAt   *time.Time         `bson:"decided_at,omitempty" json:"decided_at,omitempty"`
+	// Why the proposal was rejected or found stale.
+	Reason string `bson:"reason,omitempty" json:"reason,omitempty"`
+	// The version of the contract the proposal was applied as.
+	AppliedVersion *int64 `bson:"applied_version,omitempty" json:"applied_version,omitempty"`
+	// The revision of the branches of the base version, see itemsRevision.
+	BaseItems string `bson:"base_items,omitempty" json:"-"`
+}
+
+func NewProposal(contract *Contract, StartAt, EndAt time.Time, Data ArbitraryData) (*Proposal, error) {
+	// The branch is tried on a copy of the contract so that
+	// proposals that could never be applied are refused early,
+	// and the end date is resolved the way Branch does.
+	preview, err := cloneContract(contract)
+	if err != nil {
+		return nil, err
+	}
+	branch, err := preview.Branch(StartAt, EndAt, Data)
+	if err != nil {
+		return nil, err
+	}
+	return &Proposal{
+		ID:          primitive.NewObjectID(),
+		ContractID:  contract.ID,
+		BaseVersion: contract.Version,
+		BaseItems:   itemsRevision(contract.Items),
+		StartAt:     branch.StartAt,
+		EndAt:       branch.EndAt,
+		Data:        Data,
+		Status:      ProposalPending,
+		CreatedAt:   time.Now().UTC(),
+	}, nil
+}
+
+func (p *Proposal) Preview(contract *Contract) (*Contract, error) {
+	// The contract as it would be if the branch of the proposal were
+	// made on it, whether or not it is the version proposed against.
+	preview, err := cloneContract(contract)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = preview.Branch(p.StartAt, p.EndAt, p.Data); err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+func (p *Proposal) Stale(contract *Contract) bool {
+	// Whether the branches of the contract changed since the proposal
+	// was made. Changes to the meta, deletion and restoration leave
+	// the proposal as it is. Proposals made before revisions were
+	// kept only hold for the version they were made against.
+	if p.BaseItems == "" {
+		return contract.Version != p.BaseVersion
+	}
+	return itemsRevision(contract.Items) != p.BaseItems
+}
+
+func (p *Proposal) Apply(contract *Contract) (*Branch, error) {
+	// Branches the contract as proposed, given that its branches
+	// are still those the proposal was made against.
+	if p.Stale(contract) {
+		return nil, fmt.Errorf("%w (version %d, proposed against %d)", ErrProposalStale, contract.Version, p.BaseVersion)
+	}
+	return contract.Branch(p.StartAt, p.EndAt, p.Data)
+}
+
+func itemsRevision(items []*Branch) string {
+	// Tells sets of branches apart by their identifiers and what
+	// replaced them, which is all that branching changes. The
+	// order in which stores return the branches doesn't matter.
+	entries := make([]string, len(items))
+	for i, item := range items {
+		entry := item.ID.Hex()
+		for _, id := range item.ReplacedBy {
+			entry += "," + id.Hex()
+		}
+		entries[i] = entry
+	}
+	sort.Strings(entries)
+
+	hash := sha256.New()
+	for _, entry := range entries {
+		hash.Write([]byte(entry))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// How long accepting a proposal may take. Proposals still being accepted
+// after that were left behind by a server that stopped meanwhile.
+const acceptTimeout = 5 * time.Minute
+
+func (p *Proposal) abandoned(now time.Time) bool {
+	// Accepted proposals have their applied version set once their
+	// branch is made, until then they are only claimed.
+	return p.Status == ProposalAccepted && p.AppliedVersion == nil &&
+		p.DecidedAt != nil && now.Sub(*p.DecidedAt) > acceptTimeout
+}
+
+func (p *Proposal) decide(status, by, reason string) {
+	now := time.Now().UTC()
+	p.Status, p.DecidedBy, p.DecidedAt, p.Reason = status, by, &now, reason
+}
+
+type ProposalStore interface {
+	Insert(ctx context.Context, proposal *Proposal) error
+	// Get returns a proposal on a contract, or ErrProposalNotFound.
+	Get(ctx context.Context, contractID, id primitive.ObjectID) (*Proposal, error)
+	// List returns the proposals on a contract in the order they were
+	// made, only those with the given status unless it is empty.
+	List(ctx context.Context, contractID primitive.ObjectID, status string) ([]*Proposal, error)
+	// Decide stores the proposal given that its stored status is still
+	// the given one, or returns ErrProposalDecided.
+	Decide(ctx context.Context, proposal *Proposal, from string) error
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestProposalApply(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+	proposal, err := NewProposal(contract, newDate(2023, 1, 1), time.Time{}, ArbitraryData{"price": 12})
+	require.NoError(t, err)
+
+	// Previews leave the contract as it is.
+	preview, err := proposal.Preview(contract)
+	require.NoError(t, err)
+	require.Len(t, preview.Items, 3)
+	require.Len(t, contract.Items, 1)
+
+	// Only changes to the branches make the proposal stale.
+	changed, err := cloneContract(contract)
+	require.NoError(t, err)
+	_, err = changed.Branch(newDate(2023, 6, 1), time.Time{}, ArbitraryData{"price": 14})
+	require.NoError(t, err)
+	require.True(t, proposal.Stale(changed))
+	_, err = proposal.Apply(changed)
+	require.ErrorIs(t, err, ErrProposalStale)
+	_, err = proposal.Preview(changed)
+	require.NoError(t, err)
+
+	contract.Version += 2
+	contract.Meta = ArbitraryData{"name": "Rent"}
+	require.False(t, proposal.Stale(contract))
+	branch, err := proposal.Apply(contract)
+	require.NoError(t, err)
+	require.Equal(t, newDate(2023, 10, 10), branch.EndAt)
+	require.Len(t, contract.Items, 3)
+
+	// Proposals stored without a revision hold for their version.
+	legacy := &Proposal{BaseVersion: 2}
+	require.False(t, legacy.Stale(contract))
+	contract.Version++
+	require.True(t, legacy.Stale(contract))
+}
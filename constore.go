@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound        = errors.New("contract not found")
+	ErrVersionConflict = errors.New("contract was modified by another request")
+	ErrInvalidID       = errors.New("id is not a valid ObjectID")
+)
+
+// ContractQuery selects contracts, which are ordered by the Sort field
+// ("_id" if empty, i.e. by creation) and then by ID, the newest first
+// unless Ascending is set.
+type ContractQuery struct {
+	Sort      string
+	Ascending bool
+	// Only select contracts that come after this one; CursorValue is
+	// its value of the Sort field if that is not "_id".
+	Cursor      primitive.ObjectID
+	CursorValue time.Time
+	Limit       int64 // Maximum number of contracts, zero for no limit.
+	OmitItems   bool  // Leave out the items of contracts.
+	// Also select the contracts that are deleted.
+	IncludeDeleted bool
+	Filter         ContractFilter
+}
+
+// byID tells if the query is ordered by ID only.
+func (q ContractQuery) byID() bool {
+	return q.Sort == "" || q.Sort == "_id"
+}
+
+// InsertErrors maps the positions of contracts that could not be
+// inserted to the reason; the rest of the contracts are inserted.
+type InsertErrors map[int]error
+
+func (e InsertErrors) Error() string {
+	indices := make([]int, 0, len(e))
+	for index := range e {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+
+	messages := make([]string, len(indices))
+	for i, index := range indices {
+		messages[i] = fmt.Sprintf("%d: %s", index, e[index])
+	}
+	return "could not insert contracts (" + strings.Join(messages, "; ") + ")"
+}
+
+type ContractCursor interface {
+	Next(ctx context.Context) bool
+	Contract() (*Contract, error)
+	Err() error
+	Close(ctx context.Context) error
+}
+
+func collect(ctx context.Context, cur ContractCursor) ([]*Contract, error) {
+	defer cur.Close(ctx)
+
+	contracts := make([]*Contract, 0)
+	for cur.Next(ctx) {
+		contract, err := cur.Contract()
+		if err != nil {
+			return nil, err
+		}
+		contracts = append(contracts, contract)
+	}
+	return contracts, cur.Err()
+}
+
+// Window narrows down the branches of a contract to the ones that
+// intersect with [From, To), zero times leave that end open. Branches
+// referred to by the selected ones are always included, so that their
+// data can be resolved.
+type Window struct {
+	From   time.Time
+	To     time.Time
+	Active bool // Leave out the replaced branches.
+}
+
+func (w Window) Contains(b *Branch) bool {
+	return (w.To.IsZero() || b.StartAt.Before(w.To)) &&
+		(w.From.IsZero() || b.EndAt.After(w.From)) &&
+		(!w.Active || len(b.ReplacedBy) == 0)
+}
+
+func (w Window) narrow(contract *Contract) *Contract {
+	selected := make(map[primitive.ObjectID]bool)
+	for _, item := range contract.Items {
+		if w.Contains(item) {
+			selected[item.ID] = true
+		}
+	}
+	for _, item := range contract.Items {
+		if selected[item.ID] {
+			if ref, ok := contract.ResolveDataref(item)["_ref"].(primitive.ObjectID); ok {
+				selected[ref] = true
+			}
+		}
+	}
+
+	items := make([]*Branch, 0, len(selected))
+	for _, item := range contract.Items {
+		if selected[item.ID] {
+			items = append(items, item)
+		}
+	}
+	contract.Items = items
+	return contract
+}
+
+func cloneContract(contract *Contract) (*Contract, error) {
+	raw, err := bson.Marshal(contract)
+	if err != nil {
+		return nil, err
+	}
+	return decodeContract(raw)
+}
+
+// DefaultTenant owns the contracts of principals that have no tenant,
+// and every contract if authentication is not enabled.
+const DefaultTenant = ""
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+func validTenant(tenant string) bool {
+	// Tenants may name databases, so they are kept simple.
+	return tenant == DefaultTenant || tenantPattern.MatchString(tenant)
+}
+
+// tenantScope narrows a store down to the contracts of a tenant, unless
+// it is not scoped at all, as is the case for maintenance such as purging.
+type tenantScope struct {
+	tenant string
+	scoped bool
+}
+
+func (s tenantScope) allows(contract *Contract) bool {
+	return !s.scoped || contract.Tenant == s.tenant
+}
+
+func (s tenantScope) claim(contracts []*Contract) {
+	// Contracts inserted through a scoped store belong to its tenant.
+	if s.scoped {
+		for _, contract := range contracts {
+			contract.Tenant = s.tenant
+		}
+	}
+}
+
+func (s tenantScope) webhooks(store WebhookStore) WebhookStore {
+	if !s.scoped {
+		return store
+	}
+	return tenantWebhooks{WebhookStore: store, tenant: s.tenant}
+}
+
+func (s tenantScope) apiKeys(store APIKeyStore) APIKeyStore {
+	if !s.scoped {
+		return store
+	}
+	return tenantAPIKeys{APIKeyStore: store, tenant: s.tenant}
+}
+
+type ContractStore interface {
+	// ForTenant returns the store narrowed down to a tenant: contracts,
+	// webhooks and API keys of other tenants are not found, and the
+	// ones created through it belong to the tenant.
+	ForTenant(tenant string) (ContractStore, error)
+	// Get returns the contract with given ID, or ErrNotFound.
+	Get(ctx context.Context, id primitive.ObjectID) (*Contract, error)
+	// GetWindow is Get, but only loads the branches within the window.
+	GetWindow(ctx context.Context, id primitive.ObjectID, window Window) (*Contract, error)
+	// List returns the contracts selected by the query.
+	List(ctx context.Context, query ContractQuery) ([]*Contract, error)
+	// Find returns a cursor over the contracts selected by the query,
+	// so that they can be consumed without loading all of them at once.
+	Find(ctx context.Context, query ContractQuery) (ContractCursor, error)
+	// Boundaries returns the times at which active branches of contracts
+	// start or end as selected by the query, ordered by time and then
+	// by contract ID.
+	Boundaries(ctx context.Context, query BoundaryQuery) ([]Boundary, error)
+	// Insert adds new contracts along with their events, failing with
+	// InsertErrors if some of them could not be inserted (in which case
+	// their events are not recorded either).
+	Insert(ctx context.Context, contracts []*Contract, events ...*Event) error
+	// Update stores the items, meta and deletion time of a contract,
+	// given that the stored version is still the version of the
+	// contract, and records the event of the change (if any) as the
+	// new version. Either both or none of them are stored. It returns
+	// the updated contract, ErrVersionConflict or ErrNotFound.
+	Update(ctx context.Context, contract *Contract, event *Event) (*Contract, error)
+	// PatchMeta changes the meta of a contract in place, without a
+	// version check unless the patch has one, and bumps its version.
+	// The event (if any) is recorded along with it, given the new
+	// version and meta. It returns the updated contract, or
+	// ErrPatchNotApplied if the contract does not satisfy the
+	// conditions of the patch.
+	PatchMeta(ctx context.Context, id primitive.ObjectID, patch MetaPatch, event *Event) (*Contract, error)
+	// Purge removes the contracts deleted before the given time for
+	// good, along with their events, grants and proposals, and returns
+	// how many there were.
+	Purge(ctx context.Context, before time.Time) (int64, error)
+	// Events returns the store of the event log of contracts.
+	Events() EventStore
+	// Webhooks returns the store of webhooks and their deliveries.
+	Webhooks() WebhookStore
+	// Idempotency returns the store of requests with idempotency keys.
+	Idempotency() IdempotencyStore
+	// APIKeys returns the store of the keys to the API.
+	APIKeys() APIKeyStore
+	// Grants returns the store of the roles given on single contracts.
+	Grants() GrantStore
+	// Proposals returns the store of the branches waiting for approval.
+	Proposals() ProposalStore
+	Close(ctx context.Context) error
+}
+
+func purgeBefore(retention string, now time.Time) (time.Time, error) {
+	// Contracts deleted before the returned time are due for purging.
+	d, err := ParseDuration(retention)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid retention period: %s", err)
+	}
+	d.Negative = !d.Negative
+	return d.AddTo(now), nil
+}
+
+func RunPurge(ctx context.Context, store ContractStore, retention string, interval time.Duration) {
+	// Periodically purges the contracts deleted for longer than the
+	// retention period, until the context is done. Expired idempotency
+	// keys are forgotten along the way.
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now().UTC()
+		if err := store.Idempotency().Expire(ctx, now.Add(-idempotencyTTL)); err != nil {
+			log.Printf("could not expire idempotency keys: %s", err)
+		}
+
+		before, err := purgeBefore(retention, now)
+		if err == nil {
+			var purged int64
+			if purged, err = store.Purge(ctx, before); purged > 0 {
+				log.Printf("purged %d deleted contracts", purged)
+			}
+		}
+		if err != nil {
+			log.Printf("could not purge deleted contracts: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func OpenStore() (ContractStore, error) {
+	// Opens the store selected by the STORAGE_BACKEND variable.
+	switch StorageBackend {
+	case "", "mongo":
+		return NewMongoStore(MongoConnect())
+	case "mongo-split":
+		return NewMongoSplitStore(MongoConnect())
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return NewFileStore(StoragePath)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q, expected mongo, mongo-split, memory or file", StorageBackend)
+}
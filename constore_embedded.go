@@ -0,0 +1,956 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"time"
+)
+
+const contractBucket = "contract"
+
+type embeddedStore struct {
+	engine kvEngine
+	scope  tenantScope
+}
+
+func NewMemoryStore() ContractStore {
+	// A store that keeps contracts in memory, mainly to run the API
+	// without a database; nothing is kept once the process exits.
+	return &embeddedStore{engine: newMemoryEngine()}
+}
+
+func NewFileStore(path string) (ContractStore, error) {
+	// A store that keeps contracts in a single database file, suitable
+	// for local development and single node deployments.
+	engine, err := newBoltEngine(path)
+	if err != nil {
+		return nil, err
+	}
+	return &embeddedStore{engine: engine}, nil
+}
+
+func (s *embeddedStore) ForTenant(tenant string) (ContractStore, error) {
+	scoped := *s
+	scoped.scope = tenantScope{tenant: tenant, scoped: true}
+	return &scoped, nil
+}
+
+func (s tenantScope) allowsRaw(raw []byte) bool {
+	// Looks at the tenant without decoding the whole contract.
+	tenant, _ := bson.Raw(raw).Lookup("tenant").StringValueOK()
+	return !s.scoped || tenant == s.tenant
+}
+
+func decodeContract(raw []byte) (*Contract, error) {
+	/*
+		Contracts are kept BSON encoded with their ObjectID as the key.
+		Since ObjectIDs start with their timestamp, keys are naturally
+		ordered by _id as in MongoDB. BSON also makes sure that decoded
+		values have the same types and precision (e.g. of times) as
+		they would have with MongoDB.
+	*/
+	var contract *Contract
+	if err := bson.Unmarshal(raw, &contract); err != nil {
+		return nil, err
+	}
+	return contract, nil
+}
+
+func (s *embeddedStore) Get(_ context.Context, id primitive.ObjectID) (*Contract, error) {
+	var raw []byte
+	_ = s.engine.View(func(tx kvTx) error {
+		raw = tx.Get(contractBucket, id[:])
+		return nil
+	})
+	if raw == nil || !s.scope.allowsRaw(raw) {
+		return nil, ErrNotFound
+	}
+	return decodeContract(raw)
+}
+
+func (s *embeddedStore) GetWindow(ctx context.Context, id primitive.ObjectID, window Window) (*Contract, error) {
+	contract, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return window.narrow(contract), nil
+}
+
+func isDeleted(raw []byte) bool {
+	// Looks at the deletion time without decoding the whole contract.
+	value, err := bson.Raw(raw).LookupErr("deleted_at")
+	return err == nil && value.Type == bsontype.DateTime
+}
+
+const embeddedPageSize = 100
+
+type embeddedCursor struct {
+	store     *embeddedStore
+	query     ContractQuery
+	after     []byte
+	page      [][]byte
+	current   []byte
+	remaining int64
+	done      bool
+	err       error
+}
+
+func (c *embeddedCursor) fill() {
+	// Fetch the next page in a short transaction, so that
+	// slow consumers don't keep a transaction open.
+	size := int64(embeddedPageSize)
+	if c.query.Limit > 0 && c.remaining < size {
+		size = c.remaining
+	}
+
+	c.done = true
+	c.err = c.store.engine.View(func(tx kvTx) error {
+		return tx.Scan(contractBucket, c.after, !c.query.Ascending, func(key, value []byte) (bool, error) {
+			c.after = append([]byte{}, key...)
+			if (!c.query.IncludeDeleted && isDeleted(value)) || !c.store.scope.allowsRaw(value) {
+				return true, nil
+			}
+			c.page = append(c.page, append([]byte{}, value...))
+			if int64(len(c.page)) < size {
+				return true, nil
+			}
+			c.done = false
+			return false, nil
+		})
+	})
+}
+
+func (c *embeddedCursor) Next(context.Context) bool {
+	if c.err != nil || (c.query.Limit > 0 && c.remaining <= 0) {
+		return false
+	}
+	if len(c.page) == 0 && !c.done {
+		c.fill()
+	}
+	if len(c.page) == 0 {
+		return false
+	}
+	c.current, c.page = c.page[0], c.page[1:]
+	c.remaining--
+	return true
+}
+
+func (c *embeddedCursor) Contract() (*Contract, error) {
+	contract, err := decodeContract(c.current)
+	if err == nil && c.query.OmitItems {
+		contract.Items = nil
+	}
+	return contract, err
+}
+
+func (c *embeddedCursor) Err() error {
+	return c.err
+}
+
+func (c *embeddedCursor) Close(context.Context) error {
+	c.page, c.done = nil, true
+	return nil
+}
+
+func (s *embeddedStore) Find(ctx context.Context, query ContractQuery) (ContractCursor, error) {
+	/*
+		Contracts are kept in the order of their IDs, so that is the
+		only order they can be read in. Filters are applied to the
+		contracts as they are read, other orders need all of them to
+		be read and sorted first.
+	*/
+	if query.byID() && query.Filter.Empty() {
+		cur := &embeddedCursor{store: s, query: query, remaining: query.Limit}
+		if !query.Cursor.IsZero() {
+			cur.after = query.Cursor[:]
+		}
+		return cur, nil
+	}
+
+	broad := ContractQuery{
+		IncludeDeleted: query.IncludeDeleted,
+		OmitItems:      query.OmitItems && !query.Filter.usesItems(),
+	}
+	if query.byID() {
+		broad.Ascending, broad.Cursor = query.Ascending, query.Cursor
+		inner, _ := s.Find(ctx, broad)
+		return filterCursor(inner, query), nil
+	}
+
+	inner, _ := s.Find(ctx, broad)
+	contracts, err := collect(ctx, filterCursor(inner, ContractQuery{Filter: query.Filter, OmitItems: query.OmitItems}))
+	if err != nil {
+		return nil, err
+	}
+	sortContracts(contracts, query)
+
+	var selected []*Contract
+	for _, contract := range contracts {
+		if query.Limit > 0 && int64(len(selected)) >= query.Limit {
+			break
+		}
+		if query.after(contract) {
+			selected = append(selected, contract)
+		}
+	}
+	return &sliceCursor{contracts: selected}, nil
+}
+
+func (s *embeddedStore) List(ctx context.Context, query ContractQuery) ([]*Contract, error) {
+	cur, err := s.Find(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return collect(ctx, cur)
+}
+
+func (s *embeddedStore) Boundaries(ctx context.Context, query BoundaryQuery) ([]Boundary, error) {
+	// Contracts are read as a whole anyway, so are their boundaries.
+	cur, err := s.Find(ctx, ContractQuery{IncludeDeleted: true, Filter: ContractFilter{Changing: query.Window}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var boundaries []Boundary
+	for cur.Next(ctx) {
+		contract, err := cur.Contract()
+		if err != nil {
+			return nil, err
+		}
+		boundaries = append(boundaries, contract.boundaries(query)...)
+	}
+	if err = cur.Err(); err != nil {
+		return nil, err
+	}
+	return orderBoundaries(boundaries, query.Limit), nil
+}
+
+func (s *embeddedStore) Insert(_ context.Context, contracts []*Contract, events ...*Event) error {
+	s.scope.claim(contracts)
+	failed := make(InsertErrors)
+	err := s.engine.Update(func(tx kvTx) error {
+		inserted := make(map[primitive.ObjectID]bool)
+		for i, contract := range contracts {
+			if tx.Get(contractBucket, contract.ID[:]) != nil {
+				failed[i] = fmt.Errorf("duplicate contract ID %s", contract.ID.Hex())
+				continue
+			}
+			raw, err := bson.Marshal(contract)
+			if err != nil {
+				failed[i] = err
+				continue
+			}
+			if err = tx.Put(contractBucket, contract.ID[:], raw); err != nil {
+				return err
+			}
+			inserted[contract.ID] = true
+		}
+		for _, event := range insertedEvents(inserted, events) {
+			if err := putEvent(tx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+func (s *embeddedStore) Update(_ context.Context, contract *Contract, event *Event) (*Contract, error) {
+	var updated *Contract
+	err := s.engine.Update(func(tx kvTx) error {
+		raw := tx.Get(contractBucket, contract.ID[:])
+		if raw == nil || !s.scope.allowsRaw(raw) {
+			return ErrNotFound
+		}
+		stored, err := decodeContract(raw)
+		if err != nil {
+			return err
+		}
+		if stored.Version != contract.Version {
+			return ErrVersionConflict
+		}
+
+		stored.Items = contract.Items
+		stored.Meta = contract.Meta
+		stored.DeletedAt = contract.DeletedAt
+		stored.Version++
+		stored.UpdatedAt = time.Now().UTC()
+
+		if raw, err = bson.Marshal(stored); err != nil {
+			return err
+		}
+		if err = tx.Put(contractBucket, contract.ID[:], raw); err != nil {
+			return err
+		}
+		if event != nil {
+			event.Sequence = stored.Version
+			if err = putEvent(tx, event); err != nil {
+				return err
+			}
+		}
+		updated, err = decodeContract(raw)
+		return err
+	})
+	return updated, err
+}
+
+func (s *embeddedStore) PatchMeta(
+	_ context.Context, id primitive.ObjectID, patch MetaPatch, event *Event,
+) (*Contract, error) {
+	var updated *Contract
+	err := s.engine.Update(func(tx kvTx) error {
+		raw := tx.Get(contractBucket, id[:])
+		if raw == nil || !s.scope.allowsRaw(raw) {
+			return ErrPatchNotApplied
+		}
+		stored, err := decodeContract(raw)
+		if err != nil {
+			return err
+		}
+		if !patch.Applies(stored) {
+			return ErrPatchNotApplied
+		}
+
+		patch.Apply(stored.Meta)
+		stored.Version++
+		stored.UpdatedAt = time.Now().UTC()
+
+		if raw, err = bson.Marshal(stored); err != nil {
+			return err
+		}
+		if err = tx.Put(contractBucket, id[:], raw); err != nil {
+			return err
+		}
+		if event != nil {
+			event.Sequence, event.Payload.Meta = stored.Version, stored.Meta
+			if err = putEvent(tx, event); err != nil {
+				return err
+			}
+		}
+		updated, err = decodeContract(raw)
+		return err
+	})
+	return updated, err
+}
+
+func (s *embeddedStore) Purge(_ context.Context, before time.Time) (int64, error) {
+	var purged int64
+	err := s.engine.Update(func(tx kvTx) error {
+		return tx.Scan(contractBucket, nil, false, func(key, value []byte) (bool, error) {
+			deletedAt, ok := bson.Raw(value).Lookup("deleted_at").DateTimeOK()
+			if !ok || !time.UnixMilli(deletedAt).Before(before) || !s.scope.allowsRaw(value) {
+				return true, nil
+			}
+			id := append([]byte{}, key...)
+			if err := tx.Delete(contractBucket, id); err != nil {
+				return false, err
+			}
+			err := deletePrefixed(tx, eventBucket, id)
+			if err == nil {
+				err = deleteGrants(tx, id)
+			}
+			if err == nil {
+				err = deletePrefixed(tx, proposalBucket, id)
+			}
+			purged++
+			return err == nil, err
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+func deletePrefixed(tx kvTx, bucket string, prefix []byte) error {
+	// Removes the keys of a bucket that start with the prefix, such as
+	// the events of a contract.
+	var keys [][]byte
+	err := tx.Scan(bucket, prefix, false, func(key, _ []byte) (bool, error) {
+		if !bytes.HasPrefix(key, prefix) {
+			return false, nil
+		}
+		keys = append(keys, append([]byte{}, key...))
+		return true, nil
+	})
+	for _, key := range keys {
+		if err == nil {
+			err = tx.Delete(bucket, key)
+		}
+	}
+	return err
+}
+
+func (s *embeddedStore) Close(context.Context) error {
+	return s.engine.Close()
+}
+
+func (s *embeddedStore) Events() EventStore {
+	return embeddedEventStore{engine: s.engine}
+}
+
+const eventBucket = "event"
+
+type embeddedEventStore struct {
+	engine kvEngine
+}
+
+func eventKey(contractID primitive.ObjectID, sequence int64) []byte {
+	// Events of a contract are next to each other, ordered by sequence.
+	key := make([]byte, 0, len(contractID)+8)
+	key = append(key, contractID[:]...)
+	return binary.BigEndian.AppendUint64(key, uint64(sequence))
+}
+
+func putEvent(tx kvTx, event *Event) error {
+	key := eventKey(event.ContractID, event.Sequence)
+	if tx.Get(eventBucket, key) != nil {
+		return fmt.Errorf("event %d of contract %s is already recorded", event.Sequence, event.ContractID.Hex())
+	}
+	raw, err := bson.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return tx.Put(eventBucket, key, raw)
+}
+
+func (s embeddedEventStore) Append(_ context.Context, events ...*Event) error {
+	return s.engine.Update(func(tx kvTx) error {
+		for _, event := range events {
+			if err := putEvent(tx, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s embeddedEventStore) List(_ context.Context, contractID primitive.ObjectID, until int64) ([]*Event, error) {
+	events := make([]*Event, 0)
+	err := s.engine.View(func(tx kvTx) error {
+		return tx.Scan(eventBucket, contractID[:], false, func(key, value []byte) (bool, error) {
+			if !bytes.HasPrefix(key, contractID[:]) {
+				return false, nil
+			}
+			var event *Event
+			if err := bson.Unmarshal(value, &event); err != nil {
+				return false, err
+			}
+			if until >= 0 && event.Sequence > until {
+				return false, nil
+			}
+			events = append(events, event)
+			return true, nil
+		})
+	})
+	return events, err
+}
+
+func (s *embeddedStore) Webhooks() WebhookStore {
+	return s.scope.webhooks(embeddedWebhookStore{engine: s.engine})
+}
+
+const (
+	webhookBucket  = "webhook"
+	deliveryBucket = "delivery"
+	// Pending deliveries by when they are due, so that claiming one
+	// doesn't go through those delivered long ago.
+	dueBucket = "delivery_due"
+)
+
+type embeddedWebhookStore struct {
+	engine kvEngine
+}
+
+func putDocument(tx kvTx, bucket string, id primitive.ObjectID, document interface{}) error {
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return tx.Put(bucket, id[:], raw)
+}
+
+func (s embeddedWebhookStore) Create(_ context.Context, webhook *Webhook) error {
+	return s.engine.Update(func(tx kvTx) error {
+		return putDocument(tx, webhookBucket, webhook.ID, webhook)
+	})
+}
+
+func (s embeddedWebhookStore) Get(_ context.Context, id primitive.ObjectID) (*Webhook, error) {
+	var raw []byte
+	_ = s.engine.View(func(tx kvTx) error {
+		raw = tx.Get(webhookBucket, id[:])
+		return nil
+	})
+	if raw == nil {
+		return nil, ErrWebhookNotFound
+	}
+	var webhook *Webhook
+	err := bson.Unmarshal(raw, &webhook)
+	return webhook, err
+}
+
+func (s embeddedWebhookStore) scan(keep func(*Webhook) bool) ([]*Webhook, error) {
+	webhooks := make([]*Webhook, 0)
+	err := s.engine.View(func(tx kvTx) error {
+		return tx.Scan(webhookBucket, nil, false, func(_, value []byte) (bool, error) {
+			var webhook *Webhook
+			if err := bson.Unmarshal(value, &webhook); err != nil {
+				return false, err
+			}
+			if keep(webhook) {
+				webhooks = append(webhooks, webhook)
+			}
+			return true, nil
+		})
+	})
+	return webhooks, err
+}
+
+func (s embeddedWebhookStore) List(context.Context) ([]*Webhook, error) {
+	return s.scan(func(*Webhook) bool { return true })
+}
+
+func (s embeddedWebhookStore) ListTenant(_ context.Context, tenant string) ([]*Webhook, error) {
+	return s.scan(func(webhook *Webhook) bool { return webhook.Tenant == tenant })
+}
+
+func (s embeddedWebhookStore) Delete(_ context.Context, id primitive.ObjectID) error {
+	return s.engine.Update(func(tx kvTx) error {
+		if tx.Get(webhookBucket, id[:]) == nil {
+			return ErrWebhookNotFound
+		}
+		return tx.Delete(webhookBucket, id[:])
+	})
+}
+
+func dueKey(delivery *Delivery) []byte {
+	// Times are stored in milliseconds, so are the keys, in order to
+	// match deliveries read back.
+	key := binary.BigEndian.AppendUint64(nil, uint64(delivery.NextAttemptAt.UnixMilli()))
+	return append(key, delivery.ID[:]...)
+}
+
+func putDelivery(tx kvTx, delivery *Delivery) error {
+	if raw := tx.Get(deliveryBucket, delivery.ID[:]); raw != nil {
+		var stored *Delivery
+		if err := bson.Unmarshal(raw, &stored); err != nil {
+			return err
+		}
+		if err := tx.Delete(dueBucket, dueKey(stored)); err != nil {
+			return err
+		}
+	}
+	if delivery.Status == DeliveryPending {
+		if err := tx.Put(dueBucket, dueKey(delivery), delivery.ID[:]); err != nil {
+			return err
+		}
+	}
+	return putDocument(tx, deliveryBucket, delivery.ID, delivery)
+}
+
+func (s embeddedWebhookStore) Enqueue(_ context.Context, deliveries ...*Delivery) error {
+	return s.engine.Update(func(tx kvTx) error {
+		for _, delivery := range deliveries {
+			if err := putDelivery(tx, delivery); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s embeddedWebhookStore) Claim(_ context.Context, now time.Time, lease time.Duration) (*Delivery, error) {
+	// The delivery due the earliest is the first one of the index,
+	// if it is due at all.
+	var claimed *Delivery
+	err := s.engine.Update(func(tx kvTx) error {
+		var id []byte
+		err := tx.Scan(dueBucket, nil, false, func(key, value []byte) (bool, error) {
+			if int64(binary.BigEndian.Uint64(key)) <= now.UnixMilli() {
+				id = append([]byte{}, value...)
+			}
+			return false, nil
+		})
+		if err != nil || id == nil {
+			return err
+		}
+		if err = bson.Unmarshal(tx.Get(deliveryBucket, id), &claimed); err != nil {
+			return err
+		}
+		claimed.NextAttemptAt = now.Add(lease)
+		return putDelivery(tx, claimed)
+	})
+	return claimed, err
+}
+
+func (s embeddedWebhookStore) Save(_ context.Context, delivery *Delivery) error {
+	return s.engine.Update(func(tx kvTx) error {
+		return putDelivery(tx, delivery)
+	})
+}
+
+func (s embeddedWebhookStore) Deliveries(_ context.Context, webhookID primitive.ObjectID, limit int) ([]*Delivery, error) {
+	deliveries := make([]*Delivery, 0)
+	err := s.engine.View(func(tx kvTx) error {
+		return tx.Scan(deliveryBucket, nil, true, func(_, value []byte) (bool, error) {
+			var delivery *Delivery
+			if err := bson.Unmarshal(value, &delivery); err != nil {
+				return false, err
+			}
+			if delivery.WebhookID == webhookID {
+				deliveries = append(deliveries, delivery)
+			}
+			return len(deliveries) < limit, nil
+		})
+	})
+	return deliveries, err
+}
+
+func (s *embeddedStore) APIKeys() APIKeyStore {
+	return s.scope.apiKeys(embeddedAPIKeyStore{engine: s.engine})
+}
+
+// Keys are kept by their hash, which is what they are looked up by.
+const apiKeyBucket = "api_key"
+
+type embeddedAPIKeyStore struct {
+	engine kvEngine
+}
+
+func (s embeddedAPIKeyStore) Create(_ context.Context, key *APIKey) error {
+	raw, err := bson.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.engine.Update(func(tx kvTx) error {
+		return tx.Put(apiKeyBucket, []byte(key.Hash), raw)
+	})
+}
+
+func (s embeddedAPIKeyStore) Lookup(_ context.Context, hash string) (*APIKey, error) {
+	var raw []byte
+	_ = s.engine.View(func(tx kvTx) error {
+		raw = tx.Get(apiKeyBucket, []byte(hash))
+		return nil
+	})
+	if raw == nil {
+		return nil, ErrAPIKeyNotFound
+	}
+	var key *APIKey
+	err := bson.Unmarshal(raw, &key)
+	return key, err
+}
+
+func (s embeddedAPIKeyStore) List(context.Context) ([]*APIKey, error) {
+	keys := make([]*APIKey, 0)
+	err := s.engine.View(func(tx kvTx) error {
+		return tx.Scan(apiKeyBucket, nil, false, func(_, value []byte) (bool, error) {
+			var key *APIKey
+			if err := bson.Unmarshal(value, &key); err != nil {
+				return false, err
+			}
+			keys = append(keys, key)
+			return true, nil
+		})
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i].ID[:], keys[j].ID[:]) < 0
+	})
+	return keys, err
+}
+
+func (s embeddedAPIKeyStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	keys, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.ID == id {
+			return s.engine.Update(func(tx kvTx) error {
+				return tx.Delete(apiKeyBucket, []byte(key.Hash))
+			})
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+func (s *embeddedStore) Idempotency() IdempotencyStore {
+	return embeddedIdempotencyStore{engine: s.engine}
+}
+
+const idempotencyBucket = "idempotency"
+
+type embeddedIdempotencyStore struct {
+	engine kvEngine
+}
+
+func (s embeddedIdempotencyStore) Reserve(_ context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	var existing *IdempotencyRecord
+	err := s.engine.Update(func(tx kvTx) error {
+		if raw := tx.Get(idempotencyBucket, []byte(record.Key)); raw != nil {
+			if err := bson.Unmarshal(raw, &existing); err != nil {
+				return err
+			}
+			if !existing.expired(record.CreatedAt) {
+				return nil
+			}
+			existing = nil
+		}
+		raw, err := bson.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return tx.Put(idempotencyBucket, []byte(record.Key), raw)
+	})
+	return existing, err
+}
+
+func (s embeddedIdempotencyStore) Complete(_ context.Context, record *IdempotencyRecord) error {
+	return s.engine.Update(func(tx kvTx) error {
+		raw, err := bson.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return tx.Put(idempotencyBucket, []byte(record.Key), raw)
+	})
+}
+
+func (s embeddedIdempotencyStore) Release(_ context.Context, key string) error {
+	return s.engine.Update(func(tx kvTx) error {
+		return tx.Delete(idempotencyBucket, []byte(key))
+	})
+}
+
+func (s embeddedIdempotencyStore) Expire(_ context.Context, before time.Time) error {
+	return s.engine.Update(func(tx kvTx) error {
+		var expired [][]byte
+		err := tx.Scan(idempotencyBucket, nil, false, func(key, value []byte) (bool, error) {
+			createdAt, ok := bson.Raw(value).Lookup("created_at").DateTimeOK()
+			if ok && time.UnixMilli(createdAt).Before(before) {
+				expired = append(expired, append([]byte{}, key...))
+			}
+			return true, nil
+		})
+		for _, key := range expired {
+			if err == nil {
+				err = tx.Delete(idempotencyBucket, key)
+			}
+		}
+		return err
+	})
+}
+
+func (s *embeddedStore) Grants() GrantStore {
+	return embeddedGrantStore{engine: s.engine}
+}
+
+const (
+	grantBucket  = "grant"
+	deniedBucket = "grant_denied"
+)
+
+type embeddedGrantStore struct {
+	engine kvEngine
+}
+
+func grantKey(contractID primitive.ObjectID, subject string) []byte {
+	// Grants on a contract are next to each other, ordered by subject.
+	return append(append([]byte{}, contractID[:]...), subject...)
+}
+
+func deniedPrefix(subject string) []byte {
+	// The contracts a subject is denied are next to each other.
+	return append([]byte(subject), 0)
+}
+
+func deniedKey(contractID primitive.ObjectID, subject string) []byte {
+	return append(deniedPrefix(subject), contractID[:]...)
+}
+
+func (s embeddedGrantStore) Put(_ context.Context, grant *Grant) error {
+	raw, err := bson.Marshal(grant)
+	if err != nil {
+		return err
+	}
+	return s.engine.Update(func(tx kvTx) error {
+		if err := tx.Put(grantBucket, grantKey(grant.ContractID, grant.Subject), raw); err != nil {
+			return err
+		}
+		if grant.Role == RoleNone {
+			return tx.Put(deniedBucket, deniedKey(grant.ContractID, grant.Subject), []byte{})
+		}
+		return tx.Delete(deniedBucket, deniedKey(grant.ContractID, grant.Subject))
+	})
+}
+
+func (s embeddedGrantStore) Get(_ context.Context, contractID primitive.ObjectID, subject string) (*Grant, error) {
+	var raw []byte
+	_ = s.engine.View(func(tx kvTx) error {
+		raw = tx.Get(grantBucket, grantKey(contractID, subject))
+		return nil
+	})
+	if raw == nil {
+		return nil, ErrGrantNotFound
+	}
+	var grant *Grant
+	err := bson.Unmarshal(raw, &grant)
+	return grant, err
+}
+
+func (s embeddedGrantStore) List(_ context.Context, contractID primitive.ObjectID) ([]*Grant, error) {
+	grants := make([]*Grant, 0)
+	err := s.engine.View(func(tx kvTx) error {
+		return tx.Scan(grantBucket, contractID[:], false, func(key, value []byte) (bool, error) {
+			if !bytes.HasPrefix(key, contractID[:]) {
+				return false, nil
+			}
+			var grant *Grant
+			if err := bson.Unmarshal(value, &grant); err != nil {
+				return false, err
+			}
+			grants = append(grants, grant)
+			return true, nil
+		})
+	})
+	return grants, err
+}
+
+func (s embeddedGrantStore) Denied(_ context.Context, subject string) ([]primitive.ObjectID, error) {
+	var denied []primitive.ObjectID
+	prefix := deniedPrefix(subject)
+	err := s.engine.View(func(tx kvTx) error {
+		return tx.Scan(deniedBucket, prefix, false, func(key, _ []byte) (bool, error) {
+			if !bytes.HasPrefix(key, prefix) {
+				return false, nil
+			}
+			var id primitive.ObjectID
+			copy(id[:], key[len(prefix):])
+			denied = append(denied, id)
+			return true, nil
+		})
+	})
+	return denied, err
+}
+
+func (s embeddedGrantStore) Delete(_ context.Context, contractID primitive.ObjectID, subject string) error {
+	key := grantKey(contractID, subject)
+	return s.engine.Update(func(tx kvTx) error {
+		if tx.Get(grantBucket, key) == nil {
+			return ErrGrantNotFound
+		}
+		if err := tx.Delete(deniedBucket, deniedKey(contractID, subject)); err != nil {
+			return err
+		}
+		return tx.Delete(grantBucket, key)
+	})
+}
+
+func deleteGrants(tx kvTx, contractID []byte) error {
+	// Removes the grants on a contract along with the denials among them.
+	err := tx.Scan(grantBucket, contractID, false, func(key, _ []byte) (bool, error) {
+		if !bytes.HasPrefix(key, contractID) {
+			return false, nil
+		}
+		var id primitive.ObjectID
+		copy(id[:], contractID)
+		return true, tx.Delete(deniedBucket, deniedKey(id, string(key[len(contractID):])))
+	})
+	if err != nil {
+		return err
+	}
+	return deletePrefixed(tx, grantBucket, contractID)
+}
+
+func (s *embeddedStore) Proposals() ProposalStore {
+	return embeddedProposalStore{engine: s.engine}
+}
+
+const proposalBucket = "proposal"
+
+type embeddedProposalStore struct {
+	engine kvEngine
+}
+
+func proposalKey(contractID, id primitive.ObjectID) []byte {
+	// Proposals on a contract are next to each other, in the order
+	// they were made.
+	return append(append([]byte{}, contractID[:]...), id[:]...)
+}
+
+func (s embeddedProposalStore) Insert(_ context.Context, proposal *Proposal) error {
+	raw, err := bson.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+	return s.engine.Update(func(tx kvTx) error {
+		return tx.Put(proposalBucket, proposalKey(proposal.ContractID, proposal.ID), raw)
+	})
+}
+
+func (s embeddedProposalStore) Get(_ context.Context, contractID, id primitive.ObjectID) (*Proposal, error) {
+	var raw []byte
+	_ = s.engine.View(func(tx kvTx) error {
+		raw = tx.Get(proposalBucket, proposalKey(contractID, id))
+		return nil
+	})
+	if raw == nil {
+		return nil, ErrProposalNotFound
+	}
+	var proposal *Proposal
+	err := bson.Unmarshal(raw, &proposal)
+	return proposal, err
+}
+
+func (s embeddedProposalStore) List(_ context.Context, contractID primitive.ObjectID, status string) ([]*Proposal, error) {
+	proposals := make([]*Proposal, 0)
+	err := s.engine.View(func(tx kvTx) error {
+		return tx.Scan(proposalBucket, contractID[:], false, func(key, value []byte) (bool, error) {
+			if !bytes.HasPrefix(key, contractID[:]) {
+				return false, nil
+			}
+			if stored, _ := bson.Raw(value).Lookup("status").StringValueOK(); status != "" && stored != status {
+				return true, nil
+			}
+			var proposal *Proposal
+			if err := bson.Unmarshal(value, &proposal); err != nil {
+				return false, err
+			}
+			proposals = append(proposals, proposal)
+			return true, nil
+		})
+	})
+	return proposals, err
+}
+
+func (s embeddedProposalStore) Decide(_ context.Context, proposal *Proposal, from string) error {
+	raw, err := bson.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+	key := proposalKey(proposal.ContractID, proposal.ID)
+	return s.engine.Update(func(tx kvTx) error {
+		stored := tx.Get(proposalBucket, key)
+		if stored == nil {
+			return ErrProposalNotFound
+		}
+		if status, _ := bson.Raw(stored).Lookup("status").StringValueOK(); status != from {
+			return ErrProposalDecided
+		}
+		return tx.Put(proposalBucket, key, raw)
+	})
+}
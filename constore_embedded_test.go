@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "contracts.db")
+	ctx := context.Background()
+
+	store, err := NewFileStore(path)
+	require.NoError(t, err)
+
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{"key": "world"}, ArbitraryData{"n": 1})
+	_, _ = contract.Branch(newDate(2022, 11, 10), time.Time{}, ArbitraryData{"key": "venus"})
+	require.NoError(t, store.Insert(ctx, []*Contract{contract}))
+	require.NoError(t, store.Close(ctx))
+
+	store, err = NewFileStore(path)
+	require.NoError(t, err)
+	defer store.Close(ctx)
+
+	stored, err := store.Get(ctx, contract.ID)
+	require.NoError(t, err)
+	require.Len(t, stored.Items, 3)
+	require.Equal(t, contract.Items[1].ID, stored.Items[1].ID)
+	require.Equal(t, ArbitraryData{"_ref": contract.Items[0].ID}, stored.Items[1].Data)
+	require.Equal(t, ArbitraryData{"n": int32(1)}, stored.Meta)
+	require.Equal(t, newDate(2022, 11, 10), stored.Items[2].StartAt)
+	require.Equal(t, contract.CreatedAt.Truncate(time.Millisecond), stored.CreatedAt)
+}
+
+func TestEmbeddedStore(t *testing.T) {
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "contracts.db"))
+	require.NoError(t, err)
+	defer store.Close(context.Background())
+
+	testContractStore(t, store)
+}
+
+func TestEmbeddedEventStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore().Events()
+
+	first, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+	second, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+
+	for version := int64(0); version < 3; version++ {
+		first.Version, second.Version = version, version
+		require.NoError(t, store.Append(ctx,
+			NewEvent(first, EventMeta, "", EventPayload{}, nil),
+			NewEvent(second, EventMeta, "", EventPayload{}, nil)))
+	}
+	require.Error(t, store.Append(ctx, NewEvent(first, EventMeta, "", EventPayload{}, nil)))
+
+	events, err := store.List(ctx, first.ID, -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	for i, event := range events {
+		require.Equal(t, first.ID, event.ContractID)
+		require.EqualValues(t, i, event.Sequence)
+	}
+
+	events, err = store.List(ctx, second.ID, 1)
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+
+	events, err = store.List(ctx, primitive.NewObjectID(), -1)
+	require.NoError(t, err)
+	require.Empty(t, events)
+}
+
+func TestEmbeddedStorePurge(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "contracts.db"))
+	require.NoError(t, err)
+	defer store.Close(ctx)
+
+	var contracts []*Contract
+	for i := 0; i < 3; i++ {
+		contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+		contracts = append(contracts, contract)
+	}
+	require.NoError(t, store.Insert(ctx, contracts))
+
+	for i, deletedAt := range []time.Time{newDate(2023, 1, 1), newDate(2023, 3, 1)} {
+		contracts[i].DeletedAt = &deletedAt
+		_, err = store.Update(ctx, contracts[i], nil)
+		require.NoError(t, err)
+		require.NoError(t, store.Events().Append(ctx, NewEvent(contracts[i], EventDelete, "", EventPayload{}, nil)))
+	}
+
+	listed, err := store.List(ctx, ContractQuery{})
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	listed, _ = store.List(ctx, ContractQuery{IncludeDeleted: true})
+	require.Len(t, listed, 3)
+
+	purged, err := store.Purge(ctx, newDate(2023, 2, 1))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, purged)
+
+	_, err = store.Get(ctx, contracts[0].ID)
+	require.Equal(t, ErrNotFound, err)
+	events, _ := store.Events().List(ctx, contracts[0].ID, -1)
+	require.Empty(t, events)
+
+	_, err = store.Get(ctx, contracts[1].ID)
+	require.NoError(t, err)
+	events, _ = store.Events().List(ctx, contracts[1].ID, -1)
+	require.Len(t, events, 1)
+}
+
+func TestEmbeddedIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "contracts.db"))
+	require.NoError(t, err)
+	defer store.Close(ctx)
+	keys := store.Idempotency()
+
+	now := time.Now().UTC()
+	record := &IdempotencyRecord{Key: "a", RequestHash: "x", CreatedAt: now.Add(-time.Hour)}
+	existing, err := keys.Reserve(ctx, record)
+	require.NoError(t, err)
+	require.Nil(t, existing)
+
+	existing, err = keys.Reserve(ctx, &IdempotencyRecord{Key: "a", RequestHash: "y", CreatedAt: now})
+	require.NoError(t, err)
+	require.Equal(t, "x", existing.RequestHash)
+	require.False(t, existing.Completed)
+
+	record.Completed, record.Status, record.Body = true, 201, []byte("{}")
+	require.NoError(t, keys.Complete(ctx, record))
+	existing, _ = keys.Reserve(ctx, &IdempotencyRecord{Key: "a", CreatedAt: now})
+	require.Equal(t, 201, existing.Status)
+	require.Equal(t, []byte("{}"), existing.Body)
+
+	// Expired records make way for new ones.
+	existing, _ = keys.Reserve(ctx, &IdempotencyRecord{Key: "a", RequestHash: "z", CreatedAt: now.Add(idempotencyTTL)})
+	require.Nil(t, existing)
+
+	require.NoError(t, keys.Release(ctx, "a"))
+	existing, _ = keys.Reserve(ctx, &IdempotencyRecord{Key: "a", CreatedAt: now})
+	require.Nil(t, existing)
+
+	require.NoError(t, keys.Expire(ctx, now.Add(time.Minute)))
+	existing, _ = keys.Reserve(ctx, &IdempotencyRecord{Key: "a", RequestHash: "w", CreatedAt: now})
+	require.Nil(t, existing)
+}
+
+func TestEmbeddedAPIKeyStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "contracts.db"))
+	require.NoError(t, err)
+	defer store.Close(ctx)
+	keys := store.APIKeys()
+
+	first, secret, err := NewAPIKey("first", RoleAdmin)
+	require.NoError(t, err)
+	second, _, err := NewAPIKey("second", RoleEditor)
+	require.NoError(t, err)
+	require.NoError(t, keys.Create(ctx, second))
+	require.NoError(t, keys.Create(ctx, first))
+
+	found, err := keys.Lookup(ctx, hashAPIKey(secret))
+	require.NoError(t, err)
+	require.Equal(t, first.ID, found.ID)
+	require.Equal(t, RoleAdmin, found.Role)
+
+	list, err := keys.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, first.ID, list[0].ID)
+
+	require.NoError(t, keys.Delete(ctx, first.ID))
+	require.ErrorIs(t, keys.Delete(ctx, first.ID), ErrAPIKeyNotFound)
+	_, err = keys.Lookup(ctx, hashAPIKey(secret))
+	require.ErrorIs(t, err, ErrAPIKeyNotFound)
+}
+
+func TestEmbeddedTenants(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	acme, err := store.ForTenant("acme")
+	require.NoError(t, err)
+	other, err := store.ForTenant("other")
+	require.NoError(t, err)
+
+	newContract := func() *Contract {
+		contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+		return contract
+	}
+	contract := newContract()
+	require.NoError(t, acme.Insert(ctx, []*Contract{contract}))
+	require.Equal(t, "acme", contract.Tenant)
+	require.NoError(t, store.Insert(ctx, []*Contract{newContract()}))
+
+	_, err = other.Get(ctx, contract.ID)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = other.Update(ctx, contract, nil)
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = other.PatchMeta(ctx, contract.ID, MetaPatch{Version: -1, Set: map[string]interface{}{"name": "Rent"}}, nil)
+	require.ErrorIs(t, err, ErrPatchNotApplied)
+
+	found, err := acme.Get(ctx, contract.ID)
+	require.NoError(t, err)
+	require.Equal(t, "acme", found.Tenant)
+
+	// Unscoped stores see every tenant, the default one only its own.
+	for scoped, count := range map[ContractStore]int{acme: 1, other: 0, store: 2} {
+		contracts, err := scoped.List(ctx, ContractQuery{})
+		require.NoError(t, err)
+		require.Len(t, contracts, count)
+	}
+	fallback, err := store.ForTenant(DefaultTenant)
+	require.NoError(t, err)
+	contracts, err := fallback.List(ctx, ContractQuery{})
+	require.NoError(t, err)
+	require.Len(t, contracts, 1)
+	require.NotEqual(t, contract.ID, contracts[0].ID)
+
+	webhook := &Webhook{ID: primitive.NewObjectID(), URL: "https://example.com"}
+	require.NoError(t, acme.Webhooks().Create(ctx, webhook))
+	_, err = other.Webhooks().Get(ctx, webhook.ID)
+	require.ErrorIs(t, err, ErrWebhookNotFound)
+	require.ErrorIs(t, other.Webhooks().Delete(ctx, webhook.ID), ErrWebhookNotFound)
+	webhooks, err := other.Webhooks().List(ctx)
+	require.NoError(t, err)
+	require.Empty(t, webhooks)
+	webhooks, err = acme.Webhooks().List(ctx)
+	require.NoError(t, err)
+	require.Len(t, webhooks, 1)
+}
+
+func TestEmbeddedGrantStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	grants := store.Grants()
+
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+	require.NoError(t, store.Insert(ctx, []*Contract{contract}))
+	other := primitive.NewObjectID()
+	for _, grant := range []*Grant{
+		{ContractID: contract.ID, Subject: "bob", Role: RoleViewer},
+		{ContractID: contract.ID, Subject: "alice", Role: RoleViewer},
+		{ContractID: contract.ID, Subject: "bob", Role: RoleEditor},
+		{ContractID: other, Subject: "alice", Role: RoleAdmin},
+	} {
+		require.NoError(t, grants.Put(ctx, grant))
+	}
+
+	list, err := grants.List(ctx, contract.ID)
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, "alice", list[0].Subject)
+	require.Equal(t, RoleEditor, list[1].Role)
+
+	grant, err := grants.Get(ctx, other, "alice")
+	require.NoError(t, err)
+	require.Equal(t, RoleAdmin, grant.Role)
+	_, err = grants.Get(ctx, other, "bob")
+	require.ErrorIs(t, err, ErrGrantNotFound)
+
+	require.NoError(t, grants.Delete(ctx, contract.ID, "alice"))
+	require.ErrorIs(t, grants.Delete(ctx, contract.ID, "alice"), ErrGrantNotFound)
+
+	// Denials are found by subject, and go along with their grants.
+	for _, grant := range []*Grant{
+		{ContractID: contract.ID, Subject: "carol", Role: RoleNone},
+		{ContractID: other, Subject: "carol", Role: RoleNone},
+		{ContractID: other, Subject: "bob", Role: RoleNone},
+		{ContractID: other, Subject: "bob", Role: RoleViewer},
+	} {
+		require.NoError(t, grants.Put(ctx, grant))
+	}
+	denied, err := grants.Denied(ctx, "carol")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []primitive.ObjectID{contract.ID, other}, denied)
+	denied, err = grants.Denied(ctx, "bob")
+	require.NoError(t, err)
+	require.Empty(t, denied)
+	require.NoError(t, grants.Delete(ctx, other, "carol"))
+
+	// Grants go along with the contracts they are on.
+	deletedAt := newDate(2022, 1, 1)
+	contract.DeletedAt = &deletedAt
+	_, err = store.Update(ctx, contract, nil)
+	require.NoError(t, err)
+	_, err = store.Purge(ctx, newDate(2022, 2, 1))
+	require.NoError(t, err)
+	list, err = grants.List(ctx, contract.ID)
+	require.NoError(t, err)
+	require.Empty(t, list)
+	denied, err = grants.Denied(ctx, "carol")
+	require.NoError(t, err)
+	require.Empty(t, denied)
+}
+
+func TestEmbeddedProposalStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	proposals := store.Proposals()
+
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+	require.NoError(t, store.Insert(ctx, []*Contract{contract}))
+	first, err := NewProposal(contract, newDate(2023, 1, 1), time.Time{}, ArbitraryData{"price": 12})
+	require.NoError(t, err)
+	require.Equal(t, newDate(2023, 10, 10), first.EndAt)
+	second, err := NewProposal(contract, newDate(2023, 2, 1), time.Time{}, ArbitraryData{"price": 14})
+	require.NoError(t, err)
+	for _, proposal := range []*Proposal{first, second} {
+		require.NoError(t, proposals.Insert(ctx, proposal))
+	}
+	_, err = NewProposal(contract, newDate(2024, 1, 1), time.Time{}, ArbitraryData{})
+	require.ErrorIs(t, err, ErrOutOfBounds)
+
+	// Decisions only go through for proposals still as expected.
+	first.decide(ProposalRejected, "alice", "too expensive")
+	require.NoError(t, proposals.Decide(ctx, first, ProposalPending))
+	require.ErrorIs(t, proposals.Decide(ctx, first, ProposalPending), ErrProposalDecided)
+
+	list, err := proposals.List(ctx, contract.ID, "")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	require.Equal(t, first.ID, list[0].ID)
+	require.Equal(t, "too expensive", list[0].Reason)
+	list, err = proposals.List(ctx, contract.ID, ProposalPending)
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	require.Equal(t, second.ID, list[0].ID)
+
+	_, err = proposals.Get(ctx, primitive.NewObjectID(), second.ID)
+	require.ErrorIs(t, err, ErrProposalNotFound)
+
+	// Proposals go along with the contracts they are on.
+	deletedAt := newDate(2022, 1, 1)
+	contract.DeletedAt = &deletedAt
+	_, err = store.Update(ctx, contract, nil)
+	require.NoError(t, err)
+	_, err = store.Purge(ctx, newDate(2022, 2, 1))
+	require.NoError(t, err)
+	list, err = proposals.List(ctx, contract.ID, "")
+	require.NoError(t, err)
+	require.Empty(t, list)
+}
+
+func TestEmbeddedDeliveryQueue(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore().Webhooks()
+	webhook := &Webhook{ID: primitive.NewObjectID(), URL: "http://localhost", Secret: "0123456789abcdef"}
+	require.NoError(t, store.Create(ctx, webhook))
+
+	now := time.Now().UTC()
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+	deliveries := make([]*Delivery, 3)
+	for i := range deliveries {
+		delivery, err := NewDelivery(webhook, NewEvent(contract, EventCreate, "", EventPayload{}, nil), contract)
+		require.NoError(t, err)
+		delivery.NextAttemptAt = now.Add(time.Duration(1-i) * time.Minute)
+		deliveries[i] = delivery
+	}
+	require.NoError(t, store.Enqueue(ctx, deliveries...))
+
+	// Deliveries are claimed in the order they are due, each for the
+	// length of the lease.
+	claimed, err := store.Claim(ctx, now, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, deliveries[2].ID, claimed.ID)
+	claimed, err = store.Claim(ctx, now, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, deliveries[1].ID, claimed.ID)
+	claimed, err = store.Claim(ctx, now, time.Minute)
+	require.NoError(t, err)
+	require.Nil(t, claimed)
+
+	// Finished deliveries are never claimed again.
+	later := now.Add(2 * time.Minute)
+	for _, delivery := range deliveries[1:] {
+		delivery.Status = DeliverySucceeded
+		require.NoError(t, store.Save(ctx, delivery))
+	}
+	claimed, err = store.Claim(ctx, later, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, deliveries[0].ID, claimed.ID)
+	claimed, err = store.Claim(ctx, later, time.Minute)
+	require.NoError(t, err)
+	require.Nil(t, claimed)
+}
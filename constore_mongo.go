@@ -0,0 +1,1110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type mongoStore struct {
+	client      *mongo.Client
+	coll        *mongo.Collection
+	txOptions   *options.TransactionOptions
+	events      *mongoEventStore
+	grants      *mongoGrantStore
+	proposals   *mongoProposalStore
+	webhooks    *mongoWebhookStore
+	idempotency *mongoIdempotencyStore
+	apiKeys     *mongoAPIKeyStore
+	scope       tenantScope
+	databases   *tenantDatabases
+}
+
+func NewMongoStore(mi *MongoInstance) (ContractStore, error) {
+	webhooks, err := newMongoWebhookStore(mi.Database)
+	if err != nil {
+		return nil, err
+	}
+	idempotency, err := newMongoIdempotencyStore(mi.Database)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys, err := newMongoAPIKeyStore(mi.Database)
+	if err != nil {
+		return nil, err
+	}
+	store := &mongoStore{
+		client:      mi.Client,
+		txOptions:   options.Transaction(),
+		webhooks:    webhooks,
+		idempotency: idempotency,
+		apiKeys:     apiKeys,
+		databases:   newTenantDatabases(mi),
+	}
+	if err = store.use(mi.Database); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *mongoStore) use(db *mongo.Database) error {
+	// Keeps the contracts, their events, grants and proposals in the
+	// given database.
+	events, err := newMongoEventStore(db)
+	if err != nil {
+		return err
+	}
+	if s.grants, err = newMongoGrantStore(db); err != nil {
+		return err
+	}
+	if s.proposals, err = newMongoProposalStore(db); err != nil {
+		return err
+	}
+	s.coll, s.events = db.Collection("contract"), events
+	return createContractIndexes(s.coll, true)
+}
+
+func createContractIndexes(coll *mongo.Collection, items bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Contracts are listed by tenant, in any of the orders they can be
+	// sorted by.
+	models := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "updated_at", Value: -1}, {Key: "_id", Value: -1}}},
+	}
+	if items {
+		// Used to find the branches starting or ending within a window.
+		models = append(models,
+			mongo.IndexModel{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "items.start_at", Value: 1}}},
+			mongo.IndexModel{Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "items.end_at", Value: 1}}},
+		)
+	}
+	_, err := coll.Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// tenantDatabases keeps the contracts of each tenant in a database of
+// its own, named after the main one and the tenant (e.g. "charlie_acme"),
+// if TENANT_DATABASES is set. The main database keeps the contracts of
+// the default tenant, along with whatever is not a contract.
+type tenantDatabases struct {
+	client *mongo.Client
+	name   string
+	mu     sync.Mutex
+	stores map[string]ContractStore
+}
+
+func newTenantDatabases(mi *MongoInstance) *tenantDatabases {
+	if !TenantDatabases {
+		return nil
+	}
+	return &tenantDatabases{client: mi.Client, name: mi.Database.Name(), stores: make(map[string]ContractStore)}
+}
+
+func (d *tenantDatabases) store(tenant string, open func(db *mongo.Database) (ContractStore, error)) (ContractStore, error) {
+	// Opens the store of a tenant once, since that creates indexes.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if store, ok := d.stores[tenant]; ok {
+		return store, nil
+	}
+	store, err := open(d.client.Database(d.name + "_" + tenant))
+	if err != nil {
+		return nil, err
+	}
+	d.stores[tenant] = store
+	return store, nil
+}
+
+func (d *tenantDatabases) purge(ctx context.Context, root ContractStore, before time.Time) (int64, error) {
+	// Purges the databases of every tenant, opened or not.
+	prefix := d.name + "_"
+	names, err := d.client.ListDatabaseNames(ctx, bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}})
+	if err != nil {
+		return 0, err
+	}
+
+	var purged int64
+	for _, name := range names {
+		tenant := strings.TrimPrefix(name, prefix)
+		if !validTenant(tenant) || tenant == DefaultTenant {
+			continue
+		}
+		store, err := root.ForTenant(tenant)
+		if err != nil {
+			return purged, err
+		}
+		count, err := store.Purge(ctx, before)
+		if purged += count; err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (s tenantScope) filter(filter bson.M) bson.M {
+	// Narrows down a filter to the contracts of the tenant. Contracts
+	// of the default tenant have no tenant field.
+	if s.scoped && s.tenant == DefaultTenant {
+		filter["tenant"] = bson.M{"$in": bson.A{nil, ""}}
+	} else if s.scoped {
+		filter["tenant"] = s.tenant
+	}
+	return filter
+}
+
+func (s *mongoStore) ForTenant(tenant string) (ContractStore, error) {
+	scoped := *s
+	scoped.scope = tenantScope{tenant: tenant, scoped: true}
+	if s.databases == nil || tenant == DefaultTenant {
+		return &scoped, nil
+	}
+	return s.databases.store(tenant, func(db *mongo.Database) (ContractStore, error) {
+		return &scoped, scoped.use(db)
+	})
+}
+
+func (s *mongoStore) Events() EventStore {
+	return s.events
+}
+
+func (s *mongoStore) Webhooks() WebhookStore {
+	return s.scope.webhooks(s.webhooks)
+}
+
+func (s *mongoStore) Grants() GrantStore {
+	return s.grants
+}
+
+func (s *mongoStore) Proposals() ProposalStore {
+	return s.proposals
+}
+
+func (s *mongoStore) Idempotency() IdempotencyStore {
+	return s.idempotency
+}
+
+func (s *mongoStore) APIKeys() APIKeyStore {
+	return s.scope.apiKeys(s.apiKeys)
+}
+
+func (s *mongoStore) Get(ctx context.Context, id primitive.ObjectID) (*Contract, error) {
+	var contract *Contract
+	err := s.coll.FindOne(ctx, s.scope.filter(bson.M{"_id": id})).Decode(&contract)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	return contract, err
+}
+
+func (s *mongoStore) GetWindow(ctx context.Context, id primitive.ObjectID, window Window) (*Contract, error) {
+	// The whole document has to be read anyway.
+	contract, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return window.narrow(contract), nil
+}
+
+type mongoCursor struct {
+	*mongo.Cursor
+}
+
+func (c mongoCursor) Contract() (*Contract, error) {
+	var contract *Contract
+	err := c.Decode(&contract)
+	return contract, err
+}
+
+func conditionValues(values []string) bson.A {
+	// Filter values might be stored as strings, numbers or booleans.
+	candidates := bson.A{}
+	for _, value := range values {
+		candidates = append(candidates, value)
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			candidates = append(candidates, number)
+		}
+		if boolean, err := strconv.ParseBool(value); err == nil {
+			candidates = append(candidates, boolean)
+		}
+	}
+	return candidates
+}
+
+func windowRange(window Window) bson.M {
+	// Times within [From, To) of the window.
+	bounds := bson.M{}
+	if !window.From.IsZero() {
+		bounds["$gte"] = window.From
+	}
+	if !window.To.IsZero() {
+		bounds["$lt"] = window.To
+	}
+	if len(bounds) == 0 {
+		bounds["$exists"] = true
+	}
+	return bounds
+}
+
+func mongoQuery(query ContractQuery, items bool) (bson.M, *options.FindOptions, bool) {
+	/*
+		Translates a query to a MongoDB filter and options. Conditions
+		that can't be expressed (or only approximately) are left to
+		the filter of the query, in which case the returned filter
+		selects more contracts than needed and false is returned. The
+		items of contracts can be filtered by only if they are in the
+		contract documents.
+	*/
+	exact := true
+	and := bson.A{}
+	if !query.IncludeDeleted {
+		// Matches both null and missing fields.
+		and = append(and, bson.M{"deleted_at": nil})
+	}
+
+	field, direction, op := "_id", -1, "$lt"
+	if !query.byID() {
+		field = query.Sort
+	}
+	if query.Ascending {
+		direction, op = 1, "$gt"
+	}
+	if !query.Cursor.IsZero() {
+		if query.byID() {
+			and = append(and, bson.M{"_id": bson.M{op: query.Cursor}})
+		} else {
+			and = append(and, bson.M{"$or": bson.A{
+				bson.M{field: bson.M{op: query.CursorValue}},
+				bson.M{field: query.CursorValue, "_id": bson.M{op: query.Cursor}},
+			}})
+		}
+	}
+
+	if len(query.Filter.Exclude) > 0 {
+		and = append(and, bson.M{"_id": bson.M{"$nin": query.Filter.Exclude}})
+	}
+
+	for _, condition := range query.Filter.Conditions {
+		switch {
+		case strings.HasPrefix(condition.Field, "meta.") && (condition.Op == "eq" || condition.Op == "in"):
+			/*
+				$in also matches arrays holding the values, which conditions
+				don't, so arrays are left out. Paths of nested objects are
+				also resolved through arrays along the way, so only top
+				level keys are matched exactly.
+			*/
+			and = append(and, bson.M{condition.Field: bson.M{
+				"$in":  conditionValues(condition.Values),
+				"$not": bson.M{"$type": "array"},
+			}})
+			if strings.Contains(strings.TrimPrefix(condition.Field, "meta."), ".") {
+				exact = false
+			}
+		case (condition.Field == "created_at" || condition.Field == "updated_at") && condition.Op != "ne":
+			times := bson.A{}
+			for _, value := range condition.Values {
+				parsed, _ := parseTime(value)
+				times = append(times, parsed)
+			}
+			if condition.Op == "eq" || condition.Op == "in" {
+				and = append(and, bson.M{condition.Field: bson.M{"$in": times}})
+			} else {
+				and = append(and, bson.M{condition.Field: bson.M{"$" + condition.Op: times[0]}})
+			}
+		default:
+			exact = false
+		}
+	}
+	if at := query.Filter.ActiveAt; !at.IsZero() {
+		if items {
+			and = append(and, bson.M{"items": bson.M{"$elemMatch": bson.M{
+				"replaced_by": bson.M{"$in": bson.A{nil, bson.A{}}},
+				"start_at":    bson.M{"$lte": at},
+				"end_at":      bson.M{"$gt": at},
+			}}})
+		} else {
+			exact = false
+		}
+	}
+
+	if window := query.Filter.Changing; window != (Window{}) {
+		if items {
+			// Either end of a branch is matched on its own so that
+			// both can make use of their index.
+			active := bson.M{"$in": bson.A{nil, bson.A{}}}
+			and = append(and, bson.M{"$or": bson.A{
+				bson.M{"items": bson.M{"$elemMatch": bson.M{"replaced_by": active, "start_at": windowRange(window)}}},
+				bson.M{"items": bson.M{"$elemMatch": bson.M{"replaced_by": active, "end_at": windowRange(window)}}},
+			}})
+		} else {
+			exact = false
+		}
+	}
+
+	sort := bson.D{{Key: field, Value: direction}}
+	if field != "_id" {
+		sort = append(sort, bson.E{Key: "_id", Value: direction})
+	}
+	opts := options.Find().SetSort(sort)
+	if exact {
+		opts.SetLimit(query.Limit)
+	}
+
+	filter := bson.M{}
+	if len(and) > 0 {
+		filter["$and"] = and
+	}
+	return filter, opts, exact
+}
+
+func (s *mongoStore) Find(ctx context.Context, query ContractQuery) (ContractCursor, error) {
+	filter, opts, exact := mongoQuery(query, true)
+	filter = s.scope.filter(filter)
+	if query.OmitItems && (exact || !query.Filter.usesItems()) {
+		opts.SetProjection(bson.D{{Key: "items", Value: 0}})
+	}
+
+	cur, err := s.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !exact {
+		return filterCursor(mongoCursor{cur}, query), nil
+	}
+	return mongoCursor{cur}, nil
+}
+
+func (s *mongoStore) List(ctx context.Context, query ContractQuery) ([]*Contract, error) {
+	cur, err := s.Find(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return collect(ctx, cur)
+}
+
+func boundaryFilter(field string, query BoundaryQuery) bson.M {
+	// Selects the boundaries at the given field that the query does.
+	filter := bson.M{field: windowRange(query.Window)}
+	if after := query.After; after != nil {
+		filter["$or"] = bson.A{
+			bson.M{field: bson.M{"$gt": after.At}},
+			bson.M{field: after.At, "contract_id": bson.M{"$gt": after.ContractID}},
+		}
+	}
+	return filter
+}
+
+func (s *mongoStore) Boundaries(ctx context.Context, query BoundaryQuery) ([]Boundary, error) {
+	/*
+		The contracts with an active branch starting or ending within
+		the window are found by the indexes on the bounds of branches,
+		then their active branches are unwound into boundaries, which
+		are sorted and limited by the server.
+	*/
+	active := bson.M{"$in": bson.A{nil, bson.A{}}}
+	window := windowRange(query.Window)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: s.scope.filter(bson.M{"$or": bson.A{
+			bson.M{"items": bson.M{"$elemMatch": bson.M{"replaced_by": active, "start_at": window}}},
+			bson.M{"items": bson.M{"$elemMatch": bson.M{"replaced_by": active, "end_at": window}}},
+		}})}},
+		{{Key: "$unwind", Value: "$items"}},
+		{{Key: "$match", Value: bson.M{"items.replaced_by": active}}},
+		{{Key: "$project", Value: bson.M{
+			"_id": 0, "contract_id": "$_id", "at": bson.A{"$items.start_at", "$items.end_at"},
+		}}},
+		{{Key: "$unwind", Value: "$at"}},
+		{{Key: "$match", Value: boundaryFilter("at", query)}},
+		// A branch ending where another one starts makes one boundary.
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"at": "$at", "contract_id": "$contract_id"}}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$_id"}}},
+		{{Key: "$sort", Value: bson.D{{Key: "at", Value: 1}, {Key: "contract_id", Value: 1}}}},
+	}
+	if query.Limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: query.Limit}})
+	}
+
+	cur, err := s.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	boundaries := make([]Boundary, 0)
+	err = cur.All(ctx, &boundaries)
+	return boundaries, err
+}
+
+func (s *mongoStore) Insert(ctx context.Context, contracts []*Contract, events ...*Event) error {
+	/*
+		Contracts and their events are inserted in a transaction, so
+		that no contract is ever stored without its events. Write errors
+		abort transactions, so the contracts that can't be inserted
+		(those with an ID already taken) are told beforehand.
+	*/
+	s.scope.claim(contracts)
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	var failed InsertErrors
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		failed = make(InsertErrors)
+		taken, err := takenIDs(sc, s.coll, contracts)
+		if err != nil {
+			return nil, err
+		}
+
+		var documents []interface{}
+		inserted := make(map[primitive.ObjectID]bool)
+		for i, contract := range contracts {
+			if taken[contract.ID] {
+				failed[i] = fmt.Errorf("duplicate contract ID %s", contract.ID.Hex())
+				continue
+			}
+			taken[contract.ID], inserted[contract.ID] = true, true
+			documents = append(documents, contract)
+		}
+		if len(documents) > 0 {
+			if _, err = s.coll.InsertMany(sc, documents); err != nil {
+				return nil, err
+			}
+		}
+		if recorded := insertedEvents(inserted, events); len(recorded) > 0 {
+			if err = s.events.Append(sc, recorded...); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}, s.txOptions)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+func takenIDs(ctx context.Context, coll *mongo.Collection, contracts []*Contract) (map[primitive.ObjectID]bool, error) {
+	// The IDs of the contracts that are already stored.
+	ids := make(bson.A, len(contracts))
+	for i, contract := range contracts {
+		ids[i] = contract.ID
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+	cur, err := coll.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		return nil, err
+	}
+	var documents []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err = cur.All(ctx, &documents); err != nil {
+		return nil, err
+	}
+	taken := make(map[primitive.ObjectID]bool, len(documents))
+	for _, document := range documents {
+		taken[document.ID] = true
+	}
+	return taken, nil
+}
+
+func (s *mongoStore) Update(ctx context.Context, contract *Contract, event *Event) (*Contract, error) {
+	// The change and its event are written in a transaction.
+	session, err := s.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	updated, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		filter := s.scope.filter(bson.M{"_id": contract.ID, "version": contract.Version})
+		if contract.Version == 0 {
+			// Contracts created before versioning have no version field.
+			filter["version"] = bson.M{"$in": bson.A{0, nil}}
+		}
+		update := bson.M{
+			"$set": bson.M{
+				"items":      contract.Items,
+				"meta":       contract.Meta,
+				"deleted_at": contract.DeletedAt,
+				"version":    contract.Version + 1,
+			},
+			"$currentDate": bson.M{"updated_at": true},
+		}
+		opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+		var document *Contract
+		err := s.coll.FindOneAndUpdate(sc, filter, update, opts).Decode(&document)
+		if err == mongo.ErrNoDocuments {
+			// Tell apart a missing contract from a stale version.
+			count, err := s.coll.CountDocuments(sc, s.scope.filter(bson.M{"_id": contract.ID}), options.Count().SetLimit(1))
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				return nil, ErrNotFound
+			}
+			return nil, ErrVersionConflict
+		} else if err != nil {
+			return nil, err
+		}
+		if event != nil {
+			event.Sequence = document.Version
+			if err = s.events.Append(sc, event); err != nil {
+				return nil, err
+			}
+		}
+		return document, nil
+	}, s.txOptions)
+	if err != nil {
+		return nil, err
+	}
+	return updated.(*Contract), nil
+}
+
+func purgeDeleted(
+	ctx context.Context, coll *mongo.Collection, scope tenantScope, before time.Time, related ...*mongo.Collection,
+) (int64, error) {
+	// Removes the deleted contracts in coll, then whatever refers to
+	// them by contract_id in the related collections.
+	filter := scope.filter(bson.M{"deleted_at": bson.M{"$lt": before}})
+	cur, err := coll.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	var documents []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err = cur.All(ctx, &documents); err != nil || len(documents) == 0 {
+		return 0, err
+	}
+
+	ids := make(bson.A, len(documents))
+	for i, document := range documents {
+		ids[i] = document.ID
+	}
+	result, err := coll.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, err
+	}
+	for _, related := range related {
+		if _, err = related.DeleteMany(ctx, bson.M{"contract_id": bson.M{"$in": ids}}); err != nil {
+			return result.DeletedCount, err
+		}
+	}
+	return result.DeletedCount, nil
+}
+
+func (s *mongoStore) Purge(ctx context.Context, before time.Time) (int64, error) {
+	purged, err := purgeDeleted(ctx, s.coll, s.scope, before, s.events.coll, s.grants.coll, s.proposals.coll)
+	if err == nil && !s.scope.scoped && s.databases != nil {
+		var more int64
+		more, err = s.databases.purge(ctx, s, before)
+		purged += more
+	}
+	return purged, err
+}
+
+func mongoMetaPatch(id primitive.ObjectID, patch MetaPatch) (bson.M, bson.M) {
+	// The filter and the update that make the patch in place.
+	and := bson.A{bson.M{"_id": id}, bson.M{"deleted_at": nil}}
+	if patch.Version == 0 {
+		and = append(and, bson.M{"version": bson.M{"$in": bson.A{0, nil}}})
+	} else if patch.Version > 0 {
+		and = append(and, bson.M{"version": patch.Version})
+	}
+	for _, path := range patch.Exists {
+		and = append(and, bson.M{"meta." + path: bson.M{"$exists": true}})
+	}
+	for _, path := range patch.Objects {
+		and = append(and, bson.M{"meta." + path: bson.M{"$type": "object"}})
+	}
+	for _, path := range patch.Merge {
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"meta." + path: bson.M{"$type": "object"}},
+			bson.M{"meta." + path: bson.M{"$exists": false}},
+		}})
+	}
+	for path, value := range patch.Equal {
+		// Equality also matches arrays holding the value.
+		and = append(and, bson.M{"meta." + path: bson.M{"$eq": value, "$not": bson.M{"$type": "array"}}})
+	}
+
+	set := bson.M{}
+	for path, value := range patch.Set {
+		set["meta."+path] = value
+	}
+	update := bson.M{
+		"$inc":         bson.M{"version": 1},
+		"$currentDate": bson.M{"updated_at": true},
+	}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(patch.Unset) > 0 {
+		unset := bson.M{}
+		for _, path := range patch.Unset {
+			unset["meta."+path] = ""
+		}
+		update["$unset"] = unset
+	}
+	return bson.M{"$and": and}, update
+}
+
+func patchContract(
+	ctx context.Context, coll *mongo.Collection, scope tenantScope, id primitive.ObjectID, patch MetaPatch,
+) (*Contract, error) {
+	filter, update := mongoMetaPatch(id, patch)
+	filter = scope.filter(filter)
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var contract *Contract
+	err := coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&contract)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPatchNotApplied
+	}
+	return contract, err
+}
+
+func (s *mongoStore) PatchMeta(
+	ctx context.Context, id primitive.ObjectID, patch MetaPatch, event *Event,
+) (*Contract, error) {
+	// The patch and its event are written in a transaction.
+	session, err := s.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	contract, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		contract, err := patchContract(sc, s.coll, s.scope, id, patch)
+		if err != nil {
+			return nil, err
+		}
+		if event != nil {
+			event.Sequence, event.Payload.Meta = contract.Version, contract.Meta
+			if err = s.events.Append(sc, event); err != nil {
+				return nil, err
+			}
+		}
+		return contract, nil
+	}, s.txOptions)
+	if err != nil {
+		return nil, err
+	}
+	return contract.(*Contract), nil
+}
+
+func (s *mongoStore) Close(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return s.client.Disconnect(ctx)
+}
+
+type mongoEventStore struct {
+	coll *mongo.Collection
+}
+
+func newMongoEventStore(db *mongo.Database) (*mongoEventStore, error) {
+	coll := db.Collection("events")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Also guards against recording two events for the same version.
+	_, err := coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "contract_id", Value: 1}, {Key: "sequence", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mongoEventStore{coll: coll}, nil
+}
+
+func (s *mongoEventStore) Append(ctx context.Context, events ...*Event) error {
+	documents := make([]interface{}, len(events))
+	for i, event := range events {
+		documents[i] = event
+	}
+	_, err := s.coll.InsertMany(ctx, documents)
+	return err
+}
+
+func (s *mongoEventStore) List(ctx context.Context, contractID primitive.ObjectID, until int64) ([]*Event, error) {
+	filter := bson.M{"contract_id": contractID}
+	if until >= 0 {
+		filter["sequence"] = bson.M{"$lte": until}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "sequence", Value: 1}})
+
+	cur, err := s.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*Event, 0)
+	err = cur.All(ctx, &events)
+	return events, err
+}
+
+type mongoWebhookStore struct {
+	webhooks   *mongo.Collection
+	deliveries *mongo.Collection
+}
+
+func newMongoWebhookStore(db *mongo.Database) (*mongoWebhookStore, error) {
+	store := &mongoWebhookStore{
+		webhooks:   db.Collection("webhook"),
+		deliveries: db.Collection("webhook_delivery"),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := store.deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "_id", Value: -1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = store.webhooks.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *mongoWebhookStore) Create(ctx context.Context, webhook *Webhook) error {
+	_, err := s.webhooks.InsertOne(ctx, webhook)
+	return err
+}
+
+func (s *mongoWebhookStore) Get(ctx context.Context, id primitive.ObjectID) (*Webhook, error) {
+	var webhook *Webhook
+	err := s.webhooks.FindOne(ctx, bson.M{"_id": id}).Decode(&webhook)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrWebhookNotFound
+	}
+	return webhook, err
+}
+
+func (s *mongoWebhookStore) find(ctx context.Context, filter bson.M) ([]*Webhook, error) {
+	cur, err := s.webhooks.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	webhooks := make([]*Webhook, 0)
+	err = cur.All(ctx, &webhooks)
+	return webhooks, err
+}
+
+func (s *mongoWebhookStore) List(ctx context.Context) ([]*Webhook, error) {
+	return s.find(ctx, bson.M{})
+}
+
+func (s *mongoWebhookStore) ListTenant(ctx context.Context, tenant string) ([]*Webhook, error) {
+	// Webhooks of the default tenant have no tenant field.
+	return s.find(ctx, tenantScope{tenant: tenant, scoped: true}.filter(bson.M{}))
+}
+
+func (s *mongoWebhookStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.webhooks.DeleteOne(ctx, bson.M{"_id": id})
+	if err == nil && result.DeletedCount == 0 {
+		return ErrWebhookNotFound
+	}
+	return err
+}
+
+func (s *mongoWebhookStore) Enqueue(ctx context.Context, deliveries ...*Delivery) error {
+	documents := make([]interface{}, len(deliveries))
+	for i, delivery := range deliveries {
+		documents[i] = delivery
+	}
+	_, err := s.deliveries.InsertMany(ctx, documents)
+	return err
+}
+
+func (s *mongoWebhookStore) Claim(ctx context.Context, now time.Time, lease time.Duration) (*Delivery, error) {
+	filter := bson.M{"status": DeliveryPending, "next_attempt_at": bson.M{"$lte": now}}
+	update := bson.M{"$set": bson.M{"next_attempt_at": now.Add(lease)}}
+	opts := options.FindOneAndUpdate().SetSort(bson.D{{Key: "next_attempt_at", Value: 1}})
+
+	var delivery *Delivery
+	err := s.deliveries.FindOneAndUpdate(ctx, filter, update, opts).Decode(&delivery)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return delivery, err
+}
+
+func (s *mongoWebhookStore) Save(ctx context.Context, delivery *Delivery) error {
+	_, err := s.deliveries.ReplaceOne(ctx, bson.M{"_id": delivery.ID}, delivery)
+	return err
+}
+
+func (s *mongoWebhookStore) Deliveries(ctx context.Context, webhookID primitive.ObjectID, limit int) ([]*Delivery, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetLimit(int64(limit))
+	cur, err := s.deliveries.Find(ctx, bson.M{"webhook_id": webhookID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]*Delivery, 0)
+	err = cur.All(ctx, &deliveries)
+	return deliveries, err
+}
+
+type mongoIdempotencyStore struct {
+	coll *mongo.Collection
+}
+
+func newMongoIdempotencyStore(db *mongo.Database) (*mongoIdempotencyStore, error) {
+	store := &mongoIdempotencyStore{coll: db.Collection("idempotency_key")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := store.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "created_at", Value: 1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *mongoIdempotencyStore) Reserve(ctx context.Context, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	/*
+		The key being the _id, inserting fails if it is taken. Expired
+		records are replaced, given that nobody replaced them already.
+	*/
+	_, err := s.coll.InsertOne(ctx, record)
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, err
+	}
+
+	var existing *IdempotencyRecord
+	if err = s.coll.FindOne(ctx, bson.M{"_id": record.Key}).Decode(&existing); err != nil {
+		return nil, err
+	}
+	if !existing.expired(record.CreatedAt) {
+		return existing, nil
+	}
+	result, err := s.coll.ReplaceOne(ctx, bson.M{"_id": record.Key, "created_at": existing.CreatedAt}, record)
+	if err != nil || result.MatchedCount == 1 {
+		return nil, err
+	}
+	err = s.coll.FindOne(ctx, bson.M{"_id": record.Key}).Decode(&existing)
+	return existing, err
+}
+
+func (s *mongoIdempotencyStore) Complete(ctx context.Context, record *IdempotencyRecord) error {
+	_, err := s.coll.ReplaceOne(ctx, bson.M{"_id": record.Key}, record)
+	return err
+}
+
+func (s *mongoIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.coll.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
+
+func (s *mongoIdempotencyStore) Expire(ctx context.Context, before time.Time) error {
+	_, err := s.coll.DeleteMany(ctx, bson.M{"created_at": bson.M{"$lt": before}})
+	return err
+}
+
+type mongoAPIKeyStore struct {
+	coll *mongo.Collection
+}
+
+func newMongoAPIKeyStore(db *mongo.Database) (*mongoAPIKeyStore, error) {
+	store := &mongoAPIKeyStore{coll: db.Collection("api_key")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := store.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *mongoAPIKeyStore) Create(ctx context.Context, key *APIKey) error {
+	_, err := s.coll.InsertOne(ctx, key)
+	return err
+}
+
+func (s *mongoAPIKeyStore) Lookup(ctx context.Context, hash string) (*APIKey, error) {
+	var key *APIKey
+	err := s.coll.FindOne(ctx, bson.M{"hash": hash}).Decode(&key)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+func (s *mongoAPIKeyStore) List(ctx context.Context) ([]*APIKey, error) {
+	cur, err := s.coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]*APIKey, 0)
+	err = cur.All(ctx, &keys)
+	return keys, err
+}
+
+func (s *mongoAPIKeyStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	result, err := s.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err == nil && result.DeletedCount == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
+
+type mongoGrantStore struct {
+	coll *mongo.Collection
+}
+
+func newMongoGrantStore(db *mongo.Database) (*mongoGrantStore, error) {
+	store := &mongoGrantStore{coll: db.Collection("grant")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := store.coll.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "contract_id", Value: 1}, {Key: "subject", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "subject", Value: 1}, {Key: "role", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *mongoGrantStore) Put(ctx context.Context, grant *Grant) error {
+	filter := bson.M{"contract_id": grant.ContractID, "subject": grant.Subject}
+	_, err := s.coll.ReplaceOne(ctx, filter, grant, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *mongoGrantStore) Get(ctx context.Context, contractID primitive.ObjectID, subject string) (*Grant, error) {
+	var grant *Grant
+	err := s.coll.FindOne(ctx, bson.M{"contract_id": contractID, "subject": subject}).Decode(&grant)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrGrantNotFound
+	}
+	return grant, err
+}
+
+func (s *mongoGrantStore) List(ctx context.Context, contractID primitive.ObjectID) ([]*Grant, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "subject", Value: 1}})
+	cur, err := s.coll.Find(ctx, bson.M{"contract_id": contractID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	grants := make([]*Grant, 0)
+	err = cur.All(ctx, &grants)
+	return grants, err
+}
+
+func (s *mongoGrantStore) Denied(ctx context.Context, subject string) ([]primitive.ObjectID, error) {
+	ids, err := s.coll.Distinct(ctx, "contract_id", bson.M{"subject": subject, "role": RoleNone})
+	if err != nil {
+		return nil, err
+	}
+	denied := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		if id, ok := id.(primitive.ObjectID); ok {
+			denied = append(denied, id)
+		}
+	}
+	return denied, nil
+}
+
+func (s *mongoGrantStore) Delete(ctx context.Context, contractID primitive.ObjectID, subject string) error {
+	result, err := s.coll.DeleteOne(ctx, bson.M{"contract_id": contractID, "subject": subject})
+	if err == nil && result.DeletedCount == 0 {
+		return ErrGrantNotFound
+	}
+	return err
+}
+
+type mongoProposalStore struct {
+	coll *mongo.Collection
+}
+
+func newMongoProposalStore(db *mongo.Database) (*mongoProposalStore, error) {
+	store := &mongoProposalStore{coll: db.Collection("proposal")}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := store.coll.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "contract_id", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *mongoProposalStore) Insert(ctx context.Context, proposal *Proposal) error {
+	_, err := s.coll.InsertOne(ctx, proposal)
+	return err
+}
+
+func (s *mongoProposalStore) Get(ctx context.Context, contractID, id primitive.ObjectID) (*Proposal, error) {
+	var proposal *Proposal
+	err := s.coll.FindOne(ctx, bson.M{"_id": id, "contract_id": contractID}).Decode(&proposal)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrProposalNotFound
+	}
+	return proposal, err
+}
+
+func (s *mongoProposalStore) List(ctx context.Context, contractID primitive.ObjectID, status string) ([]*Proposal, error) {
+	filter := bson.M{"contract_id": contractID}
+	if status != "" {
+		filter["status"] = status
+	}
+	cur, err := s.coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	proposals := make([]*Proposal, 0)
+	err = cur.All(ctx, &proposals)
+	return proposals, err
+}
+
+func (s *mongoProposalStore) Decide(ctx context.Context, proposal *Proposal, from string) error {
+	filter := bson.M{"_id": proposal.ID, "contract_id": proposal.ContractID, "status": from}
+	result, err := s.coll.ReplaceOne(ctx, filter, proposal)
+	if err == nil && result.MatchedCount == 0 {
+		return ErrProposalDecided
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"testing"
+)
+
+func testMongoInstance(t *testing.T) *MongoInstance {
+	// MongoDB stores are only tested given TEST_MONGO_URI, each test
+	// in a database of its own which is dropped afterwards.
+	uri := os.Getenv("TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("TEST_MONGO_URI is not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	require.NoError(t, err)
+	db := client.Database("charlie_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		_ = db.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+	return &MongoInstance{Client: client, Database: db}
+}
+
+func TestMongoStore(t *testing.T) {
+	// Needs TEST_MONGO_URI to point to a replica set.
+	store, err := NewMongoStore(testMongoInstance(t))
+	require.NoError(t, err)
+	testContractStore(t, store)
+}
+
+func TestMongoQueryMeta(t *testing.T) {
+	query := func(field string) (bson.M, bool) {
+		condition, err := NewCondition(field, "eq", "gold")
+		require.NoError(t, err)
+		filter, _, exact := mongoQuery(ContractQuery{
+			IncludeDeleted: true, Filter: ContractFilter{Conditions: []Condition{condition}},
+		}, true)
+		return filter, exact
+	}
+
+	// Arrays holding the value don't match, as with Condition.Match.
+	filter, exact := query("meta.plan")
+	require.True(t, exact)
+	require.Equal(t, bson.M{"$and": bson.A{bson.M{"meta.plan": bson.M{
+		"$in":  bson.A{"gold"},
+		"$not": bson.M{"$type": "array"},
+	}}}}, filter)
+
+	// Nested paths are resolved through arrays, so they are checked again.
+	_, exact = query("meta.plan.tier")
+	require.False(t, exact)
+}
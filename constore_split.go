@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// branchDocument is a branch kept in its own document, along with
+// the fields needed to find it without loading the contract.
+type branchDocument struct {
+	Branch     `bson:",inline"`
+	ContractID primitive.ObjectID `bson:"contract_id"`
+	Position   int                `bson:"position"`
+	Replaced   bool               `bson:"replaced"`
+}
+
+type mongoSplitStore struct {
+	client      *mongo.Client
+	coll        *mongo.Collection
+	branches    *mongo.Collection
+	txOptions   *options.TransactionOptions
+	events      *mongoEventStore
+	grants      *mongoGrantStore
+	proposals   *mongoProposalStore
+	webhooks    *mongoWebhookStore
+	idempotency *mongoIdempotencyStore
+	apiKeys     *mongoAPIKeyStore
+	scope       tenantScope
+	databases   *tenantDatabases
+}
+
+func NewMongoSplitStore(mi *MongoInstance) (ContractStore, error) {
+	/*
+		A MongoDB store that keeps the branches of contracts in their own
+		collection rather than in the items of the contract document, so
+		that contracts with a long history don't hit the document size
+		limit and reads can load only the branches they need.
+
+		Updates touch both collections in a transaction, which requires
+		a replica set (or a sharded cluster).
+	*/
+	webhooks, err := newMongoWebhookStore(mi.Database)
+	if err != nil {
+		return nil, err
+	}
+	idempotency, err := newMongoIdempotencyStore(mi.Database)
+	if err != nil {
+		return nil, err
+	}
+	apiKeys, err := newMongoAPIKeyStore(mi.Database)
+	if err != nil {
+		return nil, err
+	}
+	store := &mongoSplitStore{
+		client:      mi.Client,
+		txOptions:   options.Transaction(),
+		webhooks:    webhooks,
+		idempotency: idempotency,
+		apiKeys:     apiKeys,
+		databases:   newTenantDatabases(mi),
+	}
+	if err = store.use(mi.Database); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *mongoSplitStore) use(db *mongo.Database) error {
+	// Keeps the contracts, their branches, events, grants and proposals
+	// in the given database.
+	events, err := newMongoEventStore(db)
+	if err != nil {
+		return err
+	}
+	if s.grants, err = newMongoGrantStore(db); err != nil {
+		return err
+	}
+	if s.proposals, err = newMongoProposalStore(db); err != nil {
+		return err
+	}
+	s.coll, s.branches, s.events = db.Collection("contract"), db.Collection("branch"), events
+	if err = createContractIndexes(s.coll, false); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err = s.branches.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "contract_id", Value: 1}, {Key: "position", Value: 1}}},
+		{Keys: bson.D{{Key: "contract_id", Value: 1}, {Key: "start_at", Value: 1}}},
+		{Keys: bson.D{{Key: "contract_id", Value: 1}, {Key: "end_at", Value: 1}}},
+		{Keys: bson.D{{Key: "contract_id", Value: 1}, {Key: "replaced", Value: 1}, {Key: "start_at", Value: 1}}},
+		// Boundaries are read in the order of these.
+		{Keys: bson.D{{Key: "replaced", Value: 1}, {Key: "start_at", Value: 1}, {Key: "contract_id", Value: 1}}},
+		{Keys: bson.D{{Key: "replaced", Value: 1}, {Key: "end_at", Value: 1}, {Key: "contract_id", Value: 1}}},
+	})
+	return err
+}
+
+func (s *mongoSplitStore) ForTenant(tenant string) (ContractStore, error) {
+	scoped := *s
+	scoped.scope = tenantScope{tenant: tenant, scoped: true}
+	if s.databases == nil || tenant == DefaultTenant {
+		return &scoped, nil
+	}
+	return s.databases.store(tenant, func(db *mongo.Database) (ContractStore, error) {
+		return &scoped, scoped.use(db)
+	})
+}
+
+func (s *mongoSplitStore) Events() EventStore {
+	return s.events
+}
+
+func (s *mongoSplitStore) Webhooks() WebhookStore {
+	return s.scope.webhooks(s.webhooks)
+}
+
+func (s *mongoSplitStore) Grants() GrantStore {
+	return s.grants
+}
+
+func (s *mongoSplitStore) Proposals() ProposalStore {
+	return s.proposals
+}
+
+func (s *mongoSplitStore) Idempotency() IdempotencyStore {
+	return s.idempotency
+}
+
+func (s *mongoSplitStore) APIKeys() APIKeyStore {
+	return s.scope.apiKeys(s.apiKeys)
+}
+
+func contractDocument(contract *Contract) bson.M {
+	document := bson.M{
+		"_id":        contract.ID,
+		"meta":       contract.Meta,
+		"version":    contract.Version,
+		"created_at": contract.CreatedAt,
+		"updated_at": contract.UpdatedAt,
+	}
+	if contract.Tenant != DefaultTenant {
+		document["tenant"] = contract.Tenant
+	}
+	return document
+}
+
+func newBranchDocument(contract *Contract, position int) *branchDocument {
+	branch := contract.Items[position]
+	return &branchDocument{
+		Branch:     *branch,
+		ContractID: contract.ID,
+		Position:   position,
+		Replaced:   len(branch.ReplacedBy) > 0,
+	}
+}
+
+func (s *mongoSplitStore) findBranches(ctx context.Context, filter bson.M) ([]*Branch, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "position", Value: 1}})
+	cur, err := s.branches.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	items := make([]*Branch, 0)
+	for cur.Next(ctx) {
+		var document branchDocument
+		if err = cur.Decode(&document); err != nil {
+			return nil, err
+		}
+		items = append(items, &document.Branch)
+	}
+	return items, cur.Err()
+}
+
+func (s *mongoSplitStore) getContract(ctx context.Context, id primitive.ObjectID) (*Contract, error) {
+	var contract *Contract
+	err := s.coll.FindOne(ctx, s.scope.filter(bson.M{"_id": id})).Decode(&contract)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	return contract, err
+}
+
+func (s *mongoSplitStore) Get(ctx context.Context, id primitive.ObjectID) (*Contract, error) {
+	contract, err := s.getContract(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	contract.Items, err = s.findBranches(ctx, bson.M{"contract_id": id})
+	return contract, err
+}
+
+func (s *mongoSplitStore) GetWindow(ctx context.Context, id primitive.ObjectID, window Window) (*Contract, error) {
+	contract, err := s.getContract(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{"contract_id": id}
+	if !window.From.IsZero() {
+		filter["end_at"] = bson.M{"$gt": window.From}
+	}
+	if !window.To.IsZero() {
+		filter["start_at"] = bson.M{"$lt": window.To}
+	}
+	if window.Active {
+		filter["replaced"] = false
+	}
+	if contract.Items, err = s.findBranches(ctx, filter); err != nil {
+		return nil, err
+	}
+
+	// Data references always point to the branch that holds the data,
+	// so a single lookup is enough to resolve them.
+	loaded := make(map[primitive.ObjectID]bool)
+	for _, item := range contract.Items {
+		loaded[item.ID] = true
+	}
+	var refs []primitive.ObjectID
+	for _, item := range contract.Items {
+		if ref, ok := item.Data["_ref"].(primitive.ObjectID); ok && !loaded[ref] {
+			loaded[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) > 0 {
+		referred, err := s.findBranches(ctx, bson.M{"contract_id": id, "_id": bson.M{"$in": refs}})
+		if err != nil {
+			return nil, err
+		}
+		contract.Items = append(contract.Items, referred...)
+	}
+	return contract, nil
+}
+
+type mongoSplitCursor struct {
+	mongoCursor
+	ctx   context.Context
+	store *mongoSplitStore
+	query ContractQuery
+}
+
+func (c mongoSplitCursor) Contract() (*Contract, error) {
+	contract, err := c.mongoCursor.Contract()
+	if err != nil || c.query.OmitItems {
+		return contract, err
+	}
+	contract.Items, err = c.store.findBranches(c.ctx, bson.M{"contract_id": contract.ID})
+	return contract, err
+}
+
+func (s *mongoSplitStore) changing(ctx context.Context, window Window) (bson.A, error) {
+	// IDs of the contracts having an active branch that
+	// starts or ends within the window.
+	ids, err := s.branches.Distinct(ctx, "contract_id", bson.M{"replaced": false, "$or": bson.A{
+		bson.M{"start_at": windowRange(window)},
+		bson.M{"end_at": windowRange(window)},
+	}})
+	if ids == nil {
+		ids = bson.A{}
+	}
+	return ids, err
+}
+
+func (s *mongoSplitStore) Find(ctx context.Context, query ContractQuery) (ContractCursor, error) {
+	var ids bson.A
+	if window := query.Filter.Changing; window != (Window{}) {
+		var err error
+		if ids, err = s.changing(ctx, window); err != nil {
+			return nil, err
+		}
+		query.Filter.Changing = Window{}
+	}
+
+	filter, opts, exact := mongoQuery(query, false)
+	if ids != nil {
+		filter = bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$in": ids}}}}
+	}
+	filter = s.scope.filter(filter)
+	cur, err := s.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if exact {
+		return mongoSplitCursor{mongoCursor: mongoCursor{cur}, ctx: ctx, store: s, query: query}, nil
+	}
+
+	// Load the branches only if they are needed for filtering.
+	broad := query
+	broad.OmitItems = query.OmitItems && !query.Filter.usesItems()
+	return filterCursor(mongoSplitCursor{mongoCursor: mongoCursor{cur}, ctx: ctx, store: s, query: broad}, query), nil
+}
+
+func (s *mongoSplitStore) List(ctx context.Context, query ContractQuery) ([]*Contract, error) {
+	cur, err := s.Find(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return collect(ctx, cur)
+}
+
+func (s *mongoSplitStore) Boundaries(ctx context.Context, query BoundaryQuery) ([]Boundary, error) {
+	/*
+		The starts and the ends of active branches are read in order
+		from their indexes, each up to the limit, then merged. Tenants
+		are not known to branches, so the boundaries of contracts of
+		other tenants are left for Get to tell apart.
+	*/
+	var boundaries []Boundary
+	for _, field := range []string{"start_at", "end_at"} {
+		filter := boundaryFilter(field, query)
+		filter["replaced"] = false
+		opts := options.Find().
+			SetSort(bson.D{{Key: field, Value: 1}, {Key: "contract_id", Value: 1}}).
+			SetProjection(bson.M{field: 1, "contract_id": 1})
+		if query.Limit > 0 {
+			opts.SetLimit(query.Limit)
+		}
+
+		cur, err := s.branches.Find(ctx, filter, opts)
+		if err != nil {
+			return nil, err
+		}
+		var documents []branchDocument
+		if err = cur.All(ctx, &documents); err != nil {
+			return nil, err
+		}
+		for _, document := range documents {
+			at := document.StartAt
+			if field == "end_at" {
+				at = document.EndAt
+			}
+			boundaries = append(boundaries, Boundary{At: at, ContractID: document.ContractID})
+		}
+	}
+	return orderBoundaries(boundaries, query.Limit), nil
+}
+
+func (s *mongoSplitStore) Insert(ctx context.Context, contracts []*Contract, events ...*Event) error {
+	/*
+		Contracts, their branches and events are inserted in a
+		transaction, so that no contract is ever stored without its
+		branches or events. Write errors abort transactions, so the
+		contracts that can't be inserted (those with an ID already
+		taken) are told beforehand.
+	*/
+	s.scope.claim(contracts)
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	var failed InsertErrors
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		failed = make(InsertErrors)
+		taken, err := takenIDs(sc, s.coll, contracts)
+		if err != nil {
+			return nil, err
+		}
+
+		var documents, branches []interface{}
+		inserted := make(map[primitive.ObjectID]bool)
+		for i, contract := range contracts {
+			if taken[contract.ID] {
+				failed[i] = fmt.Errorf("duplicate contract ID %s", contract.ID.Hex())
+				continue
+			}
+			taken[contract.ID], inserted[contract.ID] = true, true
+			documents = append(documents, contractDocument(contract))
+			for position := range contract.Items {
+				branches = append(branches, newBranchDocument(contract, position))
+			}
+		}
+		if len(documents) > 0 {
+			if _, err = s.coll.InsertMany(sc, documents); err != nil {
+				return nil, err
+			}
+		}
+		if len(branches) > 0 {
+			if _, err = s.branches.InsertMany(sc, branches); err != nil {
+				return nil, err
+			}
+		}
+		if recorded := insertedEvents(inserted, events); len(recorded) > 0 {
+			if err = s.events.Append(sc, recorded...); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}, s.txOptions)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+func (s *mongoSplitStore) Update(ctx context.Context, contract *Contract, event *Event) (*Contract, error) {
+	/*
+		Branches are only ever added or replaced, so instead of writing
+		every branch, the stored ones are compared by their replacement
+		state and only the new and newly replaced branches are written.
+	*/
+	session, err := s.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		filter := s.scope.filter(bson.M{"_id": contract.ID, "version": contract.Version})
+		if contract.Version == 0 {
+			filter["version"] = bson.M{"$in": bson.A{0, nil}}
+		}
+		update := bson.M{
+			"$set":         bson.M{"meta": contract.Meta, "deleted_at": contract.DeletedAt, "version": contract.Version + 1},
+			"$currentDate": bson.M{"updated_at": true},
+		}
+		result, err := s.coll.UpdateOne(sc, filter, update)
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			count, err := s.coll.CountDocuments(sc, s.scope.filter(bson.M{"_id": contract.ID}), options.Count().SetLimit(1))
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				return nil, ErrNotFound
+			}
+			return nil, ErrVersionConflict
+		}
+		if event != nil {
+			event.Sequence = contract.Version + 1
+			if err = s.events.Append(sc, event); err != nil {
+				return nil, err
+			}
+		}
+		return nil, s.writeBranches(sc, contract)
+	}, s.txOptions)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, contract.ID)
+}
+
+func (s *mongoSplitStore) writeBranches(ctx context.Context, contract *Contract) error {
+	opts := options.Find().SetProjection(bson.M{"replaced_by": 1})
+	cur, err := s.branches.Find(ctx, bson.M{"contract_id": contract.ID}, opts)
+	if err != nil {
+		return err
+	}
+
+	stored := make(map[primitive.ObjectID]int)
+	for cur.Next(ctx) {
+		var document struct {
+			ID         primitive.ObjectID   `bson:"_id"`
+			ReplacedBy []primitive.ObjectID `bson:"replaced_by"`
+		}
+		if err = cur.Decode(&document); err != nil {
+			_ = cur.Close(ctx)
+			return err
+		}
+		stored[document.ID] = len(document.ReplacedBy)
+	}
+	if err = cur.Close(ctx); err != nil {
+		return err
+	}
+
+	var models []mongo.WriteModel
+	for position, item := range contract.Items {
+		replaced, exists := stored[item.ID]
+		delete(stored, item.ID)
+		switch {
+		case !exists:
+			models = append(models, mongo.NewInsertOneModel().SetDocument(newBranchDocument(contract, position)))
+		case replaced != len(item.ReplacedBy):
+			models = append(models, mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"_id": item.ID}).
+				SetUpdate(bson.M{"$set": bson.M{
+					"replaced_by": item.ReplacedBy,
+					"replaced":    len(item.ReplacedBy) > 0,
+				}}))
+		}
+	}
+	// Whatever is left was removed from the contract.
+	for id := range stored {
+		models = append(models, mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": id}))
+	}
+
+	if len(models) == 0 {
+		return nil
+	}
+	_, err = s.branches.BulkWrite(ctx, models)
+	return err
+}
+
+func (s *mongoSplitStore) PatchMeta(
+	ctx context.Context, id primitive.ObjectID, patch MetaPatch, event *Event,
+) (*Contract, error) {
+	// Branches are not touched, the transaction only keeps the
+	// patch and its event together.
+	session, err := s.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.EndSession(ctx)
+
+	contract, err := session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		contract, err := patchContract(sc, s.coll, s.scope, id, patch)
+		if err != nil {
+			return nil, err
+		}
+		if event != nil {
+			event.Sequence, event.Payload.Meta = contract.Version, contract.Meta
+			if err = s.events.Append(sc, event); err != nil {
+				return nil, err
+			}
+		}
+		return contract, nil
+	}, s.txOptions)
+	if err != nil {
+		return nil, err
+	}
+	patched := contract.(*Contract)
+	patched.Items, err = s.findBranches(ctx, bson.M{"contract_id": id})
+	return patched, err
+}
+
+func (s *mongoSplitStore) Purge(ctx context.Context, before time.Time) (int64, error) {
+	purged, err := purgeDeleted(ctx, s.coll, s.scope, before, s.branches, s.events.coll, s.grants.coll, s.proposals.coll)
+	if err == nil && !s.scope.scoped && s.databases != nil {
+		var more int64
+		more, err = s.databases.purge(ctx, s, before)
+		purged += more
+	}
+	return purged, err
+}
+
+func (s *mongoSplitStore) Close(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return s.client.Disconnect(ctx)
+}
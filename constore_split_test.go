@@ -0,0 +1,13 @@
+package main
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMongoSplitStore(t *testing.T) {
+	// Needs TEST_MONGO_URI to point to a replica set.
+	store, err := NewMongoSplitStore(testMongoInstance(t))
+	require.NoError(t, err)
+	testContractStore(t, store)
+}
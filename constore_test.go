@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{"key": "world"}, ArbitraryData{})
+	venus, _ := contract.Branch(newDate(2022, 11, 10), time.Time{}, ArbitraryData{"key": "venus"})
+	mars, _ := contract.Branch(newDate(2023, 3, 10), newDate(2023, 4, 10), ArbitraryData{"key": "mars"})
+
+	ids := func(window Window) []primitive.ObjectID {
+		narrowed, err := cloneContract(contract)
+		require.NoError(t, err)
+
+		var ids []primitive.ObjectID
+		for _, item := range window.narrow(narrowed).Items {
+			ids = append(ids, item.ID)
+		}
+		return ids
+	}
+
+	require.Equal(t, []primitive.ObjectID{mars.ID},
+		ids(Window{From: newDate(2023, 3, 15), To: newDate(2023, 3, 20), Active: true}))
+
+	// The right split of venus refers to the replaced venus branch.
+	after := ids(Window{From: newDate(2023, 5, 1), Active: true})
+	require.Len(t, after, 2)
+	require.Equal(t, venus.ID, after[0])
+
+	require.Equal(t, []primitive.ObjectID{contract.Items[0].ID, contract.Items[1].ID},
+		ids(Window{To: newDate(2022, 11, 1)}))
+	require.Len(t, ids(Window{}), len(contract.Items))
+}
+
+func TestPurgeBefore(t *testing.T) {
+	before, err := purgeBefore("P30D", newDate(2023, 3, 31))
+	require.NoError(t, err)
+	require.Equal(t, newDate(2023, 3, 1), before)
+
+	_, err = purgeBefore("30 days", newDate(2023, 3, 31))
+	require.Error(t, err)
+}
+
+func testContractStore(t *testing.T, store ContractStore) {
+	// What every store does, whatever it keeps contracts in.
+	ctx := context.Background()
+
+	var contracts []*Contract
+	for i := 0; i < embeddedPageSize+5; i++ {
+		contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+		contracts = append(contracts, contract)
+	}
+	_, _ = contracts[0].Branch(newDate(2022, 11, 10), time.Time{}, ArbitraryData{"key": "venus"})
+	created := NewEvent(contracts[0], EventCreate, "", EventPayload{}, nil)
+	require.NoError(t, store.Insert(ctx, contracts, created))
+
+	stored, err := store.Get(ctx, contracts[0].ID)
+	require.NoError(t, err)
+	require.Len(t, stored.Items, 3)
+	for i, item := range contracts[0].Items {
+		require.Equal(t, item.ID, stored.Items[i].ID)
+		require.ElementsMatch(t, item.ReplacedBy, stored.Items[i].ReplacedBy)
+	}
+
+	// Contracts that can't be inserted are told apart from the others,
+	// and only the events of those inserted are recorded.
+	other, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+	err = store.Insert(ctx, []*Contract{contracts[0], other},
+		NewEvent(contracts[0], EventCreate, "", EventPayload{}, nil),
+		NewEvent(other, EventCreate, "", EventPayload{}, nil))
+	require.IsType(t, InsertErrors{}, err)
+	require.Len(t, err.(InsertErrors), 1)
+	require.Contains(t, err.(InsertErrors)[0].Error(), "duplicate")
+	stored, err = store.Get(ctx, other.ID)
+	require.NoError(t, err)
+	require.Len(t, stored.Items, 1)
+	contracts = append(contracts, other)
+
+	events, err := store.Events().List(ctx, contracts[0].ID, -1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.Equal(t, created.ID, events[0].ID)
+	events, err = store.Events().List(ctx, other.ID, -1)
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+
+	all, err := store.List(ctx, ContractQuery{OmitItems: true})
+	require.NoError(t, err)
+	require.Len(t, all, len(contracts))
+	require.Equal(t, contracts[len(contracts)-1].ID, all[0].ID)
+	require.Nil(t, all[0].Items)
+
+	page, err := store.List(ctx, ContractQuery{Cursor: contracts[3].ID, Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, page, 2)
+	require.Equal(t, contracts[2].ID, page[0].ID)
+	require.Equal(t, contracts[1].ID, page[1].ID)
+	require.Len(t, page[0].Items, 1)
+
+	contract := page[0]
+	contract.Meta = ArbitraryData{"name": "Lease"}
+	_, _ = contract.Branch(newDate(2023, 1, 1), time.Time{}, ArbitraryData{"key": "mars"})
+	event := NewEvent(contract, EventBranch, "", EventPayload{}, nil)
+	updated, err := store.Update(ctx, contract, event)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, updated.Version)
+	require.Equal(t, ArbitraryData{"name": "Lease"}, updated.Meta)
+	require.Len(t, updated.Items, 3)
+	require.EqualValues(t, 1, event.Sequence)
+
+	_, err = store.Update(ctx, contract, nil)
+	require.Equal(t, ErrVersionConflict, err)
+
+	event = NewEvent(updated, EventMeta, "", EventPayload{}, nil)
+	patched, err := store.PatchMeta(ctx, contract.ID, MetaPatch{Version: -1, Set: map[string]interface{}{"kind": "rent"}}, event)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, patched.Version)
+	require.Len(t, patched.Items, 3)
+	require.EqualValues(t, 2, event.Sequence)
+	require.Equal(t, ArbitraryData{"name": "Lease", "kind": "rent"}, event.Payload.Meta)
+
+	// A change is not stored if its event can't be recorded.
+	taken := NewEvent(patched, EventMeta, "", EventPayload{}, nil)
+	taken.Sequence = 3
+	require.NoError(t, store.Events().Append(ctx, taken))
+	patched.Meta = ArbitraryData{}
+	_, err = store.Update(ctx, patched, NewEvent(patched, EventMeta, "", EventPayload{}, nil))
+	require.Error(t, err)
+	_, err = store.PatchMeta(ctx, contract.ID, MetaPatch{Version: -1, Unset: []string{"name"}},
+		NewEvent(patched, EventMeta, "", EventPayload{}, nil))
+	require.Error(t, err)
+	stored, err = store.Get(ctx, contract.ID)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, stored.Version)
+	require.Equal(t, ArbitraryData{"name": "Lease", "kind": "rent"}, stored.Meta)
+
+	events, err = store.Events().List(ctx, contract.ID, -1)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	_, err = store.Get(ctx, primitive.NewObjectID())
+	require.Equal(t, ErrNotFound, err)
+	_, err = store.Update(ctx, &Contract{ID: primitive.NewObjectID()}, nil)
+	require.Equal(t, ErrNotFound, err)
+
+	// Boundaries are ordered by time and then by contract ID, a branch
+	// ending where another one starts making one of them.
+	boundaries, err := store.Boundaries(ctx, BoundaryQuery{Window: Window{From: newDate(2022, 11, 10), To: newDate(2022, 11, 11)}})
+	require.NoError(t, err)
+	require.Equal(t, []Boundary{{At: newDate(2022, 11, 10), ContractID: contracts[0].ID}}, boundaries)
+
+	ends := BoundaryQuery{Window: Window{From: newDate(2023, 10, 10), To: newDate(2023, 10, 11)}, Limit: 3}
+	boundaries, err = store.Boundaries(ctx, ends)
+	require.NoError(t, err)
+	require.Len(t, boundaries, 3)
+	require.True(t, boundaries[1].after(boundaries[0]))
+	require.True(t, boundaries[2].after(boundaries[1]))
+	ends.After = &boundaries[2]
+	more, err := store.Boundaries(ctx, ends)
+	require.NoError(t, err)
+	require.Len(t, more, 3)
+	require.True(t, more[0].after(boundaries[2]))
+
+	// Meta conditions match the same contracts whichever store filters.
+	var tagged []*Contract
+	for _, meta := range []ArbitraryData{
+		{"tag": "gold"},
+		{"tag": []interface{}{"gold", "silver"}},
+		{"plan": map[string]interface{}{"tier": "gold"}},
+		{"plan": []interface{}{map[string]interface{}{"tier": "gold"}}},
+		{"tag": int32(10)},
+	} {
+		contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, meta)
+		tagged = append(tagged, contract)
+	}
+	require.NoError(t, store.Insert(ctx, tagged))
+	filtered := func(field, op string, values ...string) []primitive.ObjectID {
+		condition, err := NewCondition(field, op, values...)
+		require.NoError(t, err)
+		found, err := store.List(ctx, ContractQuery{Filter: ContractFilter{Conditions: []Condition{condition}}, Limit: 10})
+		require.NoError(t, err)
+		ids := make([]primitive.ObjectID, 0)
+		for _, contract := range found {
+			ids = append(ids, contract.ID)
+		}
+		return ids
+	}
+	require.Equal(t, []primitive.ObjectID{tagged[0].ID}, filtered("meta.tag", "eq", "gold"))
+	require.Equal(t, []primitive.ObjectID{tagged[4].ID, tagged[0].ID}, filtered("meta.tag", "in", "silver", "gold", "10"))
+	require.Equal(t, []primitive.ObjectID{tagged[2].ID}, filtered("meta.plan.tier", "eq", "gold"))
+
+	// Excluded contracts are left out of every listing.
+	condition, _ := NewCondition("meta.tag", "in", "silver", "gold", "10")
+	found, err := store.List(ctx, ContractQuery{Filter: ContractFilter{
+		Conditions: []Condition{condition}, Exclude: []primitive.ObjectID{tagged[0].ID},
+	}})
+	require.NoError(t, err)
+	require.Len(t, found, 1)
+	require.Equal(t, tagged[4].ID, found[0].ID)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"strings"
+	"time"
+)
+
+// TimelineOptions controls the output of Contract.TimelineSVG.
+type TimelineOptions struct {
+	Width    int       // Width of the image in pixels.
+	From, To time.Time // Visible date range, defaults to the bounds of all items.
+}
+
+const (
+	defaultTimelineWidth = 800
+	svgLabelWidth        = 90
+	svgMargin            = 12
+	svgAxisHeight        = 32
+	svgRowHeight         = 24
+	svgBarHeight         = 14
+)
+
+func svgEscape(s string) string {
+	var b bytes.Buffer
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+type svgTick struct {
+	at    time.Time
+	label string
+}
+
+func timelineTicks(from, to time.Time) []svgTick {
+	// Picks a tick interval that gives a readable amount of ticks
+	// for the given range, aligned to calendar boundaries.
+	span := to.Sub(from)
+	next, layout := func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }, "Jan 2"
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch {
+	case span > 4*365*day:
+		next, layout = func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }, "2006"
+		start = time.Date(from.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	case span > 120*day:
+		next, layout = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }, "Jan 2006"
+		start = time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case span > 21*day:
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+	}
+
+	var ticks []svgTick
+	for t := start; !t.After(to); t = next(t) {
+		if !t.Before(from) {
+			ticks = append(ticks, svgTick{at: t, label: t.Format(layout)})
+		}
+	}
+	return ticks
+}
+
+func (c *Contract) TimelineSVG(w io.Writer, opts TimelineOptions) error {
+	/*
+		Renders the items of the contract as horizontal bars on a date
+		axis, one row per branch. Active branches are drawn solid while
+		replaced ones are faded and outlined with a dashed stroke. When a
+		branch refers to the data of another one, a dashed connector is
+		drawn from the referenced branch.
+	*/
+	width := opts.Width
+	if width <= 0 {
+		width = defaultTimelineWidth
+	}
+
+	from, to := opts.From, opts.To
+	for _, item := range c.Items {
+		if opts.From.IsZero() && (from.IsZero() || item.StartAt.Before(from)) {
+			from = item.StartAt
+		}
+		if opts.To.IsZero() && item.EndAt.After(to) {
+			to = item.EndAt
+		}
+	}
+	if !to.After(from) {
+		return fmt.Errorf("the visible range of the timeline would span nothing (%s - %s)", from, to)
+	}
+
+	plot := float64(width - svgLabelWidth - 2*svgMargin)
+	x := func(t time.Time) float64 {
+		ratio := float64(t.Sub(from)) / float64(to.Sub(from))
+		ratio = minFloat(1, maxFloat(0, ratio))
+		return svgLabelWidth + svgMargin + ratio*plot
+	}
+	y := func(row int) float64 {
+		return svgAxisHeight + float64(row)*svgRowHeight + (svgRowHeight-svgBarHeight)/2
+	}
+	height := svgAxisHeight + len(c.Items)*svgRowHeight + svgMargin
+
+	var b strings.Builder
+	_, _ = fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" `+
+		`font-family="sans-serif" font-size="11">`+"\n", width, height, width, height)
+	b.WriteString(`<style>.active{fill:#3b7dd8}.replaced{fill:#c9ced6;fill-opacity:.6;stroke:#8a929e;` +
+		`stroke-dasharray:3 2}.ref{fill:none;stroke:#e0823d;stroke-dasharray:4 3}.tick{stroke:#e3e6ea}` +
+		`.label{fill:#333}</style>` + "\n")
+
+	for _, tick := range timelineTicks(from, to) {
+		tx := x(tick.at)
+		_, _ = fmt.Fprintf(&b, `<line class="tick" x1="%.1f" y1="%d" x2="%.1f" y2="%d"/>`+"\n",
+			tx, svgAxisHeight-6, tx, height-svgMargin)
+		_, _ = fmt.Fprintf(&b, `<text class="label" x="%.1f" y="%d" text-anchor="middle">%s</text>`+"\n",
+			tx, svgAxisHeight-10, svgEscape(tick.label))
+	}
+
+	rows := make(map[primitive.ObjectID]int, len(c.Items))
+	for i, item := range c.Items {
+		rows[item.ID] = i
+	}
+
+	for i, item := range c.Items {
+		class := "active"
+		if len(item.ReplacedBy) > 0 {
+			class = "replaced"
+		}
+
+		x1, x2 := x(item.StartAt), x(item.EndAt)
+		title := fmt.Sprintf("%s\n%s - %s (%s)\n%s", item.ID.Hex(),
+			item.StartAt.Format(time.RFC3339), item.EndAt.Format(time.RFC3339),
+			duration(item.Span()), summarizeData(c.ResolveData(item)))
+
+		_, _ = fmt.Fprintf(&b, `<text class="label" x="%d" y="%.1f">%d %s</text>`+"\n",
+			svgMargin, y(i)+svgBarHeight-3, i, shortID(item.ID))
+		if !item.EndAt.After(from) || !item.StartAt.Before(to) {
+			continue
+		}
+		_, _ = fmt.Fprintf(&b, `<rect class="%s" x="%.1f" y="%.1f" width="%.1f" height="%d" rx="2">`+
+			`<title>%s</title></rect>`+"\n",
+			class, x1, y(i), maxFloat(1, x2-x1), svgBarHeight, svgEscape(title))
+	}
+
+	for i, item := range c.Items {
+		ref, ok := item.Data["_ref"].(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		source, ok := rows[ref]
+		if !ok {
+			continue
+		}
+		// Connect the bottom (or top) of the referenced bar to the
+		// start of the branch that refers to it.
+		sx, tx := x(maxDate(c.Items[source].StartAt, item.StartAt)), x(item.StartAt)
+		sy, ty := y(source)+svgBarHeight, y(i)
+		if source > i {
+			sy, ty = y(source), y(i)+svgBarHeight
+		}
+		_, _ = fmt.Fprintf(&b, `<path class="ref" d="M%.1f %.1f C%.1f %.1f %.1f %.1f %.1f %.1f"/>`+"\n",
+			sx, sy, sx, (sy+ty)/2, tx, (sy+ty)/2, tx, ty)
+	}
+	b.WriteString("</svg>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
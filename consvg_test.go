@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/xml"
+	"github.com/stretchr/testify/require"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func svgElements(t *testing.T, svg string) map[string][]xml.StartElement {
+	elements := make(map[string][]xml.StartElement)
+	decoder := xml.NewDecoder(strings.NewReader(svg))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return elements
+		}
+		require.NoError(t, err)
+		if element, ok := token.(xml.StartElement); ok {
+			elements[element.Name.Local] = append(elements[element.Name.Local], element)
+		}
+	}
+}
+
+func svgClasses(elements []xml.StartElement) []string {
+	var classes []string
+	for _, element := range elements {
+		for _, attr := range element.Attr {
+			if attr.Name.Local == "class" {
+				classes = append(classes, attr.Value)
+			}
+		}
+	}
+	return classes
+}
+
+func TestContract_TimelineSVG(t *testing.T) {
+	startAt, endAt := newDate(2022, 10, 10), newDate(2023, 10, 10)
+
+	contract, _ := NewContract(startAt, endAt, ArbitraryData{"key": "<world>"}, nil)
+	_, _ = contract.Branch(startAt.Add(time.Hour*24*30), startAt.Add(time.Hour*24*60), ArbitraryData{"key": "venus"})
+
+	var b strings.Builder
+	require.NoError(t, contract.TimelineSVG(&b, TimelineOptions{Width: 600}))
+
+	elements := svgElements(t, b.String())
+	require.Equal(t, "600", elements["svg"][0].Attr[1].Value)
+	require.Equal(t, []string{"replaced", "active", "active", "active"}, svgClasses(elements["rect"]))
+	require.Equal(t, []string{"ref", "ref"}, svgClasses(elements["path"]))
+	require.Contains(t, b.String(), "key: &lt;world&gt;")
+
+	// Monthly ticks for a year long contract.
+	require.Contains(t, b.String(), ">Nov 2022</text>")
+	require.Contains(t, b.String(), ">Oct 2023</text>")
+}
+
+func TestContract_TimelineSVGRange(t *testing.T) {
+	startAt, endAt := newDate(2022, 10, 10), newDate(2023, 10, 10)
+
+	contract, _ := NewContract(startAt, endAt, ArbitraryData{"key": "world"}, nil)
+	_, _ = contract.Branch(startAt.Add(time.Hour*24*30), time.Time{}, ArbitraryData{"key": "venus"})
+
+	var b strings.Builder
+	err := contract.TimelineSVG(&b, TimelineOptions{From: newDate(2022, 10, 10), To: newDate(2022, 10, 20)})
+	require.NoError(t, err)
+
+	// The new branch starts after the visible range.
+	elements := svgElements(t, b.String())
+	require.Equal(t, []string{"replaced", "active"}, svgClasses(elements["rect"]))
+	require.Contains(t, b.String(), ">Oct 10</text>")
+
+	err = contract.TimelineSVG(&b, TimelineOptions{From: newDate(2022, 10, 20), To: newDate(2022, 10, 10)})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "would span nothing")
+}
@@ -1,160 +1,1578 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/gofiber/fiber/v2"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"io"
+	"log"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// ContractPayload creates a contract, which ends either at EndAt or
+// after its Term.
+type ContractPayload struct {
+	StartAt time.Time     `json:"start_at" validate:"required"`
+	EndAt   *RelativeTime `json:"end_at" validate:"required_without=Term,excluded_with=Term"`
+	Term    *Duration     `json:"term" validate:"required_without=EndAt,excluded_with=EndAt"`
+	Meta    fiber.Map     `json:"meta" validate:"required"`
+	Data    fiber.Map     `json:"data" validate:"required"`
+}
+
 func (h *Handler) CreateContract(c *fiber.Ctx) error {
-	payload := new(struct {
-		StartAt time.Time `json:"start_at" validate:"required"`
-		EndAt   time.Time `json:"end_at" validate:"required"`
-		Meta    fiber.Map `json:"meta" validate:"required"`
-		Data    fiber.Map `json:"data" validate:"required"`
-	})
+	payload := new(ContractPayload)
 
 	if err := c.BodyParser(&payload); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": err.Error()})
+		return invalidBody(err)
 	}
 
-	if fieldErrors := h.validateStruct(payload); fieldErrors != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fieldErrors)
+	if err := h.validateStruct(payload); err != nil {
+		return err
 	}
 
-	contract, err := NewContract(payload.StartAt, payload.EndAt, payload.Data, payload.Meta)
+	endAt := resolveEnd(payload.StartAt, payload.EndAt, payload.Term)
+	contract, err := NewContract(payload.StartAt, endAt, payload.Data, payload.Meta)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": err.Error()})
+		return err
 	}
 	contract.UpdatedAt = time.Now().UTC()
+	attribute(contract.Items, actor(c))
 
-	coll := h.database.Collection("contract")
-	if _, err := coll.InsertOne(context.TODO(), contract); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": err.Error()})
+	event := NewEvent(contract, EventCreate, actor(c), EventPayload{
+		StartAt: &payload.StartAt, EndAt: &endAt, Data: payload.Data, Meta: payload.Meta,
+	}, contract.Items)
+	if err = storeOf(c).Insert(context.TODO(), []*Contract{contract}, event); err != nil {
+		return err
 	}
+	h.notify(c, contract, event)
+	c.Set(fiber.HeaderETag, etag(contract))
 	return c.Status(201).JSON(contract)
 }
 
-func getContract(mc *mongo.Collection, c *fiber.Ctx) (*Contract, error) {
-	id := c.Params("id")
+func paramID(c *fiber.Ctx, key string) (primitive.ObjectID, error) {
+	objectID, err := primitive.ObjectIDFromHex(c.Params(key))
+	if err != nil {
+		return objectID, fmt.Errorf("%w: %q", ErrInvalidID, c.Params(key))
+	}
+	return objectID, nil
+}
+
+func contractID(c *fiber.Ctx) (primitive.ObjectID, error) {
+	return paramID(c, "id")
+}
+
+func includeDeleted(c *fiber.Ctx) bool {
+	return c.Query("include_deleted") == "true"
+}
+
+func visible(contract *Contract, err error, includeDeleted bool) (*Contract, error) {
+	// Deleted contracts are only visible when asked for.
+	if err == nil && contract.DeletedAt != nil && !includeDeleted {
+		return nil, ErrNotFound
+	}
+	return contract, err
+}
 
-	objectID, err := primitive.ObjectIDFromHex(id)
+func (h *Handler) findContract(c *fiber.Ctx, includeDeleted bool) (*Contract, error) {
+	objectID, err := contractID(c)
 	if err != nil {
 		return nil, err
 	}
+	contract, err := storeOf(c).Get(context.TODO(), objectID)
+	return visible(contract, err, includeDeleted)
+}
 
-	var contract *Contract
-	filter := bson.M{"_id": objectID}
-	err = mc.FindOne(context.TODO(), filter).Decode(&contract)
+func (h *Handler) getContract(c *fiber.Ctx) (*Contract, error) {
+	return h.findContract(c, includeDeleted(c))
+}
 
+func (h *Handler) getContractWindow(c *fiber.Ctx, window Window) (*Contract, error) {
+	// Same as getContract, for views that only need some of the branches.
+	objectID, err := contractID(c)
 	if err != nil {
 		return nil, err
 	}
-	return contract, nil
+	contract, err := storeOf(c).GetWindow(context.TODO(), objectID, window)
+	return visible(contract, err, includeDeleted(c))
+}
+
+var errPreconditionFailed = errors.New("the contract does not match the If-Match header")
+
+func etag(contract *Contract) string {
+	return strconv.Quote(strconv.FormatInt(contract.Version, 10))
+}
+
+func ifMatch(c *fiber.Ctx, contract *Contract) bool {
+	header := c.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		return true
+	}
+	current := etag(contract)
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+func actor(c *fiber.Ctx) string {
+	// Whoever made the request: the authenticated principal, or
+	// as told by the client if authentication is not enabled.
+	if principal := principalOf(c); principal != nil {
+		return principal.Subject
+	}
+	return c.Get("X-Actor")
+}
+
+func (h *Handler) notify(c *fiber.Ctx, contract *Contract, event *Event) {
+	/*
+		Queues deliveries for the webhooks interested in the event.
+		The change and its event are already stored at this point,
+		so failures are logged rather than failing the request.
+	*/
+	ctx, store := context.TODO(), storeOf(c)
+	webhooks, err := store.Webhooks().List(ctx)
+	if err != nil {
+		log.Printf("could not list webhooks: %s", err)
+		return
+	}
+	var deliveries []*Delivery
+	for _, webhook := range webhooks {
+		if !webhook.Matches(event, contract) {
+			continue
+		}
+		delivery, err := NewDelivery(webhook, event, contract)
+		if err != nil {
+			log.Printf("could not create delivery for webhook %s: %s", webhook.ID.Hex(), err)
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if len(deliveries) > 0 {
+		if err = store.Webhooks().Enqueue(ctx, deliveries...); err != nil {
+			log.Printf("could not queue webhook deliveries: %s", err)
+		}
+	}
+}
+
+func (h *Handler) updateContract(
+	c *fiber.Ctx, kind string,
+	apply func(*Contract) (EventPayload, error), overlaps func(base, current *Contract) bool,
+) (*Contract, error) {
+	/*
+		Applies a change to the requested contract and stores it, given
+		that nobody else changed the contract in the meantime. When that
+		happens, the change is applied again to the fresh contract (up to
+		MergeRetries times) provided that the concurrent changes do not
+		overlap with it. Clients that sent If-Match expect a particular
+		version, so their changes are never merged.
+
+		Changes are stored along with their event.
+	*/
+	// Deleted contracts can only be restored.
+	contract, err := h.findContract(c, kind == EventRestore)
+	if err != nil {
+		return nil, err
+	}
+	if !ifMatch(c, contract) {
+		return nil, errPreconditionFailed
+	}
+
+	for attempt := 0; ; attempt++ {
+		base, err := cloneContract(contract)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := apply(contract)
+		if err != nil {
+			return nil, err
+		}
+		var created []*Branch
+		for _, item := range contract.Items {
+			if !base.Contains(item) {
+				item.CreatedBy = actor(c)
+				created = append(created, item)
+			}
+		}
+
+		event := NewEvent(contract, kind, actor(c), payload, created)
+		updated, err := storeOf(c).Update(context.TODO(), contract, event)
+		if err == nil {
+			h.notify(c, updated, event)
+		}
+		if !errors.Is(err, ErrVersionConflict) || attempt >= h.mergeRetries || c.Get(fiber.HeaderIfMatch) != "" {
+			return updated, err
+		}
+
+		// The contract may have been deleted in the meantime.
+		contract, err = storeOf(c).Get(context.TODO(), contract.ID)
+		if contract, err = visible(contract, err, kind == EventRestore); err != nil {
+			return nil, err
+		}
+		if overlaps(base, contract) {
+			return nil, ErrVersionConflict
+		}
+	}
 }
 
 func (h *Handler) GetContract(c *fiber.Ctx) error {
-	coll := h.database.Collection("contract")
-	contract, err := getContract(coll, c)
+	contract, err := h.getContract(c)
 	if err != nil {
-		return c.SendStatus(fiber.StatusNotFound)
+		return err
 	}
+	c.Set(fiber.HeaderETag, etag(contract))
 	return c.JSON(contract)
 }
 
-func (h *Handler) UpdateContract(c *fiber.Ctx) error {
-	objectID, err := primitive.ObjectIDFromHex(c.Params("id"))
+func ifMatchVersion(c *fiber.Ctx) (int64, bool) {
+	// The version required by the If-Match header, negative if any
+	// version would do. False if it requires one of many versions.
+	header := strings.TrimSpace(c.Get(fiber.HeaderIfMatch))
+	if header == "" || header == "*" {
+		return -1, true
+	}
+	unquoted, err := strconv.Unquote(header)
 	if err != nil {
-		return c.SendStatus(fiber.StatusNotFound)
+		return 0, false
+	}
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	return version, err == nil
+}
+
+func (h *Handler) patchContract(
+	c *fiber.Ctx, patch MetaPatch, translated bool, apply func(doc interface{}) (interface{}, error),
+) error {
+	/*
+		Patches are made in place by the store when they can be, so
+		that clients changing different parts of the meta don't get in
+		the way of each other. Otherwise, or if the stored contract does
+		not satisfy the conditions of the patch, it is applied to the
+		contract as any other change, which also tells what went wrong.
+	*/
+	if version, ok := ifMatchVersion(c); translated && ok {
+		id, err := contractID(c)
+		if err != nil {
+			return err
+		}
+		patch.Version = version
+		event := NewEvent(&Contract{ID: id}, EventMeta, actor(c), EventPayload{}, nil)
+		document, err := storeOf(c).PatchMeta(context.TODO(), id, patch, event)
+		if err == nil {
+			h.notify(c, document, event)
+			c.Set(fiber.HeaderETag, etag(document))
+			return c.JSON(document)
+		}
+		if err != ErrPatchNotApplied {
+			return err
+		}
 	}
 
-	payload := new(struct {
-		Meta fiber.Map `json:"meta" validate:"required"`
+	document, err := h.updateContract(c, EventMeta, func(contract *Contract) (EventPayload, error) {
+		meta, err := patchMeta(contract.Meta, apply)
+		if errors.Is(err, errPatchTestFailed) {
+			return EventPayload{}, err
+		} else if err != nil {
+			return EventPayload{}, NewProblem(fiber.StatusConflict, "patch_not_applicable", err.Error())
+		}
+		contract.Meta = meta
+		return EventPayload{Meta: meta}, nil
+	}, func(base, current *Contract) bool {
+		// Patches apply to whatever the meta is by then,
+		// their tests make sure that it is as expected.
+		return false
 	})
-	if err = c.BodyParser(&payload); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": err.Error()})
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderETag, etag(document))
+	return c.JSON(document)
+}
+
+// MetaPayload replaces the meta of a contract.
+type MetaPayload struct {
+	Meta fiber.Map `json:"meta" validate:"required"`
+}
+
+func (h *Handler) UpdateContract(c *fiber.Ctx) error {
+	/*
+		Replaces the meta, or patches it given a JSON Patch (RFC 6902)
+		or a JSON Merge Patch (RFC 7386) along with their content types.
+		Patches are relative to the contract, e.g. "/meta/plan" or
+		{"meta": {"plan": "gold"}}, but only meta can be patched.
+	*/
+	switch strings.TrimSpace(strings.SplitN(c.Get(fiber.HeaderContentType), ";", 2)[0]) {
+	case "application/json-patch+json":
+		ops, err := ParseJSONPatch(c.Body())
+		if err != nil {
+			return NewProblem(fiber.StatusUnprocessableEntity, "invalid_patch", err.Error())
+		}
+		patch, translated := TranslateJSONPatch(ops)
+		return h.patchContract(c, patch, translated, func(doc interface{}) (interface{}, error) {
+			return applyJSONPatch(doc, ops)
+		})
+	case "application/merge-patch+json":
+		var merge map[string]interface{}
+		if err := json.Unmarshal(c.Body(), &merge); err != nil {
+			return invalidBody(err)
+		}
+		meta, ok := merge["meta"].(map[string]interface{})
+		if len(merge) != 1 || !ok {
+			return NewProblem(fiber.StatusUnprocessableEntity, "invalid_patch",
+				"a merge patch must only have meta, which must be an object.")
+		}
+		patch, translated := TranslateMergePatch(meta)
+		return h.patchContract(c, patch, translated, func(doc interface{}) (interface{}, error) {
+			return applyMergePatch(doc, merge), nil
+		})
 	}
 
-	if fieldErrors := h.validateStruct(payload); fieldErrors != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fieldErrors)
+	payload := new(MetaPayload)
+	if err := c.BodyParser(&payload); err != nil {
+		return invalidBody(err)
 	}
 
-	coll := h.database.Collection("contract")
-	filter := bson.M{"_id": objectID}
-	update := bson.M{"$set": bson.M{"meta": payload.Meta}, "$currentDate": bson.M{"updated_at": true}}
-	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := h.validateStruct(payload); err != nil {
+		return err
+	}
 
-	var document *Contract
-	if err = coll.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&document); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+	document, err := h.updateContract(c, EventMeta, func(contract *Contract) (EventPayload, error) {
+		contract.Meta = payload.Meta
+		return EventPayload{Meta: payload.Meta}, nil
+	}, func(base, current *Contract) bool {
+		// Meta is replaced as a whole, concurrent changes
+		// to the items are fine.
+		return !reflect.DeepEqual(base.Meta, current.Meta)
+	})
+	if err != nil {
+		return err
 	}
+	c.Set(fiber.HeaderETag, etag(document))
 	return c.JSON(document)
 }
 
-func (h *Handler) ListContracts(c *fiber.Ctx) error {
-	var filter bson.M
+var sortFields = map[string]bool{"_id": true, "created_at": true, "updated_at": true}
+
+func encodeCursor(contract *Contract, query ContractQuery) string {
+	// Cursors of queries ordered by a time also hold the time
+	// of the contract, in milliseconds as that is what is stored.
+	if query.byID() {
+		return contract.ID.Hex()
+	}
+	return fmt.Sprintf("%d_%s", sortValue(contract, query.Sort).UnixMilli(), contract.ID.Hex())
+}
+
+func decodeCursor(cursor string, query *ContractQuery) error {
+	invalid := fmt.Errorf("cursor is invalid for this ordering")
+	if !query.byID() {
+		value, id, found := strings.Cut(cursor, "_")
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if !found || err != nil {
+			return invalid
+		}
+		query.CursorValue, cursor = time.UnixMilli(millis).UTC(), id
+	}
+
+	var err error
+	if query.Cursor, err = primitive.ObjectIDFromHex(cursor); err != nil {
+		return invalid
+	}
+	return nil
+}
+
+func listFilter(c *fiber.Ctx) (ContractFilter, error) {
+	/*
+		Builds the filter from query parameters such as "meta.plan=gold",
+		"meta.seats[gte]=10", "meta.plan[in]=gold,silver" or
+		"created_at[lt]=2023-01-01". Data conditions ("data.price[gt]=10")
+		apply to the data in effect at "data_at", the current time by
+		default. "active_at" selects contracts in effect at that time.
+	*/
+	var filter ContractFilter
+	var err error
+
+	for key, target := range map[string]*time.Time{"active_at": &filter.ActiveAt, "data_at": &filter.DataAt} {
+		if value := c.Query(key); value != "" {
+			if *target, err = parseTime(value); err != nil {
+				return filter, fmt.Errorf("%s must be a date or an RFC 3339 timestamp", key)
+			}
+		}
+	}
+
+	var keys []string
+	c.Context().QueryArgs().VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		field, op := key, "eq"
+		if open := strings.IndexByte(key, '['); open > 0 && strings.HasSuffix(key, "]") {
+			field, op = key[:open], key[open+1:len(key)-1]
+		}
+		switch field {
+		case "created_at", "updated_at", "start_at", "end_at":
+		default:
+			if !strings.HasPrefix(field, "meta.") && !strings.HasPrefix(field, "data.") {
+				continue
+			}
+		}
+
+		values := []string{c.Query(key)}
+		if op == "in" {
+			values = splitQuery(c, key)
+		}
+		condition, err := NewCondition(field, op, values...)
+		if err != nil {
+			return filter, fmt.Errorf("%s: %s", key, err)
+		}
+		filter.Conditions = append(filter.Conditions, condition)
+	}
+	return filter, nil
+}
+
+func listQuery(c *fiber.Ctx) (ContractQuery, error) {
+	var query ContractQuery
+	var err error
+
+	order := c.Query("sort", "-_id")
+	query.Sort = strings.TrimPrefix(order, "-")
+	query.Ascending = !strings.HasPrefix(order, "-")
+	if !sortFields[query.Sort] {
+		return query, fmt.Errorf("sort must be one of _id, created_at or updated_at, optionally prefixed with -")
+	}
+
+	if value := c.Query("limit"); value != "" {
+		if query.Limit, err = strconv.ParseInt(value, 10, 64); err != nil || query.Limit < 1 {
+			return query, fmt.Errorf("limit must be a positive integer")
+		}
+	}
 	if cursor := c.Query("cursor"); cursor != "" {
-		objectID, err := primitive.ObjectIDFromHex(cursor)
-		if err == nil {
-			// $lt since the query is ordered by {_id, -1}
-			filter = bson.M{"_id": bson.M{"$lt": objectID}}
+		if err = decodeCursor(cursor, &query); err != nil {
+			return query, err
 		}
 	}
+	query.IncludeDeleted = includeDeleted(c)
+	query.Filter, err = listFilter(c)
+	return query, err
+}
 
-	opts := options.Find().
-		SetProjection(bson.D{{Key: "items", Value: 0}}).
-		SetLimit(10).
-		SetSort(bson.D{{Key: "_id", Value: -1}})
+const (
+	defaultListLimit = 10
+	maxListLimit     = 100
+)
 
-	collection := h.database.Collection("contract")
-	cur, err := collection.Find(context.TODO(), filter, opts)
+func (h *Handler) ListContracts(c *fiber.Ctx) error {
+	query, err := listQuery(c)
+	if err != nil {
+		return invalidParameter(err.Error())
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultListLimit
+	}
+	if query.Limit > maxListLimit {
+		return invalidParameter(fmt.Sprintf("limit must be at most %d", maxListLimit))
+	}
+	query.OmitItems = true
+	if err = excludeDenied(c, &query.Filter); err != nil {
+		return err
+	}
 
-	contracts := make([]fiber.Map, 0)
-	if err = cur.All(context.TODO(), &contracts); err != nil {
-		return c.SendStatus(fiber.StatusInternalServerError)
+	contracts, err := storeOf(c).List(context.TODO(), query)
+	if err != nil {
+		return err
 	}
 
-	results := fiber.Map{"results": contracts}
-	return c.JSON(results)
+	// A full page might be followed by more.
+	var next *string
+	if len(contracts) > 0 && int64(len(contracts)) == query.Limit {
+		cursor := encodeCursor(contracts[len(contracts)-1], query)
+		next = &cursor
+	}
+	return c.JSON(fiber.Map{"results": contracts, "next": next})
+}
+
+const defaultChangeDays = 30
+
+func (h *Handler) ListChanges(c *fiber.Ctx) error {
+	/*
+		Lists where active branches start or end across all contracts
+		matched by the listing filter, from "from" (the current time by
+		default) until "to" (30 days later by default). Pages work like
+		those of ListContracts.
+	*/
+	var query ChangeQuery
+	var err error
+
+	query.Window.From = time.Now().UTC()
+	for key, target := range map[string]*time.Time{"from": &query.Window.From, "to": &query.Window.To} {
+		if value := c.Query(key); value != "" {
+			if *target, err = parseTime(value); err != nil {
+				return invalidParameter(fmt.Sprintf("%s must be a date or an RFC 3339 timestamp.", key))
+			}
+		}
+	}
+	if query.Window.To.IsZero() {
+		query.Window.To = query.Window.From.AddDate(0, 0, defaultChangeDays)
+	}
+	if !query.Window.To.After(query.Window.From) {
+		return invalidParameter("to must be after from.")
+	}
+
+	query.Limit = defaultListLimit
+	if value := c.Query("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit < 1 || query.Limit > maxListLimit {
+			return invalidParameter(fmt.Sprintf("limit must be an integer between 1 and %d", maxListLimit))
+		}
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		// The same form as the cursors of listings ordered by a time.
+		contracts := ContractQuery{Sort: "at"}
+		if err = decodeCursor(cursor, &contracts); err != nil {
+			return invalidParameter(err.Error())
+		}
+		query.CursorAt, query.Cursor = contracts.CursorValue, contracts.Cursor
+	}
+	if query.Contracts.Filter, err = listFilter(c); err != nil {
+		return invalidParameter(err.Error())
+	}
+	if err = excludeDenied(c, &query.Contracts.Filter); err != nil {
+		return err
+	}
+
+	changes, more, err := FindChanges(context.TODO(), storeOf(c), query)
+	if err != nil {
+		return err
+	}
+
+	var next *string
+	if more {
+		last := changes[len(changes)-1]
+		cursor := fmt.Sprintf("%d_%s", last.At.UnixMilli(), last.ContractID.Hex())
+		next = &cursor
+	}
+	return c.JSON(fiber.Map{"results": changes, "next": next})
+}
+
+// BranchPayload creates a branch, which ends where the contract ends
+// unless EndAt or Term is given.
+type BranchPayload struct {
+	StartAt time.Time     `json:"start_at" validate:"required"`
+	EndAt   *RelativeTime `json:"end_at" validate:"excluded_with=Term"`
+	Term    *Duration     `json:"term" validate:"excluded_with=EndAt"`
+	Data    fiber.Map     `json:"data" validate:"required"`
 }
 
 func (h *Handler) BranchContract(c *fiber.Ctx) error {
-	payload := new(struct {
-		StartAt time.Time `json:"start_at" validate:"required"`
-		EndAt   time.Time `json:"end_at"`
-		Data    fiber.Map `json:"data" validate:"required"`
+	payload := new(BranchPayload)
+
+	if err := c.BodyParser(&payload); err != nil {
+		return invalidBody(err)
+	}
+
+	if err := h.validateStruct(payload); err != nil {
+		return err
+	}
+
+	startAt := payload.StartAt
+	endAt := resolveEnd(payload.StartAt, payload.EndAt, payload.Term)
+
+	document, err := h.updateContract(c, EventBranch, func(contract *Contract) (EventPayload, error) {
+		branch, err := contract.Branch(startAt, endAt, payload.Data)
+		if err != nil {
+			return EventPayload{}, err
+		}
+		// Keep the resolved end so that a retry doesn't
+		// pick up a different default end date.
+		startAt, endAt = branch.StartAt, branch.EndAt
+		return EventPayload{StartAt: &startAt, EndAt: &endAt, Data: payload.Data}, nil
+	}, func(base, current *Contract) bool {
+		// Branches added in the meantime must not touch the period of
+		// this branch. Splits of existing branches (the ones referring
+		// to their data) don't count since the data stays the same.
+		for _, item := range current.Items {
+			if _, split := item.Data["_ref"]; split || base.Contains(item) {
+				continue
+			}
+			if item.StartAt.Before(endAt) && item.EndAt.After(startAt) {
+				return true
+			}
+		}
+		return false
 	})
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderETag, etag(document))
+	return c.JSON(document)
+}
+
+func (h *Handler) ListBranches(c *fiber.Ctx) error {
+	/*
+		Lists the branches of a contract that intersect with the period
+		from "from" to "to". "active=true" leaves out the branches that
+		were replaced, "active=false" selects only them.
+	*/
+	var filter BranchFilter
+	var err error
+
+	for key, target := range map[string]*time.Time{"from": &filter.Window.From, "to": &filter.Window.To} {
+		if value := c.Query(key); value != "" {
+			if *target, err = parseTime(value); err != nil {
+				return invalidParameter(fmt.Sprintf("%s must be a date or an RFC 3339 timestamp.", key))
+			}
+		}
+	}
+	switch c.Query("active") {
+	case "":
+	case "true":
+		filter.Window.Active = true
+	case "false":
+		filter.Replaced = true
+	default:
+		return invalidParameter("active must be either true or false.")
+	}
+
+	// Replacements are told by the replaced branches, so all of
+	// the branches are needed even if only some are listed.
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"results": contract.DescribeBranches(contract.SelectBranches(filter))})
+}
+
+// BranchDetail is a branch along with its lineage.
+type BranchDetail struct {
+	*BranchInfo
+	Lineage *Lineage `json:"lineage"`
+}
+
+func (h *Handler) GetBranch(c *fiber.Ctx) error {
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := paramID(c, "bid")
+	if err != nil {
+		return err
+	}
+	branch, err := contract.FindBranch(id)
+	if err != nil {
+		return err
+	}
+	return c.JSON(BranchDetail{contract.DescribeBranch(branch), contract.Lineage(branch)})
+}
+
+func (h *Handler) ExplainContract(c *fiber.Ctx) error {
+	width, err := strconv.Atoi(c.Query("width", strconv.Itoa(defaultGanttWidth)))
+	if err != nil || width < 10 || width > 500 {
+		return invalidParameter("width must be an integer between 10 and 500.")
+	}
+
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
+	}
+
+	c.Type("txt", "utf-8")
+	return contract.Gantt(c, GanttOptions{Width: width, ASCII: c.Query("ascii") == "true"})
+}
+
+func calendarOptions(c *fiber.Ctx) (CalendarOptions, error) {
+	var opts CalendarOptions
+	if notice := c.Query("notice"); notice != "" {
+		for _, value := range strings.Split(notice, ",") {
+			days, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || days <= 0 {
+				return opts, fmt.Errorf("notice must be a comma separated list of positive day counts")
+			}
+			opts.Notice = append(opts.Notice, time.Duration(days)*day)
+		}
+	}
+	return opts, nil
+}
+
+func (h *Handler) ContractCalendar(c *fiber.Ctx) error {
+	opts, err := calendarOptions(c)
+	if err != nil {
+		return invalidParameter(err.Error())
+	}
 
+	contract, err := h.getContractWindow(c, Window{Active: true})
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, "text/calendar; charset=utf-8")
+	return WriteCalendar(c, []*Contract{contract}, opts)
+}
+
+func (h *Handler) ListCalendar(c *fiber.Ctx) error {
+	// Calendar feed of every contract matched by the listing filter.
+	opts, err := calendarOptions(c)
+	if err != nil {
+		return invalidParameter(err.Error())
+	}
+
+	c.Set(fiber.HeaderContentType, "text/calendar; charset=utf-8")
+	return h.streamContracts(c, func(w io.Writer) (func(*Contract) error, func() error, error) {
+		cal, err := newCalendarStream(w, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cal.Write, cal.Close, nil
+	})
+}
+
+func (h *Handler) ContractTimeline(c *fiber.Ctx) error {
+	var opts TimelineOptions
+	var err error
+
+	if opts.Width, err = strconv.Atoi(c.Query("width", strconv.Itoa(defaultTimelineWidth))); err != nil ||
+		opts.Width < 200 || opts.Width > 10000 {
+		return invalidParameter("width must be an integer between 200 and 10000.")
+	}
+	for key, target := range map[string]*time.Time{"from": &opts.From, "to": &opts.To} {
+		if value := c.Query(key); value != "" {
+			if *target, err = parseTime(value); err != nil {
+				return invalidParameter(fmt.Sprintf("%s must be a date or an RFC 3339 timestamp.", key))
+			}
+		}
+	}
+
+	contract, err := h.getContractWindow(c, Window{From: opts.From, To: opts.To})
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	if err = contract.TimelineSVG(&b, opts); err != nil {
+		return invalidParameter(err.Error())
+	}
+	c.Type("svg")
+	return c.Send(b.Bytes())
+}
+
+func splitQuery(c *fiber.Ctx, key string) []string {
+	var values []string
+	for _, value := range strings.Split(c.Query(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (h *Handler) streamContracts(
+	c *fiber.Ctx, open func(w io.Writer) (write func(*Contract) error, end func() error, err error),
+) error {
+	/*
+		Streams every contract matched by the listing filter to the
+		response, iterating the cursor instead of loading all documents
+		at once. Formats that need to be ended after the last contract
+		return an end function. Once the stream starts the status can
+		no longer change, so errors past that point are only logged.
+	*/
+	query, err := listQuery(c)
+	if err != nil {
+		return invalidParameter(err.Error())
+	}
+	if err = excludeDenied(c, &query.Filter); err != nil {
+		return err
+	}
+	cur, err := storeOf(c).Find(context.TODO(), query)
+	if err != nil {
+		return err
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx := context.Background()
+		defer cur.Close(ctx)
+
+		write, end, err := open(w)
+		if err != nil {
+			log.Printf("export: could not start: %s", err)
+			return
+		}
+		for cur.Next(ctx) {
+			contract, err := cur.Contract()
+			if err != nil {
+				log.Printf("export: could not decode contract: %s", err)
+				return
+			}
+			if err = write(contract); err != nil {
+				log.Printf("export: could not write contract %s: %s", contract.ID.Hex(), err)
+				return
+			}
+			if err = w.Flush(); err != nil {
+				return
+			}
+		}
+		if err = cur.Err(); err != nil {
+			log.Printf("export: cursor failed: %s", err)
+			return
+		}
+		if end != nil {
+			if err = end(); err != nil {
+				log.Printf("export: could not end: %s", err)
+				return
+			}
+		}
+		_ = w.Flush()
+	})
+	return nil
+}
+
+func (h *Handler) ExportContracts(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	return h.streamContracts(c, func(w io.Writer) (func(*Contract) error, func() error, error) {
+		encoder := json.NewEncoder(w)
+		return func(contract *Contract) error {
+			return encoder.Encode(contract)
+		}, nil, nil
+	})
+}
+
+func (h *Handler) ExportTimelines(c *fiber.Ctx) error {
+	dataKeys, metaKeys := splitQuery(c, "keys"), splitQuery(c, "meta")
+
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	c.Attachment("timelines.csv")
+	return h.streamContracts(c, func(w io.Writer) (func(*Contract) error, func() error, error) {
+		t, err := newTimelineCSV(w, dataKeys, metaKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		return t.Write, nil, nil
+	})
+}
+
+func importFormat(contentType string) string {
+	switch strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]) {
+	case "text/csv":
+		return "csv"
+	case "application/x-ndjson", "application/ndjson":
+		return "ndjson"
+	}
+	return ""
+}
+
+func (h *Handler) ImportContracts(c *fiber.Ctx) error {
+	format := importFormat(string(c.Request().Header.ContentType()))
+	if format == "" {
+		return NewProblem(fiber.StatusUnsupportedMediaType, "unsupported_media_type",
+			"Content-Type must be text/csv or application/x-ndjson.")
+	}
+
+	batch, err := strconv.Atoi(c.Query("batch", strconv.Itoa(defaultImportBatch)))
+	if err != nil || batch <= 0 {
+		return invalidParameter("batch must be a positive integer.")
+	}
+
+	report, err := importContracts(context.TODO(), storeOf(c), bytes.NewReader(c.Body()), format, batch, actor(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(report)
+}
+
+func (h *Handler) ContractEvents(c *fiber.Ctx) error {
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
+	}
+	// Contracts created before the event log have no events.
+	events, err := storeOf(c).Events().List(context.TODO(), contract.ID, -1)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"results": events})
+}
+
+func (h *Handler) replay(c *fiber.Ctx, objectID primitive.ObjectID, version int64) (*Contract, error) {
+	events, err := storeOf(c).Events().List(context.TODO(), objectID, version)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		return nil, NewProblem(fiber.StatusNotFound, "no_events", "the contract has no recorded events")
+	}
+	if version >= 0 && events[len(events)-1].Sequence != version {
+		return nil, NewProblem(fiber.StatusBadRequest, "unknown_version", "there is no such version of the contract")
+	}
+
+	contract, err := Replay(events)
+	if err != nil {
+		return nil, NewProblem(fiber.StatusUnprocessableEntity, "replay_failed", err.Error())
+	}
+	return contract, nil
+}
+
+func (h *Handler) ReplayContract(c *fiber.Ctx) error {
+	// Rebuilds the contract as it was at the given
+	// version (by default the latest) from its events. Events are
+	// kept by contract, so the contract is looked up first to make
+	// sure that it is of the tenant.
+	contract, err := h.findContract(c, true)
+	if err != nil {
+		return err
+	}
+	version, err := strconv.ParseInt(c.Query("version", "-1"), 10, 64)
+	if err != nil {
+		return invalidParameter("version must be an integer.")
+	}
+
+	contract, err = h.replay(c, contract.ID, version)
+	if err != nil {
+		return err
+	}
+	return c.JSON(contract)
+}
+
+// Verification tells if a contract matches the replay of its events.
+type Verification struct {
+	Consistent      bool  `json:"consistent"`
+	Version         int64 `json:"version"`
+	ReplayedVersion int64 `json:"replayed_version"`
+}
+
+func (h *Handler) VerifyContract(c *fiber.Ctx) error {
+	// Tells if the stored contract matches the replay of its events.
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
+	}
+
+	replayed, err := h.replay(c, contract.ID, -1)
+	if err != nil {
+		return err
+	}
+	consistent, err := Consistent(contract, replayed)
+	if err != nil {
+		return err
+	}
+	return c.JSON(Verification{Consistent: consistent, Version: contract.Version, ReplayedVersion: replayed.Version})
+}
+
+// VersionPayload tells a former version of a contract.
+type VersionPayload struct {
+	Version *int64 `json:"version" validate:"required,min=0"`
+}
+
+func (h *Handler) RevertContract(c *fiber.Ctx) error {
+	payload := new(VersionPayload)
+	if err := c.BodyParser(&payload); err != nil {
+		return invalidBody(err)
+	}
+
+	if err := h.validateStruct(payload); err != nil {
+		return err
+	}
+	version := *payload.Version
+
+	document, err := h.updateContract(c, EventRevert, func(contract *Contract) (EventPayload, error) {
+		if version >= contract.Version {
+			return EventPayload{}, NewProblem(fiber.StatusBadRequest, "invalid_version", "can only revert to a former version")
+		}
+		target, err := h.replay(c, contract.ID, version)
+		if err != nil {
+			return EventPayload{}, err
+		}
+		contract.Items = target.Items
+		contract.Meta = target.Meta
+		return EventPayload{Version: &version}, nil
+	}, func(base, current *Contract) bool {
+		// Reverting discards every change since the version,
+		// including the concurrent ones.
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderETag, etag(document))
+	return c.JSON(document)
+}
+
+func (h *Handler) metaHistory(c *fiber.Ctx, contract *Contract) ([]*MetaRevision, error) {
+	events, err := storeOf(c).Events().List(context.TODO(), contract.ID, -1)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 {
+		// Contracts created before the event log only have
+		// the meta they have now.
+		return []*MetaRevision{{Version: contract.Version, Meta: contract.Meta, CreatedAt: contract.UpdatedAt}}, nil
+	}
+	revisions, err := MetaHistory(events)
+	if err != nil {
+		return nil, NewProblem(fiber.StatusUnprocessableEntity, "replay_failed", err.Error())
+	}
+	return revisions, nil
+}
+
+func (h *Handler) MetaHistory(c *fiber.Ctx) error {
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
+	}
+	revisions, err := h.metaHistory(c, contract)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"results": revisions})
+}
+
+func (h *Handler) GetMeta(c *fiber.Ctx) error {
+	// The meta of the contract as of "at", the current time by default.
+	at := time.Now().UTC()
+	if value := c.Query("at"); value != "" {
+		var err error
+		if at, err = parseTime(value); err != nil {
+			return invalidParameter("at must be a date or an RFC 3339 timestamp.")
+		}
+	}
+
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
+	}
+	revisions, err := h.metaHistory(c, contract)
+	if err != nil {
+		return err
+	}
+	revision := MetaAt(revisions, at)
+	if revision == nil {
+		return NewProblem(fiber.StatusNotFound, "meta_not_found", "the contract did not exist at that time")
+	}
+	return c.JSON(revision)
+}
+
+func (h *Handler) RestoreMeta(c *fiber.Ctx) error {
+	// Sets the meta back to what it was at the given version.
+	payload := new(VersionPayload)
+	if err := c.BodyParser(&payload); err != nil {
+		return invalidBody(err)
+	}
+
+	if err := h.validateStruct(payload); err != nil {
+		return err
+	}
+	version := *payload.Version
+
+	document, err := h.updateContract(c, EventMeta, func(contract *Contract) (EventPayload, error) {
+		if version >= contract.Version {
+			return EventPayload{}, NewProblem(fiber.StatusBadRequest, "invalid_version",
+				"can only restore the meta of a former version")
+		}
+		revisions, err := h.metaHistory(c, contract)
+		if err != nil {
+			return EventPayload{}, err
+		}
+		var target *MetaRevision
+		for _, revision := range revisions {
+			if revision.Version <= version {
+				target = revision
+			}
+		}
+		if target == nil {
+			return EventPayload{}, NewProblem(fiber.StatusBadRequest, "unknown_version", "there is no such version of the contract")
+		}
+		contract.Meta = target.Meta
+		return EventPayload{Meta: target.Meta}, nil
+	}, func(base, current *Contract) bool {
+		return !reflect.DeepEqual(base.Meta, current.Meta)
+	})
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderETag, etag(document))
+	return c.JSON(document)
+}
+
+// WebhookPayload registers a webhook for the given events,
+// every event if there are none.
+type WebhookPayload struct {
+	URL    string    `json:"url" validate:"required,url"`
+	Secret string    `json:"secret" validate:"required,min=16"`
+	Events []string  `json:"events" validate:"dive,oneof=create branch meta revert delete restore"`
+	Meta   fiber.Map `json:"meta"`
+}
+
+func (h *Handler) CreateWebhook(c *fiber.Ctx) error {
+	payload := new(WebhookPayload)
+	if err := c.BodyParser(&payload); err != nil {
+		return invalidBody(err)
+	}
+
+	if err := h.validateStruct(payload); err != nil {
+		return err
+	}
+
+	webhook := &Webhook{
+		ID:        primitive.NewObjectID(),
+		URL:       payload.URL,
+		Secret:    payload.Secret,
+		Events:    payload.Events,
+		Meta:      payload.Meta,
+		CreatedAt: time.Now().UTC(),
+	}
+	if webhook.Events == nil {
+		webhook.Events = make([]string, 0)
+	}
+	if err := storeOf(c).Webhooks().Create(context.TODO(), webhook); err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(webhook)
+}
+
+func (h *Handler) ListWebhooks(c *fiber.Ctx) error {
+	webhooks, err := storeOf(c).Webhooks().List(context.TODO())
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"results": webhooks})
+}
+
+func (h *Handler) GetWebhook(c *fiber.Ctx) error {
+	objectID, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	webhook, err := storeOf(c).Webhooks().Get(context.TODO(), objectID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(webhook)
+}
+
+func (h *Handler) DeleteWebhook(c *fiber.Ctx) error {
+	objectID, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	if err = storeOf(c).Webhooks().Delete(context.TODO(), objectID); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *Handler) WebhookDeliveries(c *fiber.Ctx) error {
+	// The latest deliveries of a webhook, newest first.
+	limit, err := strconv.Atoi(c.Query("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		return invalidParameter("limit must be an integer between 1 and 500.")
+	}
+
+	objectID, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	if _, err = storeOf(c).Webhooks().Get(context.TODO(), objectID); err != nil {
+		return err
+	}
+	deliveries, err := storeOf(c).Webhooks().Deliveries(context.TODO(), objectID, limit)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"results": deliveries})
+}
+
+// APIKeyPayload creates an API key.
+type APIKeyPayload struct {
+	Name string `json:"name" validate:"required,max=100"`
+	Role string `json:"role" validate:"omitempty,oneof=viewer editor approver admin"`
+}
+
+// CreatedAPIKey is a new API key along with the key itself, which
+// can't be told afterwards.
+type CreatedAPIKey struct {
+	*APIKey
+	Key string `json:"key"`
+}
+
+func (h *Handler) CreateAPIKey(c *fiber.Ctx) error {
+	payload := new(APIKeyPayload)
 	if err := c.BodyParser(&payload); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": err.Error()})
+		return invalidBody(err)
+	}
+
+	if err := h.validateStruct(payload); err != nil {
+		return err
+	}
+
+	if payload.Role == "" {
+		payload.Role = RoleViewer
+	}
+	key, secret, err := NewAPIKey(payload.Name, payload.Role)
+	if err != nil {
+		return err
+	}
+	if err = storeOf(c).APIKeys().Create(context.TODO(), key); err != nil {
+		return err
+	}
+	return c.Status(fiber.StatusCreated).JSON(CreatedAPIKey{APIKey: key, Key: secret})
+}
+
+func (h *Handler) ListAPIKeys(c *fiber.Ctx) error {
+	keys, err := storeOf(c).APIKeys().List(context.TODO())
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		key.Role = key.role()
+	}
+	return c.JSON(fiber.Map{"results": keys})
+}
+
+func (h *Handler) DeleteAPIKey(c *fiber.Ctx) error {
+	objectID, err := paramID(c, "id")
+	if err != nil {
+		return err
+	}
+	if err = storeOf(c).APIKeys().Delete(context.TODO(), objectID); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// GrantPayload gives a subject a role on a contract.
+type GrantPayload struct {
+	Subject string `json:"subject" validate:"required,max=200"`
+	Role    string `json:"role" validate:"required,oneof=none viewer editor approver admin"`
+}
+
+func (h *Handler) CreateGrant(c *fiber.Ctx) error {
+	// Grants replace whatever the subject was granted before.
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
+	}
+	payload := new(GrantPayload)
+	if err = c.BodyParser(&payload); err != nil {
+		return invalidBody(err)
+	}
+
+	if err = h.validateStruct(payload); err != nil {
+		return err
+	}
+
+	grant := &Grant{
+		ContractID: contract.ID,
+		Subject:    payload.Subject,
+		Role:       payload.Role,
+		GrantedBy:  actor(c),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err = storeOf(c).Grants().Put(context.TODO(), grant); err != nil {
+		return err
 	}
+	return c.Status(fiber.StatusCreated).JSON(grant)
+}
+
+func (h *Handler) ListGrants(c *fiber.Ctx) error {
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
+	}
+	grants, err := storeOf(c).Grants().List(context.TODO(), contract.ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(fiber.Map{"results": grants})
+}
 
-	if fieldErrors := h.validateStruct(payload); fieldErrors != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fieldErrors)
+func (h *Handler) DeleteGrant(c *fiber.Ctx) error {
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
 	}
+	subject, err := url.PathUnescape(c.Params("subject"))
+	if err != nil {
+		return invalidParameter("subject is not properly escaped.")
+	}
+	if err = storeOf(c).Grants().Delete(context.TODO(), contract.ID, subject); err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// RejectionPayload tells why a proposal is rejected.
+type RejectionPayload struct {
+	Reason string `json:"reason" validate:"max=1000"`
+}
+
+// ProposalView is a proposal along with the contract as it would be if
+// the proposal were accepted, or as it is once accepted. Stale tells if the
+// branches of the contract changed after the proposal was made.
+type ProposalView struct {
+	Proposal *Proposal `json:"proposal"`
+	Contract *Contract `json:"contract"`
+	Stale    bool      `json:"stale"`
+}
 
-	coll := h.database.Collection("contract")
-	contract, err := getContract(coll, c)
+func (h *Handler) CreateProposal(c *fiber.Ctx) error {
+	/*
+		Proposes a branch of the contract as it is now (or as If-Match
+		requires it to be), which is only made once an approver accepts
+		the proposal. Branches that could not be made are refused here
+		the same way they would be when branching.
+	*/
+	contract, err := h.findContract(c, false)
 	if err != nil {
-		return c.SendStatus(fiber.StatusNotFound)
+		return err
+	}
+	if !ifMatch(c, contract) {
+		return errPreconditionFailed
+	}
+	payload := new(BranchPayload)
+	if err = c.BodyParser(&payload); err != nil {
+		return invalidBody(err)
+	}
+
+	if err = h.validateStruct(payload); err != nil {
+		return err
 	}
 
-	_, err = contract.Branch(payload.StartAt, payload.EndAt, payload.Data)
+	endAt := resolveEnd(payload.StartAt, payload.EndAt, payload.Term)
+	proposal, err := NewProposal(contract, payload.StartAt, endAt, payload.Data)
 	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"detail": err.Error()})
+		return err
+	}
+	proposal.ProposedBy = actor(c)
+	if err = storeOf(c).Proposals().Insert(context.TODO(), proposal); err != nil {
+		return err
 	}
+	return c.Status(fiber.StatusCreated).JSON(proposal)
+}
 
-	filter := bson.M{"_id": contract.ID}
-	update := bson.M{"$set": bson.M{"items": contract.Items}, "$currentDate": bson.M{"updated_at": true}}
-	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+func (h *Handler) ListProposals(c *fiber.Ctx) error {
+	contract, err := h.getContract(c)
+	if err != nil {
+		return err
+	}
+	status := c.Query("status")
+	switch status {
+	case "", ProposalPending, ProposalAccepted, ProposalRejected, ProposalStale:
+	default:
+		return invalidParameter("status must be one of pending, accepted, rejected and stale.")
+	}
+	proposals, err := storeOf(c).Proposals().List(context.TODO(), contract.ID, status)
+	if err != nil {
+		return err
+	}
+	for i, proposal := range proposals {
+		if proposals[i], err = h.settleProposal(c, proposal); err != nil {
+			return err
+		}
+	}
+	return c.JSON(fiber.Map{"results": proposals})
+}
 
-	var document *Contract
-	if err = coll.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&document); err != nil {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"detail": err.Error()})
+func (h *Handler) getProposal(c *fiber.Ctx) (*Contract, *Proposal, error) {
+	contract, err := h.getContract(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	id, err := paramID(c, "pid")
+	if err != nil {
+		return nil, nil, err
+	}
+	proposal, err := storeOf(c).Proposals().Get(context.TODO(), contract.ID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	proposal, err = h.settleProposal(c, proposal)
+	return contract, proposal, err
+}
+
+func (h *Handler) settleProposal(c *fiber.Ctx, proposal *Proposal) (*Proposal, error) {
+	/*
+		Proposals whose acceptance was abandoned are recorded as
+		accepted if their branch was made, since its event tells which
+		proposal it is for, or as pending again otherwise. Whoever
+		settles them first wins, others read what it was settled as.
+	*/
+	if !proposal.abandoned(time.Now().UTC()) {
+		return proposal, nil
+	}
+	ctx, store := context.TODO(), storeOf(c)
+	events, err := store.Events().List(ctx, proposal.ContractID, -1)
+	if err != nil {
+		return nil, err
+	}
+	proposal.Status, proposal.DecidedBy, proposal.DecidedAt = ProposalPending, "", nil
+	for _, event := range events {
+		if event.Payload.Proposal != nil && *event.Payload.Proposal == proposal.ID {
+			version := event.Sequence
+			proposal.decide(ProposalAccepted, event.Actor, "")
+			proposal.AppliedVersion = &version
+			break
+		}
+	}
+	err = store.Proposals().Decide(ctx, proposal, ProposalAccepted)
+	if errors.Is(err, ErrProposalDecided) {
+		return store.Proposals().Get(ctx, proposal.ContractID, proposal.ID)
+	}
+	return proposal, err
+}
+
+func pending(proposal *Proposal) error {
+	if proposal.Status != ProposalPending {
+		return fmt.Errorf("%w: it is %s", ErrProposalDecided, proposal.Status)
+	}
+	return nil
+}
+
+func (h *Handler) GetProposal(c *fiber.Ctx) error {
+	_, proposal, err := h.getProposal(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(proposal)
+}
+
+func (h *Handler) PreviewProposal(c *fiber.Ctx) error {
+	// Previews the proposal on the contract as it is now, which
+	// might not be the version the proposal was made against.
+	contract, proposal, err := h.getProposal(c)
+	if err != nil {
+		return err
+	}
+	if err = pending(proposal); err != nil {
+		return err
+	}
+	preview, err := proposal.Preview(contract)
+	if err != nil {
+		return err
+	}
+	return c.JSON(ProposalView{Proposal: proposal, Contract: preview, Stale: proposal.Stale(contract)})
+}
+
+func (h *Handler) decideProposal(c *fiber.Ctx, proposal *Proposal, from string) {
+	// Stores the outcome of an accepted proposal, which was
+	// claimed beforehand so there is nobody else to decide it.
+	if err := storeOf(c).Proposals().Decide(context.TODO(), proposal, from); err != nil {
+		log.Printf("could not store proposal %s as %s: %s", proposal.ID.Hex(), proposal.Status, err)
+	}
+}
+
+func (h *Handler) AcceptProposal(c *fiber.Ctx) error {
+	/*
+		Makes the branch of a proposal, given that the branches of the
+		contract are still those it was proposed against. Otherwise the
+		proposal is recorded as stale and has to be made again, since
+		whoever accepts it did not see what it does to the contract as
+		it is now. Concurrent changes are never merged for that reason.
+
+		The proposal is claimed first, so that it can't be rejected or
+		accepted by someone else while its branch is being made.
+	*/
+	_, proposal, err := h.getProposal(c)
+	if err != nil {
+		return err
+	}
+	if err = pending(proposal); err != nil {
+		return err
+	}
+	proposal.decide(ProposalAccepted, actor(c), "")
+	if err = storeOf(c).Proposals().Decide(context.TODO(), proposal, ProposalPending); err != nil {
+		return err
+	}
+
+	document, err := h.updateContract(c, EventBranch, func(contract *Contract) (EventPayload, error) {
+		if _, err := proposal.Apply(contract); err != nil {
+			return EventPayload{}, err
+		}
+		return EventPayload{
+			StartAt: &proposal.StartAt, EndAt: &proposal.EndAt, Data: proposal.Data, Proposal: &proposal.ID,
+		}, nil
+	}, func(base, current *Contract) bool {
+		return true
+	})
+	switch {
+	case errors.Is(err, ErrProposalStale) || errors.Is(err, ErrVersionConflict):
+		proposal.decide(ProposalStale, actor(c), ErrProposalStale.Error())
+		h.decideProposal(c, proposal, ProposalAccepted)
+		return ErrProposalStale
+	case err != nil:
+		// Errors that have nothing to do with the proposal leave it
+		// pending, such as failing to store the contract.
+		proposal.Status, proposal.DecidedBy, proposal.DecidedAt = ProposalPending, "", nil
+		h.decideProposal(c, proposal, ProposalAccepted)
+		return err
+	}
+	proposal.AppliedVersion = &document.Version
+	h.decideProposal(c, proposal, ProposalAccepted)
+	c.Set(fiber.HeaderETag, etag(document))
+	return c.JSON(ProposalView{Proposal: proposal, Contract: document})
+}
+
+func (h *Handler) RejectProposal(c *fiber.Ctx) error {
+	_, proposal, err := h.getProposal(c)
+	if err != nil {
+		return err
+	}
+	payload := new(RejectionPayload)
+	if len(c.Body()) > 0 {
+		if err = c.BodyParser(&payload); err != nil {
+			return invalidBody(err)
+		}
+	}
+
+	if err = h.validateStruct(payload); err != nil {
+		return err
+	}
+	if err = pending(proposal); err != nil {
+		return err
+	}
+
+	proposal.decide(ProposalRejected, actor(c), payload.Reason)
+	if err = storeOf(c).Proposals().Decide(context.TODO(), proposal, ProposalPending); err != nil {
+		return err
+	}
+	return c.JSON(proposal)
+}
+
+func (h *Handler) DeleteContract(c *fiber.Ctx) error {
+	// Deleted contracts are kept until they are purged.
+	_, err := h.updateContract(c, EventDelete, func(contract *Contract) (EventPayload, error) {
+		deletedAt := time.Now().UTC()
+		contract.DeletedAt = &deletedAt
+		return EventPayload{}, nil
+	}, func(base, current *Contract) bool {
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (h *Handler) RestoreContract(c *fiber.Ctx) error {
+	document, err := h.updateContract(c, EventRestore, func(contract *Contract) (EventPayload, error) {
+		if contract.DeletedAt == nil {
+			return EventPayload{}, NewProblem(fiber.StatusBadRequest, "not_deleted", "the contract is not deleted")
+		}
+		contract.DeletedAt = nil
+		return EventPayload{}, nil
+	}, func(base, current *Contract) bool {
+		return false
+	})
+	if err != nil {
+		return err
 	}
+	c.Set(fiber.HeaderETag, etag(document))
 	return c.JSON(document)
 }
@@ -0,0 +1,1322 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestApp() *fiber.App {
+	return newApp(NewHandler(NewMemoryStore()))
+}
+
+func newAuthApp(store ContractStore, authenticators ...Authenticator) *fiber.App {
+	// An app as served with AUTH_METHODS set.
+	handler := NewHandler(store)
+	handler.authenticated = true
+	return newApp(handler, Authenticate(authenticators...))
+}
+
+func doRequest(t *testing.T, app *fiber.App, method, path, body string, headers ...string) (*http.Response, []byte) {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := app.Test(req, -1)
+	require.NoError(t, err)
+
+	content, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, content
+}
+
+func decodeMap(t *testing.T, content []byte) map[string]interface{} {
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(content, &decoded), string(content))
+	return decoded
+}
+
+func createTestContract(t *testing.T, app *fiber.App, body string) map[string]interface{} {
+	resp, content := doRequest(t, app, "POST", "/contracts/", body)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	return decodeMap(t, content)
+}
+
+const testContract = `{"start_at": "2022-10-10T00:00:00Z", "end_at": "2023-10-10T00:00:00Z",
+	"meta": {"name": "Lease"}, "data": {"price": 10}}`
+
+func TestCreateAndGetContract(t *testing.T) {
+	app := newTestApp()
+	created := createTestContract(t, app, testContract)
+
+	require.Equal(t, map[string]interface{}{"name": "Lease"}, created["meta"])
+	require.EqualValues(t, 0, created["version"])
+
+	resp, content := doRequest(t, app, "GET", "/contracts/"+created["_id"].(string)+"/", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	contract := decodeMap(t, content)
+	items := contract["items"].([]interface{})
+	require.Len(t, items, 1)
+
+	item := items[0].(map[string]interface{})
+	require.Equal(t, "365days", item["span"])
+	require.Equal(t, "P365D", item["span_iso"])
+	require.Equal(t, map[string]interface{}{"price": float64(10)}, item["data"])
+
+	resp, content = doRequest(t, app, "GET", "/contracts/not-an-id/", "")
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "invalid_id", decodeMap(t, content)["code"])
+
+	resp, content = doRequest(t, app, "GET", "/contracts/63a0b5d1b6c3f1e2d4a5b6c7/", "")
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "contract_not_found", decodeMap(t, content)["code"])
+}
+
+func TestCreateContractTerm(t *testing.T) {
+	app := newTestApp()
+	created := createTestContract(t, app,
+		`{"start_at": "2022-10-10T00:00:00Z", "term": "P1Y", "meta": {}, "data": {}}`)
+
+	item := created["items"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "2023-10-10T00:00:00Z", item["end_at"])
+
+	created = createTestContract(t, app,
+		`{"start_at": "2022-10-10T00:00:00Z", "end_at": "+P45D", "meta": {}, "data": {}}`)
+	item = created["items"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "2022-11-24T00:00:00Z", item["end_at"])
+}
+
+func TestCreateContractInvalid(t *testing.T) {
+	app := newTestApp()
+
+	resp, content := doRequest(t, app, "POST", "/contracts/", `{"start_at": "2022-10-10T00:00:00Z", "meta": {}, "data": {}}`)
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "application/problem+json", resp.Header.Get(fiber.HeaderContentType))
+	require.Equal(t, map[string]interface{}{
+		"type":     "urn:charlie:problem:validation_failed",
+		"title":    "Bad Request",
+		"status":   float64(400),
+		"detail":   "One or more of the fields are invalid.",
+		"instance": "/contracts/",
+		"code":     "validation_failed",
+		"fields": map[string]interface{}{
+			"end_at": map[string]interface{}{"tag": "required_without"},
+			"term":   map[string]interface{}{"tag": "required_without"},
+		},
+	}, decodeMap(t, content))
+
+	resp, _ = doRequest(t, app, "POST", "/contracts/",
+		`{"start_at": "2022-10-10T00:00:00Z", "end_at": "+P1Q", "meta": {}, "data": {}}`)
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	resp, content = doRequest(t, app, "POST", "/contracts/",
+		`{"start_at": "2022-10-10T00:00:00Z", "end_at": "2022-10-10T00:00:00Z", "meta": {}, "data": {}}`)
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, string(content), "this branch would span nothing")
+	require.Equal(t, "empty_span", decodeMap(t, content)["code"])
+}
+
+func TestBranchAndUpdateContract(t *testing.T) {
+	app := newTestApp()
+	id := createTestContract(t, app, testContract)["_id"].(string)
+
+	resp, content := doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2022-11-10T00:00:00Z", "term": "P1M", "data": {"price": 12}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+
+	contract := decodeMap(t, content)
+	require.Len(t, contract["items"], 4)
+	require.EqualValues(t, 1, contract["version"])
+
+	resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2025-11-10T00:00:00Z", "data": {"price": 12}}`)
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	require.Contains(t, string(content), "out of the boundary")
+	require.Equal(t, "branch_out_of_bounds", decodeMap(t, content)["code"])
+
+	resp, content = doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": {"name": "Rent"}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+
+	contract = decodeMap(t, content)
+	require.Equal(t, map[string]interface{}{"name": "Rent"}, contract["meta"])
+	require.Len(t, contract["items"], 4)
+	require.EqualValues(t, 2, contract["version"])
+}
+
+func TestListContracts(t *testing.T) {
+	app := newTestApp()
+
+	var ids []string
+	for i := 0; i < defaultListLimit+2; i++ {
+		ids = append(ids, createTestContract(t, app, testContract)["_id"].(string))
+	}
+
+	resp, content := doRequest(t, app, "GET", "/contracts/", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	results := decodeMap(t, content)["results"].([]interface{})
+	require.Len(t, results, 10)
+
+	first := results[0].(map[string]interface{})
+	require.Equal(t, ids[11], first["_id"])
+	require.NotContains(t, first, "items")
+
+	last := results[9].(map[string]interface{})["_id"].(string)
+	_, content = doRequest(t, app, "GET", "/contracts/?cursor="+last, "")
+	results = decodeMap(t, content)["results"].([]interface{})
+	require.Len(t, results, 2)
+	require.Equal(t, ids[1], results[0].(map[string]interface{})["_id"])
+	require.Equal(t, ids[0], results[1].(map[string]interface{})["_id"])
+}
+
+func TestRenderContract(t *testing.T) {
+	app := newTestApp()
+	id := createTestContract(t, app, testContract)["_id"].(string)
+
+	resp, content := doRequest(t, app, "GET", "/contracts/"+id+"/explain?ascii=true&width=20", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.Contains(t, string(content), ";|####################| 365days")
+
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/explain?width=5", "")
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/calendar.ics?notice=30", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("Content-Type"), "text/calendar")
+	require.Equal(t, 3, strings.Count(string(content), "BEGIN:VEVENT"))
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/timeline.svg?from=2022-01-01", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, "image/svg+xml", resp.Header.Get("Content-Type"))
+	require.Contains(t, string(content), `class="active"`)
+}
+
+func TestListCalendar(t *testing.T) {
+	// The feed has every contract, however many there are.
+	app := newTestApp()
+	for i := 0; i < defaultListLimit+2; i++ {
+		createTestContract(t, app, testContract)
+	}
+
+	resp, content := doRequest(t, app, "GET", "/contracts/calendar.ics", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("Content-Type"), "text/calendar")
+	require.True(t, strings.HasPrefix(string(content), "BEGIN:VCALENDAR\r\n"))
+	require.True(t, strings.HasSuffix(string(content), "END:VCALENDAR\r\n"))
+	require.Equal(t, 2*(defaultListLimit+2), strings.Count(string(content), "BEGIN:VEVENT"))
+}
+
+func TestExportContracts(t *testing.T) {
+	app := newTestApp()
+	first := createTestContract(t, app, testContract)["_id"].(string)
+	second := createTestContract(t, app, testContract)["_id"].(string)
+
+	resp, content := doRequest(t, app, "GET", "/contracts/export.ndjson", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+	require.Equal(t, second, decodeMap(t, []byte(lines[0]))["_id"])
+	require.Equal(t, first, decodeMap(t, []byte(lines[1]))["_id"])
+
+	resp, content = doRequest(t, app, "GET", "/contracts/export.csv?keys=price&meta=name", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, "contract_id,branch_id,start_at,end_at,span,meta.name,data.price",
+		strings.SplitN(string(content), "\n", 2)[0])
+	require.Equal(t, 3, strings.Count(string(content), "\n"))
+}
+
+func TestImportContracts(t *testing.T) {
+	app := newTestApp()
+
+	input := `{"ref": "a", "start_at": "2022-10-10", "end_at": "2023-10-10", "data": {"price": 10}, "meta": {"name": "Lease"}}
+{"ref": "a", "start_at": "2022-11-10", "data": {"price": 12}}
+{"ref": "b", "start_at": "2022-11-10", "data": {}}`
+
+	resp, content := doRequest(t, app, "POST", "/contracts/import", input, "Content-Type", "application/x-ndjson")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+
+	report := decodeMap(t, content)
+	require.EqualValues(t, 1, report["imported"])
+	require.Len(t, report["errors"], 1)
+
+	id := report["contracts"].(map[string]interface{})["a"].(string)
+	_, content = doRequest(t, app, "GET", "/contracts/"+id+"/", "")
+	require.Len(t, decodeMap(t, content)["items"], 3)
+
+	resp, _ = doRequest(t, app, "POST", "/contracts/import", input, "Content-Type", "application/xml")
+	require.Equal(t, fiber.StatusUnsupportedMediaType, resp.StatusCode)
+}
+
+func TestContractPreconditions(t *testing.T) {
+	app := newTestApp()
+	id := createTestContract(t, app, testContract)["_id"].(string)
+
+	resp, _ := doRequest(t, app, "GET", "/contracts/"+id+"/", "")
+	require.Equal(t, `"0"`, resp.Header.Get("ETag"))
+
+	resp, content := doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": {"name": "Rent"}}`, "If-Match", `"0"`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	require.Equal(t, `"1"`, resp.Header.Get("ETag"))
+
+	resp, _ = doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": {"name": "Lease"}}`, "If-Match", `"0"`)
+	require.Equal(t, fiber.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, _ = doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2022-11-10T00:00:00Z", "data": {}}`, "If-Match", `"0", "7"`)
+	require.Equal(t, fiber.StatusPreconditionFailed, resp.StatusCode)
+
+	resp, _ = doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2022-11-10T00:00:00Z", "data": {}}`, "If-Match", "*")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+}
+
+// racingStore runs a concurrent change right before the first update.
+type racingStore struct {
+	ContractStore
+	race func(contract *Contract)
+}
+
+func (s *racingStore) ForTenant(string) (ContractStore, error) {
+	// Tests of races don't involve tenants.
+	return s, nil
+}
+
+func (s *racingStore) Update(ctx context.Context, contract *Contract, event *Event) (*Contract, error) {
+	if race := s.race; race != nil {
+		s.race = nil
+		concurrent, err := s.Get(ctx, contract.ID)
+		if err != nil {
+			return nil, err
+		}
+		race(concurrent)
+		if _, err = s.ContractStore.Update(ctx, concurrent, nil); err != nil {
+			return nil, err
+		}
+	}
+	return s.ContractStore.Update(ctx, contract, event)
+}
+
+func TestContractConcurrentUpdates(t *testing.T) {
+	store := &racingStore{ContractStore: NewMemoryStore()}
+	handler := NewHandler(store)
+	app := newApp(handler)
+
+	id := createTestContract(t, app, testContract)["_id"].(string)
+	branch := func(start string) func(*Contract) {
+		return func(contract *Contract) {
+			startAt, _ := parseTime(start)
+			_, err := contract.Branch(startAt, startAt.AddDate(0, 1, 0), ArbitraryData{"price": 11})
+			require.NoError(t, err)
+		}
+	}
+
+	// Without retries, any concurrent change is a conflict.
+	store.race = branch("2022-11-10")
+	resp, _ := doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2023-05-10T00:00:00Z", "term": "P1M", "data": {"price": 12}}`)
+	require.Equal(t, fiber.StatusConflict, resp.StatusCode)
+
+	handler.mergeRetries = 1
+
+	store.race = branch("2022-12-10")
+	resp, content := doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2023-05-10T00:00:00Z", "term": "P1M", "data": {"price": 12}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	require.EqualValues(t, 3, decodeMap(t, content)["version"])
+
+	store.race = branch("2023-06-01")
+	resp, _ = doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2023-05-20T00:00:00Z", "term": "P1M", "data": {"price": 12}}`)
+	require.Equal(t, fiber.StatusConflict, resp.StatusCode)
+
+	// Items changed concurrently, which doesn't matter for meta.
+	store.race = branch("2023-08-01")
+	resp, content = doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": {"name": "Rent"}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+
+	store.race = func(contract *Contract) { contract.Meta = ArbitraryData{"name": "Other"} }
+	resp, _ = doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": {"name": "Lease"}}`)
+	require.Equal(t, fiber.StatusConflict, resp.StatusCode)
+
+	// Clients with If-Match asked for a particular version.
+	store.race = branch("2023-09-01")
+	resp, _ = doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": {"name": "Lease"}}`, "If-Match", "*")
+	require.Equal(t, fiber.StatusConflict, resp.StatusCode)
+
+	// Contracts deleted in the meantime are gone.
+	store.race = func(contract *Contract) {
+		deletedAt := time.Now().UTC()
+		contract.DeletedAt = &deletedAt
+	}
+	resp, _ = doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": {"name": "Lease"}}`)
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+}
+
+func TestContractEvents(t *testing.T) {
+	app := newTestApp()
+	id := createTestContract(t, app, testContract)["_id"].(string)
+
+	resp, content := doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2022-11-10T00:00:00Z", "term": "P1M", "data": {"price": 12}}`, "X-Actor", "alice")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	resp, _ = doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": {"name": "Rent"}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/revert/", `{"version": 0}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	contract := decodeMap(t, content)
+	require.EqualValues(t, 3, contract["version"])
+	require.Len(t, contract["items"], 1)
+	require.Equal(t, map[string]interface{}{"name": "Lease"}, contract["meta"])
+
+	resp, _ = doRequest(t, app, "POST", "/contracts/"+id+"/revert/", `{"version": 3}`)
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	_, content = doRequest(t, app, "GET", "/contracts/"+id+"/events/", "")
+	events := decodeMap(t, content)["results"].([]interface{})
+	require.Len(t, events, 4)
+	branch := events[1].(map[string]interface{})
+	require.Equal(t, "branch", branch["type"])
+	require.Equal(t, "alice", branch["actor"])
+
+	_, content = doRequest(t, app, "GET", "/contracts/"+id+"/replay?version=1", "")
+	require.Len(t, decodeMap(t, content)["items"], 4)
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/verify", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, true, decodeMap(t, content)["consistent"])
+
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/replay?version=9", "")
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestWebhooks(t *testing.T) {
+	app := newTestApp()
+
+	resp, content := doRequest(t, app, "POST", "/webhooks/",
+		`{"url": "http://billing.local/hook", "secret": "short", "events": ["archive"]}`)
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, map[string]interface{}{
+		"secret":    map[string]interface{}{"tag": "min"},
+		"events[0]": map[string]interface{}{"tag": "oneof"},
+	}, decodeMap(t, content)["fields"])
+
+	resp, content = doRequest(t, app, "POST", "/webhooks/",
+		`{"url": "http://billing.local/hook", "secret": "0123456789abcdef", "events": ["branch"]}`)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	webhook := decodeMap(t, content)
+	require.NotContains(t, webhook, "secret")
+	id := webhook["_id"].(string)
+
+	contract := createTestContract(t, app, testContract)["_id"].(string)
+	resp, _ = doRequest(t, app, "POST", "/contracts/"+contract+"/branch/",
+		`{"start_at": "2022-11-10T00:00:00Z", "data": {"price": 12}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	_, content = doRequest(t, app, "GET", "/webhooks/"+id+"/deliveries/", "")
+	deliveries := decodeMap(t, content)["results"].([]interface{})
+	require.Len(t, deliveries, 1)
+	require.Equal(t, "branch", deliveries[0].(map[string]interface{})["event"])
+	require.Equal(t, "pending", deliveries[0].(map[string]interface{})["status"])
+
+	_, content = doRequest(t, app, "GET", "/webhooks/", "")
+	require.Len(t, decodeMap(t, content)["results"], 1)
+
+	resp, _ = doRequest(t, app, "DELETE", "/webhooks/"+id+"/", "")
+	require.Equal(t, fiber.StatusNoContent, resp.StatusCode)
+	resp, _ = doRequest(t, app, "GET", "/webhooks/"+id+"/", "")
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+}
+
+func TestDeleteContract(t *testing.T) {
+	app := newTestApp()
+	kept := createTestContract(t, app, testContract)["_id"].(string)
+	id := createTestContract(t, app, testContract)["_id"].(string)
+
+	resp, _ := doRequest(t, app, "DELETE", "/contracts/"+id+"/", "")
+	require.Equal(t, fiber.StatusNoContent, resp.StatusCode)
+	resp, _ = doRequest(t, app, "DELETE", "/contracts/"+id+"/", "")
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/", "")
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+	resp, _ = doRequest(t, app, "POST", "/contracts/"+id+"/branch/", `{"start_at": "2022-11-10T00:00:00Z", "data": {}}`)
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+
+	resp, content := doRequest(t, app, "GET", "/contracts/"+id+"/?include_deleted=true", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Contains(t, decodeMap(t, content), "deleted_at")
+
+	_, content = doRequest(t, app, "GET", "/contracts/", "")
+	results := decodeMap(t, content)["results"].([]interface{})
+	require.Len(t, results, 1)
+	require.Equal(t, kept, results[0].(map[string]interface{})["_id"])
+
+	_, content = doRequest(t, app, "GET", "/contracts/?include_deleted=true", "")
+	require.Len(t, decodeMap(t, content)["results"], 2)
+
+	resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/restore/", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	contract := decodeMap(t, content)
+	require.NotContains(t, contract, "deleted_at")
+	require.EqualValues(t, 2, contract["version"])
+
+	resp, _ = doRequest(t, app, "POST", "/contracts/"+kept+"/restore/", "")
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	_, content = doRequest(t, app, "GET", "/contracts/"+id+"/verify", "")
+	require.Equal(t, true, decodeMap(t, content)["consistent"])
+}
+
+func TestFilterContracts(t *testing.T) {
+	app := newTestApp()
+
+	var ids []string
+	for _, body := range []string{
+		`{"start_at": "2022-01-01T00:00:00Z", "end_at": "2023-01-01T00:00:00Z", "meta": {"plan": "gold", "seats": 5}, "data": {"price": 10}}`,
+		`{"start_at": "2022-06-01T00:00:00Z", "end_at": "2024-01-01T00:00:00Z", "meta": {"plan": "silver", "seats": 20}, "data": {"price": 20}}`,
+		`{"start_at": "2023-06-01T00:00:00Z", "end_at": "2025-01-01T00:00:00Z", "meta": {"plan": "gold", "seats": 50}, "data": {"price": 30}}`,
+	} {
+		ids = append(ids, createTestContract(t, app, body)["_id"].(string))
+	}
+
+	list := func(query string) ([]string, interface{}) {
+		resp, content := doRequest(t, app, "GET", "/contracts/?"+query, "")
+		require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+		decoded := decodeMap(t, content)
+		var found []string
+		for _, result := range decoded["results"].([]interface{}) {
+			found = append(found, result.(map[string]interface{})["_id"].(string))
+		}
+		return found, decoded["next"]
+	}
+
+	found, next := list("meta.plan=gold")
+	require.Equal(t, []string{ids[2], ids[0]}, found)
+	require.Nil(t, next)
+
+	found, _ = list("meta.plan[in]=silver,bronze")
+	require.Equal(t, []string{ids[1]}, found)
+	found, _ = list("meta.seats[gte]=20&meta.seats[lt]=50")
+	require.Equal(t, []string{ids[1]}, found)
+	found, _ = list("active_at=2022-07-01")
+	require.Equal(t, []string{ids[1], ids[0]}, found)
+	found, _ = list("end_at[gt]=2023-06-01&start_at[lt]=2023-01-01")
+	require.Equal(t, []string{ids[1]}, found)
+	found, _ = list("data.price[gte]=20&data_at=2023-07-01")
+	require.Equal(t, []string{ids[2], ids[1]}, found)
+
+	found, next = list("sort=_id&limit=2")
+	require.Equal(t, []string{ids[0], ids[1]}, found)
+	require.NotNil(t, next)
+	found, _ = list("sort=_id&limit=2&cursor=" + next.(string))
+	require.Equal(t, []string{ids[2]}, found)
+
+	// Times are stored in milliseconds.
+	time.Sleep(2 * time.Millisecond)
+	resp, content := doRequest(t, app, "PATCH", "/contracts/"+ids[1]+"/", `{"meta": {"plan": "silver", "seats": 20}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+
+	found, next = list("sort=-updated_at&limit=1")
+	require.Equal(t, []string{ids[1]}, found)
+	found, _ = list("sort=-updated_at&limit=5&cursor=" + next.(string))
+	require.Len(t, found, 2)
+
+	for _, query := range []string{"sort=version", "limit=0", "limit=500", "meta.seats[like]=5", "active_at=now", "sort=updated_at&cursor=" + ids[0]} {
+		resp, _ := doRequest(t, app, "GET", "/contracts/?"+query, "")
+		require.Equal(t, fiber.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+func TestListChanges(t *testing.T) {
+	app := newTestApp()
+
+	first := createTestContract(t, app, `{"start_at": "2022-01-01T00:00:00Z", "end_at": "2022-12-01T00:00:00Z",
+		"meta": {"plan": "gold"}, "data": {"price": 10}}`)["_id"].(string)
+	second := createTestContract(t, app, `{"start_at": "2022-05-01T00:00:00Z", "end_at": "2023-05-01T00:00:00Z",
+		"meta": {"plan": "silver"}, "data": {"price": 20}}`)["_id"].(string)
+	resp, content := doRequest(t, app, "POST", "/contracts/"+first+"/branch/",
+		`{"start_at": "2022-06-01T00:00:00Z", "data": {"price": 15}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+
+	list := func(query string) ([]map[string]interface{}, interface{}) {
+		resp, content := doRequest(t, app, "GET", "/changes/?"+query, "")
+		require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+		decoded := decodeMap(t, content)
+		var changes []map[string]interface{}
+		for _, result := range decoded["results"].([]interface{}) {
+			changes = append(changes, result.(map[string]interface{}))
+		}
+		return changes, decoded["next"]
+	}
+
+	changes, next := list("from=2022-04-01&to=2022-12-31")
+	require.Nil(t, next)
+	require.Len(t, changes, 3)
+	require.Equal(t, second, changes[0]["contract_id"])
+	require.Equal(t, ChangeStart, changes[0]["type"])
+	require.Equal(t, map[string]interface{}{"plan": "silver"}, changes[0]["meta"])
+	require.Equal(t, first, changes[1]["contract_id"])
+	require.Equal(t, ChangeUpdate, changes[1]["type"])
+	require.Equal(t, "2022-06-01T00:00:00Z", changes[1]["at"])
+	require.Equal(t, map[string]interface{}{"price": float64(10)}, changes[1]["old_data"])
+	require.Equal(t, map[string]interface{}{"price": float64(15)}, changes[1]["new_data"])
+	require.Equal(t, ChangeEnd, changes[2]["type"])
+	require.Nil(t, changes[2]["new_data"])
+
+	changes, _ = list("from=2022-04-01&to=2022-12-31&meta.plan=gold")
+	require.Len(t, changes, 2)
+
+	changes, next = list("from=2022-01-01&to=2024-01-01&limit=2")
+	require.Len(t, changes, 2)
+	require.Equal(t, "2022-05-01T00:00:00Z", changes[1]["at"])
+	changes, next = list("from=2022-01-01&to=2024-01-01&limit=2&cursor=" + next.(string))
+	require.Len(t, changes, 2)
+	require.Equal(t, "2022-06-01T00:00:00Z", changes[0]["at"])
+	require.Equal(t, "2022-12-01T00:00:00Z", changes[1]["at"])
+	changes, next = list("from=2022-01-01&to=2024-01-01&limit=2&cursor=" + next.(string))
+	require.Len(t, changes, 1)
+	require.Nil(t, next)
+
+	for _, query := range []string{"from=soon", "from=2023-01-01&to=2022-01-01", "limit=0", "cursor=" + first} {
+		resp, _ := doRequest(t, app, "GET", "/changes/?"+query, "")
+		require.Equal(t, fiber.StatusBadRequest, resp.StatusCode, query)
+	}
+}
+
+func TestBranchDataRef(t *testing.T) {
+	app := newTestApp()
+	contract := createTestContract(t, app, testContract)
+	id := contract["_id"].(string)
+	first := contract["items"].([]interface{})[0].(map[string]interface{})["_id"].(string)
+
+	resp, content := doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2023-01-01T00:00:00Z", "end_at": "2023-03-01T00:00:00Z", "data": {"_ref": "`+first+`"}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+
+	// The branch holds the data of the one it refers to.
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/branches/?from=2023-02-01&to=2023-02-02&active=true", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	results := decodeMap(t, content)["results"].([]interface{})
+	require.Len(t, results, 1)
+	require.Equal(t, map[string]interface{}{"price": float64(10)}, results[0].(map[string]interface{})["data"])
+
+	for _, ref := range []string{"not-an-id", "63a0b5d1b6c3f1e2d4a5b6c7"} {
+		resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+			`{"start_at": "2023-05-01T00:00:00Z", "data": {"_ref": "`+ref+`"}}`)
+		require.Equal(t, fiber.StatusUnprocessableEntity, resp.StatusCode, ref)
+		require.Equal(t, "dangling_ref", decodeMap(t, content)["code"])
+	}
+}
+
+func TestBranches(t *testing.T) {
+	app := newTestApp()
+	id := createTestContract(t, app, testContract)["_id"].(string)
+
+	resp, content := doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2023-01-01T00:00:00Z", "end_at": "2023-03-01T00:00:00Z", "data": {"price": 12}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+
+	list := func(query string) []interface{} {
+		resp, content := doRequest(t, app, "GET", "/contracts/"+id+"/branches/?"+query, "")
+		require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+		return decodeMap(t, content)["results"].([]interface{})
+	}
+	require.Len(t, list(""), 4)
+	require.Len(t, list("active=false"), 1)
+	require.Len(t, list("from=2023-02-01&to=2023-02-02&active=true"), 1)
+
+	active := list("active=true")
+	require.Len(t, active, 3)
+	left := active[0].(map[string]interface{})
+	require.Equal(t, map[string]interface{}{"price": float64(10)}, left["data"])
+	require.NotNil(t, left["split_from"])
+
+	original := list("active=false")[0].(map[string]interface{})["branch"].(map[string]interface{})["_id"].(string)
+	branch := active[1].(map[string]interface{})["branch"].(map[string]interface{})["_id"].(string)
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/branches/"+branch+"/", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	detail := decodeMap(t, content)
+	require.Equal(t, true, detail["active"])
+	require.Equal(t, []interface{}{original}, detail["replaces"])
+	require.Nil(t, detail["split_from"])
+	lineage := detail["lineage"].(map[string]interface{})
+	require.Equal(t, []interface{}{original}, lineage["ancestors"])
+	require.Len(t, lineage["branches"], 2)
+	require.Equal(t, []interface{}{map[string]interface{}{"from": original, "to": branch}}, lineage["edges"])
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/branches/"+original+"/", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	require.Len(t, decodeMap(t, content)["lineage"].(map[string]interface{})["descendants"], 3)
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/branches/"+id+"/", "")
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "branch_not_found", decodeMap(t, content)["code"])
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/branches/nope/", "")
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/branches/?active=maybe", "")
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+func TestPatchContract(t *testing.T) {
+	app := newTestApp()
+	id := createTestContract(t, app, `{"start_at": "2022-10-10T00:00:00Z", "end_at": "2023-10-10T00:00:00Z",
+		"meta": {"name": "Lease", "plan": "gold", "tags": ["a"]}, "data": {"price": 10}}`)["_id"].(string)
+
+	patch := func(contentType, body string, headers ...string) (*http.Response, map[string]interface{}) {
+		resp, content := doRequest(t, app, "PATCH", "/contracts/"+id+"/", body,
+			append([]string{"Content-Type", contentType}, headers...)...)
+		if resp.StatusCode != fiber.StatusOK {
+			return resp, nil
+		}
+		return resp, decodeMap(t, content)
+	}
+	const jsonPatch, mergePatch = "application/json-patch+json", "application/merge-patch+json"
+
+	// Made in place.
+	resp, document := patch(jsonPatch, `[
+		{"op": "test", "path": "/meta/plan", "value": "gold"},
+		{"op": "replace", "path": "/meta/plan", "value": "silver"},
+		{"op": "add", "path": "/meta/seats", "value": 5}
+	]`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.EqualValues(t, 1, document["version"])
+	require.Equal(t, map[string]interface{}{"name": "Lease", "plan": "silver", "seats": float64(5), "tags": []interface{}{"a"}}, document["meta"])
+	require.NotEmpty(t, document["items"])
+
+	// Applied to the contract, since arrays can't be patched in place.
+	resp, document = patch(jsonPatch, `[{"op": "add", "path": "/meta/tags/-", "value": "b"}]`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, []interface{}{"a", "b"}, document["meta"].(map[string]interface{})["tags"])
+
+	resp, document = patch(mergePatch, `{"meta": {"seats": null, "owner": {"name": "Ada"}}}`, "If-Match", `"2"`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, map[string]interface{}{
+		"name": "Lease", "plan": "silver", "tags": []interface{}{"a", "b"}, "owner": map[string]interface{}{"name": "Ada"},
+	}, document["meta"])
+	require.Equal(t, `"3"`, resp.Header.Get("ETag"))
+
+	resp, _ = patch(mergePatch, `{"meta": {"plan": "gold"}}`, "If-Match", `"2"`)
+	require.Equal(t, fiber.StatusPreconditionFailed, resp.StatusCode)
+	resp, _ = patch(jsonPatch, `[{"op": "test", "path": "/meta/plan", "value": "gold"}, {"op": "remove", "path": "/meta/plan"}]`)
+	require.Equal(t, fiber.StatusConflict, resp.StatusCode)
+	resp, _ = patch(jsonPatch, `[{"op": "remove", "path": "/meta/missing"}]`)
+	require.Equal(t, fiber.StatusConflict, resp.StatusCode)
+	resp, _ = patch(jsonPatch, `[{"op": "remove", "path": "/items/0"}]`)
+	require.Equal(t, fiber.StatusUnprocessableEntity, resp.StatusCode)
+	resp, _ = patch(mergePatch, `{"meta": {"plan": "gold"}, "items": null}`)
+	require.Equal(t, fiber.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp, content := doRequest(t, app, "GET", "/contracts/"+id+"/events/", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	events := decodeMap(t, content)["results"].([]interface{})
+	require.Len(t, events, 4)
+	require.Equal(t, EventMeta, events[3].(map[string]interface{})["type"])
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/verify", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	require.Equal(t, true, decodeMap(t, content)["consistent"])
+
+	resp, _ = doRequest(t, app, "DELETE", "/contracts/"+id+"/", "")
+	require.Equal(t, fiber.StatusNoContent, resp.StatusCode)
+	resp, _ = patch(mergePatch, `{"meta": {"plan": "gold"}}`)
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+}
+
+func TestMetaRevisions(t *testing.T) {
+	app := newTestApp()
+	id := createTestContract(t, app, testContract)["_id"].(string)
+
+	for _, meta := range []string{`{"name": "Rent"}`, `{"name": "Rent", "plan": "gold"}`} {
+		resp, content := doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": `+meta+`}`, "X-Actor", "alice")
+		require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	}
+	resp, content := doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2023-01-01T00:00:00Z", "data": {"price": 12}}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/meta/history", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	revisions := decodeMap(t, content)["results"].([]interface{})
+	require.Len(t, revisions, 3)
+	second := revisions[1].(map[string]interface{})
+	require.EqualValues(t, 1, second["version"])
+	require.Equal(t, "alice", second["actor"])
+	require.Equal(t, map[string]interface{}{"name": "Rent"}, second["meta"])
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/meta", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	require.EqualValues(t, 2, decodeMap(t, content)["version"])
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/meta?at=2000-01-01", "")
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/meta?at=yesterday", "")
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/meta/restore/", `{"version": 1}`)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	restored := decodeMap(t, content)
+	require.Equal(t, map[string]interface{}{"name": "Rent"}, restored["meta"])
+	require.EqualValues(t, 4, restored["version"])
+	require.Len(t, restored["items"], 3)
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/meta/history", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Len(t, decodeMap(t, content)["results"], 4)
+
+	for _, body := range []string{`{"version": 4}`, `{}`} {
+		resp, _ = doRequest(t, app, "POST", "/contracts/"+id+"/meta/restore/", body)
+		require.Equal(t, fiber.StatusBadRequest, resp.StatusCode, body)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	app := newTestApp()
+
+	resp, content := doRequest(t, app, "POST", "/contracts/", testContract, "Idempotency-Key", "create-1")
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	created := decodeMap(t, content)
+
+	resp, replayed := doRequest(t, app, "POST", "/contracts/", testContract, "Idempotency-Key", "create-1")
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode)
+	require.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+	require.Equal(t, content, replayed)
+
+	resp, content = doRequest(t, app, "GET", "/contracts/", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Len(t, decodeMap(t, content)["results"], 1)
+
+	resp, _ = doRequest(t, app, "POST", "/contracts/", `{"meta": {}}`, "Idempotency-Key", "create-1")
+	require.Equal(t, fiber.StatusUnprocessableEntity, resp.StatusCode)
+
+	// Others making the same request with the same key are not
+	// given the response, their request is carried out.
+	resp, content = doRequest(t, app, "POST", "/contracts/", testContract,
+		"Idempotency-Key", "create-1", "X-Actor", "bob")
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+	require.NotEqual(t, created["_id"], decodeMap(t, content)["_id"])
+	resp, content = doRequest(t, app, "GET", "/contracts/", "")
+	require.Len(t, decodeMap(t, content)["results"], 2)
+
+	// Branching twice with the same key only branches once.
+	path := "/contracts/" + created["_id"].(string) + "/branch/"
+	body := `{"start_at": "2023-01-01T00:00:00Z", "data": {"price": 12}}`
+	for i := 0; i < 2; i++ {
+		resp, content = doRequest(t, app, "POST", path, body, "Idempotency-Key", "branch-1")
+		require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+		require.EqualValues(t, 1, decodeMap(t, content)["version"])
+		require.Equal(t, `"1"`, resp.Header.Get("ETag"))
+	}
+
+	// Failed requests are replayed as well.
+	for i := 0; i < 2; i++ {
+		resp, content = doRequest(t, app, "POST", "/contracts/", `{}`, "Idempotency-Key", "invalid")
+		require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+		require.Equal(t, "application/problem+json", resp.Header.Get(fiber.HeaderContentType))
+		require.Equal(t, "validation_failed", decodeMap(t, content)["code"])
+	}
+	require.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+
+	resp, _ = doRequest(t, app, "POST", "/contracts/", testContract, "Idempotency-Key", strings.Repeat("k", 256))
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+}
+
+// failingStore fails to list contracts.
+type failingStore struct {
+	ContractStore
+}
+
+func (s *failingStore) ForTenant(string) (ContractStore, error) {
+	return s, nil
+}
+
+func (s *failingStore) List(ctx context.Context, query ContractQuery) ([]*Contract, error) {
+	return nil, errors.New("connection refused by 10.0.0.1:27017")
+}
+
+func TestProblems(t *testing.T) {
+	app := newApp(NewHandler(&failingStore{NewMemoryStore()}))
+	id := createTestContract(t, app, testContract)["_id"].(string)
+
+	resp, content := doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2023-01-01T00:00:00Z", "data": {"_ref": "63a0b5d1b6c3f1e2d4a5b6c7"}}`)
+	require.Equal(t, fiber.StatusUnprocessableEntity, resp.StatusCode)
+	require.Equal(t, "dangling_ref", decodeMap(t, content)["code"])
+
+	resp, content = doRequest(t, app, "GET", "/contracts/?sort=name", "")
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "invalid_parameter", decodeMap(t, content)["code"])
+
+	// The details of internal errors are not told.
+	resp, content = doRequest(t, app, "GET", "/contracts/?limit=5", "")
+	require.Equal(t, fiber.StatusInternalServerError, resp.StatusCode)
+	require.Equal(t, "application/problem+json", resp.Header.Get(fiber.HeaderContentType))
+	problem := decodeMap(t, content)
+	require.Equal(t, "internal_error", problem["code"])
+	require.Equal(t, "/contracts/?limit=5", problem["instance"])
+	require.NotContains(t, string(content), "10.0.0.1")
+
+	resp, content = doRequest(t, app, "GET", "/webhooks/63a0b5d1b6c3f1e2d4a5b6c7/", "")
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "webhook_not_found", decodeMap(t, content)["code"])
+
+	resp, content = doRequest(t, app, "GET", "/nowhere/", "")
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "not_found", decodeMap(t, content)["code"])
+}
+
+func TestAuthentication(t *testing.T) {
+	store := NewMemoryStore()
+	admin, adminKey, err := NewAPIKey("admin", RoleAdmin)
+	require.NoError(t, err)
+	require.NoError(t, store.APIKeys().Create(context.Background(), admin))
+	secret := []byte("a shared secret")
+	app := newAuthApp(store,
+		APIKeyAuthenticator{Store: store.APIKeys()}, &JWTAuthenticator{Keys: map[string]interface{}{"": secret}},
+	)
+
+	resp, content := doRequest(t, app, "GET", "/contracts/", "")
+	require.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+	require.Equal(t, "Bearer", resp.Header.Get(fiber.HeaderWWWAuthenticate))
+	require.Equal(t, "unauthenticated", decodeMap(t, content)["code"])
+	resp, _ = doRequest(t, app, "GET", "/contracts/", "", "Authorization", "Bearer ck_nope")
+	require.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+	resp, _ = doRequest(t, app, "GET", "/openapi.json", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+
+	// Without authentication there are no keys to manage.
+	resp, _ = doRequest(t, newTestApp(), "GET", "/api-keys/", "")
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+
+	// Admins manage the keys, which are only told once.
+	resp, content = doRequest(t, app, "POST", "/api-keys/", `{"name": "reader"}`, "X-API-Key", adminKey)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	require.Equal(t, RoleViewer, decodeMap(t, content)["role"])
+	resp, content = doRequest(t, app, "POST", "/contracts/", testContract, "X-API-Key", decodeMap(t, content)["key"].(string))
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode, string(content))
+
+	resp, content = doRequest(t, app, "POST", "/api-keys/", `{"name": "deploy", "role": "editor"}`, "X-API-Key", adminKey)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	created := decodeMap(t, content)
+	deployKey := created["key"].(string)
+	require.NotContains(t, created, "hash")
+
+	resp, content = doRequest(t, app, "GET", "/api-keys/", "", "Authorization", "Bearer "+deployKey)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	require.Equal(t, "forbidden", decodeMap(t, content)["code"])
+	resp, content = doRequest(t, app, "GET", "/api-keys/", "", "Authorization", "Bearer "+adminKey)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Len(t, decodeMap(t, content)["results"], 3)
+
+	// The principal is the author of changes, whatever X-Actor says.
+	resp, content = doRequest(t, app, "POST", "/contracts/", testContract,
+		"Authorization", "Bearer "+deployKey, "X-Actor", "mallory")
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	id := decodeMap(t, content)["_id"].(string)
+	deployer := "api_key:" + created["_id"].(string)
+
+	// Tokens without any known role only read.
+	token := signJWT(t, "HS256", "", secret, map[string]interface{}{
+		"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "roles": []string{"owner"},
+	})
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/", "", "Authorization", "Bearer "+token)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2023-01-01T00:00:00Z", "data": {"price": 12}}`, "Authorization", "Bearer "+token)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+
+	token = signJWT(t, "HS256", "", secret, map[string]interface{}{
+		"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "roles": []string{"editor"},
+	})
+	resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/branch/",
+		`{"start_at": "2023-01-01T00:00:00Z", "data": {"price": 12}}`, "Authorization", "Bearer "+token)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	authors := make(map[string]int)
+	for _, item := range decodeMap(t, content)["items"].([]interface{}) {
+		authors[item.(map[string]interface{})["created_by"].(string)]++
+	}
+	require.Equal(t, map[string]int{deployer: 1, "alice": 2}, authors)
+
+	resp, content = doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": {"name": "Rent"}}`,
+		"Authorization", "Bearer "+token)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/meta/history", "", "X-API-Key", deployKey)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	var actors []interface{}
+	for _, revision := range decodeMap(t, content)["results"].([]interface{}) {
+		actors = append(actors, revision.(map[string]interface{})["actor"])
+	}
+	require.Equal(t, []interface{}{deployer, "alice"}, actors)
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/verify", "", "X-API-Key", deployKey)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, true, decodeMap(t, content)["consistent"])
+
+	resp, _ = doRequest(t, app, "DELETE", "/api-keys/"+created["_id"].(string)+"/", "", "X-API-Key", adminKey)
+	require.Equal(t, fiber.StatusNoContent, resp.StatusCode)
+	resp, _ = doRequest(t, app, "GET", "/contracts/", "", "X-API-Key", deployKey)
+	require.Equal(t, fiber.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestTenantIsolation(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	keys := make(map[string]string)
+	for _, tenant := range []string{"acme", "other"} {
+		key, secret, err := NewAPIKey(tenant, RoleAdmin)
+		require.NoError(t, err)
+		key.Tenant = tenant
+		require.NoError(t, store.APIKeys().Create(ctx, key))
+		keys[tenant] = secret
+	}
+	app := newAuthApp(store, APIKeyAuthenticator{Store: store.APIKeys()})
+
+	resp, content := doRequest(t, app, "POST", "/contracts/", testContract,
+		"X-API-Key", keys["acme"], "Idempotency-Key", "create-1")
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	created := decodeMap(t, content)
+	require.Equal(t, "acme", created["tenant"])
+	id := created["_id"].(string)
+
+	for _, request := range [][3]string{
+		{"GET", "/contracts/" + id + "/", ""},
+		{"PATCH", "/contracts/" + id + "/", `{"meta": {"name": "Rent"}}`},
+		{"POST", "/contracts/" + id + "/branch/", `{"start_at": "2023-01-01T00:00:00Z", "data": {"price": 12}}`},
+		{"DELETE", "/contracts/" + id + "/", ""},
+		{"GET", "/contracts/" + id + "/events/", ""},
+		{"GET", "/contracts/" + id + "/replay", ""},
+	} {
+		resp, content = doRequest(t, app, request[0], request[1], request[2], "X-API-Key", keys["other"])
+		require.Equal(t, fiber.StatusNotFound, resp.StatusCode, request[1])
+		require.Equal(t, "contract_not_found", decodeMap(t, content)["code"])
+	}
+	resp, content = doRequest(t, app, "GET", "/contracts/", "", "X-API-Key", keys["other"])
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Empty(t, decodeMap(t, content)["results"])
+	resp, content = doRequest(t, app, "GET", "/contracts/", "", "X-API-Key", keys["acme"])
+	require.Len(t, decodeMap(t, content)["results"], 1)
+
+	// Idempotency keys of tenants don't clash.
+	resp, content = doRequest(t, app, "POST", "/contracts/", testContract,
+		"X-API-Key", keys["other"], "Idempotency-Key", "create-1")
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+	require.NotEqual(t, id, decodeMap(t, content)["_id"])
+
+	resp, content = doRequest(t, app, "POST", "/webhooks/", `{"url": "https://example.com/hook", "secret": "0123456789abcdef"}`,
+		"X-API-Key", keys["acme"])
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	webhookID := decodeMap(t, content)["_id"].(string)
+	resp, content = doRequest(t, app, "GET", "/webhooks/", "", "X-API-Key", keys["other"])
+	require.Empty(t, decodeMap(t, content)["results"])
+	resp, _ = doRequest(t, app, "GET", "/webhooks/"+webhookID+"/", "", "X-API-Key", keys["other"])
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+
+	resp, content = doRequest(t, app, "GET", "/api-keys/", "", "X-API-Key", keys["other"])
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	results := decodeMap(t, content)["results"].([]interface{})
+	require.Len(t, results, 1)
+	require.Equal(t, "other", results[0].(map[string]interface{})["tenant"])
+}
+
+func TestAccessControl(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	keys := make(map[string]string)
+	subjects := make(map[string]string)
+	for _, role := range []string{RoleViewer, RoleEditor, RoleAdmin} {
+		key, secret, err := NewAPIKey(role, role)
+		require.NoError(t, err)
+		require.NoError(t, store.APIKeys().Create(ctx, key))
+		keys[role], subjects[role] = secret, "api_key:"+key.ID.Hex()
+	}
+	app := newAuthApp(store, APIKeyAuthenticator{Store: store.APIKeys()})
+	as := func(role string) []string {
+		return []string{"X-API-Key", keys[role]}
+	}
+
+	resp, content := doRequest(t, app, "POST", "/contracts/", testContract, as(RoleAdmin)...)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode)
+	id := decodeMap(t, content)["_id"].(string)
+	branch := `{"start_at": "2023-01-01T00:00:00Z", "data": {"price": 12}}`
+
+	// Viewers read, but can't change anything.
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/", "", as(RoleViewer)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/branch/", branch, as(RoleViewer)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	problem := decodeMap(t, content)
+	require.Equal(t, "forbidden", problem["code"])
+	require.Equal(t, PermWrite, problem["permission"])
+	require.Equal(t, RoleEditor, problem["required_role"])
+	require.Contains(t, problem["detail"], "the viewer role")
+	resp, _ = doRequest(t, app, "POST", "/contracts/", testContract, as(RoleViewer)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/grants/", "", as(RoleViewer)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+
+	// Grants allow more on a single contract.
+	grant := `{"subject": "` + subjects[RoleViewer] + `", "role": "editor"}`
+	resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/grants/", grant, as(RoleAdmin)...)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	require.Equal(t, subjects[RoleAdmin], decodeMap(t, content)["granted_by"])
+	resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/branch/", branch, as(RoleViewer)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	resp, _ = doRequest(t, app, "POST", "/contracts/", testContract, as(RoleViewer)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/grants/", "", as(RoleAdmin)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Len(t, decodeMap(t, content)["results"], 1)
+
+	path := "/contracts/" + id + "/grants/" + url.PathEscape(subjects[RoleViewer]) + "/"
+	resp, _ = doRequest(t, app, "DELETE", path, "", as(RoleAdmin)...)
+	require.Equal(t, fiber.StatusNoContent, resp.StatusCode)
+	resp, content = doRequest(t, app, "DELETE", path, "", as(RoleAdmin)...)
+	require.Equal(t, fiber.StatusNotFound, resp.StatusCode)
+	require.Equal(t, "grant_not_found", decodeMap(t, content)["code"])
+	resp, _ = doRequest(t, app, "PATCH", "/contracts/"+id+"/", `{"meta": {"name": "Rent"}}`, as(RoleViewer)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+
+	// They also allow less, down to nothing.
+	resp, content = doRequest(t, app, "POST", "/contracts/", testContract, as(RoleEditor)...)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode)
+	other := decodeMap(t, content)["_id"].(string)
+	grant = `{"subject": "` + subjects[RoleEditor] + `", "role": "viewer"}`
+	resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/grants/", grant, as(RoleAdmin)...)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/", "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	resp, _ = doRequest(t, app, "POST", "/contracts/"+id+"/branch/", branch, as(RoleEditor)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+
+	grant = `{"subject": "` + subjects[RoleEditor] + `", "role": "none"}`
+	resp, content = doRequest(t, app, "POST", "/contracts/"+id+"/grants/", grant, as(RoleAdmin)...)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	resp, content = doRequest(t, app, "GET", "/contracts/"+id+"/", "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	problem = decodeMap(t, content)
+	require.Equal(t, PermRead, problem["permission"])
+	require.Contains(t, problem["detail"], "no role")
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/events/", "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	resp, content = doRequest(t, app, "POST", "/contracts/"+other+"/branch/", branch, as(RoleEditor)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+
+	// Nor do listings show denied contracts.
+	for _, path := range []string{
+		"/contracts/", "/contracts/calendar.ics", "/contracts/export.ndjson", "/contracts/export.csv",
+		"/changes/?from=2022-01-01&to=2024-01-01",
+	} {
+		resp, content = doRequest(t, app, "GET", path, "", as(RoleEditor)...)
+		require.Equal(t, fiber.StatusOK, resp.StatusCode, path)
+		require.Contains(t, string(content), other, path)
+		require.NotContains(t, string(content), id, path)
+		resp, content = doRequest(t, app, "GET", path, "", as(RoleViewer)...)
+		require.Contains(t, string(content), id, path)
+	}
+
+	// Admins can't be kept out of a contract.
+	grant = `{"subject": "` + subjects[RoleAdmin] + `", "role": "none"}`
+	resp, _ = doRequest(t, app, "POST", "/contracts/"+id+"/grants/", grant, as(RoleAdmin)...)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode)
+	resp, _ = doRequest(t, app, "GET", "/contracts/"+id+"/grants/", "", as(RoleAdmin)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+}
+
+func TestIdempotencyPrincipals(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	keys := make(map[string]string)
+	for _, role := range []string{RoleViewer, RoleEditor, RoleAdmin} {
+		key, secret, err := NewAPIKey(role, role)
+		require.NoError(t, err)
+		require.NoError(t, store.APIKeys().Create(ctx, key))
+		keys[role] = secret
+	}
+	app := newAuthApp(store, APIKeyAuthenticator{Store: store.APIKeys()})
+	as := func(role string) []string {
+		return []string{"X-API-Key", keys[role], "Idempotency-Key", "create-1"}
+	}
+
+	// Forbidden requests are not kept, nor are the
+	// responses of others given to principals.
+	resp, _ := doRequest(t, app, "POST", "/contracts/", testContract, as(RoleViewer)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	resp, content := doRequest(t, app, "POST", "/contracts/", testContract, as(RoleEditor)...)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+	require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+	resp, _ = doRequest(t, app, "POST", "/contracts/", testContract, as(RoleViewer)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	resp, _ = doRequest(t, app, "POST", "/contracts/", testContract, as(RoleAdmin)...)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+	resp, replayed := doRequest(t, app, "POST", "/contracts/", testContract, as(RoleEditor)...)
+	require.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+	require.Equal(t, content, replayed)
+
+	// Created API keys are told once, so they are never kept.
+	created := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		resp, content = doRequest(t, app, "POST", "/api-keys/", `{"name": "deploy"}`, as(RoleAdmin)...)
+		require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+		require.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+		created[decodeMap(t, content)["key"].(string)] = true
+	}
+	require.Len(t, created, 2)
+}
+
+func TestProposals(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	keys := make(map[string]string)
+	for _, role := range []string{RoleEditor, RoleApprover} {
+		key, secret, err := NewAPIKey(role, role)
+		require.NoError(t, err)
+		require.NoError(t, store.APIKeys().Create(ctx, key))
+		keys[role] = secret
+	}
+	handler := NewHandler(store)
+	handler.branchApproval = true
+	app := newApp(handler, Authenticate(APIKeyAuthenticator{Store: store.APIKeys()}))
+	as := func(role string) []string {
+		return []string{"X-API-Key", keys[role]}
+	}
+
+	resp, content := doRequest(t, app, "POST", "/contracts/", testContract, as(RoleEditor)...)
+	require.Equal(t, fiber.StatusCreated, resp.StatusCode)
+	path := "/contracts/" + decodeMap(t, content)["_id"].(string) + "/"
+	branch := `{"start_at": "2023-01-01T00:00:00Z", "data": {"price": 12}}`
+	propose := func() string {
+		resp, content := doRequest(t, app, "POST", path+"proposals/", branch, as(RoleEditor)...)
+		require.Equal(t, fiber.StatusCreated, resp.StatusCode, string(content))
+		proposal := decodeMap(t, content)
+		require.Equal(t, ProposalPending, proposal["status"])
+		return path + "proposals/" + proposal["_id"].(string) + "/"
+	}
+
+	// Editors can only propose branches.
+	resp, content = doRequest(t, app, "POST", path+"branch/", branch, as(RoleEditor)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	require.Equal(t, RoleApprover, decodeMap(t, content)["required_role"])
+	resp, content = doRequest(t, app, "POST", path+"proposals/",
+		`{"start_at": "2025-01-01T00:00:00Z", "data": {}}`, as(RoleEditor)...)
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+	require.Equal(t, "branch_out_of_bounds", decodeMap(t, content)["code"])
+
+	accepted := propose()
+	resp, content = doRequest(t, app, "GET", accepted+"preview", "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	preview := decodeMap(t, content)
+	require.Equal(t, false, preview["stale"])
+	require.Len(t, preview["contract"].(map[string]interface{})["items"], 3)
+	resp, _ = doRequest(t, app, "POST", accepted+"accept/", "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+
+	resp, content = doRequest(t, app, "POST", accepted+"accept/", "", as(RoleApprover)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	view := decodeMap(t, content)
+	require.Equal(t, ProposalAccepted, view["proposal"].(map[string]interface{})["status"])
+	require.EqualValues(t, 1, view["proposal"].(map[string]interface{})["applied_version"])
+	require.Len(t, view["contract"].(map[string]interface{})["items"], 3)
+	resp, content = doRequest(t, app, "POST", accepted+"accept/", "", as(RoleApprover)...)
+	require.Equal(t, fiber.StatusConflict, resp.StatusCode)
+	require.Equal(t, "proposal_decided", decodeMap(t, content)["code"])
+
+	// Proposals made before the branches changed can't be accepted,
+	// whereas changes to the meta don't matter.
+	stale := propose()
+	resp, _ = doRequest(t, app, "PATCH", path, `{"meta": {"name": "Rent"}}`, as(RoleEditor)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	resp, content = doRequest(t, app, "GET", stale+"preview", "", as(RoleApprover)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, false, decodeMap(t, content)["stale"])
+	resp, _ = doRequest(t, app, "POST", path+"revert/", `{"version": 0}`, as(RoleEditor)...)
+	require.Equal(t, fiber.StatusForbidden, resp.StatusCode)
+	resp, content = doRequest(t, app, "POST", path+"branch/",
+		`{"start_at": "2023-06-01T00:00:00Z", "data": {"price": 14}}`, as(RoleApprover)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	resp, content = doRequest(t, app, "GET", stale+"preview", "", as(RoleApprover)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, true, decodeMap(t, content)["stale"])
+	resp, content = doRequest(t, app, "POST", stale+"accept/", "", as(RoleApprover)...)
+	require.Equal(t, fiber.StatusConflict, resp.StatusCode)
+	require.Equal(t, "proposal_stale", decodeMap(t, content)["code"])
+	resp, content = doRequest(t, app, "GET", stale, "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, ProposalStale, decodeMap(t, content)["status"])
+
+	rejected := propose()
+	resp, content = doRequest(t, app, "POST", rejected+"reject/", `{"reason": "too cheap"}`, as(RoleApprover)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+	require.Equal(t, "too cheap", decodeMap(t, content)["reason"])
+
+	resp, content = doRequest(t, app, "GET", path+"proposals/", "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Len(t, decodeMap(t, content)["results"], 3)
+	resp, content = doRequest(t, app, "GET", path+"proposals/?status=pending", "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Empty(t, decodeMap(t, content)["results"])
+	resp, _ = doRequest(t, app, "GET", path+"proposals/?status=unknown", "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusBadRequest, resp.StatusCode)
+
+	// The accepted proposal and the branch of the approver are the
+	// only branches made.
+	resp, content = doRequest(t, app, "GET", path+"events/", "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Len(t, decodeMap(t, content)["results"], 4)
+
+	// Acceptances cut short are settled as soon as they are looked at,
+	// as accepted if their branch was made and as pending otherwise.
+	tenant, err := store.ForTenant(DefaultTenant)
+	require.NoError(t, err)
+	abandon := func(path string) {
+		ids := strings.Split(strings.Trim(path, "/"), "/")
+		contractID, err := primitive.ObjectIDFromHex(ids[1])
+		require.NoError(t, err)
+		id, err := primitive.ObjectIDFromHex(ids[3])
+		require.NoError(t, err)
+		proposal, err := tenant.Proposals().Get(ctx, contractID, id)
+		require.NoError(t, err)
+		from := proposal.Status
+		proposal.decide(ProposalAccepted, "approver", "")
+		decidedAt := proposal.DecidedAt.Add(-acceptTimeout - time.Second)
+		proposal.AppliedVersion, proposal.DecidedAt = nil, &decidedAt
+		require.NoError(t, tenant.Proposals().Decide(ctx, proposal, from))
+	}
+	abandon(accepted)
+	resp, content = doRequest(t, app, "GET", accepted, "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	proposal := decodeMap(t, content)
+	require.Equal(t, ProposalAccepted, proposal["status"])
+	require.EqualValues(t, 1, proposal["applied_version"])
+
+	interrupted := propose()
+	abandon(interrupted)
+	resp, content = doRequest(t, app, "GET", path+"proposals/", "", as(RoleEditor)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Equal(t, ProposalPending, decodeMap(t, content)["results"].([]interface{})[3].(map[string]interface{})["status"])
+	resp, content = doRequest(t, app, "POST", interrupted+"reject/", "", as(RoleApprover)...)
+	require.Equal(t, fiber.StatusOK, resp.StatusCode, string(content))
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook is a subscription to the changes of contracts. Events lists
+// the event types to deliver (all of them if empty), Meta limits the
+// deliveries to contracts having the given meta values.
+type Webhook struct {
+	ID        primitive.ObjectID `bson:"_id" json:"_id"`
+	Tenant    string             `bson:"tenant,omitempty" json:"tenant,omitempty"`
+	URL       string             `bson:"url" json:"url"`
+	Secret    string             `bson:"secret" json:"-"`
+	Events    []string           `bson:"events" json:"events"`
+	Meta      ArbitraryData      `bson:"meta" json:"meta"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func (w *Webhook) Matches(event *Event, contract *Contract) bool {
+	if len(w.Events) > 0 {
+		found := false
+		for _, kind := range w.Events {
+			found = found || kind == event.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	for key, value := range w.Meta {
+		if current, exists := contract.Meta[key]; !exists || !reflect.DeepEqual(current, value) {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is a notification to be sent to a webhook, kept until it
+// is either delivered or given up on.
+type Delivery struct {
+	ID             primitive.ObjectID `bson:"_id" json:"_id"`
+	WebhookID      primitive.ObjectID `bson:"webhook_id" json:"webhook_id"`
+	ContractID     primitive.ObjectID `bson:"contract_id" json:"contract_id"`
+	Event          string             `bson:"event" json:"event"`
+	Body           []byte             `bson:"body" json:"-"`
+	Status         string             `bson:"status" json:"status"`
+	Attempts       int                `bson:"attempts" json:"attempts"`
+	NextAttemptAt  time.Time          `bson:"next_attempt_at" json:"next_attempt_at"`
+	ResponseStatus int                `bson:"response_status,omitempty" json:"response_status,omitempty"`
+	Error          string             `bson:"error,omitempty" json:"error,omitempty"`
+	CreatedAt      time.Time          `bson:"created_at" json:"created_at"`
+	DeliveredAt    *time.Time         `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+}
+
+func NewDelivery(webhook *Webhook, event *Event, contract *Contract) (*Delivery, error) {
+	now := time.Now().UTC()
+	delivery := &Delivery{
+		ID:            primitive.NewObjectID(),
+		WebhookID:     webhook.ID,
+		ContractID:    contract.ID,
+		Event:         event.Type,
+		Status:        DeliveryPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+	}
+
+	var err error
+	delivery.Body, err = json.Marshal(struct {
+		ID       primitive.ObjectID `json:"id"`
+		Type     string             `json:"type"`
+		Event    *Event             `json:"event"`
+		Contract *Contract          `json:"contract"`
+	}{delivery.ID, event.Type, event, contract})
+	return delivery, err
+}
+
+type WebhookStore interface {
+	Create(ctx context.Context, webhook *Webhook) error
+	// Get returns the webhook with given ID, or ErrWebhookNotFound.
+	Get(ctx context.Context, id primitive.ObjectID) (*Webhook, error)
+	// List returns every webhook, the oldest first.
+	List(ctx context.Context) ([]*Webhook, error)
+	// ListTenant returns the webhooks of a tenant, the oldest first.
+	ListTenant(ctx context.Context, tenant string) ([]*Webhook, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	// Enqueue adds deliveries to the queue.
+	Enqueue(ctx context.Context, deliveries ...*Delivery) error
+	// Claim returns a pending delivery that is due at the given time,
+	// or nil. Its next attempt is postponed by the lease so that no
+	// other dispatcher picks it up in the meantime.
+	Claim(ctx context.Context, now time.Time, lease time.Duration) (*Delivery, error)
+	// Save stores the outcome of an attempt.
+	Save(ctx context.Context, delivery *Delivery) error
+	// Deliveries returns the latest deliveries of a webhook.
+	Deliveries(ctx context.Context, webhookID primitive.ObjectID, limit int) ([]*Delivery, error)
+}
+
+// tenantWebhooks are the webhooks of a tenant, which only hear of the
+// events of its contracts. Deliveries are claimed regardless of tenants.
+type tenantWebhooks struct {
+	WebhookStore
+	tenant string
+}
+
+func (s tenantWebhooks) Create(ctx context.Context, webhook *Webhook) error {
+	webhook.Tenant = s.tenant
+	return s.WebhookStore.Create(ctx, webhook)
+}
+
+func (s tenantWebhooks) Get(ctx context.Context, id primitive.ObjectID) (*Webhook, error) {
+	webhook, err := s.WebhookStore.Get(ctx, id)
+	if err == nil && webhook.Tenant != s.tenant {
+		return nil, ErrWebhookNotFound
+	}
+	return webhook, err
+}
+
+func (s tenantWebhooks) List(ctx context.Context) ([]*Webhook, error) {
+	return s.WebhookStore.ListTenant(ctx, s.tenant)
+}
+
+func (s tenantWebhooks) Delete(ctx context.Context, id primitive.ObjectID) error {
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+	return s.WebhookStore.Delete(ctx, id)
+}
+
+func (s tenantWebhooks) Deliveries(ctx context.Context, webhookID primitive.ObjectID, limit int) ([]*Delivery, error) {
+	if _, err := s.Get(ctx, webhookID); err != nil {
+		return nil, err
+	}
+	return s.WebhookStore.Deliveries(ctx, webhookID, limit)
+}
+
+func signPayload(secret string, timestamp int64, body []byte) string {
+	// The timestamp is signed along with the body so that
+	// receivers can reject replays of old deliveries.
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+const (
+	deliveryLease       = time.Minute
+	deliveryMaxAttempts = 10
+	deliveryBaseDelay   = 10 * time.Second
+	deliveryMaxDelay    = time.Hour
+	// How many deliveries are sent to a webhook at once.
+	deliveryConcurrency = 4
+)
+
+func deliveryBackoff(attempts int) time.Duration {
+	// 10s, 20s, 40s... up to an hour between the attempts.
+	delay := deliveryBaseDelay
+	for i := 1; i < attempts && delay < deliveryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > deliveryMaxDelay {
+		delay = deliveryMaxDelay
+	}
+	return delay
+}
+
+// Dispatcher sends the queued deliveries to their webhooks.
+type Dispatcher struct {
+	store       WebhookStore
+	client      *http.Client
+	interval    time.Duration
+	concurrency int
+	now         func() time.Time
+}
+
+func NewDispatcher(store WebhookStore) *Dispatcher {
+	return &Dispatcher{
+		store:       store,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		interval:    time.Second,
+		concurrency: deliveryConcurrency,
+		now:         func() time.Time { return time.Now().UTC() },
+	}
+}
+
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.Dispatch(ctx); err != nil {
+			log.Printf("could not dispatch webhook deliveries: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) Dispatch(ctx context.Context) (err error) {
+	/*
+		Attempts every delivery that is currently due. Deliveries are
+		sent concurrently, up to d.concurrency at once for each webhook
+		so that a slow webhook holds up neither the others nor more than
+		its share of connections. Deliveries claimed while their webhook
+		is busy are left for the next round.
+	*/
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := func(saveErr error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			err = saveErr
+		}
+	}
+	defer wg.Wait()
+
+	slots := make(map[primitive.ObjectID]chan struct{})
+	for {
+		delivery, claimErr := d.store.Claim(ctx, d.now(), deliveryLease)
+		if claimErr != nil || delivery == nil {
+			failed(claimErr)
+			return
+		}
+
+		slot, exists := slots[delivery.WebhookID]
+		if !exists {
+			slot = make(chan struct{}, d.concurrency)
+			slots[delivery.WebhookID] = slot
+		}
+		select {
+		case slot <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				d.attempt(ctx, delivery)
+				<-slot
+				if saveErr := d.store.Save(ctx, delivery); saveErr != nil {
+					failed(saveErr)
+				}
+			}()
+		default:
+			delivery.NextAttemptAt = d.now().Add(d.interval)
+			if saveErr := d.store.Save(ctx, delivery); saveErr != nil {
+				failed(saveErr)
+				return
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) attempt(ctx context.Context, delivery *Delivery) {
+	now := d.now()
+	delivery.Attempts++
+
+	webhook, err := d.store.Get(ctx, delivery.WebhookID)
+	if err == nil {
+		err = d.send(ctx, webhook, delivery)
+	}
+
+	switch {
+	case err == nil:
+		delivery.Status = DeliverySucceeded
+		delivery.Error = ""
+		delivery.DeliveredAt = &now
+	case err == ErrWebhookNotFound || delivery.Attempts >= deliveryMaxAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.Error = err.Error()
+	default:
+		delivery.Error = err.Error()
+		delivery.NextAttemptAt = now.Add(deliveryBackoff(delivery.Attempts))
+	}
+}
+
+func (d *Dispatcher) send(ctx context.Context, webhook *Webhook, delivery *Delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+	timestamp := d.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "charlie-webhooks")
+	req.Header.Set("X-Charlie-Event", delivery.Event)
+	req.Header.Set("X-Charlie-Delivery", delivery.ID.Hex())
+	req.Header.Set("X-Charlie-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Charlie-Signature", signPayload(webhook.Secret, timestamp, delivery.Body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	delivery.ResponseStatus = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the webhook responded with %s", resp.Status)
+	}
+	return nil
+}
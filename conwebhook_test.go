@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{"plan": "gold"})
+	event := &Event{Type: EventBranch}
+
+	require.True(t, (&Webhook{}).Matches(event, contract))
+	require.True(t, (&Webhook{Events: []string{"create", "branch"}, Meta: ArbitraryData{"plan": "gold"}}).Matches(event, contract))
+	require.False(t, (&Webhook{Events: []string{"meta"}}).Matches(event, contract))
+	require.False(t, (&Webhook{Meta: ArbitraryData{"plan": "silver"}}).Matches(event, contract))
+	require.False(t, (&Webhook{Meta: ArbitraryData{"region": "eu"}}).Matches(event, contract))
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	require.Equal(t, 10*time.Second, deliveryBackoff(1))
+	require.Equal(t, 40*time.Second, deliveryBackoff(3))
+	require.Equal(t, time.Hour, deliveryBackoff(20))
+}
+
+func TestDispatcher(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore().Webhooks()
+
+	var received []*http.Request
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if len(received) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	webhook := &Webhook{ID: primitive.NewObjectID(), URL: server.URL, Secret: "0123456789abcdef"}
+	require.NoError(t, store.Create(ctx, webhook))
+
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+	delivery, err := NewDelivery(webhook, NewEvent(contract, EventCreate, "", EventPayload{}, nil), contract)
+	require.NoError(t, err)
+	require.NoError(t, store.Enqueue(ctx, delivery))
+
+	now := time.Now().UTC()
+	dispatcher := NewDispatcher(store)
+	dispatcher.now = func() time.Time { return now }
+
+	require.NoError(t, dispatcher.Dispatch(ctx))
+	require.Len(t, received, 1)
+
+	deliveries, err := store.Deliveries(ctx, webhook.ID, 10)
+	require.NoError(t, err)
+	require.Equal(t, DeliveryPending, deliveries[0].Status)
+	require.Equal(t, 1, deliveries[0].Attempts)
+	require.Equal(t, http.StatusServiceUnavailable, deliveries[0].ResponseStatus)
+
+	// Not due until the backoff passes.
+	require.NoError(t, dispatcher.Dispatch(ctx))
+	require.Len(t, received, 1)
+
+	now = now.Add(deliveryBackoff(1))
+	require.NoError(t, dispatcher.Dispatch(ctx))
+	require.Len(t, received, 2)
+
+	deliveries, _ = store.Deliveries(ctx, webhook.ID, 10)
+	require.Equal(t, DeliverySucceeded, deliveries[0].Status)
+	require.Equal(t, 2, deliveries[0].Attempts)
+
+	req := received[1]
+	require.Equal(t, "create", req.Header.Get("X-Charlie-Event"))
+	require.Equal(t, delivery.ID.Hex(), req.Header.Get("X-Charlie-Delivery"))
+	timestamp, _ := strconv.ParseInt(req.Header.Get("X-Charlie-Timestamp"), 10, 64)
+	require.Equal(t, signPayload(webhook.Secret, timestamp, bodies[1]), req.Header.Get("X-Charlie-Signature"))
+
+	// Deliveries of deleted webhooks are given up on.
+	require.NoError(t, store.Delete(ctx, webhook.ID))
+	orphan, _ := NewDelivery(webhook, NewEvent(contract, EventCreate, "", EventPayload{}, nil), contract)
+	require.NoError(t, store.Enqueue(ctx, orphan))
+	require.NoError(t, dispatcher.Dispatch(ctx))
+
+	deliveries, _ = store.Deliveries(ctx, webhook.ID, 1)
+	require.Equal(t, DeliveryFailed, deliveries[0].Status)
+	require.Equal(t, ErrWebhookNotFound.Error(), deliveries[0].Error)
+}
+
+func TestDispatcherConcurrency(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore().Webhooks()
+
+	// The slow webhook answers once two requests to it are in flight
+	// and the fast one was sent its deliveries, which are queued after
+	// those of the slow webhook.
+	arrived, release := make(chan struct{}, 4), make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+	}))
+	defer fast.Close()
+
+	contract, _ := NewContract(newDate(2022, 10, 10), newDate(2023, 10, 10), ArbitraryData{}, ArbitraryData{})
+	event := NewEvent(contract, EventCreate, "", EventPayload{}, nil)
+	enqueue := func(webhook *Webhook, count int) {
+		for i := 0; i < count; i++ {
+			delivery, err := NewDelivery(webhook, event, contract)
+			require.NoError(t, err)
+			require.NoError(t, store.Enqueue(ctx, delivery))
+		}
+	}
+	slowHook := &Webhook{ID: primitive.NewObjectID(), URL: slow.URL}
+	fastHook := &Webhook{ID: primitive.NewObjectID(), URL: fast.URL}
+	require.NoError(t, store.Create(ctx, slowHook))
+	require.NoError(t, store.Create(ctx, fastHook))
+	enqueue(slowHook, 3)
+	enqueue(fastHook, 2)
+
+	now := time.Now().UTC()
+	dispatcher := NewDispatcher(store)
+	dispatcher.concurrency = 2
+	dispatcher.now = func() time.Time { return now }
+
+	go func() {
+		for i := 0; i < 4; i++ {
+			<-arrived
+		}
+		close(release)
+	}()
+	require.NoError(t, dispatcher.Dispatch(ctx))
+	require.Len(t, arrived, 0)
+
+	deliveries, err := store.Deliveries(ctx, fastHook.ID, 10)
+	require.NoError(t, err)
+	for _, delivery := range deliveries {
+		require.Equal(t, DeliverySucceeded, delivery.Status)
+	}
+
+	// The third delivery to the slow webhook waits for the next round.
+	deliveries, err = store.Deliveries(ctx, slowHook.ID, 10)
+	require.NoError(t, err)
+	var succeeded, waiting int
+	for _, delivery := range deliveries {
+		switch {
+		case delivery.Status == DeliverySucceeded:
+			succeeded++
+		case delivery.Attempts == 0:
+			waiting++
+			require.WithinDuration(t, now.Add(dispatcher.interval), delivery.NextAttemptAt, time.Millisecond)
+		}
+	}
+	require.Equal(t, 2, succeeded)
+	require.Equal(t, 1, waiting)
+}
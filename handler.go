@@ -1,27 +1,39 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"github.com/go-playground/validator/v10"
 	"github.com/gofiber/fiber/v2"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"net/url"
 	"reflect"
 	"strings"
+	"time"
 )
 
 type Handler struct {
-	mongoClient *mongo.Client
-	database    *mongo.Database
-	validate    *validator.Validate
+	store        ContractStore
+	validate     *validator.Validate
+	mergeRetries int
+	// Whether branches need approval, in which case only approvers
+	// branch contracts while others propose branches.
+	branchApproval bool
+	// Whether principals are authenticated, without which
+	// there are no API keys to manage.
+	authenticated bool
 }
 
-func NewHandler() *Handler {
+func NewHandler(store ContractStore) *Handler {
 	/*
 		A handler is used as receiver in controllers so
-		that commonly used instances such as the database
-		connector and 'validator' are readily available.
+		that commonly used instances such as the contract
+		store and 'validator' are readily available.
 	*/
-	mi := MongoConnect()
-
 	validate := validator.New()
 	// Register a tag name function so that the fields json
 	// annotation can be used in the error messages.
@@ -34,14 +46,16 @@ func NewHandler() *Handler {
 	})
 
 	return &Handler{
-		mongoClient: mi.Client,
-		database:    mi.Database,
-		validate:    validate,
+		store:          store,
+		validate:       validate,
+		mergeRetries:   MergeRetries,
+		branchApproval: BranchApproval,
+		authenticated:  strings.TrimSpace(AuthMethods) != "",
 	}
 }
 
-func (h *Handler) validateStruct(s interface{}) fiber.Map {
-	// Validates a struct, if any errors returns a map
+func (h *Handler) validateStruct(s interface{}) error {
+	// Validates a struct, if any errors returns a problem
 	// detailing the error with relevant tags.
 	err := h.validate.Struct(s)
 
@@ -49,15 +63,369 @@ func (h *Handler) validateStruct(s interface{}) fiber.Map {
 		return nil
 	}
 
-	errors := make(fiber.Map)
+	fields := make(fiber.Map)
 	for _, err := range err.(validator.ValidationErrors) {
-		errors[err.Field()] = fiber.Map{
+		fields[err.Field()] = fiber.Map{
 			"tag": err.Tag(),
 		}
 	}
 
-	return fiber.Map{
-		"detail": "One or more of the fields are invalid.",
-		"fields": errors,
+	problem := NewProblem(fiber.StatusBadRequest, "validation_failed", "One or more of the fields are invalid.")
+	problem.Fields = fields
+	return problem
+}
+
+// Problem is an error response as described by RFC 7807. Code is a
+// stable identifier of the kind of problem, so that clients need not
+// rely on the wording of Detail.
+type Problem struct {
+	Type     string    `json:"type"`
+	Title    string    `json:"title"`
+	Status   int       `json:"status"`
+	Detail   string    `json:"detail,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Code     string    `json:"code"`
+	Fields   fiber.Map `json:"fields,omitempty"`
+	// The permission that was missing, for forbidden requests.
+	Permission   string `json:"permission,omitempty"`
+	RequiredRole string `json:"required_role,omitempty"`
+}
+
+func NewProblem(status int, code, detail string) *Problem {
+	return &Problem{
+		Type:   "urn:charlie:problem:" + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+func (p *Problem) Error() string {
+	return p.Detail
+}
+
+func invalidParameter(detail string) *Problem {
+	return NewProblem(fiber.StatusBadRequest, "invalid_parameter", detail)
+}
+
+func invalidBody(err error) error {
+	// Fiber tells unsupported content types by itself.
+	var e *fiber.Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return NewProblem(fiber.StatusBadRequest, "invalid_body", err.Error())
+}
+
+// Library errors along with the status and code of their problems.
+var problemTypes = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{ErrUnauthenticated, fiber.StatusUnauthorized, "unauthenticated"},
+	{ErrForbidden, fiber.StatusForbidden, "forbidden"},
+	{ErrNotFound, fiber.StatusNotFound, "contract_not_found"},
+	{ErrAPIKeyNotFound, fiber.StatusNotFound, "api_key_not_found"},
+	{ErrWebhookNotFound, fiber.StatusNotFound, "webhook_not_found"},
+	{ErrGrantNotFound, fiber.StatusNotFound, "grant_not_found"},
+	{ErrProposalNotFound, fiber.StatusNotFound, "proposal_not_found"},
+	{ErrUnknownBranch, fiber.StatusNotFound, "branch_not_found"},
+	{ErrInvalidID, fiber.StatusBadRequest, "invalid_id"},
+	{ErrOutOfBounds, fiber.StatusBadRequest, "branch_out_of_bounds"},
+	{ErrEmptySpan, fiber.StatusBadRequest, "empty_span"},
+	{ErrDanglingRef, fiber.StatusUnprocessableEntity, "dangling_ref"},
+	{ErrVersionConflict, fiber.StatusConflict, "version_conflict"},
+	{ErrProposalDecided, fiber.StatusConflict, "proposal_decided"},
+	{ErrProposalStale, fiber.StatusConflict, "proposal_stale"},
+	{errPatchTestFailed, fiber.StatusConflict, "patch_test_failed"},
+	{errIdempotencyInProgress, fiber.StatusConflict, "idempotency_key_in_use"},
+	{errPreconditionFailed, fiber.StatusPreconditionFailed, "precondition_failed"},
+}
+
+func asProblem(err error) *Problem {
+	/*
+		Tells the problem of an error: problems are returned as they
+		are, library errors have problems of their own and fiber errors
+		get a code after their status. Anything else is an internal
+		error, the details of which are not for the client to see.
+	*/
+	var problem *Problem
+	if errors.As(err, &problem) {
+		copied := *problem
+		return &copied
+	}
+	var denied *PermissionError
+	if errors.As(err, &denied) {
+		problem = NewProblem(fiber.StatusForbidden, "forbidden", err.Error())
+		problem.Permission, problem.RequiredRole = denied.Permission, denied.Required
+		return problem
+	}
+	for _, kind := range problemTypes {
+		if errors.Is(err, kind.err) {
+			return NewProblem(kind.status, kind.code, err.Error())
+		}
+	}
+	var e *fiber.Error
+	if errors.As(err, &e) {
+		code := strings.ReplaceAll(strings.ToLower(http.StatusText(e.Code)), " ", "_")
+		if code == "" {
+			code = "error"
+		}
+		return NewProblem(e.Code, code, e.Message)
+	}
+	return NewProblem(fiber.StatusInternalServerError, "internal_error", "An unexpected error occurred.")
+}
+
+func (h *Handler) ErrorHandler(c *fiber.Ctx, err error) error {
+	// Responds with the problem of the error returned by a handler.
+	problem := asProblem(err)
+	if problem.Status >= fiber.StatusInternalServerError {
+		log.Printf("%s %s: %s", c.Method(), c.OriginalURL(), err)
+	}
+	problem.Instance = c.OriginalURL()
+	if problem.Status == fiber.StatusUnauthorized {
+		c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+	}
+
+	if err = c.Status(problem.Status).JSON(problem); err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, "application/problem+json")
+	return nil
+}
+
+// Paths that can be reached without authentication.
+var publicPaths = map[string]bool{"/openapi.json": true, "/docs/": true}
+
+func credentials(c *fiber.Ctx) string {
+	// API keys may come in their own header, anything
+	// else is a bearer token.
+	if key := c.Get("X-API-Key"); key != "" {
+		return key
+	}
+	scheme, token, found := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+func Authenticate(authenticators ...Authenticator) fiber.Handler {
+	/*
+		Requires requests to be authenticated by one of the
+		authenticators, which are tried in order. The principal is
+		kept in the locals of the request, see principalOf.
+	*/
+	return func(c *fiber.Ctx) error {
+		if publicPaths[c.Path()] {
+			return c.Next()
+		}
+		token := credentials(c)
+		if token == "" {
+			return unauthenticated("no credentials were given")
+		}
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(c.UserContext(), token)
+			if err != nil {
+				return err
+			}
+			if principal != nil {
+				c.Locals("principal", principal)
+				return c.Next()
+			}
+		}
+		return unauthenticated("credentials are not of a supported kind")
+	}
+}
+
+func principalOf(c *fiber.Ctx) *Principal {
+	// The authenticated principal, nil if authentication is not enabled.
+	principal, _ := c.Locals("principal").(*Principal)
+	return principal
+}
+
+func tenantOf(c *fiber.Ctx) string {
+	// Everyone is of the default tenant if authentication is not enabled.
+	if principal := principalOf(c); principal != nil {
+		return principal.Tenant
+	}
+	return DefaultTenant
+}
+
+func (h *Handler) Scope(c *fiber.Ctx) error {
+	// Narrows down the store to the tenant of the request,
+	// so that handlers can't reach the data of other tenants.
+	store, err := h.store.ForTenant(tenantOf(c))
+	if err != nil {
+		return err
+	}
+	c.Locals("store", store)
+	return c.Next()
+}
+
+func storeOf(c *fiber.Ctx) ContractStore {
+	// The store of the tenant of the request, see Scope.
+	store, _ := c.Locals("store").(ContractStore)
+	return store
+}
+
+func Require(permission string) fiber.Handler {
+	// Requires the principal to have the permission by its role.
+	// Anyone may do anything if authentication is not enabled.
+	return func(c *fiber.Ctx) error {
+		if principal := principalOf(c); principal != nil {
+			if err := authorize(principal.Role, permission); err != nil {
+				return err
+			}
+		}
+		return c.Next()
+	}
+}
+
+func roleOn(c *fiber.Ctx, contractID primitive.ObjectID) (string, error) {
+	// The role of the principal on a contract, the one it was
+	// granted on the contract if any, unless it is an admin.
+	principal := principalOf(c)
+	if principal.Role == RoleAdmin {
+		return principal.Role, nil
+	}
+	grant, err := storeOf(c).Grants().Get(context.TODO(), contractID, principal.Subject)
+	if errors.Is(err, ErrGrantNotFound) {
+		return principal.Role, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return grant.Role, nil
+}
+
+func excludeDenied(c *fiber.Ctx, filter *ContractFilter) error {
+	// Leaves the contracts the principal was denied out of a
+	// filter, so that listings don't show them either.
+	principal := principalOf(c)
+	if principal == nil || principal.Role == RoleAdmin {
+		return nil
+	}
+	denied, err := storeOf(c).Grants().Denied(context.TODO(), principal.Subject)
+	filter.Exclude = denied
+	return err
+}
+
+func RequireOnContract(permission string) fiber.Handler {
+	// Same as Require, for the contract of the request on which
+	// the principal might have been granted more or less.
+	return func(c *fiber.Ctx) error {
+		if principalOf(c) == nil {
+			return c.Next()
+		}
+		id, err := contractID(c)
+		if err != nil {
+			return err
+		}
+		role, err := roleOn(c, id)
+		if err != nil {
+			return err
+		}
+		if err = authorize(role, permission); err != nil {
+			return err
+		}
+		return c.Next()
+	}
+}
+
+func requestHash(c *fiber.Ctx) string {
+	// Tells requests apart by what they would do.
+	hash := sha256.New()
+	for _, part := range [][]byte{
+		[]byte(c.Method()), []byte(c.OriginalURL()), []byte(c.Get(fiber.HeaderContentType)), c.Body(),
+	} {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Response headers worth replaying.
+var idempotentHeaders = []string{fiber.HeaderContentType, fiber.HeaderETag, fiber.HeaderLocation}
+
+func (h *Handler) Idempotent(c *fiber.Ctx) error {
+	/*
+		Makes POST and PATCH requests with an Idempotency-Key header
+		safe to retry: the first request with a key is handled as usual
+		and its response is kept, requests with the same key get that
+		response again instead of being handled. A key can't be used
+		for a different request, nor while its request is in progress.
+		Tenants, and whoever makes requests in them, have keys of
+		their own.
+
+		Responses of server errors are not kept, since a retry might
+		well succeed.
+	*/
+	key := c.Get("Idempotency-Key")
+	if key == "" || (c.Method() != fiber.MethodPost && c.Method() != fiber.MethodPatch) {
+		return c.Next()
+	}
+	if len(key) > 255 {
+		return NewProblem(fiber.StatusBadRequest, "invalid_idempotency_key",
+			"Idempotency-Key must be at most 255 characters.")
+	}
+
+	// Tenants can't have colons and those of actors are escaped,
+	// so keys can't be mistaken for the keys of others.
+	key = tenantOf(c) + ":" + url.QueryEscape(actor(c)) + ":" + key
+	ctx := context.TODO()
+	store := h.store.Idempotency()
+	record := &IdempotencyRecord{Key: key, RequestHash: requestHash(c), CreatedAt: time.Now().UTC()}
+	existing, err := store.Reserve(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		switch {
+		case existing.RequestHash != record.RequestHash:
+			return NewProblem(fiber.StatusUnprocessableEntity, "idempotency_key_reused",
+				"Idempotency-Key was already used for a different request.")
+		case !existing.Completed:
+			return errIdempotencyInProgress
+		}
+		for name, value := range existing.Headers {
+			c.Set(name, value)
+		}
+		c.Set("Idempotent-Replayed", "true")
+		return c.Status(existing.Status).Send(existing.Body)
+	}
+
+	if err = c.Next(); err != nil {
+		// Respond with the problem right away, so
+		// that it is kept like any other response.
+		if err = c.App().Config().ErrorHandler(c, err); err != nil {
+			if err := store.Release(ctx, key); err != nil {
+				log.Printf("could not release idempotency key: %s", err)
+			}
+			return err
+		}
+	}
+
+	response := c.Response()
+	if response.StatusCode() >= fiber.StatusInternalServerError {
+		err = store.Release(ctx, key)
+	} else {
+		record.Completed = true
+		record.Status = response.StatusCode()
+		record.Body = append([]byte{}, response.Body()...)
+		record.Headers = make(map[string]string)
+		for _, name := range idempotentHeaders {
+			if value := response.Header.Peek(name); len(value) > 0 {
+				record.Headers[name] = string(value)
+			}
+		}
+		err = store.Complete(ctx, record)
+	}
+	if err != nil {
+		log.Printf("could not store the response of idempotency key: %s", err)
 	}
+	return nil
 }
@@ -1,25 +1,110 @@
 package main
 
 import (
+	"context"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"log"
+	"os"
+	"time"
 )
 
 func main() {
-	h := NewHandler()
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	serve()
+}
+
+func newApp(h *Handler, middleware ...fiber.Handler) *fiber.App {
+	app := fiber.New(fiber.Config{
+		// Allow for sizeable imports.
+		BodyLimit:    32 * 1024 * 1024,
+		ErrorHandler: h.ErrorHandler,
+	})
+	for _, handler := range middleware {
+		app.Use(handler)
+	}
+	app.Use(h.Scope)
+
+	// Routes, along with what it takes to use them. Idempotency keys
+	// are only looked at once the request is authorized.
+	read, write, manage := Require(PermRead), Require(PermWrite), Require(PermManage)
+	readContract, writeContract := RequireOnContract(PermRead), RequireOnContract(PermWrite)
+	approveContract, manageContract := RequireOnContract(PermApprove), RequireOnContract(PermManage)
+	branchContract := writeContract
+	if h.branchApproval {
+		branchContract = approveContract
+	}
+	app.Post("/contracts/", write, h.Idempotent, h.CreateContract)
+	app.Get("/contracts/", read, h.ListContracts)
+	app.Get("/contracts/calendar.ics", read, h.ListCalendar)
+	app.Get("/contracts/export.ndjson", read, h.ExportContracts)
+	app.Get("/contracts/export.csv", read, h.ExportTimelines)
+	app.Post("/contracts/import", write, h.Idempotent, h.ImportContracts)
+	app.Get("/contracts/:id/", readContract, h.GetContract)
+	app.Patch("/contracts/:id/", writeContract, h.Idempotent, h.UpdateContract)
+	app.Delete("/contracts/:id/", writeContract, h.DeleteContract)
+	app.Post("/contracts/:id/restore/", writeContract, h.Idempotent, h.RestoreContract)
+	app.Post("/contracts/:id/branch/", branchContract, h.Idempotent, h.BranchContract)
+	app.Get("/contracts/:id/branches/", readContract, h.ListBranches)
+	app.Get("/contracts/:id/branches/:bid/", readContract, h.GetBranch)
+	app.Get("/contracts/:id/explain", readContract, h.ExplainContract)
+	app.Get("/contracts/:id/calendar.ics", readContract, h.ContractCalendar)
+	app.Get("/contracts/:id/timeline.svg", readContract, h.ContractTimeline)
+	app.Get("/contracts/:id/events/", readContract, h.ContractEvents)
+	app.Get("/contracts/:id/replay", readContract, h.ReplayContract)
+	app.Get("/contracts/:id/verify", readContract, h.VerifyContract)
+	app.Post("/contracts/:id/revert/", branchContract, h.Idempotent, h.RevertContract) // Changes the branches as much as branching.
+	app.Get("/contracts/:id/meta", readContract, h.GetMeta)
+	app.Get("/contracts/:id/meta/history", readContract, h.MetaHistory)
+	app.Post("/contracts/:id/meta/restore/", writeContract, h.Idempotent, h.RestoreMeta)
+	app.Post("/contracts/:id/proposals/", writeContract, h.Idempotent, h.CreateProposal)
+	app.Get("/contracts/:id/proposals/", readContract, h.ListProposals)
+	app.Get("/contracts/:id/proposals/:pid/", readContract, h.GetProposal)
+	app.Get("/contracts/:id/proposals/:pid/preview", readContract, h.PreviewProposal)
+	app.Post("/contracts/:id/proposals/:pid/accept/", approveContract, h.Idempotent, h.AcceptProposal)
+	app.Post("/contracts/:id/proposals/:pid/reject/", approveContract, h.Idempotent, h.RejectProposal)
+	app.Get("/contracts/:id/grants/", manageContract, h.ListGrants)
+	app.Post("/contracts/:id/grants/", manageContract, h.Idempotent, h.CreateGrant)
+	app.Delete("/contracts/:id/grants/:subject/", manageContract, h.DeleteGrant)
+	app.Get("/changes/", read, h.ListChanges)
+	app.Post("/webhooks/", manage, h.Idempotent, h.CreateWebhook)
+	app.Get("/webhooks/", read, h.ListWebhooks)
+	app.Get("/webhooks/:id/", read, h.GetWebhook)
+	app.Delete("/webhooks/:id/", manage, h.DeleteWebhook)
+	app.Get("/webhooks/:id/deliveries/", read, h.WebhookDeliveries)
+	if h.authenticated {
+		// Not idempotent, so that created keys are never kept.
+		app.Post("/api-keys/", manage, h.CreateAPIKey)
+		app.Get("/api-keys/", manage, h.ListAPIKeys)
+		app.Delete("/api-keys/:id/", manage, h.DeleteAPIKey)
+	}
+	app.Get("/openapi.json", h.OpenAPI)
+	app.Get("/docs/", h.Docs)
+	return app
+}
 
-	app := fiber.New()
-	app.Use(logger.New())
+func serve() {
+	store, err := OpenStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authenticators, err := NewAuthenticators(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	middleware := []fiber.Handler{logger.New()}
+	if len(authenticators) > 0 {
+		middleware = append(middleware, Authenticate(authenticators...))
+	}
 
-	// Routes
-	app.Post("/contracts/", h.CreateContract)
-	app.Get("/contracts/", h.ListContracts)
-	app.Get("/contracts/:id/", h.GetContract)
-	app.Patch("/contracts/:id/", h.UpdateContract)
-	app.Post("/contracts/:id/branch/", h.BranchContract)
+	app := newApp(NewHandler(store), middleware...)
+	go NewDispatcher(store.Webhooks()).Run(context.Background())
+	go RunPurge(context.Background(), store, PurgeRetention, time.Hour)
 
-	err := app.Listen(":3000")
+	err = app.Listen(":3000")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is a JSON value of the OpenAPI document, such as a schema.
+type Schema = map[string]interface{}
+
+// Types that have a JSON form of their own.
+var schemaOverrides = map[reflect.Type]Schema{
+	reflect.TypeOf(time.Time{}):          {"type": "string", "format": "date-time"},
+	reflect.TypeOf(primitive.ObjectID{}): {"type": "string", "pattern": "^[0-9a-f]{24}$"},
+	reflect.TypeOf(json.RawMessage{}):    {},
+	reflect.TypeOf(Duration{}): {
+		"type": "string", "pattern": durationPattern.String(), "example": "P1Y",
+		"description": "An ISO 8601 duration.",
+	},
+	reflect.TypeOf(RelativeTime{}): {
+		"type": "string", "example": "+P45D",
+		"description": "A date, an RFC 3339 timestamp or an ISO 8601 duration prefixed with a sign, " +
+			"relative to the start.",
+	},
+}
+
+// Properties that types add to their JSON form by themselves.
+var schemaExtras = map[reflect.Type]Schema{
+	reflect.TypeOf(Branch{}): {
+		"span":     Schema{"type": "string", "example": "365days"},
+		"span_iso": Schema{"type": "string", "example": "P365D"},
+	},
+}
+
+// Validator tags that tell about other fields, along with how to put that.
+var validateRelations = map[string]string{
+	"required_without": "Required unless %s is given.",
+	"excluded_with":    "Not allowed along with %s.",
+}
+
+// specBuilder derives schemas from Go types, keeping the ones of named
+// structs as components.
+type specBuilder struct {
+	schemas Schema
+}
+
+func jsonName(field reflect.StructField) (string, bool) {
+	// The JSON name of a field, false if it is left out.
+	if !field.IsExported() {
+		return "", false
+	}
+	name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" && options == "" {
+		return "", false
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return name, true
+}
+
+func (b *specBuilder) schema(t reflect.Type) Schema {
+	if override, ok := schemaOverrides[t]; ok {
+		schema := make(Schema, len(override))
+		for key, value := range override {
+			schema[key] = value
+		}
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint16, reflect.Uint32:
+		return Schema{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return Schema{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return Schema{"type": "string", "format": "byte"}
+		}
+		return Schema{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		if t.Elem().Kind() == reflect.Interface {
+			return Schema{"type": "object"}
+		}
+		return Schema{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, exists := b.schemas[t.Name()]; !exists {
+			// Claim the name first, types may refer to themselves.
+			b.schemas[t.Name()] = Schema{}
+			b.schemas[t.Name()] = b.object(t)
+		}
+		return Schema{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return Schema{}
+}
+
+func (b *specBuilder) object(t reflect.Type) Schema {
+	properties := make(Schema)
+	var required []string
+	b.properties(t, properties, &required)
+	for name, extra := range schemaExtras[t] {
+		properties[name] = extra
+	}
+
+	object := Schema{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		object["required"] = required
+	}
+	return object
+}
+
+func (b *specBuilder) properties(t reflect.Type, properties Schema, required *[]string) {
+	/*
+		Adds the properties of the fields of a struct, along with the
+		constraints told by their validator tags. Fields of embedded
+		structs are promoted as they are by encoding/json.
+	*/
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Tag.Get("json") == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			b.properties(embedded, properties, required)
+			continue
+		}
+		name, ok := jsonName(field)
+		if !ok {
+			continue
+		}
+
+		schema := b.schema(field.Type)
+		if _, ref := schema["$ref"]; ref {
+			// Siblings of references are ignored.
+			schema = Schema{"allOf": []interface{}{schema}}
+		}
+		if b.validation(t, schema, field.Tag.Get("validate")) {
+			*required = append(*required, name)
+		}
+		properties[name] = schema
+	}
+}
+
+func (b *specBuilder) validation(t reflect.Type, schema Schema, tag string) (required bool) {
+	/*
+		Puts the validator tags of a field into its schema, telling if
+		the field is required. Tags following "dive" are about the items
+		of the field. Tags with no counterpart in schemas are described.
+	*/
+	var notes []string
+	target := schema
+	for _, rule := range strings.Split(tag, ",") {
+		name, param, _ := strings.Cut(rule, "=")
+		switch name {
+		case "":
+		case "required":
+			required = true
+		case "dive":
+			if items, ok := target["items"].(Schema); ok {
+				target = items
+			}
+		case "url":
+			target["format"] = "uri"
+		case "email":
+			target["format"] = "email"
+		case "oneof":
+			target["enum"] = strings.Fields(param)
+		case "min", "max":
+			bound, err := strconv.ParseFloat(param, 64)
+			if err != nil {
+				break
+			}
+			key := map[string]string{"min": "minimum", "max": "maximum"}[name]
+			switch target["type"] {
+			case "string":
+				key = map[string]string{"min": "minLength", "max": "maxLength"}[name]
+			case "array":
+				key = map[string]string{"min": "minItems", "max": "maxItems"}[name]
+			}
+			target[key] = bound
+		default:
+			if format, ok := validateRelations[name]; ok {
+				if field, found := t.FieldByName(param); found {
+					param, _ = jsonName(field)
+				}
+				notes = append(notes, fmt.Sprintf(format, param))
+			}
+		}
+	}
+	if len(notes) > 0 {
+		schema["description"] = strings.Join(notes, " ")
+	}
+	return required
+}
+
+// apiParam is a parameter of an operation.
+type apiParam struct {
+	name, in, description string
+	schema                Schema
+}
+
+func query(name, kind, description string) apiParam {
+	return apiParam{name: name, in: "query", description: description, schema: Schema{"type": kind}}
+}
+
+// apiOperation documents a route. Bodies and responses are values of
+// the types they are made of, or schemas made by results, or raw
+// schemas. Content types are those of JSON unless told.
+type apiOperation struct {
+	method, path, tag, summary string
+	params                     []apiParam
+	body                       map[string]interface{} // By content type.
+	status                     int
+	response                   interface{}
+	responseType               string
+}
+
+// results is the schema of a listing, with a cursor to the next page
+// if it is paged.
+type results struct {
+	of    interface{}
+	paged bool
+}
+
+func jsonBody(v interface{}) map[string]interface{} {
+	return map[string]interface{}{fiber.MIMEApplicationJSON: v}
+}
+
+var (
+	listParams = []apiParam{
+		query("sort", "string", "_id, created_at or updated_at, optionally prefixed with - (the default is -_id)."),
+		query("limit", "integer", fmt.Sprintf("Up to %d, %d by default.", maxListLimit, defaultListLimit)),
+		query("cursor", "string", "Where the page starts, as told by next."),
+		includeDeletedParam,
+	}
+	filterParams = []apiParam{
+		query("active_at", "string", "Select the contracts in effect at this time."),
+		query("data_at", "string", "The time data conditions apply to, now by default."),
+		{name: "conditions", in: "query", description: "Conditions such as meta.plan=gold, " +
+			"meta.seats[gte]=10, meta.plan[in]=gold,silver, data.price[gt]=10 or created_at[lt]=2023-01-01.",
+			schema: Schema{"type": "object", "additionalProperties": Schema{"type": "string"}}},
+	}
+	windowParams = []apiParam{
+		query("from", "string", "A date or an RFC 3339 timestamp."),
+		query("to", "string", "A date or an RFC 3339 timestamp."),
+	}
+	noticeParam         = query("notice", "string", "Comma separated day counts to be reminded before the end.")
+	includeDeletedParam = query("include_deleted", "boolean", "Include deleted contracts.")
+)
+
+func withParams(groups ...[]apiParam) []apiParam {
+	var params []apiParam
+	for _, group := range groups {
+		params = append(params, group...)
+	}
+	return params
+}
+
+var apiOperations = []apiOperation{
+	{method: "POST", path: "/contracts/", tag: "contracts", summary: "Create a contract",
+		body: jsonBody(ContractPayload{}), status: fiber.StatusCreated, response: Contract{}},
+	{method: "GET", path: "/contracts/", tag: "contracts", summary: "List contracts",
+		params: withParams(listParams, filterParams), response: results{Contract{}, true}},
+	{method: "GET", path: "/contracts/calendar.ics", tag: "contracts", summary: "Calendar of contracts",
+		params:   withParams(listParams, filterParams, []apiParam{noticeParam}),
+		response: Schema{"type": "string"}, responseType: "text/calendar"},
+	{method: "GET", path: "/contracts/export.ndjson", tag: "contracts", summary: "Export contracts",
+		params:   withParams(listParams, filterParams),
+		response: Contract{}, responseType: "application/x-ndjson"},
+	{method: "GET", path: "/contracts/export.csv", tag: "contracts", summary: "Export the timelines of contracts",
+		params: withParams(listParams, filterParams, []apiParam{
+			query("keys", "string", "Comma separated data keys to include."),
+			query("meta", "string", "Comma separated meta keys to include."),
+		}),
+		response: Schema{"type": "string"}, responseType: "text/csv"},
+	{method: "POST", path: "/contracts/import", tag: "contracts", summary: "Import contracts",
+		params: []apiParam{query("batch", "integer", "How many contracts are stored at once.")},
+		body: map[string]interface{}{
+			"text/csv": Schema{"type": "string"}, "application/x-ndjson": Schema{"type": "string"},
+		},
+		response: ImportReport{}},
+	{method: "GET", path: "/contracts/:id/", tag: "contracts", summary: "Get a contract",
+		params: []apiParam{includeDeletedParam}, response: Contract{}},
+	{method: "PATCH", path: "/contracts/:id/", tag: "contracts", summary: "Update the meta of a contract",
+		params: []apiParam{{name: "If-Match", in: "header", schema: Schema{"type": "string"}}},
+		body: map[string]interface{}{
+			fiber.MIMEApplicationJSON:      MetaPayload{},
+			"application/json-patch+json":  []PatchOperation{},
+			"application/merge-patch+json": Schema{"type": "object", "properties": Schema{"meta": Schema{"type": "object"}}},
+		},
+		response: Contract{}},
+	{method: "DELETE", path: "/contracts/:id/", tag: "contracts", summary: "Delete a contract",
+		status: fiber.StatusNoContent},
+	{method: "POST", path: "/contracts/:id/restore/", tag: "contracts", summary: "Restore a deleted contract",
+		response: Contract{}},
+	{method: "POST", path: "/contracts/:id/branch/", tag: "branches", summary: "Branch a contract",
+		body: jsonBody(BranchPayload{}), response: Contract{}},
+	{method: "GET", path: "/contracts/:id/branches/", tag: "branches", summary: "List the branches of a contract",
+		params: withParams(windowParams, []apiParam{
+			query("active", "boolean", "Select only the active branches, or only the replaced ones."),
+		}),
+		response: results{BranchInfo{}, false}},
+	{method: "GET", path: "/contracts/:id/branches/:bid/", tag: "branches", summary: "Get a branch",
+		response: BranchDetail{}},
+	{method: "GET", path: "/contracts/:id/explain", tag: "branches", summary: "Gantt chart of a contract",
+		params: []apiParam{
+			query("width", "integer", "Between 10 and 500."), query("ascii", "boolean", "Only use ASCII."),
+		},
+		response: Schema{"type": "string"}, responseType: fiber.MIMETextPlain},
+	{method: "GET", path: "/contracts/:id/calendar.ics", tag: "branches", summary: "Calendar of a contract",
+		params: []apiParam{noticeParam}, response: Schema{"type": "string"}, responseType: "text/calendar"},
+	{method: "GET", path: "/contracts/:id/timeline.svg", tag: "branches", summary: "Timeline of a contract",
+		params:   withParams([]apiParam{query("width", "integer", "Between 200 and 10000.")}, windowParams),
+		response: Schema{"type": "string"}, responseType: "image/svg+xml"},
+	{method: "GET", path: "/contracts/:id/events/", tag: "history", summary: "List the events of a contract",
+		response: results{Event{}, false}},
+	{method: "GET", path: "/contracts/:id/replay", tag: "history", summary: "Replay the events of a contract",
+		params:   []apiParam{query("version", "integer", "The version to replay up to, the latest by default.")},
+		response: Contract{}},
+	{method: "GET", path: "/contracts/:id/verify", tag: "history", summary: "Verify a contract against its events",
+		response: Verification{}},
+	{method: "POST", path: "/contracts/:id/revert/", tag: "history", summary: "Revert a contract to a former version",
+		body: jsonBody(VersionPayload{}), response: Contract{}},
+	{method: "GET", path: "/contracts/:id/meta", tag: "history", summary: "Get the meta of a contract at a time",
+		params:   []apiParam{query("at", "string", "A date or an RFC 3339 timestamp, now by default.")},
+		response: MetaRevision{}},
+	{method: "GET", path: "/contracts/:id/meta/history", tag: "history", summary: "List the revisions of the meta",
+		response: results{MetaRevision{}, false}},
+	{method: "POST", path: "/contracts/:id/meta/restore/", tag: "history",
+		summary: "Restore the meta of a former version", body: jsonBody(VersionPayload{}), response: Contract{}},
+	{method: "GET", path: "/changes/", tag: "changes", summary: "List the changes of contracts",
+		params: withParams(windowParams, listParams[1:3], filterParams), response: results{Change{}, true}},
+	{method: "POST", path: "/webhooks/", tag: "webhooks", summary: "Register a webhook",
+		body: jsonBody(WebhookPayload{}), status: fiber.StatusCreated, response: Webhook{}},
+	{method: "GET", path: "/webhooks/", tag: "webhooks", summary: "List webhooks",
+		response: results{Webhook{}, false}},
+	{method: "GET", path: "/webhooks/:id/", tag: "webhooks", summary: "Get a webhook", response: Webhook{}},
+	{method: "DELETE", path: "/webhooks/:id/", tag: "webhooks", summary: "Delete a webhook",
+		status: fiber.StatusNoContent},
+	{method: "GET", path: "/webhooks/:id/deliveries/", tag: "webhooks", summary: "List the deliveries of a webhook",
+		params: []apiParam{query("limit", "integer", "Between 1 and 500, 50 by default.")}, response: results{Delivery{}, false}},
+	{method: "POST", path: "/api-keys/", tag: "auth", summary: "Create an API key",
+		body: jsonBody(APIKeyPayload{}), status: fiber.StatusCreated, response: CreatedAPIKey{}},
+	{method: "GET", path: "/api-keys/", tag: "auth", summary: "List API keys", response: results{APIKey{}, false}},
+	{method: "DELETE", path: "/api-keys/:id/", tag: "auth", summary: "Delete an API key",
+		status: fiber.StatusNoContent},
+	{method: "POST", path: "/contracts/:id/proposals/", tag: "proposals", summary: "Propose a branch",
+		params: []apiParam{{name: "If-Match", in: "header", schema: Schema{"type": "string"}}},
+		body:   jsonBody(BranchPayload{}), status: fiber.StatusCreated, response: Proposal{}},
+	{method: "GET", path: "/contracts/:id/proposals/", tag: "proposals", summary: "List the proposals on a contract",
+		params:   []apiParam{query("status", "string", "One of pending, accepted, rejected and stale.")},
+		response: results{Proposal{}, false}},
+	{method: "GET", path: "/contracts/:id/proposals/:pid/", tag: "proposals", summary: "Get a proposal",
+		response: Proposal{}},
+	{method: "GET", path: "/contracts/:id/proposals/:pid/preview", tag: "proposals",
+		summary: "Preview a proposal on the contract", response: ProposalView{}},
+	{method: "POST", path: "/contracts/:id/proposals/:pid/accept/", tag: "proposals", summary: "Accept a proposal",
+		response: ProposalView{}},
+	{method: "POST", path: "/contracts/:id/proposals/:pid/reject/", tag: "proposals", summary: "Reject a proposal",
+		body: jsonBody(RejectionPayload{}), response: Proposal{}},
+	{method: "GET", path: "/contracts/:id/grants/", tag: "access", summary: "List the grants on a contract",
+		response: results{Grant{}, false}},
+	{method: "POST", path: "/contracts/:id/grants/", tag: "access", summary: "Grant a role on a contract",
+		body: jsonBody(GrantPayload{}), status: fiber.StatusCreated, response: Grant{}},
+	{method: "DELETE", path: "/contracts/:id/grants/:subject/", tag: "access", summary: "Revoke a grant",
+		status: fiber.StatusNoContent},
+	{method: "GET", path: "/openapi.json", tag: "docs", summary: "This document",
+		response: Schema{"type": "object"}},
+	{method: "GET", path: "/docs/", tag: "docs", summary: "Interactive documentation",
+		response: Schema{"type": "string"}, responseType: fiber.MIMETextHTML},
+}
+
+var routeParam = regexp.MustCompile(`:(\w+)`)
+
+func openAPIPath(path string) string {
+	// Fiber parameters (":id") are put in braces.
+	return routeParam.ReplaceAllString(path, "{$1}")
+}
+
+func (b *specBuilder) content(v interface{}) Schema {
+	switch v := v.(type) {
+	case Schema:
+		return v
+	case results:
+		list := Schema{"type": "object", "properties": Schema{
+			"results": Schema{"type": "array", "items": b.content(v.of)},
+		}}
+		if v.paged {
+			list["properties"].(Schema)["next"] = Schema{
+				"type": "string", "nullable": true, "description": "The cursor of the next page, if any.",
+			}
+		}
+		return list
+	}
+	return b.schema(reflect.TypeOf(v))
+}
+
+func operationID(summary string) string {
+	// "List the branches" becomes "listTheBranches".
+	words := strings.Fields(summary)
+	for i, word := range words {
+		if i == 0 {
+			words[i] = strings.ToLower(word)
+		} else {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, "")
+}
+
+func (b *specBuilder) operation(op apiOperation) Schema {
+	var params []interface{}
+	for _, name := range routeParam.FindAllStringSubmatch(op.path, -1) {
+		// IDs are ObjectIDs, anything else is a string.
+		schema := Schema{"type": "string"}
+		if strings.HasSuffix(name[1], "id") {
+			schema = b.schema(reflect.TypeOf(primitive.ObjectID{}))
+		}
+		params = append(params, Schema{"name": name[1], "in": "path", "required": true, "schema": schema})
+	}
+	for _, param := range op.params {
+		doc := Schema{"name": param.name, "in": param.in, "schema": param.schema}
+		if param.description != "" {
+			doc["description"] = param.description
+		}
+		if param.name == "conditions" {
+			doc["style"], doc["explode"] = "form", true
+		}
+		params = append(params, doc)
+	}
+	if op.method != "GET" {
+		params = append(params, Schema{"$ref": "#/components/parameters/Actor"})
+	}
+	if op.method == "POST" || op.method == "PATCH" {
+		params = append(params, Schema{"$ref": "#/components/parameters/IdempotencyKey"})
+	}
+
+	status := op.status
+	if status == 0 {
+		status = fiber.StatusOK
+	}
+	response := Schema{"description": http.StatusText(status)}
+	if op.response != nil {
+		mime := op.responseType
+		if mime == "" {
+			mime = fiber.MIMEApplicationJSON
+		}
+		response["content"] = Schema{mime: Schema{"schema": b.content(op.response)}}
+	}
+
+	operation := Schema{
+		"summary":     op.summary,
+		"operationId": operationID(op.summary),
+		"tags":        []string{op.tag},
+		"parameters":  params,
+		"responses": Schema{
+			strconv.Itoa(status): response,
+			"default":            Schema{"$ref": "#/components/responses/Problem"},
+		},
+	}
+	if publicPaths[op.path] {
+		operation["security"] = []interface{}{}
+	}
+	if op.body != nil {
+		content := make(Schema)
+		for mime, body := range op.body {
+			content[mime] = Schema{"schema": b.content(body)}
+		}
+		operation["requestBody"] = Schema{"required": true, "content": content}
+	}
+	return operation
+}
+
+func OpenAPISpec() Schema {
+	/*
+		Builds the OpenAPI 3 document of the API from the operations,
+		deriving the schemas of bodies and responses from their types.
+		Every operation may fail with a problem (see ErrorHandler).
+	*/
+	b := &specBuilder{schemas: make(Schema)}
+	paths := make(Schema)
+	for _, op := range apiOperations {
+		path := openAPIPath(op.path)
+		if paths[path] == nil {
+			paths[path] = make(Schema)
+		}
+		paths[path].(Schema)[strings.ToLower(op.method)] = b.operation(op)
+	}
+	problem := b.schema(reflect.TypeOf(Problem{}))
+
+	return Schema{
+		"openapi": "3.0.3",
+		"info": Schema{
+			"title":       "charlie",
+			"version":     "1.0.0",
+			"description": "Contracts whose terms change over time.",
+		},
+		"paths": paths,
+		// Either of these, given that authentication is enabled.
+		"security": []interface{}{Schema{"apiKey": []string{}}, Schema{"bearer": []string{}}},
+		"components": Schema{
+			"securitySchemes": Schema{
+				"apiKey": Schema{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearer": Schema{"type": "http", "scheme": "bearer", "bearerFormat": "JWT or API key"},
+			},
+			"schemas": b.schemas,
+			"responses": Schema{
+				"Problem": Schema{
+					"description": "The problem details (RFC 7807) of an error.",
+					"content":     Schema{"application/problem+json": Schema{"schema": problem}},
+				},
+			},
+			"parameters": Schema{
+				"Actor": Schema{
+					"name": "X-Actor", "in": "header", "schema": Schema{"type": "string"},
+					"description": "Who makes the change, as recorded in the event log. " +
+						"Ignored if authentication is enabled, the principal is recorded instead.",
+				},
+				"IdempotencyKey": Schema{
+					"name": "Idempotency-Key", "in": "header", "schema": Schema{"type": "string", "maxLength": 255},
+					"description": "Makes the request safe to retry for 24 hours.",
+				},
+			},
+		},
+	}
+}
+
+//go:embed openapi.html
+var docsPage []byte
+
+func (h *Handler) OpenAPI(c *fiber.Ctx) error {
+	return c.JSON(OpenAPISpec())
+}
+
+func (h *Handler) Docs(c *fiber.Ctx) error {
+	c.Type("html", "utf-8")
+	return c.Send(docsPage)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIRoutes(t *testing.T) {
+	// Every registered route is documented, and every documented
+	// operation is registered, including those only served
+	// with authentication.
+	handler := NewHandler(NewMemoryStore())
+	handler.authenticated = true
+	app := newApp(handler)
+	resp, content := doRequest(t, app, "GET", "/openapi.json", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	paths := decodeMap(t, content)["paths"].(map[string]interface{})
+
+	registered := make(map[string]bool)
+	for _, route := range app.GetRoutes(true) {
+		if route.Method == fiber.MethodHead {
+			continue
+		}
+		path, method := openAPIPath(route.Path), strings.ToLower(route.Method)
+		registered[method+" "+path] = true
+
+		operations, ok := paths[path].(map[string]interface{})
+		require.True(t, ok, "%s is not documented", path)
+		require.Contains(t, operations, method, "%s %s is not documented", route.Method, path)
+	}
+	for path, operations := range paths {
+		for method := range operations.(map[string]interface{}) {
+			require.True(t, registered[method+" "+path], "%s %s is not registered", method, path)
+		}
+	}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	spec := OpenAPISpec()
+	schemas := spec["components"].(Schema)["schemas"].(Schema)
+
+	contract := schemas["ContractPayload"].(Schema)
+	require.Equal(t, []string{"start_at", "meta", "data"}, contract["required"])
+	properties := contract["properties"].(Schema)
+	require.Equal(t, "date-time", properties["start_at"].(Schema)["format"])
+	require.Equal(t, "Required unless term is given. Not allowed along with term.",
+		properties["end_at"].(Schema)["description"])
+
+	webhook := schemas["WebhookPayload"].(Schema)["properties"].(Schema)
+	require.Equal(t, "uri", webhook["url"].(Schema)["format"])
+	require.EqualValues(t, 16, webhook["secret"].(Schema)["minLength"])
+	require.Equal(t, []string{"create", "branch", "meta", "revert", "delete", "restore"},
+		webhook["events"].(Schema)["items"].(Schema)["enum"])
+
+	// Hidden fields are left out, fields added when marshalling are not.
+	require.NotContains(t, schemas["Webhook"].(Schema)["properties"], "secret")
+	require.Contains(t, schemas["Branch"].(Schema)["properties"], "span_iso")
+	require.Contains(t, schemas["BranchDetail"].(Schema)["properties"], "lineage")
+	require.Contains(t, schemas["BranchDetail"].(Schema)["properties"], "replaced_by")
+
+	get := spec["paths"].(Schema)["/contracts/{id}/"].(Schema)["get"].(Schema)
+	require.Equal(t, "id", get["parameters"].([]interface{})[0].(Schema)["name"])
+}
+
+func TestDocs(t *testing.T) {
+	resp, content := doRequest(t, newTestApp(), "GET", "/docs/", "")
+	require.Equal(t, fiber.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get(fiber.HeaderContentType), "text/html")
+	require.Contains(t, string(content), "/openapi.json")
+}